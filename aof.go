@@ -0,0 +1,982 @@
+package redhub
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IceFireDB/redhub/pkg/rdb"
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// FsyncPolicy tells how often the AOF is flushed to disk, like the
+// appendfsync setting of Redis.
+type FsyncPolicy int
+
+const (
+	// FsyncEverySec flushes the AOF to disk once per second: a crash loses at
+	// most the last second of writes.
+	FsyncEverySec FsyncPolicy = iota
+
+	// FsyncAlways flushes the AOF to disk before the write commands are
+	// answered.
+	FsyncAlways
+
+	// FsyncNo leaves flushing the AOF to the operating system.
+	FsyncNo
+)
+
+const (
+	// DefaultAOFDir and DefaultAOFFilename are the default AOFOptions.Dir and
+	// AOFOptions.Filename, like the appenddirname and appendfilename of Redis.
+	DefaultAOFDir      = "appendonlydir"
+	DefaultAOFFilename = "appendonly.aof"
+
+	// DefaultAOFRewritePercentage and DefaultAOFRewriteMinSize are the default
+	// AOFOptions.RewritePercentage and AOFOptions.RewriteMinSize, like the
+	// auto-aof-rewrite-percentage and auto-aof-rewrite-min-size of Redis.
+	DefaultAOFRewritePercentage = 100
+	DefaultAOFRewriteMinSize    = 64 << 20
+
+	// aofReadChunk is the size of the reads of the AOF while it is loaded.
+	aofReadChunk = 64 * 1024
+)
+
+// Types of the files of an AOF manifest.
+const (
+	aofBase    = 'b' // Base file, written by a rewrite
+	aofHistory = 'h' // Former file, deleted after a rewrite
+	aofIncr    = 'i' // Incremental file, which write commands are appended to
+)
+
+var (
+	errAOFRewriting     = errors.New("a rewrite of the AOF is already in progress")
+	errAOFNoSnapshotter = errors.New("the AOF cannot be rewritten without a snapshotter")
+)
+
+// AOFOptions configures an AOF, see OpenAOF.
+type AOFOptions struct {
+	// Dir is the directory of the AOF files.
+	// Default: DefaultAOFDir
+	Dir string
+
+	// Filename is the base name of the AOF files: a base file written by
+	// rewrites, incremental files that write commands are appended to, and
+	// the manifest that lists them.
+	// Default: DefaultAOFFilename
+	Filename string
+
+	// Fsync is how often the AOF is flushed to disk.
+	// Default: FsyncEverySec
+	Fsync FsyncPolicy
+
+	// Snapshotter provides the snapshots that rewrites turn into the base
+	// file, in the RDB format. Without it, the AOF is never rewritten and
+	// grows with every write command.
+	Snapshotter Snapshotter
+
+	// RewritePercentage and RewriteMinSize trigger a rewrite when the AOF has
+	// grown by RewritePercentage percent since the last rewrite, and is at
+	// least RewriteMinSize bytes. A negative RewritePercentage disables
+	// automatic rewrites.
+	// Default: DefaultAOFRewritePercentage and DefaultAOFRewriteMinSize
+	RewritePercentage int
+	RewriteMinSize    int64
+
+	// SnapshotTimeout is how long write commands are held back, at most, for
+	// the Snapshotter to capture the snapshot of a rewrite.
+	// Default: DefaultSnapshotTimeout
+	SnapshotTimeout time.Duration
+
+	// StrictLoad refuses to load an AOF whose last command is truncated, as
+	// left by a crash in the middle of a write. By default the truncated
+	// command is dropped from the file, like aof-load-truncated yes.
+	StrictLoad bool
+}
+
+// AOF is an append-only file: the log of the write commands of the server,
+// which is replayed to rebuild the dataset when the server starts, like the
+// AOF of Redis. Install it with SetAOF.
+//
+// The AOF is made of several files in its directory, listed by a manifest in
+// the format of Redis 7: a base file, in the RDB format, and incremental
+// files, in RESP. Write commands are appended to the last incremental file.
+// They are served one at a time, even by several event loops, so that
+// replaying the AOF applies them in the order the server did.
+// A rewrite captures a snapshot of the dataset, starts a new incremental file
+// and, once the snapshot has been written as the new base file, deletes the
+// former files.
+//
+// An AOF is safe for concurrent use.
+type AOF struct {
+	opts     AOFOptions
+	manifest aofManifest
+
+	// pause is held by the write commands, around their handler and their
+	// append, and taken exclusively to start a rewrite.
+	pause sync.RWMutex
+
+	mu           sync.Mutex
+	f            *os.File
+	buf          []byte // Commands appended but not yet written to f
+	serving      bool   // Whether a write command is served, see beginCommand
+	pending      []byte // Commands propagated while it is served
+	dirty        bool   // Whether f was written since it was last synced
+	size         int64  // Size of the AOF files
+	incrSize     int64  // Size of f, the last incremental file
+	torn         bool   // Whether f ends with a partial write, to truncate
+	baseSize     int64  // Size of the AOF after the last rewrite or load
+	err          error  // Last write error, which refuses the write commands
+	rewriting    bool
+	rewriteErr   error
+	loaded       bool
+	loading      bool
+	closed       bool
+	stop         chan struct{}
+	wg           sync.WaitGroup
+	rewriteCount int
+}
+
+// OpenAOF opens the AOF in opts.Dir, creating the directory and an empty AOF
+// if needed, and starts appending to its last incremental file. The AOF is
+// replayed by the server it is installed in when the server starts.
+//
+// Example:
+//
+//	aof, err := redhub.OpenAOF(redhub.AOFOptions{
+//	    Dir:         "/var/lib/myserver",
+//	    Snapshotter: redhub.SnapshotFunc(store.Snapshot),
+//	})
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	defer aof.Close()
+//	rh.RegisterCommands(redhub.RedisCommands...)
+//	rh.SetAOF(aof)
+func OpenAOF(opts AOFOptions) (*AOF, error) {
+	if opts.Dir == "" {
+		opts.Dir = DefaultAOFDir
+	}
+	if opts.Filename == "" {
+		opts.Filename = DefaultAOFFilename
+	}
+	if opts.RewritePercentage == 0 {
+		opts.RewritePercentage = DefaultAOFRewritePercentage
+	}
+	if opts.RewriteMinSize <= 0 {
+		opts.RewriteMinSize = DefaultAOFRewriteMinSize
+	}
+	if opts.SnapshotTimeout <= 0 {
+		opts.SnapshotTimeout = DefaultSnapshotTimeout
+	}
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	a := &AOF{opts: opts, stop: make(chan struct{})}
+	m, err := readAOFManifest(a.path(a.manifestName()))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		m = aofManifest{files: []aofFile{{name: a.incrName(1), seq: 1, typ: aofIncr}}}
+		if err := a.writeManifest(m); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	}
+	a.manifest = m
+	a.removeHistory()
+
+	incr := m.lastIncr()
+	if incr == nil {
+		// A rewrite left only a base file: new writes go to a new file.
+		seq := m.nextSeq(aofIncr)
+		m.files = append(m.files, aofFile{name: a.incrName(seq), seq: seq, typ: aofIncr})
+		if err := a.writeManifest(m); err != nil {
+			return nil, err
+		}
+		a.manifest = m
+		incr = m.lastIncr()
+	}
+	if a.f, err = os.OpenFile(a.path(incr.name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+		return nil, err
+	}
+	a.size = a.statSize()
+	a.baseSize = a.size
+	a.incrSize = fileSize(a.f)
+
+	// The policy may change to FsyncEverySec later, see RegisterConfig.
+	a.wg.Add(1)
+	go a.syncLoop()
+	return a, nil
+}
+
+// SetAOF makes the server log its write commands to a, and replay it when the
+// server starts, before accepting connections.
+//
+// The write commands of the command table (FlagWrite, see RegisterCommands)
+// are appended to the AOF once the handler has served them without an error
+// reply, and written to it before their replies are sent. RedHub also answers
+// BGREWRITEAOF, which starts a rewrite. If writing to the AOF fails, write
+// commands are refused with a -MISCONF error until a write succeeds again.
+// With FsyncAlways, the writes that could not be written or synced are not
+// answered: their connection is closed instead.
+//
+// Like with SetReplication, write commands are served one at a time by all the
+// event loops, and held back while a rewrite captures its snapshot.
+//
+// The AOF is replayed through the handler, like the commands of a client
+// whose replies are discarded. Like the replication stream, the AOF does not
+// record the database that commands apply to. The commands applied by a
+// Replica are not logged, and a server with a stream handler cannot have an
+// AOF (see SetStreamHandler). SetAOF must be called before the server is started.
+func (rs *RedHub) SetAOF(a *AOF) {
+	rs.aof = a
+}
+
+// fsyncPolicies are the names of the fsync policies in config files, by
+// FsyncPolicy.
+var fsyncPolicies = []string{"everysec", "always", "no"}
+
+// RegisterConfig declares the settings of the AOF in c, with the names of
+// Redis: appendfsync, which sets Fsync, and auto-aof-rewrite-percentage and
+// auto-aof-rewrite-min-size, which set RewritePercentage and RewriteMinSize.
+// A percentage of 0 disables automatic rewrites. Their defaults are the
+// current options.
+func (a *AOF) RegisterConfig(c *Config) error {
+	a.mu.Lock()
+	opts := a.opts
+	a.mu.Unlock()
+	percentage := opts.RewritePercentage
+	if percentage < 0 {
+		percentage = 0
+	}
+	return c.Register(
+		ConfigParam{
+			Name:    "appendfsync",
+			Type:    ConfigEnum,
+			Default: fsyncPolicies[opts.Fsync],
+			Values:  fsyncPolicies,
+			OnChange: func(v ConfigValue) error {
+				a.mu.Lock()
+				a.opts.Fsync = FsyncPolicy(v.Int)
+				a.mu.Unlock()
+				return nil
+			},
+		},
+		ConfigParam{
+			Name:    "auto-aof-rewrite-percentage",
+			Type:    ConfigInt,
+			Default: strconv.Itoa(percentage),
+			Max:     math.MaxInt32,
+			OnChange: func(v ConfigValue) error {
+				a.mu.Lock()
+				a.opts.RewritePercentage = int(v.Int)
+				if v.Int == 0 {
+					a.opts.RewritePercentage = -1
+				}
+				a.mu.Unlock()
+				return nil
+			},
+		},
+		ConfigParam{
+			Name:    "auto-aof-rewrite-min-size",
+			Type:    ConfigMemory,
+			Default: strconv.FormatInt(opts.RewriteMinSize, 10),
+			Max:     math.MaxInt64,
+			OnChange: func(v ConfigValue) error {
+				a.mu.Lock()
+				a.opts.RewriteMinSize = v.Int
+				a.mu.Unlock()
+				return nil
+			},
+		},
+	)
+}
+
+// path returns the path of the file named name in the AOF directory.
+func (a *AOF) path(name string) string {
+	return filepath.Join(a.opts.Dir, name)
+}
+
+func (a *AOF) manifestName() string {
+	return a.opts.Filename + ".manifest"
+}
+
+func (a *AOF) baseName(seq int64) string {
+	return a.opts.Filename + "." + strconv.FormatInt(seq, 10) + ".base.rdb"
+}
+
+func (a *AOF) incrName(seq int64) string {
+	return a.opts.Filename + "." + strconv.FormatInt(seq, 10) + ".incr.aof"
+}
+
+// statSize returns the size of the files of the manifest.
+func (a *AOF) statSize() int64 {
+	var size int64
+	for _, file := range a.manifest.files {
+		if fi, err := os.Stat(a.path(file.name)); err == nil {
+			size += fi.Size()
+		}
+	}
+	return size
+}
+
+// fileSize returns the size of f, or 0 if it cannot be read.
+func fileSize(f *os.File) int64 {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// Propagate appends a command to the AOF, as if a write command with these
+// arguments had been served. Handlers use it to log the effects of commands
+// that are not deterministic, for example a PEXPIREAT for an EXPIRE.
+//
+// Called by the handler of a write command, it replaces that command, like
+// Replication.Propagate, which tells how the calls are attributed. Commands
+// propagated while the AOF is replayed are ignored, as the AOF already holds
+// them.
+func (a *AOF) Propagate(args ...[]byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch {
+	case a.loading:
+	case a.serving:
+		a.pending = appendArgs(a.pending, args)
+	default:
+		a.buf = appendArgs(a.buf, args)
+		a.flushLocked()
+	}
+}
+
+// beginCommand starts serving a write command: the commands propagated until
+// endCommand replace it.
+func (a *AOF) beginCommand() {
+	a.mu.Lock()
+	a.serving = true
+	a.pending = a.pending[:0]
+	a.mu.Unlock()
+}
+
+// endCommand appends a write command served by the handler, if it succeeded,
+// or the commands the handler propagated in its place. They are written to the
+// file by the next flush. It reports whether anything was appended.
+func (a *AOF) endCommand(cmd resp.Command, succeeded bool) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.serving = false
+	switch {
+	case len(a.pending) > 0:
+		a.buf = append(a.buf, a.pending...)
+		if cap(a.pending) > maxRetainedBufferCap {
+			a.pending = nil
+		}
+	case !succeeded:
+		return false
+	case len(cmd.Raw) > 0 && cmd.Raw[0] == '*':
+		a.buf = append(a.buf, cmd.Raw...)
+	default:
+		// Inline and Tile38 commands are logged in RESP.
+		a.buf = appendArgs(a.buf, cmd.Args)
+	}
+	return true
+}
+
+// flush writes the commands appended so far to the file, and syncs it with
+// FsyncAlways, so that they are on disk before they are answered. With
+// FsyncAlways, it returns the error that kept them from reaching the disk, and
+// they must not be answered.
+func (a *AOF) flush() error {
+	a.mu.Lock()
+	rewrite := a.flushLocked()
+	var err error
+	if a.opts.Fsync == FsyncAlways {
+		err = a.err
+	}
+	a.mu.Unlock()
+	if rewrite {
+		go func() {
+			_ = a.Rewrite()
+		}()
+	}
+	return err
+}
+
+// flushLocked writes a.buf to the file. It reports whether the AOF grew enough
+// for an automatic rewrite. a.mu must be held.
+func (a *AOF) flushLocked() bool {
+	if len(a.buf) == 0 || a.f == nil {
+		return false
+	}
+	if a.torn {
+		// A partial write could not be dropped yet: a.buf cannot follow it.
+		if err := a.f.Truncate(a.incrSize); err != nil {
+			a.err = err
+			return false
+		}
+		a.torn = false
+	}
+	n, err := a.f.Write(a.buf)
+	if err != nil {
+		// Drop the partial write, which would corrupt the file, so that a.buf
+		// is written again in full.
+		if n > 0 && a.f.Truncate(a.incrSize) != nil {
+			a.torn = true
+		}
+		a.err = err
+		return false
+	}
+	a.size += int64(n)
+	a.incrSize += int64(n)
+	if cap(a.buf) > maxRetainedBufferCap {
+		a.buf = nil
+	} else {
+		a.buf = a.buf[:0]
+	}
+	if a.opts.Fsync == FsyncAlways {
+		if err := a.f.Sync(); err != nil {
+			// The commands are in the file: writeError only retries the
+			// sync, and must not write them again.
+			a.err = err
+			return false
+		}
+	}
+	a.err = nil
+	a.dirty = a.opts.Fsync == FsyncEverySec
+	return a.needsRewriteLocked()
+}
+
+// needsRewriteLocked reports whether the AOF grew enough since the last
+// rewrite for an automatic one. a.mu must be held.
+func (a *AOF) needsRewriteLocked() bool {
+	if a.opts.Snapshotter == nil || a.opts.RewritePercentage < 0 || a.rewriting || a.size < a.opts.RewriteMinSize {
+		return false
+	}
+	base := a.baseSize
+	if base == 0 {
+		base = 1
+	}
+	return (a.size-base)*100/base >= int64(a.opts.RewritePercentage)
+}
+
+// syncLoop syncs the file to disk every second, when the policy is
+// FsyncEverySec.
+func (a *AOF) syncLoop() {
+	defer a.wg.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.mu.Lock()
+			f, dirty := a.f, a.dirty
+			a.dirty = false
+			a.mu.Unlock()
+			if dirty {
+				// The file may be closed by a rewrite in the meantime, which
+				// syncs it first.
+				_ = f.Sync()
+			}
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// Rewrite starts a rewrite of the AOF in the background, like BGREWRITEAOF: a
+// snapshot of the dataset is captured while write commands are held back, and
+// new writes go to a new incremental file while the snapshot is written as the
+// new base file. It returns an error if the AOF has no Snapshotter, or if a
+// rewrite is already in progress.
+func (a *AOF) Rewrite() error {
+	if a.opts.Snapshotter == nil {
+		return errAOFNoSnapshotter
+	}
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return os.ErrClosed
+	}
+	if a.rewriting {
+		a.mu.Unlock()
+		return errAOFRewriting
+	}
+	a.rewriting = true
+	a.wg.Add(1)
+	a.mu.Unlock()
+
+	a.pause.Lock()
+	snapshot, err := takeSnapshot(a.opts.Snapshotter, a.opts.SnapshotTimeout)
+	var prev aofManifest
+	if err == nil {
+		prev, err = a.startIncr()
+	}
+	a.pause.Unlock()
+	if err != nil {
+		a.endRewrite(err)
+		return err
+	}
+	go func() {
+		a.endRewrite(a.writeBase(snapshot, prev))
+	}()
+	return nil
+}
+
+// startIncr moves the writes to a new incremental file, listed in the manifest
+// after the current files, which it returns.
+func (a *AOF) startIncr() (aofManifest, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.flushLocked()
+	if a.err != nil {
+		return aofManifest{}, a.err
+	}
+	prev := a.manifest
+	seq := prev.nextSeq(aofIncr)
+	name := a.incrName(seq)
+	f, err := os.OpenFile(a.path(name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return aofManifest{}, err
+	}
+	m := prev.clone()
+	m.files = append(m.files, aofFile{name: name, seq: seq, typ: aofIncr})
+	if err := a.writeManifest(m); err != nil {
+		f.Close()
+		os.Remove(a.path(name))
+		return aofManifest{}, err
+	}
+	if a.opts.Fsync != FsyncNo {
+		_ = a.f.Sync()
+	}
+	_ = a.f.Close()
+	a.f, a.dirty = f, false
+	a.incrSize = 0
+	a.manifest = m
+	return prev, nil
+}
+
+// writeBase writes the snapshot as the new base file, then replaces the files
+// of prev, the manifest before the rewrite started, with it.
+func (a *AOF) writeBase(snapshot io.WriterTo, prev aofManifest) error {
+	tmp, err := os.CreateTemp(a.opts.Dir, "temp-rewriteaof-*.rdb")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = snapshot.WriteTo(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	seq := a.manifest.nextSeq(aofBase)
+	name := a.baseName(seq)
+	if err := os.Rename(tmp.Name(), a.path(name)); err != nil {
+		return err
+	}
+	m := aofManifest{files: []aofFile{{name: name, seq: seq, typ: aofBase}}}
+	m.files = append(m.files, a.manifest.files[len(prev.files):]...)
+	if err := a.writeManifest(m); err != nil {
+		os.Remove(a.path(name))
+		return err
+	}
+	a.manifest = m
+	for _, file := range prev.files {
+		_ = os.Remove(a.path(file.name))
+	}
+	a.size = a.statSize()
+	a.baseSize = a.size
+	return nil
+}
+
+// endRewrite records the end of a rewrite.
+func (a *AOF) endRewrite(err error) {
+	a.mu.Lock()
+	a.rewriting = false
+	a.rewriteErr = err
+	a.rewriteCount++
+	a.mu.Unlock()
+	a.wg.Done()
+}
+
+// Close waits for a rewrite in progress, then writes the last commands to the
+// AOF and closes it.
+func (a *AOF) Close() error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return os.ErrClosed
+	}
+	a.closed = true
+	a.mu.Unlock()
+	close(a.stop)
+	a.wg.Wait()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.flushLocked()
+	err := a.err
+	if serr := a.f.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := a.f.Close(); err == nil {
+		err = cerr
+	}
+	a.f = nil
+	return err
+}
+
+// Size returns the size of the AOF files, in bytes.
+func (a *AOF) Size() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.size
+}
+
+// AppendInfo appends the persistence section of the INFO command to b.
+//
+// Example:
+//
+//	# Persistence
+//	aof_enabled:1
+//	aof_rewrite_in_progress:0
+//	aof_rewrites:1
+//	aof_last_bgrewrite_status:ok
+//	aof_last_write_status:ok
+//	aof_current_size:4096
+//	aof_base_size:1024
+func (a *AOF) AppendInfo(b []byte) []byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	status := func(err error) string {
+		if err != nil {
+			return "err"
+		}
+		return "ok"
+	}
+	rewriting := 0
+	if a.rewriting {
+		rewriting = 1
+	}
+	b = append(b, "# Persistence\r\naof_enabled:1\r\naof_rewrite_in_progress:"...)
+	b = strconv.AppendInt(b, int64(rewriting), 10)
+	b = append(b, "\r\naof_rewrites:"...)
+	b = strconv.AppendInt(b, int64(a.rewriteCount), 10)
+	b = append(b, "\r\naof_last_bgrewrite_status:"...)
+	b = append(b, status(a.rewriteErr)...)
+	b = append(b, "\r\naof_last_write_status:"...)
+	b = append(b, status(a.err)...)
+	b = append(b, "\r\naof_current_size:"...)
+	b = strconv.AppendInt(b, a.size, 10)
+	b = append(b, "\r\naof_base_size:"...)
+	b = strconv.AppendInt(b, a.baseSize, 10)
+	b = append(b, "\r\n"...)
+	return b
+}
+
+// writeError returns the error that refuses write commands after a failed
+// write to the AOF, or nil. The failed write is retried first.
+func (a *AOF) writeError() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err == nil {
+		return nil
+	}
+	if len(a.buf) > 0 {
+		a.flushLocked()
+	} else if a.f != nil {
+		a.err = a.f.Sync()
+	}
+	if a.err == nil {
+		return nil
+	}
+	return &resp.ReplyError{Msg: "MISCONF Errors writing to the AOF file: " + a.err.Error()}
+}
+
+// serveAOF answers BGREWRITEAOF. It reports whether cmd was that command.
+func (rs *RedHub) serveAOF(cmd resp.Command, out []byte) ([]byte, bool) {
+	if !equalFold(cmd.Args[0], "bgrewriteaof") {
+		return out, false
+	}
+	if len(cmd.Args) != 1 {
+		return resp.AppendErr(out, resp.WrongArgs("bgrewriteaof")), true
+	}
+	switch err := rs.aof.Rewrite(); {
+	case errors.Is(err, errAOFRewriting):
+		return resp.AppendError(out, "ERR Background append only file rewriting already in progress"), true
+	case err != nil:
+		return resp.AppendError(out, "ERR "+err.Error()), true
+	}
+	return resp.AppendString(out, "Background append only file rewriting started"), true
+}
+
+// loadAOF replays the AOF through the handler, once.
+func (rs *RedHub) loadAOF() error {
+	a := rs.aof
+	a.mu.Lock()
+	if a.loaded {
+		a.mu.Unlock()
+		return nil
+	}
+	a.loaded, a.loading = true, true
+	files := a.manifest.files
+	a.mu.Unlock()
+
+	c := &replicaConn{}
+	cb := &connBuffer{}
+	var out []byte
+	apply := func(cmd resp.Command) {
+		out, _, _ = rs.handle(c, cb, cmd, out[:0])
+	}
+	var err error
+	for i, file := range files {
+		err = rs.replayAOFFile(a.path(file.name), cb, apply, i == len(files)-1)
+		if errors.Is(err, os.ErrNotExist) && file.typ == aofIncr {
+			// The file was listed before anything was written to it.
+			err = nil
+		}
+		if err != nil {
+			err = fmt.Errorf("loading %s: %w", file.name, err)
+			break
+		}
+	}
+
+	a.mu.Lock()
+	a.loading = false
+	a.size = a.statSize()
+	a.baseSize = a.size
+	a.incrSize = fileSize(a.f)
+	a.mu.Unlock()
+	return err
+}
+
+// replayAOFFile replays one file of the AOF: a snapshot in the RDB format, or
+// commands in RESP. A truncated command at the end of the last file is
+// dropped from it, unless StrictLoad is set.
+func (rs *RedHub) replayAOFFile(path string, cb *connBuffer, apply func(resp.Command), last bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReaderSize(f, aofReadChunk)
+	if magic, _ := br.Peek(5); string(magic) == "REDIS" {
+		return replayRDB(br, apply)
+	}
+
+	buf := make([]byte, 0, aofReadChunk)
+	var valid int64 // Offset of the end of the last complete command
+	for {
+		if len(buf) == cap(buf) {
+			buf = append(buf, 0)[:len(buf)]
+		}
+		n, err := br.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		var consumed int
+		for consumed < len(buf) {
+			cmd, m, perr := rs.parser.ReadCommand(buf[consumed:], cb.args)
+			if perr != nil {
+				return fmt.Errorf("bad command at offset %d: %w", valid, perr)
+			}
+			if m == 0 {
+				break
+			}
+			consumed += m
+			valid += int64(m)
+			if len(cmd.Args) == 0 {
+				continue
+			}
+			cb.args = cmd.Args[:0]
+			apply(cmd)
+		}
+		buf = buf[:copy(buf, buf[consumed:])]
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+	if !last || rs.aof.opts.StrictLoad {
+		return fmt.Errorf("truncated command at offset %d", valid)
+	}
+	return os.Truncate(path, valid)
+}
+
+// replayRDB replays a snapshot in the RDB format as the commands that recreate
+// its keys, selecting their databases.
+func replayRDB(r io.Reader, apply func(resp.Command)) error {
+	selected := 0
+	selectDB := func(db int) {
+		args := [][]byte{[]byte("SELECT"), strconv.AppendInt(nil, int64(db), 10)}
+		apply(resp.Command{Raw: appendArgs(nil, args), Args: args, Kind: resp.Redis})
+		selected = db
+	}
+	err := rdb.Decode(r, rdb.Commands(func(db int, cmd resp.Command) error {
+		if db != selected {
+			selectDB(db)
+		}
+		apply(cmd)
+		return nil
+	}))
+	if err == nil && selected != 0 {
+		selectDB(0)
+	}
+	return err
+}
+
+// aofManifest lists the files of an AOF, in the order they are replayed.
+type aofManifest struct {
+	files []aofFile
+}
+
+type aofFile struct {
+	name string
+	seq  int64
+	typ  byte
+}
+
+// readAOFManifest reads a manifest, made of lines such as:
+//
+//	file appendonly.aof.1.base.rdb seq 1 type b
+//	file appendonly.aof.1.incr.aof seq 1 type i
+//
+// Files are ordered with the base first, then the incremental files by
+// sequence number.
+func readAOFManifest(path string) (aofManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return aofManifest{}, err
+	}
+	var m aofManifest
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return aofManifest{}, fmt.Errorf("invalid AOF manifest line %d", i+1)
+		}
+		var file aofFile
+		for j := 0; j < len(fields); j += 2 {
+			switch fields[j] {
+			case "file":
+				file.name = fields[j+1]
+			case "seq":
+				file.seq, err = strconv.ParseInt(fields[j+1], 10, 64)
+			case "type":
+				if len(fields[j+1]) == 1 {
+					file.typ = fields[j+1][0]
+				}
+			}
+		}
+		if err != nil || file.name == "" || strings.ContainsAny(file.name, `/\`) ||
+			(file.typ != aofBase && file.typ != aofIncr && file.typ != aofHistory) {
+			return aofManifest{}, fmt.Errorf("invalid AOF manifest line %d", i+1)
+		}
+		m.files = append(m.files, file)
+	}
+	sort.SliceStable(m.files, func(i, j int) bool {
+		fi, fj := m.files[i], m.files[j]
+		if (fi.typ == aofBase) != (fj.typ == aofBase) {
+			return fi.typ == aofBase
+		}
+		return fi.seq < fj.seq
+	})
+	return m, nil
+}
+
+// writeManifest replaces the manifest with m, atomically.
+func (a *AOF) writeManifest(m aofManifest) error {
+	var b bytes.Buffer
+	for _, file := range m.files {
+		fmt.Fprintf(&b, "file %s seq %d type %c\n", file.name, file.seq, file.typ)
+	}
+	tmp := a.path("temp-" + a.manifestName())
+	if err := os.WriteFile(tmp, b.Bytes(), 0o644); err != nil {
+		return err
+	}
+	if err := syncFile(tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, a.path(a.manifestName())); err != nil {
+		return err
+	}
+	return syncFile(a.opts.Dir)
+}
+
+// syncFile flushes a file or directory to disk.
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err
+	}
+	return nil
+}
+
+// removeHistory deletes the history files, left over by a rewrite that was
+// interrupted before it could delete them, and forgets them.
+func (a *AOF) removeHistory() {
+	files := a.manifest.files[:0:0]
+	for _, file := range a.manifest.files {
+		if file.typ == aofHistory {
+			_ = os.Remove(a.path(file.name))
+			continue
+		}
+		files = append(files, file)
+	}
+	a.manifest.files = files
+}
+
+func (m aofManifest) clone() aofManifest {
+	return aofManifest{files: append([]aofFile(nil), m.files...)}
+}
+
+// lastIncr returns the last incremental file, or nil.
+func (m aofManifest) lastIncr() *aofFile {
+	for i := len(m.files) - 1; i >= 0; i-- {
+		if m.files[i].typ == aofIncr {
+			return &m.files[i]
+		}
+	}
+	return nil
+}
+
+// nextSeq returns the sequence number of the next file of type typ.
+func (m aofManifest) nextSeq(typ byte) int64 {
+	var seq int64
+	for _, file := range m.files {
+		if file.typ == typ && file.seq > seq {
+			seq = file.seq
+		}
+	}
+	return seq + 1
+}
@@ -0,0 +1,57 @@
+//go:build linux
+
+package redhub
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAOF_PartialWrite(t *testing.T) {
+	dir := t.TempDir()
+	store := newAOFTestStore()
+	rh, aof := newAOFTestServer(t, dir, store, AOFOptions{Fsync: FsyncAlways, Snapshotter: store})
+	require.NoError(t, rh.loadAOF())
+
+	// After a rewrite, the AOF is larger than its incremental file.
+	aofTraffic(rh, "SET a 1\r\n")
+	require.NoError(t, aof.Rewrite())
+	require.Eventually(t, func() bool {
+		return strings.Contains(string(aof.AppendInfo(nil)), "aof_rewrite_in_progress:0")
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "+OK\r\n", aofTraffic(rh, "SET b 2\r\n"))
+	setB := "*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1\r\n2\r\n"
+	require.Equal(t, setB, readAOFFile(t, dir, "appendonly.aof.2.incr.aof"))
+
+	// Files cannot grow past 40 bytes, so the next command is written in part.
+	var limit syscall.Rlimit
+	require.NoError(t, syscall.Getrlimit(syscall.RLIMIT_FSIZE, &limit))
+	require.NoError(t, syscall.Setrlimit(syscall.RLIMIT_FSIZE, &syscall.Rlimit{Cur: 40, Max: limit.Max}))
+	mock := &mockConn{buf: []byte("SET c 3\r\n")}
+	mock.SetContext(&connBuffer{})
+	action := rh.OnTraffic(mock)
+	require.NoError(t, syscall.Setrlimit(syscall.RLIMIT_FSIZE, &limit))
+
+	// The write is not answered, and the partial command is dropped.
+	assert.Equal(t, gnet.Close, action)
+	assert.Empty(t, mock.written)
+	assert.Equal(t, setB, readAOFFile(t, dir, "appendonly.aof.2.incr.aof"))
+
+	// Once writes succeed again, the command is written once, in full.
+	assert.NoError(t, aof.writeError())
+	setC := "*3\r\n$3\r\nSET\r\n$1\r\nc\r\n$1\r\n3\r\n"
+	assert.Equal(t, setB+setC, readAOFFile(t, dir, "appendonly.aof.2.incr.aof"))
+	require.NoError(t, aof.Close())
+
+	replayed := newAOFTestStore()
+	rh, aof = newAOFTestServer(t, dir, replayed, AOFOptions{})
+	require.NoError(t, rh.loadAOF())
+	assert.Equal(t, map[string]string{"a": "1", "b": "2", "c": "3"}, replayed.data)
+	require.NoError(t, aof.Close())
+}
@@ -0,0 +1,359 @@
+package redhub
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IceFireDB/redhub/pkg/rdb"
+	"github.com/IceFireDB/redhub/pkg/resp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// aofTestStore is a tiny key-value store, whose snapshots are RDB files.
+type aofTestStore struct {
+	mu   sync.Mutex
+	data map[string]string
+	log  []string // Commands served, in order
+}
+
+func newAOFTestStore() *aofTestStore {
+	return &aofTestStore{data: map[string]string{}}
+}
+
+func (s *aofTestStore) handler(cmd resp.Command, out []byte) ([]byte, Action) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	args := make([]string, len(cmd.Args))
+	for i, arg := range cmd.Args {
+		args[i] = string(arg)
+	}
+	s.log = append(s.log, strings.Join(args, " "))
+	switch strings.ToLower(args[0]) {
+	case "set":
+		if args[1] == "bad" {
+			return resp.AppendErr(out, resp.ErrWrongType), None
+		}
+		s.data[args[1]] = args[2]
+		return resp.AppendOK(out), None
+	case "del":
+		n := 0
+		for _, key := range args[1:] {
+			if _, ok := s.data[key]; ok {
+				delete(s.data, key)
+				n++
+			}
+		}
+		return resp.AppendInt(out, int64(n)), None
+	case "get":
+		v, ok := s.data[args[1]]
+		if !ok {
+			return resp.AppendNull(out), None
+		}
+		return resp.AppendBulkString(out, v), None
+	}
+	return resp.AppendErr(out, resp.UnknownCommand(cmd.Args)), None
+}
+
+func (s *aofTestStore) Snapshot() (io.WriterTo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var buf bytes.Buffer
+	enc := rdb.NewEncoder(&buf, rdb.EncoderOptions{})
+	keys := make([]string, 0, len(s.data))
+	for k := range s.data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		_ = enc.String(rdb.Key{Name: []byte(k)}, []byte(s.data[k]))
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+func (s *aofTestStore) commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.log...)
+}
+
+// newAOFTestServer returns a server logging the writes of store to the AOF
+// in dir.
+func newAOFTestServer(t *testing.T, dir string, store *aofTestStore, opts AOFOptions) (*RedHub, *AOF) {
+	opts.Dir = dir
+	aof, err := OpenAOF(opts)
+	require.NoError(t, err)
+	rh := NewRedHub(nil, nil, store.handler)
+	rh.RegisterCommands(RedisCommands...)
+	rh.SetAOF(aof)
+	return rh, aof
+}
+
+func aofTraffic(rh *RedHub, input string) string {
+	mock := &mockConn{buf: []byte(input)}
+	mock.SetContext(&connBuffer{})
+	rh.OnTraffic(mock)
+	return string(mock.written)
+}
+
+func readAOFFile(t *testing.T, dir, name string) string {
+	b, err := os.ReadFile(filepath.Join(dir, name))
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestAOF_SyncError(t *testing.T) {
+	dir := t.TempDir()
+	rh, aof := newAOFTestServer(t, dir, newAOFTestStore(), AOFOptions{Fsync: FsyncAlways})
+	require.NoError(t, rh.loadAOF())
+
+	// Writes to a pipe succeed, but it cannot be synced.
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	aof.mu.Lock()
+	file := aof.f
+	aof.f = w
+	aof.mu.Unlock()
+
+	aof.Propagate([]byte("SET"), []byte("a"), []byte("1"))
+	assert.Error(t, aof.writeError())
+	assert.Error(t, aof.writeError())
+	aof.mu.Lock()
+	aof.f = file
+	aof.mu.Unlock()
+	assert.NoError(t, aof.writeError())
+
+	// The command was written once, and is not written again by the retries.
+	require.NoError(t, w.Close())
+	written, err := io.ReadAll(r)
+	require.NoError(t, err)
+	expected := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n"
+	assert.Equal(t, expected, string(written))
+	assert.Empty(t, readAOFFile(t, dir, "appendonly.aof.1.incr.aof"))
+	assert.Equal(t, int64(len(expected)), aof.Size())
+	require.NoError(t, aof.Close())
+}
+
+func TestAOF_WriteOrder(t *testing.T) {
+	dir := t.TempDir()
+	aof, err := OpenAOF(AOFOptions{Dir: dir, Fsync: FsyncNo})
+	require.NoError(t, err)
+	store := newAOFTestStore()
+	rh := NewRedHub(nil, nil, func(cmd resp.Command, out []byte) ([]byte, Action) {
+		out, action := store.handler(cmd, out)
+		runtime.Gosched()
+		return out, action
+	})
+	rh.RegisterCommands(RedisCommands...)
+	rh.SetAOF(aof)
+	require.NoError(t, rh.loadAOF())
+
+	// Several event loops write the same key.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				aofTraffic(rh, fmt.Sprintf("SET k %d-%d\r\n", i, j))
+			}
+		}(i)
+	}
+	wg.Wait()
+	require.NoError(t, aof.Close())
+
+	// Replaying the AOF applies the writes in the same order.
+	replayed := newAOFTestStore()
+	rh, aof = newAOFTestServer(t, dir, replayed, AOFOptions{})
+	require.NoError(t, rh.loadAOF())
+	assert.Equal(t, store.commands(), replayed.commands())
+	assert.Equal(t, store.data, replayed.data)
+	require.NoError(t, aof.Close())
+}
+
+func TestAOF_AppendAndReplay(t *testing.T) {
+	for _, fsync := range []FsyncPolicy{FsyncEverySec, FsyncAlways, FsyncNo} {
+		dir := t.TempDir()
+		rh, aof := newAOFTestServer(t, dir, newAOFTestStore(), AOFOptions{Fsync: fsync})
+		require.NoError(t, rh.loadAOF())
+
+		reply := aofTraffic(rh, "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\nGET a\r\nSET bad 1\r\nSET b 2\r\nDEL b\r\n")
+		assert.Equal(t, "+OK\r\n$1\r\n1\r\n-WRONGTYPE Operation against a key holding the wrong kind of value\r\n+OK\r\n:1\r\n", reply)
+		aof.Propagate([]byte("SET"), []byte("c"), []byte("3"))
+
+		// The writes are in the file before they are answered; only the
+		// write commands that succeeded are logged, inline commands in RESP.
+		expected := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n" +
+			"*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1\r\n2\r\n" +
+			"*2\r\n$3\r\nDEL\r\n$1\r\nb\r\n" +
+			"*3\r\n$3\r\nSET\r\n$1\r\nc\r\n$1\r\n3\r\n"
+		assert.Equal(t, expected, readAOFFile(t, dir, "appendonly.aof.1.incr.aof"))
+		assert.Equal(t, "file appendonly.aof.1.incr.aof seq 1 type i\n", readAOFFile(t, dir, "appendonly.aof.manifest"))
+		assert.Equal(t, int64(len(expected)), aof.Size())
+		require.NoError(t, aof.Close())
+		assert.ErrorIs(t, aof.Close(), os.ErrClosed)
+
+		store := newAOFTestStore()
+		rh, aof = newAOFTestServer(t, dir, store, AOFOptions{Fsync: fsync})
+		require.NoError(t, rh.loadAOF())
+		assert.Equal(t, []string{"SET a 1", "SET b 2", "DEL b", "SET c 3"}, store.commands())
+		assert.Equal(t, map[string]string{"a": "1", "c": "3"}, store.data)
+		require.NoError(t, aof.Close())
+	}
+}
+
+func TestAOF_PropagateInPlace(t *testing.T) {
+	dir := t.TempDir()
+	aof, err := OpenAOF(AOFOptions{Dir: dir})
+	require.NoError(t, err)
+	store := newAOFTestStore()
+	rh := NewRedHub(nil, nil, func(cmd resp.Command, out []byte) ([]byte, Action) {
+		if strings.EqualFold(string(cmd.Args[0]), "expire") {
+			// The relative TTL is logged as an absolute one.
+			aof.Propagate([]byte("PEXPIREAT"), cmd.Args[1], []byte("1700000000000"))
+			return resp.AppendInt(out, 1), None
+		}
+		return store.handler(cmd, out)
+	})
+	rh.RegisterCommands(RedisCommands...)
+	rh.SetAOF(aof)
+	require.NoError(t, rh.loadAOF())
+
+	assert.Equal(t, ":1\r\n+OK\r\n", aofTraffic(rh, "EXPIRE a 100\r\nSET a 1\r\n"))
+	expected := "*3\r\n$9\r\nPEXPIREAT\r\n$1\r\na\r\n$13\r\n1700000000000\r\n" +
+		"*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n"
+	assert.Equal(t, expected, readAOFFile(t, dir, "appendonly.aof.1.incr.aof"))
+	require.NoError(t, aof.Close())
+}
+
+func TestAOF_Rewrite(t *testing.T) {
+	dir := t.TempDir()
+	store := newAOFTestStore()
+	rh, aof := newAOFTestServer(t, dir, store, AOFOptions{Snapshotter: store})
+	require.NoError(t, rh.loadAOF())
+
+	aofTraffic(rh, "SET a 1\r\nSET b 2\r\nSET a 3\r\n")
+	assert.Equal(t, "+Background append only file rewriting started\r\n", aofTraffic(rh, "BGREWRITEAOF\r\n"))
+	aofTraffic(rh, "SET c 4\r\n")
+	require.Eventually(t, func() bool {
+		return strings.Contains(string(aof.AppendInfo(nil)), "aof_rewrite_in_progress:0")
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(t, string(aof.AppendInfo(nil)), "aof_last_bgrewrite_status:ok")
+
+	// The base holds the snapshot, and the new incremental file the writes
+	// made since; the former files are gone.
+	assert.Equal(t, "file appendonly.aof.1.base.rdb seq 1 type b\nfile appendonly.aof.2.incr.aof seq 2 type i\n",
+		readAOFFile(t, dir, "appendonly.aof.manifest"))
+	assert.NoFileExists(t, filepath.Join(dir, "appendonly.aof.1.incr.aof"))
+	assert.Equal(t, "*3\r\n$3\r\nSET\r\n$1\r\nc\r\n$1\r\n4\r\n", readAOFFile(t, dir, "appendonly.aof.2.incr.aof"))
+	require.NoError(t, aof.Close())
+
+	replayed := newAOFTestStore()
+	rh, aof = newAOFTestServer(t, dir, replayed, AOFOptions{})
+	require.NoError(t, rh.loadAOF())
+	assert.Equal(t, []string{"SET a 3", "SET b 2", "SET c 4"}, replayed.commands())
+	assert.Equal(t, store.data, replayed.data)
+
+	// Without a snapshotter, the AOF cannot be rewritten.
+	assert.Equal(t, "-ERR the AOF cannot be rewritten without a snapshotter\r\n", aofTraffic(rh, "BGREWRITEAOF\r\n"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'bgrewriteaof' command\r\n", aofTraffic(rh, "BGREWRITEAOF now\r\n"))
+	require.NoError(t, aof.Close())
+}
+
+func TestAOF_SnapshotTimeout(t *testing.T) {
+	dir := t.TempDir()
+	store := newAOFTestStore()
+	release := make(chan struct{})
+	defer close(release)
+	slow := SnapshotFunc(func() (io.WriterTo, error) {
+		<-release
+		return store.Snapshot()
+	})
+	rh, aof := newAOFTestServer(t, dir, store, AOFOptions{Snapshotter: slow, SnapshotTimeout: 10 * time.Millisecond})
+	require.NoError(t, rh.loadAOF())
+	defer aof.Close()
+
+	// The rewrite fails, and writes resume.
+	assert.Equal(t, errSnapshotTimeout, aof.Rewrite())
+	assert.Contains(t, string(aof.AppendInfo(nil)), "aof_last_bgrewrite_status:err")
+	assert.Equal(t, "+OK\r\n", aofTraffic(rh, "SET a 1\r\n"))
+	assert.NoFileExists(t, filepath.Join(dir, "appendonly.aof.1.base.rdb"))
+}
+
+func TestAOF_AutoRewrite(t *testing.T) {
+	dir := t.TempDir()
+	store := newAOFTestStore()
+	rh, aof := newAOFTestServer(t, dir, store, AOFOptions{Snapshotter: store, RewriteMinSize: 64})
+	require.NoError(t, rh.loadAOF())
+	defer aof.Close()
+
+	aofTraffic(rh, "SET a 1\r\nSET a 2\r\nSET a 3\r\n")
+	require.Eventually(t, func() bool {
+		return strings.Contains(string(aof.AppendInfo(nil)), "aof_rewrites:1\r\n")
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.FileExists(t, filepath.Join(dir, "appendonly.aof.1.base.rdb"))
+}
+
+func TestAOF_Truncated(t *testing.T) {
+	dir := t.TempDir()
+	complete := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "appendonly.aof.manifest"),
+		[]byte("file appendonly.aof.1.incr.aof seq 1 type i\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "appendonly.aof.1.incr.aof"),
+		[]byte(complete+"*3\r\n$3\r\nSET\r\n$1\r\nb"), 0o644))
+
+	rh, aof := newAOFTestServer(t, dir, newAOFTestStore(), AOFOptions{StrictLoad: true})
+	assert.ErrorContains(t, rh.loadAOF(), "truncated command at offset 27")
+	require.NoError(t, aof.Close())
+
+	store := newAOFTestStore()
+	rh, aof = newAOFTestServer(t, dir, store, AOFOptions{})
+	require.NoError(t, rh.loadAOF())
+	assert.Equal(t, []string{"SET a 1"}, store.commands())
+	assert.Equal(t, complete, readAOFFile(t, dir, "appendonly.aof.1.incr.aof"))
+
+	// New writes follow the last complete command.
+	aofTraffic(rh, "SET c 3\r\n")
+	require.NoError(t, aof.Close())
+	assert.Equal(t, complete+"*3\r\n$3\r\nSET\r\n$1\r\nc\r\n$1\r\n3\r\n", readAOFFile(t, dir, "appendonly.aof.1.incr.aof"))
+}
+
+func TestAOF_Manifest(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "m")
+	require.NoError(t, os.WriteFile(path, []byte("# comment\n"+
+		"file appendonly.aof.3.incr.aof seq 3 type i\n"+
+		"file appendonly.aof.2.base.rdb seq 2 type b\n"+
+		"type i seq 2 file appendonly.aof.2.incr.aof\n"+
+		"file appendonly.aof.1.incr.aof seq 1 type h\n"), 0o644))
+	m, err := readAOFManifest(path)
+	require.NoError(t, err)
+	var names []string
+	for _, file := range m.files {
+		names = append(names, file.name)
+	}
+	assert.Equal(t, []string{
+		"appendonly.aof.2.base.rdb", "appendonly.aof.1.incr.aof", "appendonly.aof.2.incr.aof", "appendonly.aof.3.incr.aof",
+	}, names)
+	assert.Equal(t, int64(4), m.nextSeq(aofIncr))
+	assert.Equal(t, int64(3), m.nextSeq(aofBase))
+
+	for _, bad := range []string{"file a seq 1\n", "file a seq x type i\n", "file ../a seq 1 type i\n", "file a seq 1 type z\n"} {
+		require.NoError(t, os.WriteFile(path, []byte(bad), 0o644))
+		_, err := readAOFManifest(path)
+		assert.Error(t, err, bad)
+	}
+}
@@ -0,0 +1,156 @@
+package redhub
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/IceFireDB/redhub/pkg/cluster"
+	"github.com/IceFireDB/redhub/pkg/resp"
+	"github.com/panjf2000/gnet/v2"
+)
+
+const (
+	// busTickInterval is how often the cluster bus is ticked.
+	busTickInterval = 100 * time.Millisecond
+
+	// maxBusMessage is the largest message accepted on the cluster bus.
+	maxBusMessage = 1 << 20
+)
+
+// SetClusterBus makes the server a node of a Redis Cluster whose nodes find each
+// other and agree on the topology through the cluster bus b. It implies
+// SetCluster(b.Cluster()).
+//
+// The bus is served by a listener with Bus set, conventionally on the client
+// port plus 10000. That listener accepts the links of the other nodes, and also
+// opens the links to them on its own event loops. SetClusterBus must be called
+// before the server is started.
+//
+// Example:
+//
+//	c := cluster.New(cluster.Node{IP: "127.0.0.1", Port: 7000})
+//	rh.RegisterCommands(redhub.RedisCommands...)
+//	rh.SetClusterBus(cluster.NewBus(c, cluster.BusOptions{}))
+//	err := redhub.ListenAndServeAll([]redhub.Listener{
+//	    {Addr: "tcp://127.0.0.1:7000"},
+//	    {Addr: "tcp://127.0.0.1:17000", Bus: true},
+//	}, rh)
+//
+// A node then joins the cluster with CLUSTER MEET, sent to any of its nodes.
+func (rs *RedHub) SetClusterBus(b *cluster.Bus) {
+	rs.bus = b
+	rs.cluster = b.Cluster()
+}
+
+// busGnetOptions returns the gnet options of a cluster bus listener. The bus is
+// ticked, and outgoing links are registered with a load balancer that is safe
+// to call from outside the event loops. As the links between nodes are closed
+// on both sides, the address is reused so that a restarted node can listen
+// again while the links of its previous run are in TIME_WAIT.
+func busGnetOptions(options Options) []gnet.Option {
+	return append(options.gnetOptions(),
+		gnet.WithTicker(true),
+		gnet.WithLoadBalancing(gnet.LeastConnections),
+		gnet.WithReuseAddr(true))
+}
+
+// openBusLink attaches a cluster bus link to c: the link being dialed for an
+// outgoing connection, or a new one for an incoming connection.
+func (h *listenerHandler) openBusLink(c gnet.Conn) ([]byte, gnet.Action) {
+	if l, ok := c.Context().(*cluster.Link); ok {
+		first, err := h.bus.Connected(l, c, time.Now())
+		if err != nil {
+			return nil, gnet.Close
+		}
+		return first, gnet.None
+	}
+	c.SetContext(h.bus.Accept(c))
+	return nil, gnet.None
+}
+
+// readBusLink passes the complete messages received on c to the cluster bus and
+// writes its replies.
+func (h *listenerHandler) readBusLink(c gnet.Conn) gnet.Action {
+	l, ok := c.Context().(*cluster.Link)
+	if !ok {
+		return gnet.Close
+	}
+	buf, _ := c.Peek(-1)
+	now := time.Now()
+	var out []byte
+	var n int
+	for n < len(buf) {
+		if buf[n] != '*' {
+			return gnet.Close
+		}
+		size, _ := resp.ReadNextRESP(buf[n:])
+		if size == 0 {
+			if len(buf)-n > maxBusMessage {
+				return gnet.Close
+			}
+			break
+		}
+		reply, err := h.bus.Receive(l, buf[n:n+size], now)
+		if err != nil {
+			return gnet.Close
+		}
+		out = append(out, reply...)
+		n += size
+	}
+	_, _ = c.Discard(n)
+	if len(out) > 0 {
+		_, _ = c.Write(out)
+	}
+	return gnet.None
+}
+
+// closeBusLink tells the cluster bus that the link of c is closed.
+func (h *listenerHandler) closeBusLink(c gnet.Conn) {
+	if l, ok := c.Context().(*cluster.Link); ok {
+		h.bus.Disconnected(l)
+	}
+}
+
+// tickBus advances the cluster bus: it dials the links the bus asks for, and
+// sends its messages. It runs on the ticker goroutine of the engine, so writes
+// go through AsyncWrite.
+func (h *listenerHandler) tickBus() {
+	dial, send := h.bus.Tick(time.Now())
+	for _, l := range dial {
+		h.dialBus(l)
+	}
+	for _, m := range send {
+		c, ok := m.Conn.(gnet.Conn)
+		if !ok {
+			continue
+		}
+		if m.Data == nil {
+			_ = c.CloseWithCallback(nil)
+		} else {
+			_ = c.AsyncWrite(m.Data, nil)
+		}
+	}
+}
+
+// dialBus opens the connection of an outgoing cluster bus link on the engine of
+// the listener. The link is the context of the connection, which makes
+// openBusLink see it as outgoing.
+func (h *listenerHandler) dialBus(l *cluster.Link) {
+	addr, err := net.ResolveTCPAddr("tcp", l.Addr)
+	if err != nil {
+		h.bus.Disconnected(l)
+		return
+	}
+	ctx := gnet.NewContext(gnet.NewNetAddrContext(context.Background(), addr), l)
+	registered, err := h.eng.Register(ctx)
+	if err != nil {
+		h.bus.Disconnected(l)
+		return
+	}
+	go func() {
+		if res := <-registered; res.Err != nil {
+			h.bus.Disconnected(l)
+		}
+	}()
+}
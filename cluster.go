@@ -0,0 +1,84 @@
+package redhub
+
+import (
+	"github.com/IceFireDB/redhub/pkg/cluster"
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// SetCluster makes the server a node of a Redis Cluster, with c holding its
+// view of the cluster.
+//
+// Before a registered command (see RegisterCommands) reaches the handler, its
+// keys are routed with c.Route: commands for slots served by another node are
+// answered with a -MOVED or -ASK redirection, and the handler only sees the
+// commands it must serve. RedHub also answers the following commands itself:
+//
+//   - CLUSTER, for the subcommands supported by cluster.Cluster.Command; other
+//     subcommands are passed to the handler;
+//   - ASKING, which lets the next command run on a node importing its slot;
+//   - READONLY and READWRITE, which let a replica serve read-only commands.
+//
+// SetCluster must be called before the server is started.
+//
+// Example:
+//
+//	c := cluster.New(cluster.Node{ID: myID, IP: "10.0.0.1", Port: 6379})
+//	nodes, _ := cluster.ParseNodes(conf) // or build the []cluster.Node in code
+//	if err := c.SetNodes(nodes); err != nil {
+//	    log.Fatal(err)
+//	}
+//	rh.RegisterCommands(redhub.RedisCommands...)
+//	rh.SetCluster(c)
+func (rs *RedHub) SetCluster(c *cluster.Cluster) {
+	rs.cluster = c
+}
+
+// routeCluster answers the cluster commands and redirects commands for slots
+// that are not served locally. spec is the spec of cmd, or nil if the command
+// is not registered. It reports whether cmd was answered.
+func (rs *RedHub) routeCluster(cb *connBuffer, spec *CommandSpec, cmd resp.Command, out []byte) ([]byte, bool) {
+	asking := cb.asking
+	cb.asking = false
+
+	name := cmd.Args[0]
+	switch {
+	case equalFold(name, "cluster"):
+		return rs.cluster.Command(cmd.Args, out)
+	case equalFold(name, "asking"):
+		cb.asking = true
+		return resp.AppendString(out, "OK"), true
+	case equalFold(name, "readonly"):
+		cb.readonly = true
+		return resp.AppendString(out, "OK"), true
+	case equalFold(name, "readwrite"):
+		cb.readonly = false
+		return resp.AppendString(out, "OK"), true
+	}
+	if spec == nil {
+		return out, false
+	}
+
+	cb.keys = spec.AppendKeys(cb.keys[:0], cmd.Args)
+	err := rs.cluster.Route(cb.keys, asking, cb.readonly && spec.Flags&FlagWrite == 0)
+	clear(cb.keys)
+	if err != nil {
+		return cb.appendErr(out, err), true
+	}
+	return out, false
+}
+
+// equalFold reports whether b equals the lower case string s, ignoring case.
+func equalFold(b []byte, s string) bool {
+	if len(b) != len(s) {
+		return false
+	}
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		if c != s[i] {
+			return false
+		}
+	}
+	return true
+}
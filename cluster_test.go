@@ -0,0 +1,198 @@
+package redhub
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IceFireDB/redhub/pkg/cluster"
+	"github.com/IceFireDB/redhub/pkg/resp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCluster(t *testing.T) {
+	idA := strings.Repeat("a", 40)
+	idB := strings.Repeat("b", 40)
+	idR := strings.Repeat("r", 40)
+	nodes := []cluster.Node{
+		{ID: idA, IP: "127.0.0.1", Port: 7000, Slots: []cluster.SlotRange{{Start: 0, End: 8191}}},
+		{ID: idB, IP: "127.0.0.1", Port: 7001, Slots: []cluster.SlotRange{{Start: 8192, End: 16383}}},
+		{ID: idR, IP: "127.0.0.1", Port: 7002, PrimaryID: idA},
+	}
+
+	newNode := func(id string) *RedHub {
+		c := cluster.New(cluster.Node{ID: id})
+		assert.NoError(t, c.SetNodes(nodes))
+		rh := NewRedHub(nil, nil, func(cmd resp.Command, out []byte) ([]byte, Action) {
+			return resp.AppendBulkString(out, "served "+strings.ToLower(string(cmd.Args[0]))), None
+		})
+		rh.RegisterCommands(RedisCommands...)
+		rh.SetCluster(c)
+		return rh
+	}
+
+	// "bar" is in slot 5061, served by A, and "foo" in slot 12182, served by B.
+	tests := []struct {
+		name     string
+		node     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "local",
+			node:     idA,
+			input:    "GET bar\r\nSET {bar}x 1\r\n",
+			expected: "$10\r\nserved get\r\n$10\r\nserved set\r\n",
+		},
+		{
+			name:     "moved",
+			node:     idA,
+			input:    "GET foo\r\nMSET bar 1 foo 2\r\n",
+			expected: "-MOVED 12182 127.0.0.1:7001\r\n-CROSSSLOT Keys in request don't hash to the same slot\r\n",
+		},
+		{
+			name:     "unregistered commands are not routed",
+			node:     idA,
+			input:    "FOO foo\r\n",
+			expected: "$10\r\nserved foo\r\n",
+		},
+		{
+			name:     "cluster commands",
+			node:     idB,
+			input:    "CLUSTER KEYSLOT foo\r\nCLUSTER MYID\r\nCLUSTER COUNTKEYSINSLOT 1\r\n",
+			expected: ":12182\r\n$40\r\n" + idB + "\r\n$14\r\nserved cluster\r\n",
+		},
+		{
+			name:  "readonly replica",
+			node:  idR,
+			input: "GET bar\r\nREADONLY\r\nGET bar\r\nSET bar 1\r\nGET foo\r\nREADWRITE\r\nGET bar\r\n",
+			expected: "-MOVED 5061 127.0.0.1:7000\r\n+OK\r\n$10\r\nserved get\r\n-MOVED 5061 127.0.0.1:7000\r\n" +
+				"-MOVED 12182 127.0.0.1:7001\r\n+OK\r\n-MOVED 5061 127.0.0.1:7000\r\n",
+		},
+		{
+			name:     "arity is checked first",
+			node:     idA,
+			input:    "GET foo bar\r\n",
+			expected: "-ERR wrong number of arguments for 'get' command\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rh := newNode(tt.node)
+			mock := &mockConn{id: tt.name, buf: []byte(tt.input)}
+			mock.SetContext(&connBuffer{})
+			rh.OnTraffic(mock)
+			assert.Equal(t, tt.expected, string(mock.written))
+		})
+	}
+
+	t.Run("asking", func(t *testing.T) {
+		rh := newNode(idA)
+		assert.NoError(t, rh.cluster.SetImporting(12182, idB))
+		mock := &mockConn{buf: []byte("GET foo\r\nASKING\r\nGET foo\r\nGET foo\r\n")}
+		mock.SetContext(&connBuffer{})
+		rh.OnTraffic(mock)
+		// ASKING only applies to the next command.
+		assert.Equal(t, "-MOVED 12182 127.0.0.1:7001\r\n+OK\r\n$10\r\nserved get\r\n-MOVED 12182 127.0.0.1:7001\r\n",
+			string(mock.written))
+	})
+
+	t.Run("tile38", func(t *testing.T) {
+		rh := newNode(idA)
+		rh.SetParser(&resp.Parser{Tile38: true})
+		mock := &mockConn{buf: []byte("$7 GET foo\r\n")}
+		mock.SetContext(&connBuffer{})
+		rh.OnTraffic(mock)
+		assert.Equal(t, "$47 {\"ok\":false,\"err\":\"MOVED 12182 127.0.0.1:7001\"}\r\n", string(mock.written))
+	})
+}
+
+func TestClusterBus_Integration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	// Three primaries on localhost, with their bus on the port plus 10000.
+	ports := []int{16390, 16391, 16392}
+	var nodes []*RedHub
+	var done []chan error
+	for i, port := range ports {
+		c := cluster.New(cluster.Node{IP: "127.0.0.1", Port: port})
+		start := i * cluster.SlotCount / len(ports)
+		end := (i+1)*cluster.SlotCount/len(ports) - 1
+		assert.NoError(t, c.AssignSlots(c.Myself().ID, cluster.SlotRange{Start: start, End: end}))
+		rh := NewRedHub(
+			func(c *Conn) (out []byte, action Action) { return nil, None },
+			func(c *Conn, err error) (action Action) { return None },
+			func(cmd resp.Command, out []byte) ([]byte, Action) {
+				return resp.AppendString(out, "OK"), None
+			},
+		)
+		rh.RegisterCommands(RedisCommands...)
+		rh.SetClusterBus(cluster.NewBus(c, cluster.BusOptions{NodeTimeout: 500 * time.Millisecond}))
+		serverErr := make(chan error, 1)
+		go func() {
+			serverErr <- ListenAndServeAll([]Listener{
+				{Addr: "tcp://127.0.0.1:" + strconv.Itoa(port)},
+				{Addr: "tcp://127.0.0.1:" + strconv.Itoa(port+10000), Bus: true},
+			}, rh)
+		}()
+		nodes = append(nodes, rh)
+		done = append(done, serverErr)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	command := func(port int, args ...string) string {
+		conn, err := net.DialTimeout("tcp", "127.0.0.1:"+strconv.Itoa(port), time.Second)
+		if err != nil {
+			return err.Error()
+		}
+		defer conn.Close()
+		var req []byte
+		req = resp.AppendArray(req, len(args))
+		for _, arg := range args {
+			req = resp.AppendBulkString(req, arg)
+		}
+		_, _ = conn.Write(req)
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		v, err := resp.NewReader(conn).ReadValue()
+		if err != nil {
+			return err.Error()
+		}
+		return string(v.Data)
+	}
+
+	assert.Equal(t, "OK", command(16390, "CLUSTER", "MEET", "127.0.0.1", "16391"))
+	assert.Equal(t, "OK", command(16390, "CLUSTER", "MEET", "127.0.0.1", "16392", "26392"))
+
+	// The third node learns about the second one through gossip, and all of
+	// them agree on the slots: "foo" is in slot 12182, served by the third node.
+	assert.Eventually(t, func() bool {
+		return strings.Contains(command(16392, "CLUSTER", "INFO"), "cluster_known_nodes:3\r\n") &&
+			command(16391, "GET", "foo") == "MOVED 12182 127.0.0.1:16392" &&
+			command(16392, "GET", "foo") == "OK"
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// Stopping the second node makes the others flag it FAIL.
+	id := nodes[1].cluster.Myself().ID
+	assert.NoError(t, nodes[1].Close())
+	assert.Eventually(t, func() bool {
+		return strings.Contains(command(16390, "CLUSTER", "NODES"), id+" 127.0.0.1:16391@26391 fail,master") &&
+			strings.Contains(command(16392, "CLUSTER", "INFO"), "cluster_state:fail\r\n")
+	}, 5*time.Second, 50*time.Millisecond)
+
+	for _, rh := range []*RedHub{nodes[0], nodes[2]} {
+		assert.NoError(t, rh.Close())
+	}
+	for _, serverErr := range done {
+		select {
+		case err := <-serverErr:
+			assert.NoError(t, err)
+		case <-time.After(2 * time.Second):
+			t.Error("Server did not stop within timeout")
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package redhub
+
+import "github.com/IceFireDB/redhub/pkg/resp"
+
+// CommandFlag describes a property of a command, see CommandSpec.
+type CommandFlag uint32
+
+const (
+	// FlagWrite marks a command that may modify the dataset.
+	FlagWrite CommandFlag = 1 << iota
+
+	// FlagReadOnly marks a command that only reads the dataset. With the
+	// cluster enabled, it can be served by a replica to a client that sent
+	// READONLY.
+	FlagReadOnly
+
+	// FlagAdmin marks an administrative command, such as CONFIG or SHUTDOWN.
+	FlagAdmin
+
+	// FlagPubSub marks a Pub/Sub command.
+	FlagPubSub
+)
+
+// CommandSpec describes a command of the application, like an entry of the
+// Redis command table. RedHub uses it for the features that need to know about
+// commands before the handler runs, such as routing commands to the right node
+// of a cluster by their keys.
+//
+// Keys are found at positions FirstKey, FirstKey+Step, ... up to LastKey, where
+// position 0 is the command name. A negative LastKey counts from the end, so -1
+// is the last argument. For commands whose keys cannot be found this way, such
+// as EVAL, KeysFunc finds them instead.
+//
+// Example:
+//
+//	rh.RegisterCommands(
+//	    redhub.CommandSpec{Name: "get", Arity: 2, Flags: redhub.FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+//	    redhub.CommandSpec{Name: "mset", Arity: -3, Flags: redhub.FlagWrite, FirstKey: 1, LastKey: -1, Step: 2},
+//	)
+type CommandSpec struct {
+	// Name is the name of the command, in lower case.
+	Name string
+
+	// Arity is the number of arguments, including the command name. A negative
+	// arity is a minimum: -2 means at least two. Zero disables the check.
+	Arity int
+
+	// Flags describe the command.
+	Flags CommandFlag
+
+	// FirstKey, LastKey and Step locate the keys among the arguments. A zero
+	// FirstKey means the command has no keys.
+	FirstKey int
+	LastKey  int
+	Step     int
+
+	// KeysFunc, if set, appends the keys of a command to dst instead of
+	// FirstKey, LastKey and Step.
+	KeysFunc func(dst [][]byte, args [][]byte) [][]byte
+}
+
+// AppendKeys appends the keys of the command with arguments args to dst.
+// Positions that are out of range are ignored.
+//
+// Example:
+//
+//	spec := redhub.CommandSpec{Name: "mset", FirstKey: 1, LastKey: -1, Step: 2}
+//	keys := spec.AppendKeys(nil, cmd.Args) // MSET a 1 b 2: [a b]
+func (s *CommandSpec) AppendKeys(dst [][]byte, args [][]byte) [][]byte {
+	if s.KeysFunc != nil {
+		return s.KeysFunc(dst, args)
+	}
+	if s.FirstKey <= 0 {
+		return dst
+	}
+	last := s.LastKey
+	if last < 0 {
+		last += len(args)
+	}
+	if last >= len(args) {
+		last = len(args) - 1
+	}
+	step := s.Step
+	if step <= 0 {
+		step = 1
+	}
+	for i := s.FirstKey; i <= last; i += step {
+		dst = append(dst, args[i])
+	}
+	return dst
+}
+
+// checkArity reports whether a command with n arguments matches the arity.
+func (s *CommandSpec) checkArity(n int) bool {
+	return s.Arity == 0 || s.Arity > 0 && n == s.Arity || s.Arity < 0 && n >= -s.Arity
+}
+
+// commandTable maps the names of the registered commands to their specs.
+type commandTable map[string]*CommandSpec
+
+// maxCommandName is the longest command name looked up in a commandTable.
+const maxCommandName = 64
+
+// lookup returns the spec of the command named name, in any case, or nil.
+func (t commandTable) lookup(name []byte) *CommandSpec {
+	if len(t) == 0 || len(name) > maxCommandName {
+		return nil
+	}
+	var buf [maxCommandName]byte
+	for i, c := range name {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		buf[i] = c
+	}
+	// Indexing a map with a converted byte slice does not allocate.
+	return t[string(buf[:len(name)])]
+}
+
+// RegisterCommands adds commands to the command table of the server, replacing
+// any command registered before with the same name.
+//
+// Registered commands are checked for their arity before the handler runs, and
+// answered with "-ERR wrong number of arguments" if it does not match. Their
+// keys drive the redirections of a cluster (see SetCluster). Commands that are
+// not registered are passed to the handler unchecked.
+//
+// RedisCommands holds the specs of the common Redis commands, so a server
+// implementing a subset of Redis can register them directly:
+//
+//	rh.RegisterCommands(redhub.RedisCommands...)
+//
+// RegisterCommands must be called before the server is started.
+func (rs *RedHub) RegisterCommands(specs ...CommandSpec) {
+	if rs.commands == nil {
+		rs.commands = make(commandTable, len(specs))
+	}
+	for i := range specs {
+		spec := specs[i]
+		rs.commands[spec.Name] = &spec
+	}
+}
+
+// LookupCommand returns the spec of a registered command, in any case.
+func (rs *RedHub) LookupCommand(name string) (CommandSpec, bool) {
+	spec := rs.commands.lookup([]byte(name))
+	if spec == nil {
+		return CommandSpec{}, false
+	}
+	return *spec, true
+}
+
+// checkCommand runs the checks of the command table on cmd before it reaches
+// the handler. It reports whether the command was answered by RedHub itself,
+// with its reply appended to out.
+func (rs *RedHub) checkCommand(cb *connBuffer, cmd resp.Command, out []byte) ([]byte, bool) {
+	spec := rs.commands.lookup(cmd.Args[0])
+	if spec != nil && !spec.checkArity(len(cmd.Args)) {
+		return cb.appendErr(out, resp.WrongArgs(spec.Name)), true
+	}
+	if rs.cluster != nil {
+		return rs.routeCluster(cb, spec, cmd, out)
+	}
+	return out, false
+}
+
+// RedisCommands are the specs of the common Redis commands on strings, keys,
+// hashes, lists, sets and sorted sets, and of Pub/Sub, as listed by COMMAND
+// INFO.
+var RedisCommands = []CommandSpec{
+	// Connection and server
+	{Name: "ping", Arity: -1},
+	{Name: "echo", Arity: 2},
+	{Name: "select", Arity: 2},
+	{Name: "quit", Arity: -1},
+	{Name: "client", Arity: -2},
+	{Name: "dbsize", Arity: 1, Flags: FlagReadOnly},
+	{Name: "flushdb", Arity: -1, Flags: FlagWrite},
+	{Name: "flushall", Arity: -1, Flags: FlagWrite},
+	{Name: "config", Arity: -2, Flags: FlagAdmin},
+	{Name: "info", Arity: -1},
+
+	// Keys
+	{Name: "del", Arity: -2, Flags: FlagWrite, FirstKey: 1, LastKey: -1, Step: 1},
+	{Name: "unlink", Arity: -2, Flags: FlagWrite, FirstKey: 1, LastKey: -1, Step: 1},
+	{Name: "exists", Arity: -2, Flags: FlagReadOnly, FirstKey: 1, LastKey: -1, Step: 1},
+	{Name: "type", Arity: 2, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "expire", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "pexpire", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "expireat", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "pexpireat", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "persist", Arity: 2, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "ttl", Arity: 2, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "pttl", Arity: 2, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "rename", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 2, Step: 1},
+	{Name: "renamenx", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 2, Step: 1},
+	{Name: "keys", Arity: 2, Flags: FlagReadOnly},
+	{Name: "scan", Arity: -2, Flags: FlagReadOnly},
+
+	// Strings
+	{Name: "get", Arity: 2, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "set", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "setnx", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "setex", Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "psetex", Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "getset", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "getdel", Arity: 2, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "mget", Arity: -2, Flags: FlagReadOnly, FirstKey: 1, LastKey: -1, Step: 1},
+	{Name: "mset", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: -1, Step: 2},
+	{Name: "msetnx", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: -1, Step: 2},
+	{Name: "append", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "strlen", Arity: 2, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "incr", Arity: 2, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "decr", Arity: 2, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "incrby", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "decrby", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "incrbyfloat", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "getrange", Arity: 4, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "setrange", Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+
+	// Hashes
+	{Name: "hget", Arity: 3, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "hset", Arity: -4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "hsetnx", Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "hmget", Arity: -3, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "hmset", Arity: -4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "hdel", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "hexists", Arity: 3, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "hlen", Arity: 2, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "hgetall", Arity: 2, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "hkeys", Arity: 2, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "hvals", Arity: 2, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "hincrby", Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+
+	// Lists
+	{Name: "lpush", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "rpush", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "lpop", Arity: -2, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "rpop", Arity: -2, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "llen", Arity: 2, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "lrange", Arity: 4, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "lindex", Arity: 3, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "lset", Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "lrem", Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "ltrim", Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "rpoplpush", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 2, Step: 1},
+	{Name: "lmove", Arity: 5, Flags: FlagWrite, FirstKey: 1, LastKey: 2, Step: 1},
+
+	// Sets
+	{Name: "sadd", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "srem", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "smembers", Arity: 2, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "sismember", Arity: 3, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "scard", Arity: 2, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "spop", Arity: -2, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "sinter", Arity: -2, Flags: FlagReadOnly, FirstKey: 1, LastKey: -1, Step: 1},
+	{Name: "sunion", Arity: -2, Flags: FlagReadOnly, FirstKey: 1, LastKey: -1, Step: 1},
+	{Name: "sdiff", Arity: -2, Flags: FlagReadOnly, FirstKey: 1, LastKey: -1, Step: 1},
+	{Name: "sinterstore", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: -1, Step: 1},
+	{Name: "sunionstore", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: -1, Step: 1},
+	{Name: "sdiffstore", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: -1, Step: 1},
+
+	// Sorted sets
+	{Name: "zadd", Arity: -4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "zrem", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "zincrby", Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "zscore", Arity: 3, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "zcard", Arity: 2, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "zrank", Arity: -3, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "zrange", Arity: -4, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "zrangebyscore", Arity: -4, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "zcount", Arity: 4, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1},
+	{Name: "zremrangebyscore", Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, Step: 1},
+
+	// Pub/Sub
+	{Name: "subscribe", Arity: -2, Flags: FlagPubSub},
+	{Name: "unsubscribe", Arity: -1, Flags: FlagPubSub},
+	{Name: "psubscribe", Arity: -2, Flags: FlagPubSub},
+	{Name: "punsubscribe", Arity: -1, Flags: FlagPubSub},
+	{Name: "publish", Arity: 3, Flags: FlagPubSub},
+	{Name: "pubsub", Arity: -2, Flags: FlagPubSub},
+}
@@ -0,0 +1,106 @@
+package redhub
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+	"github.com/stretchr/testify/assert"
+)
+
+func args(s string) [][]byte {
+	var b [][]byte
+	for _, f := range strings.Fields(s) {
+		b = append(b, []byte(f))
+	}
+	return b
+}
+
+func TestCommandSpecAppendKeys(t *testing.T) {
+	evalKeys := func(dst [][]byte, args [][]byte) [][]byte {
+		// EVAL script numkeys key [key ...] arg [arg ...]
+		n := int(args[2][0] - '0')
+		return append(dst, args[3:3+n]...)
+	}
+
+	tests := []struct {
+		name     string
+		spec     CommandSpec
+		args     string
+		expected string
+	}{
+		{"no keys", CommandSpec{Name: "ping"}, "PING", ""},
+		{"single", CommandSpec{Name: "get", FirstKey: 1, LastKey: 1, Step: 1}, "GET k", "k"},
+		{"all", CommandSpec{Name: "del", FirstKey: 1, LastKey: -1, Step: 1}, "DEL a b c", "a b c"},
+		{"step", CommandSpec{Name: "mset", FirstKey: 1, LastKey: -1, Step: 2}, "MSET a 1 b 2", "a b"},
+		{"two", CommandSpec{Name: "rename", FirstKey: 1, LastKey: 2, Step: 1}, "RENAME a b", "a b"},
+		{"all but last", CommandSpec{Name: "blpop", FirstKey: 1, LastKey: -2, Step: 1}, "BLPOP a b 0", "a b"},
+		{"missing", CommandSpec{Name: "get", FirstKey: 1, LastKey: 1, Step: 1}, "GET", ""},
+		{"truncated", CommandSpec{Name: "rename", FirstKey: 1, LastKey: 2, Step: 1}, "RENAME a", "a"},
+		{"zero step", CommandSpec{Name: "del", FirstKey: 1, LastKey: -1}, "DEL a b", "a b"},
+		{"func", CommandSpec{Name: "eval", KeysFunc: evalKeys}, "EVAL s 2 a b x", "a b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := tt.spec.AppendKeys(nil, args(tt.args))
+			assert.Equal(t, args(tt.expected), keys)
+		})
+	}
+}
+
+func TestRegisterCommands(t *testing.T) {
+	rh := NewRedHub(nil, nil, nil)
+	_, ok := rh.LookupCommand("get")
+	assert.False(t, ok)
+
+	rh.RegisterCommands(RedisCommands...)
+	spec, ok := rh.LookupCommand("GET")
+	assert.True(t, ok)
+	assert.Equal(t, CommandSpec{Name: "get", Arity: 2, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, Step: 1}, spec)
+
+	rh.RegisterCommands(CommandSpec{Name: "get", Arity: -2})
+	spec, _ = rh.LookupCommand("Get")
+	assert.Equal(t, -2, spec.Arity)
+
+	_, ok = rh.LookupCommand(strings.Repeat("x", maxCommandName+1))
+	assert.False(t, ok)
+
+	for _, spec := range RedisCommands {
+		assert.Equal(t, strings.ToLower(spec.Name), spec.Name)
+		assert.False(t, spec.Flags&FlagWrite != 0 && spec.Flags&FlagReadOnly != 0, spec.Name)
+	}
+}
+
+func TestOnTraffic_Arity(t *testing.T) {
+	var calls int
+	rh := NewRedHub(nil, nil, func(cmd resp.Command, out []byte) ([]byte, Action) {
+		calls++
+		return resp.AppendString(out, "OK"), None
+	})
+	rh.RegisterCommands(
+		CommandSpec{Name: "get", Arity: 2},
+		CommandSpec{Name: "set", Arity: -3},
+	)
+
+	mock := &mockConn{buf: []byte("GET\r\nget a\r\nGET a b\r\nSET a\r\nSET a b EX 1\r\nUNKNOWN\r\n")}
+	mock.SetContext(&connBuffer{})
+	rh.OnTraffic(mock)
+	assert.Equal(t, "-ERR wrong number of arguments for 'get' command\r\n"+
+		"+OK\r\n"+
+		"-ERR wrong number of arguments for 'get' command\r\n"+
+		"-ERR wrong number of arguments for 'set' command\r\n"+
+		"+OK\r\n"+
+		"+OK\r\n", string(mock.written))
+	assert.Equal(t, 3, calls)
+}
+
+func TestCommandLookupZeroAllocs(t *testing.T) {
+	rh := NewRedHub(nil, nil, nil)
+	rh.RegisterCommands(RedisCommands...)
+	name := []byte("HGETALL")
+	allocs := testing.AllocsPerRun(100, func() {
+		rh.commands.lookup(name)
+	})
+	assert.Equal(t, 0.0, allocs)
+}
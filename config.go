@@ -0,0 +1,795 @@
+package redhub
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// ConfigType is the type of the value of a configuration parameter.
+type ConfigType int
+
+const (
+	// ConfigString is a string, such as the dir of Redis.
+	ConfigString ConfigType = iota
+
+	// ConfigInt is an integer, such as maxclients.
+	ConfigInt
+
+	// ConfigBool is "yes" or "no", such as appendonly.
+	ConfigBool
+
+	// ConfigDuration is an integer number of ConfigParam.Unit, such as
+	// timeout, in seconds.
+	ConfigDuration
+
+	// ConfigMemory is a number of bytes, which may be written with a unit:
+	// 1k is 1000 bytes, 1kb 1024 bytes, and likewise for m, mb, g and gb,
+	// such as maxmemory.
+	ConfigMemory
+
+	// ConfigEnum is one of ConfigParam.Values, such as appendfsync.
+	ConfigEnum
+)
+
+// maxIOThreads is the largest io-threads, like in Redis.
+const maxIOThreads = 128
+
+// configRewriteMarker is the comment CONFIG REWRITE writes before the
+// parameters it adds at the end of the file.
+const configRewriteMarker = "# Generated by CONFIG REWRITE"
+
+var errConfigNoFile = errors.New("The server is running without a config file")
+
+// ConfigValue is the value of a configuration parameter.
+type ConfigValue struct {
+	// Text is the value as CONFIG GET shows it: yes or no for a boolean, the
+	// number of bytes for a memory size, the number of units for a duration.
+	Text string
+
+	// Int is the value of an integer, the number of bytes of a memory size,
+	// the number of units of a duration, and the index in Values of an enum.
+	Int int64
+
+	// Bool is the value of a boolean.
+	Bool bool
+
+	// Duration is the value of a duration.
+	Duration time.Duration
+}
+
+// ConfigParam describes a configuration parameter, see Config.Register.
+type ConfigParam struct {
+	// Name is the name of the parameter, in lower case, such as "maxmemory".
+	Name string
+
+	// Aliases are the other names of the parameter, which CONFIG GET, CONFIG
+	// SET and config files accept as well.
+	Aliases []string
+
+	// Type is the type of the value.
+	Type ConfigType
+
+	// Default is the initial value, in the syntax of CONFIG SET.
+	Default string
+
+	// Min and Max bound the value of an integer, a duration or a memory size.
+	// The value is not bounded when both are zero.
+	Min, Max int64
+
+	// Unit is the unit of a duration.
+	// Default: time.Second
+	Unit time.Duration
+
+	// Values are the values of an enum, in lower case.
+	Values []string
+
+	// Immutable parameters are only set by config files: CONFIG SET refuses
+	// to change them.
+	Immutable bool
+
+	// Normalize, if set, checks a string and returns it in the form CONFIG
+	// GET shows.
+	Normalize func(s string) (string, error)
+
+	// Validate, if set, checks a value before it is set.
+	Validate func(v ConfigValue) error
+
+	// OnChange, if set, is called when the value is set by CONFIG SET or a
+	// config file. If it fails, the value is not changed.
+	OnChange func(v ConfigValue) error
+}
+
+// Config is a registry of typed configuration parameters, which RedHub
+// exposes through the CONFIG command like Redis. Install it with SetConfig.
+//
+// The application registers its parameters with Register, and the
+// components of the server with their RegisterConfig methods, such as
+// Options.RegisterConfig and AOF.RegisterConfig. Load reads a config file in
+// the format of redis.conf at startup, and CONFIG REWRITE writes the current
+// values back to it.
+//
+// A Config is safe for concurrent use.
+type Config struct {
+	// setMu serializes the changes of the values, so that their OnChange
+	// callbacks are called in the order of the changes.
+	setMu sync.Mutex
+
+	mu        sync.RWMutex
+	params    map[string]*configEntry // By name and alias
+	entries   []*configEntry          // In the order of registration
+	path      string                  // Config file loaded, for CONFIG REWRITE
+	resetStat []func()
+}
+
+// configEntry is a registered parameter and its value.
+type configEntry struct {
+	param ConfigParam
+	def   ConfigValue
+	value ConfigValue
+}
+
+// configChange is a parameter about to be set.
+type configChange struct {
+	entry    *configEntry
+	name     string // Name used to set it, for error messages
+	old, new ConfigValue
+}
+
+// NewConfig returns an empty configuration registry.
+//
+// Example:
+//
+//	config := redhub.NewConfig()
+//	options.RegisterConfig(config)
+//	aof.RegisterConfig(config)
+//	config.Register(redhub.ConfigParam{
+//	    Name: "maxmemory", Type: redhub.ConfigMemory, Default: "0",
+//	    OnChange: func(v redhub.ConfigValue) error { store.SetMaxMemory(v.Int); return nil },
+//	})
+//	if err := config.Load("/etc/myserver.conf"); err != nil {
+//	    log.Fatal(err)
+//	}
+//	rh.SetConfig(config)
+func NewConfig() *Config {
+	return &Config{params: make(map[string]*configEntry)}
+}
+
+// SetConfig makes RedHub answer the following subcommands of CONFIG from c,
+// like Redis:
+//
+//   - CONFIG GET pattern [pattern ...] returns the parameters whose name or
+//     alias matches one of the glob-style patterns.
+//   - CONFIG SET parameter value [parameter value ...] sets parameters. The
+//     values are all checked before any is set, and if one fails to apply,
+//     the others are restored: either all parameters change, or none does.
+//   - CONFIG RESETSTAT calls the functions registered with OnResetStat.
+//   - CONFIG REWRITE writes the current values to the config file loaded.
+//
+// The other subcommands are passed to the handler. SetConfig must be called
+// before the server is started.
+func (rs *RedHub) SetConfig(c *Config) {
+	rs.config = c
+}
+
+// Register adds parameters to the registry, with their default value.
+// OnChange is not called for the default values. Register fails if a name is
+// already registered or a default value is invalid, and then registers none
+// of the parameters.
+func (c *Config) Register(params ...ConfigParam) error {
+	entries := make([]*configEntry, 0, len(params))
+	for _, p := range params {
+		if p.Type == ConfigDuration && p.Unit <= 0 {
+			p.Unit = time.Second
+		}
+		def, err := p.parse(p.Default)
+		if err != nil {
+			return fmt.Errorf("invalid default value of config parameter %s: %w", p.Name, err)
+		}
+		entries = append(entries, &configEntry{param: p, def: def, value: def})
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make(map[string]bool)
+	for _, e := range entries {
+		for _, name := range e.names() {
+			if _, dup := c.params[name]; dup || names[name] || name == "" {
+				return fmt.Errorf("config parameter %q registered twice", name)
+			}
+			names[name] = true
+		}
+	}
+	for _, e := range entries {
+		for _, name := range e.names() {
+			c.params[name] = e
+		}
+		c.entries = append(c.entries, e)
+	}
+	return nil
+}
+
+// names returns the name and the aliases of the parameter, in lower case.
+func (e *configEntry) names() []string {
+	names := make([]string, 0, 1+len(e.param.Aliases))
+	for _, name := range append([]string{e.param.Name}, e.param.Aliases...) {
+		names = append(names, strings.ToLower(name))
+	}
+	return names
+}
+
+// Get returns the value of the parameter named name, or one of its aliases.
+func (c *Config) Get(name string) (ConfigValue, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	e := c.params[strings.ToLower(name)]
+	if e == nil {
+		return ConfigValue{}, false
+	}
+	return e.value, true
+}
+
+// Set sets parameters from pairs of names and values, like CONFIG SET: the
+// values are all checked before any is set, and if the OnChange callback of
+// one fails, the parameters already changed are restored. Immutable
+// parameters cannot be set.
+//
+// Example:
+//
+//	err := config.Set("maxmemory", "1gb", "appendfsync", "always")
+func (c *Config) Set(pairs ...string) error {
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return errors.New("wrong number of arguments for CONFIG SET")
+	}
+	c.setMu.Lock()
+	defer c.setMu.Unlock()
+	changes := make([]configChange, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		name, text := pairs[i], pairs[i+1]
+		c.mu.RLock()
+		e := c.params[strings.ToLower(name)]
+		var old ConfigValue
+		if e != nil {
+			old = e.value
+		}
+		c.mu.RUnlock()
+		if e == nil {
+			return errors.New("Unknown option or number of arguments for CONFIG SET - '" + name + "'")
+		}
+		for _, ch := range changes {
+			if ch.entry == e {
+				return configSetError(name, errors.New("duplicate parameter"))
+			}
+		}
+		if e.param.Immutable {
+			return configSetError(name, errors.New("can't set immutable config"))
+		}
+		v, err := e.param.parse(text)
+		if err != nil {
+			return configSetError(name, err)
+		}
+		changes = append(changes, configChange{entry: e, name: name, old: old, new: v})
+	}
+	return c.apply(changes)
+}
+
+// configSetError returns the error of CONFIG SET for the parameter name.
+func configSetError(name string, err error) error {
+	return fmt.Errorf("CONFIG SET failed (possibly related to argument '%s') - %w", name, err)
+}
+
+// apply sets the values of changes and calls their OnChange callbacks. If one
+// fails, the values of the changes already applied are restored, and their
+// callbacks called again. c.setMu must be held.
+func (c *Config) apply(changes []configChange) error {
+	c.mu.Lock()
+	for _, ch := range changes {
+		ch.entry.value = ch.new
+	}
+	c.mu.Unlock()
+	for i, ch := range changes {
+		if ch.entry.param.OnChange == nil {
+			continue
+		}
+		if err := ch.entry.param.OnChange(ch.new); err != nil {
+			c.mu.Lock()
+			for _, ch := range changes {
+				ch.entry.value = ch.old
+			}
+			c.mu.Unlock()
+			for j := i - 1; j >= 0; j-- {
+				if onChange := changes[j].entry.param.OnChange; onChange != nil {
+					_ = onChange(changes[j].old)
+				}
+			}
+			return configSetError(ch.name, err)
+		}
+	}
+	return nil
+}
+
+// OnResetStat registers a function that CONFIG RESETSTAT calls, to reset the
+// statistics of the server.
+func (c *Config) OnResetStat(fn func()) {
+	c.mu.Lock()
+	c.resetStat = append(c.resetStat, fn)
+	c.mu.Unlock()
+}
+
+// ResetStat calls the functions registered with OnResetStat.
+func (c *Config) ResetStat() {
+	c.mu.RLock()
+	fns := c.resetStat
+	c.mu.RUnlock()
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+// Load sets the parameters from a config file in the format of redis.conf:
+// a parameter per line, followed by its value, with the quoting rules of
+// inline commands. Empty lines and lines starting with # are ignored. When a
+// parameter appears several times, the last value is kept. Unlike CONFIG
+// SET, Load sets immutable parameters.
+//
+// Like Set, Load sets either all the parameters of the file or none of them.
+// The file is the one CONFIG REWRITE writes to.
+//
+// Example of config file:
+//
+//	# Network
+//	tcp-keepalive 300
+//	io-threads 4
+//
+//	appendfsync everysec
+//	notify-keyspace-events "KEA"
+func (c *Config) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	c.setMu.Lock()
+	defer c.setMu.Unlock()
+	var changes []configChange
+	for i, line := range bytes.Split(data, []byte{'\n'}) {
+		args, err := configLine(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if len(args) < 2 {
+			return fmt.Errorf("%s:%d: wrong number of arguments", path, i+1)
+		}
+		name := string(args[0])
+		c.mu.RLock()
+		e := c.params[strings.ToLower(name)]
+		var old ConfigValue
+		if e != nil {
+			old = e.value
+		}
+		c.mu.RUnlock()
+		if e == nil {
+			return fmt.Errorf("%s:%d: bad directive '%s'", path, i+1, name)
+		}
+		v, err := e.param.parse(string(bytes.Join(args[1:], []byte{' '})))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s: %w", path, i+1, name, err)
+		}
+		ch := configChange{entry: e, name: name, old: old, new: v}
+		found := false
+		for j := range changes {
+			if changes[j].entry == e {
+				changes[j].new = v
+				found = true
+			}
+		}
+		if !found {
+			changes = append(changes, ch)
+		}
+	}
+	if err := c.apply(changes); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	c.mu.Lock()
+	c.path = path
+	c.mu.Unlock()
+	return nil
+}
+
+// configLine splits a line of a config file into arguments. Comments have
+// none.
+func configLine(line []byte) ([][]byte, error) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 || line[0] == '#' {
+		return nil, nil
+	}
+	return resp.SplitArgs(line)
+}
+
+// Rewrite writes the current values to the config file loaded by Load, like
+// CONFIG REWRITE. The lines of the registered parameters are replaced with
+// their current value, and the other lines are kept as they are. The
+// parameters whose value differs from the default, and that the file does not
+// mention, are added at the end of the file. The file is replaced atomically.
+func (c *Config) Rewrite() error {
+	c.setMu.Lock()
+	defer c.setMu.Unlock()
+	c.mu.RLock()
+	path := c.path
+	c.mu.RUnlock()
+	if path == "" {
+		return errConfigNoFile
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	data = bytes.TrimRight(data, "\n")
+
+	c.mu.RLock()
+	var out []byte
+	written := make(map[*configEntry]bool)
+	marker := false // Whether the file has the marker of a former rewrite
+	if len(data) > 0 {
+		for _, line := range bytes.Split(data, []byte{'\n'}) {
+			if string(bytes.TrimSpace(line)) == configRewriteMarker {
+				marker = true
+			}
+			args, err := configLine(line)
+			var e *configEntry
+			if err == nil && len(args) > 0 {
+				e = c.params[strings.ToLower(string(args[0]))]
+			}
+			switch {
+			case e == nil:
+				out = append(out, line...)
+				out = append(out, '\n')
+			case !written[e]:
+				out = e.appendLine(out)
+				written[e] = true
+			}
+		}
+	}
+	for _, e := range c.entries {
+		if written[e] || e.value.Text == e.def.Text {
+			continue
+		}
+		if !marker {
+			out = append(out, configRewriteMarker+"\n"...)
+			marker = true
+		}
+		out = e.appendLine(out)
+	}
+	c.mu.RUnlock()
+
+	return writeFileAtomic(path, out)
+}
+
+// appendLine appends the line of the parameter to a config file.
+func (e *configEntry) appendLine(b []byte) []byte {
+	b = append(b, e.param.Name...)
+	b = append(b, ' ')
+	switch e.param.Type {
+	case ConfigMemory:
+		b = appendMemory(b, e.value.Int)
+	case ConfigString:
+		b = appendConfigString(b, e.value.Text)
+	default:
+		b = append(b, e.value.Text...)
+	}
+	return append(b, '\n')
+}
+
+// writeFileAtomic replaces the file at path with data, through a temporary
+// file renamed over it.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "temp-config-*.conf")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		if fi, serr := os.Stat(path); serr == nil {
+			err = os.Chmod(f.Name(), fi.Mode().Perm())
+		}
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// parse parses text as a value of the parameter, in the syntax of CONFIG SET.
+func (p *ConfigParam) parse(text string) (ConfigValue, error) {
+	v := ConfigValue{Text: text}
+	switch p.Type {
+	case ConfigString:
+		if p.Normalize != nil {
+			s, err := p.Normalize(text)
+			if err != nil {
+				return v, err
+			}
+			v.Text = s
+		}
+	case ConfigInt, ConfigDuration:
+		n, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return v, errors.New("argument couldn't be parsed into an integer")
+		}
+		if err := p.checkRange(n); err != nil {
+			return v, err
+		}
+		v.Int, v.Text = n, strconv.FormatInt(n, 10)
+		if p.Type == ConfigDuration {
+			v.Duration = time.Duration(n) * p.Unit
+		}
+	case ConfigBool:
+		switch {
+		case strings.EqualFold(text, "yes"):
+			v.Bool, v.Text = true, "yes"
+		case strings.EqualFold(text, "no"):
+			v.Bool, v.Text = false, "no"
+		default:
+			return v, errors.New("argument must be 'yes' or 'no'")
+		}
+	case ConfigMemory:
+		n, ok := parseMemory(text)
+		if !ok {
+			return v, errors.New("argument must be a memory value")
+		}
+		if err := p.checkRange(n); err != nil {
+			return v, err
+		}
+		v.Int, v.Text = n, strconv.FormatInt(n, 10)
+	case ConfigEnum:
+		found := false
+		for i, value := range p.Values {
+			if strings.EqualFold(text, value) {
+				v.Int, v.Text = int64(i), value
+				found = true
+				break
+			}
+		}
+		if !found {
+			return v, errors.New("argument(s) must be one of the following: " + strings.Join(p.Values, ", "))
+		}
+	default:
+		return v, fmt.Errorf("unknown config type %d", p.Type)
+	}
+	if p.Validate != nil {
+		if err := p.Validate(v); err != nil {
+			return v, err
+		}
+	}
+	return v, nil
+}
+
+// checkRange checks that n is between Min and Max, if they are set.
+func (p *ConfigParam) checkRange(n int64) error {
+	if (p.Min != 0 || p.Max != 0) && (n < p.Min || n > p.Max) {
+		return fmt.Errorf("argument must be between %d and %d inclusive", p.Min, p.Max)
+	}
+	return nil
+}
+
+// memoryUnits are the units of memory sizes, longest suffix first.
+var memoryUnits = []struct {
+	suffix string
+	n      int64
+}{
+	{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10},
+	{"g", 1000 * 1000 * 1000}, {"m", 1000 * 1000}, {"k", 1000}, {"b", 1},
+}
+
+// parseMemory parses a memory size such as 100, 1k or 64mb, like memtoull in
+// Redis.
+func parseMemory(s string) (int64, bool) {
+	s = strings.ToLower(s)
+	mul := int64(1)
+	for _, u := range memoryUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mul = s[:len(s)-len(u.suffix)], u.n
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > (1<<63-1)/mul {
+		return 0, false
+	}
+	return n * mul, true
+}
+
+// appendMemory appends a memory size with the largest unit it is a multiple
+// of, as CONFIG REWRITE writes them.
+func appendMemory(b []byte, n int64) []byte {
+	for _, u := range memoryUnits[:3] {
+		if n != 0 && n%u.n == 0 {
+			b = strconv.AppendInt(b, n/u.n, 10)
+			return append(b, u.suffix...)
+		}
+	}
+	return strconv.AppendInt(b, n, 10)
+}
+
+// appendConfigString appends s to a config file, quoted if it is empty or
+// has characters that would not be read back as they are.
+func appendConfigString(b []byte, s string) []byte {
+	plain := s != ""
+	for i := 0; i < len(s) && plain; i++ {
+		c := s[i]
+		plain = c > ' ' && c < 0x7f && c != '"' && c != '\'' && c != '\\'
+	}
+	if plain {
+		return append(b, s...)
+	}
+	const hex = "0123456789abcdef"
+	b = append(b, '"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', '"':
+			b = append(b, '\\', c)
+		case '\n':
+			b = append(b, '\\', 'n')
+		case '\r':
+			b = append(b, '\\', 'r')
+		case '\t':
+			b = append(b, '\\', 't')
+		default:
+			if c >= ' ' && c < 0x7f {
+				b = append(b, c)
+			} else {
+				b = append(b, '\\', 'x', hex[c>>4], hex[c&0xf])
+			}
+		}
+	}
+	return append(b, '"')
+}
+
+// serveConfig answers CONFIG GET, SET, RESETSTAT and REWRITE. It reports
+// whether cmd was one of them.
+func (rs *RedHub) serveConfig(cb *connBuffer, cmd resp.Command, out []byte) ([]byte, bool) {
+	args := cmd.Args
+	if !equalFold(args[0], "config") || len(args) < 2 {
+		return out, false
+	}
+	c := rs.config
+	switch sub := args[1]; {
+	case equalFold(sub, "get"):
+		if len(args) < 3 {
+			return cb.appendErr(out, resp.WrongArgs("config|get")), true
+		}
+		return c.appendGet(out, cb.writer.Protocol(), args[2:]), true
+	case equalFold(sub, "set"):
+		if len(args) < 4 || len(args)%2 != 0 {
+			return cb.appendErr(out, resp.WrongArgs("config|set")), true
+		}
+		pairs := make([]string, len(args)-2)
+		for i, arg := range args[2:] {
+			pairs[i] = string(arg)
+		}
+		if err := c.Set(pairs...); err != nil {
+			return cb.appendError(out, "ERR "+err.Error()), true
+		}
+		return resp.AppendOK(out), true
+	case equalFold(sub, "resetstat"):
+		if len(args) != 2 {
+			return cb.appendErr(out, resp.WrongArgs("config|resetstat")), true
+		}
+		c.ResetStat()
+		return resp.AppendOK(out), true
+	case equalFold(sub, "rewrite"):
+		if len(args) != 2 {
+			return cb.appendErr(out, resp.WrongArgs("config|rewrite")), true
+		}
+		if err := c.Rewrite(); errors.Is(err, errConfigNoFile) {
+			return cb.appendError(out, "ERR "+err.Error()), true
+		} else if err != nil {
+			return cb.appendError(out, "ERR Rewriting config file: "+err.Error()), true
+		}
+		return resp.AppendOK(out), true
+	}
+	return out, false
+}
+
+// appendGet appends the reply of CONFIG GET: the parameters whose name or
+// alias matches one of the patterns, sorted by name.
+func (c *Config) appendGet(out []byte, proto resp.Protocol, patterns [][]byte) []byte {
+	c.mu.RLock()
+	values := make(map[string]string)
+	for name, e := range c.params {
+		for _, pattern := range patterns {
+			if stringMatch(string(pattern), []byte(name), true) {
+				values[name] = e.value.Text
+				break
+			}
+		}
+	}
+	c.mu.RUnlock()
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out = appendMapHeader(out, proto, len(names))
+	for _, name := range names {
+		out = resp.AppendBulkString(out, name)
+		out = resp.AppendBulkString(out, values[name])
+	}
+	return out
+}
+
+// RegisterConfig declares the options that config files set, with the names
+// of Redis: tcp-keepalive, in seconds, and io-threads, the number of event
+// loops, which enables Multicore when above 1. Their defaults are the current
+// options. Both are immutable: load the config file before starting the
+// server with the options.
+//
+// Example:
+//
+//	var options redhub.Options
+//	options.RegisterConfig(config)
+//	if err := config.Load(path); err != nil {
+//	    log.Fatal(err)
+//	}
+//	rh.SetConfig(config)
+//	log.Fatal(redhub.ListenAndServe(addr, options, rh))
+func (options *Options) RegisterConfig(c *Config) error {
+	threads := 1
+	if options.Multicore {
+		threads = options.NumEventLoop
+		if threads <= 0 {
+			threads = runtime.NumCPU()
+		}
+	}
+	if threads > maxIOThreads {
+		threads = maxIOThreads
+	}
+	return c.Register(
+		ConfigParam{
+			Name:      "tcp-keepalive",
+			Type:      ConfigDuration,
+			Default:   strconv.FormatInt(int64(options.TCPKeepAlive/time.Second), 10),
+			Max:       math.MaxInt32,
+			Immutable: true,
+			OnChange: func(v ConfigValue) error {
+				options.TCPKeepAlive = v.Duration
+				return nil
+			},
+		},
+		ConfigParam{
+			Name:      "io-threads",
+			Type:      ConfigInt,
+			Default:   strconv.Itoa(threads),
+			Min:       1,
+			Max:       maxIOThreads,
+			Immutable: true,
+			OnChange: func(v ConfigValue) error {
+				options.Multicore = v.Int > 1
+				options.NumEventLoop = int(v.Int)
+				return nil
+			},
+		},
+	)
+}
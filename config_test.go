@@ -0,0 +1,272 @@
+package redhub
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestConfig(t *testing.T) (*Config, map[string]ConfigValue) {
+	changed := make(map[string]ConfigValue)
+	onChange := func(name string) func(ConfigValue) error {
+		return func(v ConfigValue) error {
+			changed[name] = v
+			return nil
+		}
+	}
+	c := NewConfig()
+	require.NoError(t, c.Register(
+		ConfigParam{Name: "maxclients", Type: ConfigInt, Default: "10000", Min: 1, Max: 65000, OnChange: onChange("maxclients")},
+		ConfigParam{Name: "appendonly", Type: ConfigBool, Default: "no", OnChange: onChange("appendonly")},
+		ConfigParam{Name: "timeout", Type: ConfigDuration, Default: "0", OnChange: onChange("timeout")},
+		ConfigParam{Name: "maxmemory", Type: ConfigMemory, Default: "0", OnChange: onChange("maxmemory")},
+		ConfigParam{Name: "maxmemory-policy", Type: ConfigEnum, Default: "noeviction", Values: []string{"noeviction", "allkeys-lru"}},
+		ConfigParam{Name: "save", Type: ConfigString, Default: "3600 1"},
+		ConfigParam{Name: "replica-read-only", Aliases: []string{"slave-read-only"}, Type: ConfigBool, Default: "yes"},
+		ConfigParam{Name: "databases", Type: ConfigInt, Default: "16", Immutable: true},
+	))
+	return c, changed
+}
+
+func TestConfig_Set(t *testing.T) {
+	c, changed := newTestConfig(t)
+
+	v, ok := c.Get("maxclients")
+	require.True(t, ok)
+	assert.Equal(t, ConfigValue{Text: "10000", Int: 10000}, v)
+	assert.Empty(t, changed)
+	_, ok = c.Get("nope")
+	assert.False(t, ok)
+
+	require.NoError(t, c.Set("MAXCLIENTS", "50", "appendonly", "YES", "timeout", "30", "maxmemory", "1gb", "maxmemory-policy", "ALLKEYS-LRU"))
+	assert.Equal(t, ConfigValue{Text: "50", Int: 50}, changed["maxclients"])
+	assert.Equal(t, ConfigValue{Text: "yes", Bool: true}, changed["appendonly"])
+	assert.Equal(t, ConfigValue{Text: "30", Int: 30, Duration: 30 * time.Second}, changed["timeout"])
+	assert.Equal(t, ConfigValue{Text: "1073741824", Int: 1 << 30}, changed["maxmemory"])
+	v, _ = c.Get("maxmemory-policy")
+	assert.Equal(t, ConfigValue{Text: "allkeys-lru", Int: 1}, v)
+	require.NoError(t, c.Set("slave-read-only", "no"))
+	v, _ = c.Get("replica-read-only")
+	assert.Equal(t, "no", v.Text)
+
+	for _, tt := range []struct {
+		pairs []string
+		err   string
+	}{
+		{[]string{"nope", "1"}, "Unknown option or number of arguments for CONFIG SET - 'nope'"},
+		{[]string{"maxclients", "0"}, "CONFIG SET failed (possibly related to argument 'maxclients') - argument must be between 1 and 65000 inclusive"},
+		{[]string{"maxclients", "x"}, "CONFIG SET failed (possibly related to argument 'maxclients') - argument couldn't be parsed into an integer"},
+		{[]string{"appendonly", "maybe"}, "CONFIG SET failed (possibly related to argument 'appendonly') - argument must be 'yes' or 'no'"},
+		{[]string{"maxmemory", "1tb"}, "CONFIG SET failed (possibly related to argument 'maxmemory') - argument must be a memory value"},
+		{[]string{"maxmemory-policy", "lru"}, "CONFIG SET failed (possibly related to argument 'maxmemory-policy') - argument(s) must be one of the following: noeviction, allkeys-lru"},
+		{[]string{"databases", "1"}, "CONFIG SET failed (possibly related to argument 'databases') - can't set immutable config"},
+		{[]string{"maxclients", "1", "MaxClients", "2"}, "CONFIG SET failed (possibly related to argument 'MaxClients') - duplicate parameter"},
+		// Nothing is set when one of the values is invalid.
+		{[]string{"maxclients", "2", "appendonly", "maybe"}, "CONFIG SET failed (possibly related to argument 'appendonly') - argument must be 'yes' or 'no'"},
+	} {
+		err := c.Set(tt.pairs...)
+		if assert.Error(t, err, tt.pairs) {
+			assert.Equal(t, tt.err, err.Error(), tt.pairs)
+		}
+	}
+	v, _ = c.Get("maxclients")
+	assert.Equal(t, "50", v.Text)
+}
+
+func TestConfig_SetRollback(t *testing.T) {
+	c := NewConfig()
+	var a, b []string
+	require.NoError(t, c.Register(
+		ConfigParam{Name: "a", Type: ConfigString, Default: "a0", OnChange: func(v ConfigValue) error {
+			a = append(a, v.Text)
+			return nil
+		}},
+		ConfigParam{Name: "b", Type: ConfigString, Default: "b0", OnChange: func(v ConfigValue) error {
+			if v.Text == "bad" {
+				return errors.New("cannot apply")
+			}
+			b = append(b, v.Text)
+			return nil
+		}},
+	))
+
+	err := c.Set("a", "a1", "b", "bad")
+	require.EqualError(t, err, "CONFIG SET failed (possibly related to argument 'b') - cannot apply")
+	// a was applied, then restored.
+	assert.Equal(t, []string{"a1", "a0"}, a)
+	assert.Empty(t, b)
+	v, _ := c.Get("a")
+	assert.Equal(t, "a0", v.Text)
+}
+
+func TestConfig_Register(t *testing.T) {
+	c, _ := newTestConfig(t)
+	assert.Error(t, c.Register(ConfigParam{Name: "x", Type: ConfigInt, Default: "x"}))
+	assert.Error(t, c.Register(ConfigParam{Name: "x", Type: ConfigInt, Default: "1"}, ConfigParam{Name: "slave-read-only", Type: ConfigInt, Default: "1"}))
+	// Nothing was registered by the failed calls.
+	_, ok := c.Get("x")
+	assert.False(t, ok)
+	assert.NoError(t, c.Register(ConfigParam{Name: "x", Type: ConfigInt, Default: "1"}))
+}
+
+func TestConfig_Command(t *testing.T) {
+	rh, ps := newPubSubTestServer()
+	c, _ := newTestConfig(t)
+	require.NoError(t, ps.RegisterConfig(c))
+	var resets int
+	c.OnResetStat(func() { resets++ })
+	rh.SetConfig(c)
+	client := newPubSubClient(rh)
+
+	assert.Equal(t, "*4\r\n$9\r\nmaxmemory\r\n$1\r\n0\r\n$16\r\nmaxmemory-policy\r\n$10\r\nnoeviction\r\n", client.send("CONFIG GET maxmemory*\r\n"))
+	assert.Equal(t, "*6\r\n$10\r\nappendonly\r\n$2\r\nno\r\n$17\r\nreplica-read-only\r\n$3\r\nyes\r\n$15\r\nslave-read-only\r\n$3\r\nyes\r\n",
+		client.send("config get APPENDONLY *read-only\r\n"))
+	assert.Equal(t, "*0\r\n", client.send("CONFIG GET nope\r\n"))
+
+	assert.Equal(t, "+OK\r\n", client.send("CONFIG SET maxmemory 100mb notify-keyspace-events KEA\r\n"))
+	assert.Equal(t, "*2\r\n$9\r\nmaxmemory\r\n$9\r\n104857600\r\n", client.send("CONFIG GET maxmemory\r\n"))
+	assert.Equal(t, "*2\r\n$22\r\nnotify-keyspace-events\r\n$3\r\nAKE\r\n", client.send("CONFIG GET notify-keyspace-events\r\n"))
+	assert.Equal(t, NotifyAll|NotifyKeyspace|NotifyKeyevent, ps.NotifyFlags())
+	assert.Equal(t, "-ERR CONFIG SET failed (possibly related to argument 'notify-keyspace-events') - Invalid event class character. Use 'Ag$lshzxeKEtmdn'.\r\n",
+		client.send("CONFIG SET notify-keyspace-events KQ\r\n"))
+	assert.Equal(t, "-ERR Unknown option or number of arguments for CONFIG SET - 'nope'\r\n", client.send("CONFIG SET nope 1\r\n"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'config|set' command\r\n", client.send("CONFIG SET maxmemory 1 timeout\r\n"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'config|get' command\r\n", client.send("CONFIG GET\r\n"))
+
+	assert.Equal(t, "+OK\r\n", client.send("CONFIG RESETSTAT\r\n"))
+	assert.Equal(t, 1, resets)
+	assert.Equal(t, "-ERR The server is running without a config file\r\n", client.send("CONFIG REWRITE\r\n"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'config|resetstat' command\r\n", client.send("CONFIG RESETSTAT x\r\n"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'config|rewrite' command\r\n", client.send("CONFIG REWRITE x\r\n"))
+	assert.Equal(t, 1, resets)
+	// The other CONFIG commands go to the handler.
+	assert.Equal(t, "+OK\r\n", client.send("CONFIG HELP\r\n"))
+}
+
+func TestConfig_LoadRewrite(t *testing.T) {
+	c, changed := newTestConfig(t)
+	path := filepath.Join(t.TempDir(), "redis.conf")
+	require.NoError(t, os.WriteFile(path, []byte("# Limits\n"+
+		"maxclients 100\n"+
+		"\n"+
+		"slave-read-only yes\n"+
+		"databases 4\n"+
+		"save 900 1\n"+
+		"maxclients 200\n"+
+		"timeout 10\n"), 0o600))
+	require.NoError(t, c.Load(path))
+	assert.Equal(t, int64(200), changed["maxclients"].Int)
+	assert.Equal(t, 10*time.Second, changed["timeout"].Duration)
+	v, _ := c.Get("databases")
+	assert.Equal(t, "4", v.Text)
+	v, _ = c.Get("save")
+	assert.Equal(t, "900 1", v.Text)
+
+	require.NoError(t, c.Set("maxmemory", "2gb", "timeout", "0", "save", "", "replica-read-only", "no"))
+	require.NoError(t, c.Rewrite())
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "# Limits\n"+
+		"maxclients 200\n"+
+		"\n"+
+		"replica-read-only no\n"+
+		"databases 4\n"+
+		"save \"\"\n"+
+		"timeout 0\n"+
+		configRewriteMarker+"\n"+
+		"maxmemory 2gb\n", string(data))
+
+	// The file written loads back to the same values, and rewrites to itself.
+	loaded, _ := newTestConfig(t)
+	require.NoError(t, loaded.Load(path))
+	for _, name := range []string{"maxclients", "replica-read-only", "databases", "save", "timeout", "maxmemory"} {
+		want, _ := c.Get(name)
+		got, _ := loaded.Get(name)
+		assert.Equal(t, want, got, name)
+	}
+	require.NoError(t, loaded.Rewrite())
+	again, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, string(data), string(again))
+
+	for content, msg := range map[string]string{
+		"maxclients 1\nnope 1\n":   ":2: bad directive 'nope'",
+		"maxclients\n":             ":1: wrong number of arguments",
+		"maxclients 0\n":           ":1: maxclients: argument must be between 1 and 65000 inclusive",
+		"save \"900 1\n":           ":1: Protocol error: unbalanced quotes in request",
+		"appendonly yes\nsave x\n": "",
+	} {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		err := loaded.Load(path)
+		if msg == "" {
+			assert.NoError(t, err, content)
+		} else if assert.Error(t, err, content) {
+			assert.Equal(t, path+msg, err.Error(), content)
+		}
+	}
+}
+
+func TestConfig_Components(t *testing.T) {
+	c := NewConfig()
+	var options Options
+	require.NoError(t, options.RegisterConfig(c))
+	aof, err := OpenAOF(AOFOptions{Dir: t.TempDir()})
+	require.NoError(t, err)
+	defer aof.Close()
+	require.NoError(t, aof.RegisterConfig(c))
+	tracking := NewTracking(TrackingOptions{})
+	require.NoError(t, tracking.RegisterConfig(c))
+
+	for name, text := range map[string]string{
+		"tcp-keepalive":               "0",
+		"io-threads":                  "1",
+		"appendfsync":                 "everysec",
+		"auto-aof-rewrite-percentage": "100",
+		"auto-aof-rewrite-min-size":   "67108864",
+		"tracking-table-max-keys":     "1000000",
+	} {
+		v, ok := c.Get(name)
+		assert.True(t, ok, name)
+		assert.Equal(t, text, v.Text, name)
+	}
+
+	path := filepath.Join(t.TempDir(), "redhub.conf")
+	require.NoError(t, os.WriteFile(path, []byte("tcp-keepalive 300\nio-threads 4\n"), 0o600))
+	require.NoError(t, c.Load(path))
+	assert.Equal(t, 300*time.Second, options.TCPKeepAlive)
+	assert.True(t, options.Multicore)
+	assert.Equal(t, 4, options.NumEventLoop)
+	assert.Error(t, c.Set("io-threads", "2"))
+
+	require.NoError(t, c.Set("appendfsync", "always", "auto-aof-rewrite-percentage", "0", "auto-aof-rewrite-min-size", "1mb", "tracking-table-max-keys", "0"))
+	aof.mu.Lock()
+	assert.Equal(t, FsyncAlways, aof.opts.Fsync)
+	assert.Equal(t, -1, aof.opts.RewritePercentage)
+	assert.Equal(t, int64(1<<20), aof.opts.RewriteMinSize)
+	aof.mu.Unlock()
+	tracking.mu.Lock()
+	assert.Greater(t, tracking.opts.MaxKeys, DefaultTrackingMaxKeys)
+	tracking.mu.Unlock()
+}
+
+func TestParseMemory(t *testing.T) {
+	for s, n := range map[string]int64{
+		"0": 0, "100": 100, "1k": 1000, "1kb": 1024, "2MB": 2 << 20, "3g": 3e9, "1gb": 1 << 30, "10b": 10,
+	} {
+		got, ok := parseMemory(s)
+		assert.True(t, ok, s)
+		assert.Equal(t, n, got, s)
+	}
+	for _, s := range []string{"", "-1", "kb", "1tb", "1.5gb", "99999999999gb"} {
+		_, ok := parseMemory(s)
+		assert.False(t, ok, s)
+	}
+	for n, s := range map[int64]string{0: "0", 100: "100", 1024: "1kb", 1536: "1536", 3 << 20: "3mb", 1 << 30: "1gb"} {
+		assert.Equal(t, s, string(appendMemory(nil, n)))
+	}
+}
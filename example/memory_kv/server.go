@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"strings"
 	"sync"
 
@@ -26,6 +27,9 @@ func main() {
 	var reusePort bool
 	var pprofDebug bool
 	var pprofAddr string
+	var unixSocket string
+	var unixSocketPerm uint
+	var configFile string
 
 	// Parse command-line arguments
 	flag.StringVar(&network, "network", "tcp", "server network (default \"tcp\")")
@@ -34,6 +38,9 @@ func main() {
 	flag.BoolVar(&reusePort, "reusePort", false, "enable port reuse")
 	flag.BoolVar(&pprofDebug, "pprofDebug", false, "enable pprof debugging")
 	flag.StringVar(&pprofAddr, "pprofAddr", ":8888", "pprof address")
+	flag.StringVar(&unixSocket, "unixsocket", "", "also listen on this Unix domain socket")
+	flag.UintVar(&unixSocketPerm, "unixsocketperm", 0, "permissions of the Unix domain socket (e.g. 0770)")
+	flag.StringVar(&configFile, "config", "", "redis.conf-style file to load, and to write with CONFIG REWRITE")
 	flag.Parse()
 
 	// Start pprof server if debugging is enabled
@@ -52,6 +59,24 @@ func main() {
 		ReusePort: reusePort,
 	}
 
+	// Declare the configuration parameters. save and appendonly are only
+	// reported, as redis-benchmark reads them with CONFIG GET.
+	config := redhub.NewConfig()
+	if err := option.RegisterConfig(config); err != nil {
+		log.Fatal(err)
+	}
+	if err := config.Register(
+		redhub.ConfigParam{Name: "save", Type: redhub.ConfigString, Default: ""},
+		redhub.ConfigParam{Name: "appendonly", Type: redhub.ConfigBool, Default: "no"},
+	); err != nil {
+		log.Fatal(err)
+	}
+	if configFile != "" {
+		if err := config.Load(configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// Create a new RedHub instance with custom handlers
 	rh := redhub.NewRedHub(
 		// Connection initialization handler
@@ -68,7 +93,7 @@ func main() {
 			switch strings.ToLower(string(cmd.Args[0])) {
 			default:
 				// Handle unknown commands
-				out = resp.AppendError(out, "ERR unknown command '"+string(cmd.Args[0])+"'")
+				out = resp.AppendErr(out, resp.UnknownCommand(cmd.Args))
 			case "ping":
 				// Handle PING command
 				out = resp.AppendString(out, "PONG")
@@ -79,17 +104,19 @@ func main() {
 			case "set":
 				// Handle SET command
 				if len(cmd.Args) != 3 {
-					out = resp.AppendError(out, "ERR wrong number of arguments for '"+string(cmd.Args[0])+"' command")
+					out = resp.AppendErr(out, resp.WrongArgs(string(cmd.Args[0])))
 					break
 				}
+				// Arguments point into the connection's read buffer, so copy the value
+				// before storing it.
 				mu.Lock()
-				items[string(cmd.Args[1])] = cmd.Args[2]
+				items[string(cmd.Args[1])] = append([]byte(nil), cmd.Args[2]...)
 				mu.Unlock()
 				out = resp.AppendString(out, "OK")
 			case "get":
 				// Handle GET command
 				if len(cmd.Args) != 2 {
-					out = resp.AppendError(out, "ERR wrong number of arguments for '"+string(cmd.Args[0])+"' command")
+					out = resp.AppendErr(out, resp.WrongArgs(string(cmd.Args[0])))
 					break
 				}
 				mu.RLock()
@@ -103,7 +130,7 @@ func main() {
 			case "del":
 				// Handle DEL command
 				if len(cmd.Args) != 2 {
-					out = resp.AppendError(out, "ERR wrong number of arguments for '"+string(cmd.Args[0])+"' command")
+					out = resp.AppendErr(out, resp.WrongArgs(string(cmd.Args[0])))
 					break
 				}
 				mu.Lock()
@@ -116,20 +143,37 @@ func main() {
 					out = resp.AppendInt(out, 1)
 				}
 			case "config":
-				// Handle CONFIG command (for redis-benchmark compatibility)
-				out = resp.AppendArray(out, 2)
-				out = resp.AppendBulk(out, cmd.Args[2])
-				out = resp.AppendBulkString(out, "")
+				// Handle the other CONFIG subcommands (GET, SET, RESETSTAT and
+				// REWRITE are answered by the config)
+				if len(cmd.Args) < 2 {
+					out = resp.AppendErr(out, resp.WrongArgs(string(cmd.Args[0])))
+					break
+				}
+				out = resp.AppendError(out, "ERR unknown subcommand '"+string(cmd.Args[1])+"'. Try CONFIG HELP.")
 			}
 			return out, status
 		},
 	)
 
+	rh.SetConfig(config)
+
+	// Serve the TCP address, plus the Unix domain socket if one was requested
+	listeners := []redhub.Listener{{Addr: protoAddr, Options: option}}
+	if unixSocket != "" {
+		listeners = append(listeners, redhub.Listener{
+			Addr: "unix://" + unixSocket,
+			Options: redhub.Options{
+				Multicore:      multicore,
+				UnixSocketPerm: os.FileMode(unixSocketPerm),
+			},
+		})
+	}
+
 	// Log the server start
 	log.Printf("started redhub server at %s", addr)
 
 	// Start the RedHub server
-	err := redhub.ListenAndServe(protoAddr, option, rh)
+	err := redhub.ListenAndServeAll(listeners, rh)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,240 @@
+package redhub
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// Listener describes one of the addresses served by ListenAndServeAll.
+//
+// Each listener runs its own gnet engine with its own Options, while all of them
+// share the same RedHub handlers. This mirrors Redis's bind and unixsocket
+// configuration, for example a TCP port alongside a local Unix domain socket, and
+// of its tls-port, a TCP port serving TLS alongside a plaintext one.
+type Listener struct {
+	// Addr is the address to listen on, in the same format as for ListenAndServe,
+	// e.g. "tcp://0.0.0.0:6379" or "unix:///var/run/redhub.sock".
+	Addr string
+
+	// Options configures the engine serving this listener.
+	Options Options
+
+	// TLSConfig serves this listener over TLS when set, on a TCP address. It
+	// needs at least one certificate, or GetCertificate; set ClientAuth to
+	// authenticate the clients with their certificates, like Redis's
+	// tls-auth-clients.
+	//
+	// gnet has no TLS layer, so the engine of the listener listens on a Unix
+	// domain socket private to the process instead, and each client is relayed
+	// there, decrypted, by goroutines of its own. Conn.RemoteAddr is thus the
+	// address of that socket rather than the client's, and Options.ReusePort has
+	// no effect.
+	TLSConfig *tls.Config
+
+	// Bus makes this listener the cluster bus port of the node, set with
+	// SetClusterBus, rather than a port for clients. Its engine always has a
+	// ticker, which drives the bus.
+	Bus bool
+}
+
+// listenerHandler is the gnet.EventHandler of a single listener. It forwards all
+// events to the shared RedHub and only adds the listener-specific boot steps,
+// except on a cluster bus listener, whose connections are links of the bus.
+type listenerHandler struct {
+	*RedHub
+	ln  Listener
+	tls *tlsBridge // Bridge of the TLS clients, on a TLS listener
+	eng gnet.Engine
+	err error
+}
+
+// OnBoot applies the listener's socket settings before registering its engine,
+// and starts accepting the clients of a TLS listener.
+func (h *listenerHandler) OnBoot(eng gnet.Engine) gnet.Action {
+	if h.err = h.ln.chmodSocket(); h.err != nil {
+		return gnet.Shutdown
+	}
+	h.eng = eng
+	action := h.RedHub.OnBoot(eng)
+	if action == gnet.None && h.tls != nil {
+		h.tls.start()
+	}
+	return action
+}
+
+// OnOpen opens a client connection, or a link of the cluster bus.
+func (h *listenerHandler) OnOpen(c gnet.Conn) ([]byte, gnet.Action) {
+	if h.ln.Bus {
+		return h.openBusLink(c)
+	}
+	return h.RedHub.OnOpen(c)
+}
+
+// OnTraffic reads the commands of a client, or the messages of the cluster bus.
+func (h *listenerHandler) OnTraffic(c gnet.Conn) gnet.Action {
+	if h.ln.Bus {
+		return h.readBusLink(c)
+	}
+	return h.RedHub.OnTraffic(c)
+}
+
+// OnClose closes a client connection, or a link of the cluster bus.
+func (h *listenerHandler) OnClose(c gnet.Conn, err error) gnet.Action {
+	if h.ln.Bus {
+		h.closeBusLink(c)
+		return gnet.None
+	}
+	return h.RedHub.OnClose(c, err)
+}
+
+// OnTick ticks the cluster bus on a bus listener.
+func (h *listenerHandler) OnTick() (time.Duration, gnet.Action) {
+	if h.ln.Bus {
+		h.tickBus()
+		return busTickInterval, gnet.None
+	}
+	return h.RedHub.OnTick()
+}
+
+// unixSocketPath returns the socket file of a "unix://" address.
+func (ln Listener) unixSocketPath() (string, bool) {
+	network, path, ok := strings.Cut(ln.Addr, "://")
+	if !ok || network != "unix" {
+		return "", false
+	}
+	return path, true
+}
+
+// removeStaleSocket removes a socket file left behind by a previous process, which
+// would otherwise make the listener fail with "address already in use".
+func (ln Listener) removeStaleSocket() error {
+	path, ok := ln.unixSocketPath()
+	if !ok {
+		return nil
+	}
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		// Anything that is not a socket is left alone and reported by the bind.
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// chmodSocket applies Options.UnixSocketPerm to the listener's socket file.
+func (ln Listener) chmodSocket() error {
+	path, ok := ln.unixSocketPath()
+	if !ok || ln.Options.UnixSocketPerm == 0 {
+		return nil
+	}
+	return os.Chmod(path, ln.Options.UnixSocketPerm)
+}
+
+// serve runs the engine of a single listener until it is stopped.
+func (rs *RedHub) serve(ln Listener) error {
+	if err := ln.removeStaleSocket(); err != nil {
+		return err
+	}
+	opts := ln.Options.gnetOptions()
+	if ln.Bus {
+		if rs.bus == nil {
+			return errors.New("bus listener without a cluster bus")
+		}
+		opts = busGnetOptions(ln.Options)
+	}
+	h := &listenerHandler{RedHub: rs, ln: ln}
+	addr := ln.Addr
+	if ln.TLSConfig != nil {
+		if ln.Bus {
+			return errors.New("bus listener with TLS")
+		}
+		bridge, err := listenTLS(ln)
+		if err != nil {
+			return err
+		}
+		defer bridge.close()
+		h.tls = bridge
+		addr = bridge.addr()
+	}
+	err := gnet.Run(h, addr, opts...)
+	if err == nil {
+		err = h.err
+	}
+	return err
+}
+
+// ListenAndServeAll starts the RedHub server on several listeners at once.
+//
+// All listeners share the handlers of rh, so a client sees the same server
+// whichever address it connects to. The function blocks until every listener
+// has stopped. If any listener fails, for example because its address is
+// already in use, the others are shut down and the first error is returned.
+// Close stops all listeners. The AOF set with SetAOF, if any, is replayed
+// before the listeners start.
+//
+// Parameters:
+//   - listeners: The addresses to listen on, each with its own options
+//   - rh: The RedHub instance created by NewRedHub
+//
+// Example:
+//
+//	err := redhub.ListenAndServeAll([]redhub.Listener{
+//	    {Addr: "tcp://0.0.0.0:6379", Options: redhub.Options{Multicore: true}},
+//	    {Addr: "unix:///var/run/redhub.sock", Options: redhub.Options{UnixSocketPerm: 0770}},
+//	}, rh)
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+func ListenAndServeAll(listeners []Listener, rh *RedHub) error {
+	if len(listeners) == 0 {
+		return errors.New("no listeners")
+	}
+
+	rh.mu.Lock()
+	if rh.running {
+		rh.mu.Unlock()
+		return errors.New("server already running")
+	}
+	if rh.streamHandler != nil && (rh.repl != nil || rh.aof != nil) {
+		rh.mu.Unlock()
+		return errors.New("a stream handler cannot be used with replication or an AOF")
+	}
+	rh.running = true
+	rh.stopping = false
+	rh.mu.Unlock()
+
+	if rh.aof != nil {
+		if err := rh.loadAOF(); err != nil {
+			rh.mu.Lock()
+			rh.running = false
+			rh.mu.Unlock()
+			return err
+		}
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		go func(ln Listener) {
+			errs <- rh.serve(ln)
+		}(ln)
+	}
+
+	var err error
+	for range listeners {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+			_ = rh.stop()
+		}
+	}
+
+	rh.mu.Lock()
+	rh.running = false
+	rh.engines = nil
+	rh.mu.Unlock()
+
+	return err
+}
@@ -0,0 +1,231 @@
+package redhub
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// NotifyFlags selects the keyspace notifications that are published, like
+// the notify-keyspace-events setting of Redis. A notification is published
+// when its class is selected, on the keyspace channel with NotifyKeyspace and
+// on the keyevent channel with NotifyKeyevent.
+type NotifyFlags uint32
+
+const (
+	// NotifyKeyspace publishes notifications on __keyspace@<db>__:<key>, with
+	// the event as the message (K).
+	NotifyKeyspace NotifyFlags = 1 << iota
+
+	// NotifyKeyevent publishes notifications on __keyevent@<db>__:<event>,
+	// with the key as the message (E).
+	NotifyKeyevent
+
+	// NotifyGeneric is the class of the commands that are not specific to a
+	// type, such as DEL, EXPIRE and RENAME (g).
+	NotifyGeneric
+
+	// NotifyString is the class of the string commands ($).
+	NotifyString
+
+	// NotifyList is the class of the list commands (l).
+	NotifyList
+
+	// NotifySet is the class of the set commands (s).
+	NotifySet
+
+	// NotifyHash is the class of the hash commands (h).
+	NotifyHash
+
+	// NotifyZSet is the class of the sorted set commands (z).
+	NotifyZSet
+
+	// NotifyExpired is the class of the keys deleted when they expire (x).
+	NotifyExpired
+
+	// NotifyEvicted is the class of the keys evicted to free memory (e).
+	NotifyEvicted
+
+	// NotifyStream is the class of the stream commands (t).
+	NotifyStream
+
+	// NotifyKeyMiss is the class of the reads of missing keys (m).
+	NotifyKeyMiss
+
+	// NotifyModule is the class of the commands of custom types (d).
+	NotifyModule
+
+	// NotifyNew is the class of the keys added to the dataset (n).
+	NotifyNew
+
+	// NotifyAll selects the classes of "A": all of them except NotifyKeyMiss
+	// and NotifyNew.
+	NotifyAll = NotifyGeneric | NotifyString | NotifyList | NotifySet | NotifyHash |
+		NotifyZSet | NotifyExpired | NotifyEvicted | NotifyStream | NotifyModule
+)
+
+// errNotifyFlags is returned by ParseNotifyFlags for an unknown character.
+var errNotifyFlags = errors.New("Invalid event class character. Use 'Ag$lshzxeKEtmdn'.")
+
+// notifyClasses are the characters of the classes, in the order String
+// writes them.
+var notifyClasses = []struct {
+	c    byte
+	flag NotifyFlags
+}{
+	{'g', NotifyGeneric}, {'$', NotifyString}, {'l', NotifyList}, {'s', NotifySet},
+	{'h', NotifyHash}, {'z', NotifyZSet}, {'x', NotifyExpired}, {'e', NotifyEvicted},
+	{'t', NotifyStream}, {'d', NotifyModule},
+}
+
+// ParseNotifyFlags parses flags in the format of notify-keyspace-events, for
+// example "KEA" or "Kx". The empty string disables the notifications.
+func ParseNotifyFlags(s string) (NotifyFlags, error) {
+	var flags NotifyFlags
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case 'A':
+			flags |= NotifyAll
+		case 'K':
+			flags |= NotifyKeyspace
+		case 'E':
+			flags |= NotifyKeyevent
+		case 'm':
+			flags |= NotifyKeyMiss
+		case 'n':
+			flags |= NotifyNew
+		default:
+			found := false
+			for _, class := range notifyClasses {
+				if class.c == c {
+					flags |= class.flag
+					found = true
+					break
+				}
+			}
+			if !found {
+				return 0, errNotifyFlags
+			}
+		}
+	}
+	return flags, nil
+}
+
+// String returns the flags in the format of notify-keyspace-events, as
+// CONFIG GET shows them.
+func (f NotifyFlags) String() string {
+	var b []byte
+	if f&NotifyAll == NotifyAll {
+		b = append(b, 'A')
+	} else {
+		for _, class := range notifyClasses {
+			if f&class.flag != 0 {
+				b = append(b, class.c)
+			}
+		}
+	}
+	if f&NotifyKeyspace != 0 {
+		b = append(b, 'K')
+	}
+	if f&NotifyKeyevent != 0 {
+		b = append(b, 'E')
+	}
+	if f&NotifyKeyMiss != 0 {
+		b = append(b, 'm')
+	}
+	if f&NotifyNew != 0 {
+		b = append(b, 'n')
+	}
+	return string(b)
+}
+
+// SetNotifyFlags selects the keyspace notifications that Notify publishes.
+// Clients change them with CONFIG SET notify-keyspace-events.
+func (ps *PubSub) SetNotifyFlags(flags NotifyFlags) {
+	ps.notify.Store(uint32(flags))
+}
+
+// NotifyFlags returns the keyspace notifications that Notify publishes.
+func (ps *PubSub) NotifyFlags() NotifyFlags {
+	return NotifyFlags(ps.notify.Load())
+}
+
+// RegisterConfig declares notify-keyspace-events in c, which sets the flags
+// of SetNotifyFlags. Its default is the current flags; once it is registered,
+// change the flags through c, or CONFIG GET shows stale flags.
+func (ps *PubSub) RegisterConfig(c *Config) error {
+	return c.Register(ConfigParam{
+		Name:    "notify-keyspace-events",
+		Type:    ConfigString,
+		Default: ps.NotifyFlags().String(),
+		Normalize: func(s string) (string, error) {
+			flags, err := ParseNotifyFlags(s)
+			return flags.String(), err
+		},
+		OnChange: func(v ConfigValue) error {
+			flags, err := ParseNotifyFlags(v.Text)
+			if err == nil {
+				ps.SetNotifyFlags(flags)
+			}
+			return err
+		},
+	})
+}
+
+// Notify emits a keyspace notification: event happened to key in database
+// db, for example "set", "del" or "expired". class is the class of the
+// event, such as NotifyString or NotifyGeneric; the notification is only
+// published when the flags select it. Handlers call Notify once the command
+// has modified the dataset.
+//
+// Like Publish, Notify never waits for the subscribers. It is cheap when the
+// notifications are disabled, which is the default.
+//
+// Example:
+//
+//	case "set":
+//	    store.Set(db, key, value)
+//	    ps.Notify(redhub.NotifyString, "set", key, db)
+//	    return resp.AppendOK(out), redhub.None
+func (ps *PubSub) Notify(class NotifyFlags, event string, key []byte, db int) {
+	flags := ps.NotifyFlags()
+	if flags&class == 0 || flags&(NotifyKeyspace|NotifyKeyevent) == 0 {
+		return
+	}
+	var channel []byte
+	if flags&NotifyKeyspace != 0 {
+		channel = append(channel, "__keyspace@"...)
+		channel = strconv.AppendInt(channel, int64(db), 10)
+		channel = append(channel, "__:"...)
+		channel = append(channel, key...)
+		ps.Publish(channel, []byte(event))
+	}
+	if flags&NotifyKeyevent != 0 {
+		channel = append(channel[:0], "__keyevent@"...)
+		channel = strconv.AppendInt(channel, int64(db), 10)
+		channel = append(channel, "__:"...)
+		channel = append(channel, event...)
+		ps.Publish(channel, key)
+	}
+}
+
+// configNotify answers CONFIG GET notify-keyspace-events and CONFIG SET
+// notify-keyspace-events flags. It reports whether cmd was one of them.
+func (rs *RedHub) configNotify(cb *connBuffer, args [][]byte, out []byte) ([]byte, bool) {
+	const param = "notify-keyspace-events"
+	switch {
+	case len(args) == 3 && equalFold(args[1], "get") && equalFold(args[2], param):
+		out = appendMapHeader(out, cb.writer.Protocol(), 1)
+		out = resp.AppendBulkString(out, param)
+		return resp.AppendBulkString(out, rs.pubsub.NotifyFlags().String()), true
+	case len(args) == 4 && equalFold(args[1], "set") && equalFold(args[2], param):
+		flags, err := ParseNotifyFlags(string(args[3]))
+		if err != nil {
+			return cb.appendError(out, "ERR CONFIG SET failed (possibly related to argument '"+param+"') - "+err.Error()), true
+		}
+		rs.pubsub.SetNotifyFlags(flags)
+		return resp.AppendOK(out), true
+	}
+	return out, false
+}
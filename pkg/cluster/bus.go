@@ -0,0 +1,615 @@
+package cluster
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// DefaultNodeTimeout is the default BusOptions.NodeTimeout, as in Redis.
+const DefaultNodeTimeout = 15 * time.Second
+
+// errLinkClosed is returned for links that the bus has dropped.
+var errLinkClosed = errors.New("cluster: bus link closed")
+
+// BusOptions configures a Bus.
+type BusOptions struct {
+	// NodeTimeout is how long a node may leave the pings of the local node
+	// unanswered before it is flagged as possibly failing (PFAIL). Zero means
+	// DefaultNodeTimeout.
+	NodeTimeout time.Duration
+}
+
+// Bus is the cluster bus of a node: it exchanges the state of the nodes with
+// its peers, so that the nodes find each other and agree on which of them
+// serves each slot, and it detects failing nodes.
+//
+// Every known node is sent a PING at regular intervals, and answers with a
+// PONG. Both carry the state of the sender, including the slots it serves and
+// its config epoch, and gossip about a few other nodes. A node that does not
+// answer within the node timeout is flagged PFAIL, and becomes FAIL once a
+// majority of the primaries report it as failing; the FAIL state is then
+// broadcast to all nodes. New nodes join with a MEET message, sent by
+// CLUSTER MEET or Meet.
+//
+// Bus does no I/O: a transport, such as a RedHub listener with Bus set, opens
+// the connections, feeds the messages received to Receive and calls Tick
+// periodically. Messages are RESP arrays of field/value pairs. A Bus is safe
+// for concurrent use.
+//
+// Example:
+//
+//	c := cluster.New(cluster.Node{IP: "127.0.0.1", Port: 7000})
+//	bus := cluster.NewBus(c, cluster.BusOptions{NodeTimeout: 5 * time.Second})
+//	bus.Meet("127.0.0.1", 17001)
+type Bus struct {
+	c       *Cluster
+	timeout time.Duration
+
+	mu    sync.Mutex
+	peers map[string]*peer    // Known nodes other than myself, by ID
+	meets map[*Link]time.Time // Links to nodes met by address, until they answer, and when first dialed
+}
+
+// peer is the bus state of a known node.
+type peer struct {
+	link     *Link
+	created  time.Time
+	lastPing time.Time // When the last ping was sent
+	pingSent time.Time // When the outstanding ping was sent, zero if none
+	pongRecv time.Time // When the last pong was received, zero if none
+
+	// reports are the failure reports of other primaries: when they last
+	// gossiped about the node as failing, by ID.
+	reports map[string]time.Time
+}
+
+// linkState is the state of the connection of a link.
+type linkState int
+
+const (
+	linkIdle linkState = iota
+	linkDialing
+	linkConnected
+	linkClosed
+)
+
+// Link is a connection of the cluster bus. The Bus creates the links to other
+// nodes, and returns them from Tick to be dialed; Accept creates the links of
+// incoming connections.
+type Link struct {
+	// Addr is the bus address to dial, "ip:port". It is empty for incoming
+	// links.
+	Addr string
+
+	// Conn is the connection of the transport, set by Connected and Accept.
+	Conn any
+
+	state    linkState
+	meet     bool      // Send MEET rather than PING once connected
+	lastDial time.Time // When the link was last returned to be dialed
+}
+
+// Message is a message to send on the connection of a link. A nil Data asks
+// the transport to close the connection.
+type Message struct {
+	Link *Link
+	Conn any // Link.Conn when the message was created
+	Data []byte
+}
+
+// busMessage is a message of the cluster bus.
+type busMessage struct {
+	Type         string       `resp:"type"` // meet, ping, pong or fail
+	ID           string       `resp:"id"`
+	IP           string       `resp:"ip"`
+	Port         int          `resp:"port"`
+	BusPort      int          `resp:"busport"`
+	Hostname     string       `resp:"hostname,omitempty"`
+	Primary      string       `resp:"primary,omitempty"`
+	CurrentEpoch uint64       `resp:"current_epoch"`
+	ConfigEpoch  uint64       `resp:"config_epoch"`
+	Slots        []byte       `resp:"slots,omitempty"` // Bitmap of the slots served by the sender
+	Gossip       []gossipNode `resp:"gossip,omitempty"`
+	Fail         string       `resp:"fail,omitempty"` // Failing node of a fail message
+}
+
+// gossipNode is the state of a node as seen by the sender of a message.
+type gossipNode struct {
+	ID      string `resp:"id"`
+	IP      string `resp:"ip"`
+	Port    int    `resp:"port"`
+	BusPort int    `resp:"busport"`
+	State   string `resp:"state"`
+}
+
+// NewBus returns the cluster bus of c. CLUSTER MEET is handled by c once it
+// has a bus.
+func NewBus(c *Cluster, opts BusOptions) *Bus {
+	if opts.NodeTimeout <= 0 {
+		opts.NodeTimeout = DefaultNodeTimeout
+	}
+	b := &Bus{
+		c:       c,
+		timeout: opts.NodeTimeout,
+		peers:   map[string]*peer{},
+		meets:   map[*Link]time.Time{},
+	}
+	c.bus = b
+	return b
+}
+
+// Cluster returns the cluster whose state the bus exchanges.
+func (b *Bus) Cluster() *Cluster {
+	return b.c
+}
+
+// Meet introduces the node listening for the cluster bus at ip:busPort. It is
+// sent a MEET message on the next Tick, and learns about the rest of the
+// cluster from the gossip that follows. The node is given up on if it does not
+// answer within the node timeout.
+func (b *Bus) Meet(ip string, busPort int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	l := &Link{Addr: net.JoinHostPort(ip, strconv.Itoa(busPort)), meet: true}
+	b.meets[l] = time.Time{}
+}
+
+// pingInterval is how often each node is pinged.
+func (b *Bus) pingInterval() time.Duration {
+	return min(b.timeout/4, time.Second)
+}
+
+// Tick advances the state of the bus to now. It returns the links to dial,
+// which the transport must follow with Connected or Disconnected, and the
+// messages to send. Tick is meant to be called about every 100 milliseconds.
+func (b *Bus) Tick(now time.Time) (dial []*Link, send []Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	send = b.syncPeers(now, send)
+
+	for l, since := range b.meets {
+		if since.IsZero() {
+			b.meets[l] = now
+		} else if now.Sub(since) > b.timeout {
+			send = b.dropLink(l, send)
+			delete(b.meets, l)
+			continue
+		}
+		if l.state == linkIdle && now.Sub(l.lastDial) >= b.pingInterval() {
+			l.state, l.lastDial = linkDialing, now
+			dial = append(dial, l)
+		}
+	}
+
+	t := b.c.topo.Load()
+	for id, p := range b.peers {
+		switch l := p.link; l.state {
+		case linkIdle:
+			if now.Sub(l.lastDial) >= b.pingInterval() {
+				l.state, l.lastDial = linkDialing, now
+				dial = append(dial, l)
+			}
+		case linkConnected:
+			if !p.pingSent.IsZero() && now.Sub(p.pingSent) > b.timeout/2 {
+				// The link may be broken rather than the node: reconnect.
+				send = append(send, Message{Link: l, Conn: l.Conn})
+				l.state = linkClosed
+				p.link = &Link{Addr: l.Addr, lastDial: now}
+			} else if p.pingSent.IsZero() && now.Sub(p.lastPing) >= b.pingInterval() {
+				p.pingSent, p.lastPing = now, now
+				send = append(send, Message{Link: l, Conn: l.Conn, Data: b.message("ping", t.byID[id], t)})
+			}
+		}
+
+		n := t.byID[id]
+		if n.State == NodeOK && now.Sub(p.lastSeen()) > b.timeout {
+			b.setState(id, NodePFail)
+		}
+	}
+	for id := range b.peers {
+		send = b.checkFailing(id, now, send)
+	}
+	return dial, send
+}
+
+// lastSeen returns when the node last answered a ping, or when it became known.
+func (p *peer) lastSeen() time.Time {
+	if p.pongRecv.After(p.created) {
+		return p.pongRecv
+	}
+	return p.created
+}
+
+// syncPeers creates the peers of the nodes added to the topology, and drops the
+// peers of the nodes removed from it, closing their links.
+func (b *Bus) syncPeers(now time.Time, send []Message) []Message {
+	t := b.c.topo.Load()
+	for _, n := range t.nodes {
+		if n == t.myself || n.IP == "" {
+			continue
+		}
+		addr := net.JoinHostPort(n.IP, strconv.Itoa(n.busPort()))
+		p, ok := b.peers[n.ID]
+		if !ok {
+			b.peers[n.ID] = &peer{link: &Link{Addr: addr}, created: now, reports: map[string]time.Time{}}
+			continue
+		}
+		if p.link.Addr != addr {
+			send = b.dropLink(p.link, send)
+			p.link = &Link{Addr: addr}
+		}
+	}
+	for id, p := range b.peers {
+		if _, ok := t.byID[id]; !ok {
+			send = b.dropLink(p.link, send)
+			delete(b.peers, id)
+		}
+	}
+	return send
+}
+
+// dropLink marks l closed, and asks the transport to close its connection.
+func (b *Bus) dropLink(l *Link, send []Message) []Message {
+	if l.state == linkConnected {
+		send = append(send, Message{Link: l, Conn: l.Conn})
+	}
+	l.state = linkClosed
+	return send
+}
+
+// Accept returns the link of an incoming connection.
+func (b *Bus) Accept(conn any) *Link {
+	return &Link{Conn: conn, state: linkConnected}
+}
+
+// Connected records that l, returned by Tick, is connected through conn, and
+// returns the first message to send on it. An error means that the link was
+// dropped in the meantime, and its connection must be closed.
+func (b *Bus) Connected(l *Link, conn any, now time.Time) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if l.state != linkDialing {
+		return nil, errLinkClosed
+	}
+	l.Conn, l.state = conn, linkConnected
+	t := b.c.topo.Load()
+	if l.meet {
+		return b.message("meet", nil, t), nil
+	}
+	for id, p := range b.peers {
+		if p.link == l {
+			p.pingSent, p.lastPing = now, now
+			return b.message("ping", t.byID[id], t), nil
+		}
+	}
+	return nil, errLinkClosed
+}
+
+// Disconnected records that the connection of l is closed, or could not be
+// established. Links to other nodes are dialed again on a later Tick.
+func (b *Bus) Disconnected(l *Link) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if l.state != linkClosed {
+		l.Conn, l.state = nil, linkIdle
+	}
+	for _, p := range b.peers {
+		if p.link == l {
+			p.pingSent = time.Time{}
+		}
+	}
+}
+
+// Receive handles data, a complete message received on l, and returns the
+// reply to send on l, if any. An error means that the connection of l must be
+// closed.
+func (b *Bus) Receive(l *Link, data []byte, now time.Time) ([]byte, error) {
+	var m busMessage
+	if err := resp.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	if m.ID == "" {
+		return nil, errors.New("cluster: bus message without sender")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if l.state == linkClosed {
+		return nil, errLinkClosed
+	}
+
+	t := b.c.topo.Load()
+	if m.ID == t.myself.ID {
+		// A MEET sent to the local node itself.
+		delete(b.meets, l)
+		l.state = linkClosed
+		return nil, errLinkClosed
+	}
+	_, known := t.byID[m.ID]
+	switch m.Type {
+	case "meet":
+		if !known {
+			b.addNode(&m)
+			known = true
+		}
+	case "ping":
+	case "pong":
+		if l.meet {
+			if err := b.met(l, &m, now); err != nil {
+				return nil, err
+			}
+			known = true
+		}
+		if p, ok := b.peers[m.ID]; ok && p.link == l {
+			p.pingSent, p.pongRecv = time.Time{}, now
+			if n := t.byID[m.ID]; n != nil && n.State != NodeOK {
+				b.setState(m.ID, NodeOK)
+			}
+		}
+	case "fail":
+		if n, ok := t.byID[m.Fail]; known && ok && n != t.myself && n.State != NodeFail {
+			b.setState(m.Fail, NodeFail)
+		}
+		return nil, nil
+	default:
+		return nil, errors.New("cluster: unknown bus message " + strconv.Quote(m.Type))
+	}
+
+	if known {
+		b.processHeader(&m)
+		b.processGossip(&m, now)
+	}
+	if m.Type == "pong" {
+		return nil, nil
+	}
+	t = b.c.topo.Load()
+	return b.message("pong", t.byID[m.ID], t), nil
+}
+
+// met turns the MEET link l into the link of the node that answered on it.
+func (b *Bus) met(l *Link, m *busMessage, now time.Time) error {
+	delete(b.meets, l)
+	l.meet = false
+	if _, ok := b.c.topo.Load().byID[m.ID]; !ok {
+		b.addNode(m)
+	}
+	if p, ok := b.peers[m.ID]; ok && p.link.state == linkConnected {
+		// Already linked to the node: drop the duplicate.
+		l.state = linkClosed
+		return errLinkClosed
+	}
+	b.peers[m.ID] = &peer{link: l, created: now, reports: map[string]time.Time{}}
+	return nil
+}
+
+// addNode adds the sender of m to the cluster. Its slots are set by
+// processHeader.
+func (b *Bus) addNode(m *busMessage) {
+	_ = b.c.AddNode(Node{
+		ID:       m.ID,
+		IP:       m.IP,
+		Port:     m.Port,
+		BusPort:  m.BusPort,
+		Hostname: m.Hostname,
+	})
+}
+
+// processHeader updates the sender of m, a known node, with the address, role,
+// epochs and slots it announced. The topology is only replaced when something
+// changed, as messages arrive several times a second.
+func (b *Bus) processHeader(m *busMessage) {
+	if b.updateSender(b.c.topo.Load(), m, false) {
+		_ = b.c.update(func(t *topology) error {
+			b.updateSender(t, m, true)
+			return nil
+		})
+	}
+}
+
+// updateSender reports whether the header of m changes t, and applies it to t
+// if apply is set.
+func (b *Bus) updateSender(t *topology, m *busMessage, apply bool) bool {
+	n := t.byID[m.ID]
+	if n == nil || n == t.myself {
+		return false
+	}
+	var changed bool
+	if m.CurrentEpoch > t.currentEpoch {
+		if apply {
+			t.currentEpoch = m.CurrentEpoch
+		}
+		changed = true
+	}
+	if n.IP != m.IP || n.Port != m.Port || n.busPort() != m.BusPort || n.Hostname != m.Hostname ||
+		n.PrimaryID != m.Primary || n.ConfigEpoch != m.ConfigEpoch {
+		if apply {
+			node := *n
+			node.IP, node.Port, node.BusPort, node.Hostname = m.IP, m.Port, m.BusPort, m.Hostname
+			node.PrimaryID, node.ConfigEpoch = m.Primary, m.ConfigEpoch
+			t.replace(&node)
+			n = &node
+		}
+		changed = true
+	}
+	if m.Primary != "" || len(m.Slots) != SlotCount/8 {
+		return changed
+	}
+	for slot := 0; slot < SlotCount; slot++ {
+		if m.Slots[slot/8]&(1<<(slot%8)) == 0 {
+			continue
+		}
+		// A claim wins over an unassigned slot, or over the claim of a node
+		// with a smaller config epoch. Slots being imported are left alone
+		// until the end of the migration.
+		owner := t.owner[slot]
+		if owner == n || owner != nil && owner.ID == n.ID || owner != nil && owner.ConfigEpoch >= m.ConfigEpoch {
+			continue
+		}
+		if _, ok := t.importing[slot]; ok {
+			continue
+		}
+		if !apply {
+			return true
+		}
+		t.owner[slot] = n
+		delete(t.migrating, slot)
+		changed = true
+	}
+	return changed
+}
+
+// processGossip adds the nodes gossiped about in m that are not known yet, and
+// records the failure reports of m if its sender is a primary.
+func (b *Bus) processGossip(m *busMessage, now time.Time) {
+	t := b.c.topo.Load()
+	sender := t.byID[m.ID]
+	for _, g := range m.Gossip {
+		n, ok := t.byID[g.ID]
+		if !ok {
+			if g.State != NodeFail.String() && g.IP != "" {
+				_ = b.c.AddNode(Node{ID: g.ID, IP: g.IP, Port: g.Port, BusPort: g.BusPort})
+			}
+			continue
+		}
+		p, ok := b.peers[n.ID]
+		if !ok || sender == nil || sender.PrimaryID != "" {
+			continue
+		}
+		if g.State == NodeOK.String() {
+			delete(p.reports, sender.ID)
+		} else {
+			p.reports[sender.ID] = now
+		}
+	}
+}
+
+// checkFailing flags the node id FAIL, and broadcasts it, if it is PFAIL for
+// the local node and for a majority of the primaries.
+func (b *Bus) checkFailing(id string, now time.Time, send []Message) []Message {
+	t := b.c.topo.Load()
+	n, p := t.byID[id], b.peers[id]
+	if n == nil || p == nil || n.State != NodePFail {
+		return send
+	}
+	var size int
+	for _, m := range t.nodes {
+		if m.PrimaryID == "" && len(t.slots(m)) > 0 {
+			size++
+		}
+	}
+	var failures int
+	for reporter, at := range p.reports {
+		if m := t.byID[reporter]; m == nil || m.PrimaryID != "" || now.Sub(at) > 2*b.timeout {
+			delete(p.reports, reporter)
+			continue
+		}
+		failures++
+	}
+	if t.myself.PrimaryID == "" {
+		failures++
+	}
+	if failures < size/2+1 {
+		return send
+	}
+
+	b.setState(id, NodeFail)
+	msg := resp.AppendAny(nil, b.header("fail", b.c.topo.Load(), id))
+	for _, q := range b.peers {
+		if q.link.state == linkConnected {
+			send = append(send, Message{Link: q.link, Conn: q.link.Conn, Data: msg})
+		}
+	}
+	return send
+}
+
+// setState sets the state of the node id.
+func (b *Bus) setState(id string, state NodeState) {
+	_ = b.c.update(func(t *topology) error {
+		if n, ok := t.byID[id]; ok {
+			node := *n
+			node.State = state
+			t.replace(&node)
+		}
+		return nil
+	})
+}
+
+// header returns a message of type typ from the local node, announcing that
+// the node fail is failing for a fail message.
+func (b *Bus) header(typ string, t *topology, fail string) busMessage {
+	me := t.myself
+	return busMessage{
+		Type:         typ,
+		ID:           me.ID,
+		IP:           me.IP,
+		Port:         me.Port,
+		BusPort:      me.busPort(),
+		Hostname:     me.Hostname,
+		Primary:      me.PrimaryID,
+		CurrentEpoch: t.currentEpoch,
+		ConfigEpoch:  me.ConfigEpoch,
+		Fail:         fail,
+	}
+}
+
+// message encodes a message of type typ from the local node, with the slots it
+// serves and gossip about a few random nodes other than to, and about every
+// node that is failing.
+func (b *Bus) message(typ string, to *Node, t *topology) []byte {
+	me := t.myself
+	m := b.header(typ, t, "")
+	if me.PrimaryID == "" {
+		m.Slots = make([]byte, SlotCount/8)
+		for slot, n := range t.owner {
+			if n == me {
+				m.Slots[slot/8] |= 1 << (slot % 8)
+			}
+		}
+	}
+
+	// As in Redis, gossip about a tenth of the nodes, and at least three.
+	others := make([]*Node, 0, len(t.nodes))
+	for _, n := range t.nodes {
+		if n != me && n != to && n.IP != "" {
+			others = append(others, n)
+		}
+	}
+	wanted := max(3, len(t.nodes)/10)
+	rand.Shuffle(len(others), func(i, j int) { others[i], others[j] = others[j], others[i] })
+	for i, n := range others {
+		if i < wanted || n.State != NodeOK {
+			m.Gossip = append(m.Gossip, gossipNode{
+				ID:      n.ID,
+				IP:      n.IP,
+				Port:    n.Port,
+				BusPort: n.busPort(),
+				State:   n.State.String(),
+			})
+		}
+	}
+	return resp.AppendAny(nil, m)
+}
+
+// linkInfo returns when the outstanding ping to the node id was sent and when
+// its last pong was received, in Unix milliseconds or zero, and whether its
+// link is connected, as listed by CLUSTER NODES.
+func (b *Bus) linkInfo(id string) (pingSent, pongRecv int64, connected bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p, ok := b.peers[id]
+	if !ok {
+		return 0, 0, false
+	}
+	if !p.pingSent.IsZero() {
+		pingSent = p.pingSent.UnixMilli()
+	}
+	if !p.pongRecv.IsZero() {
+		pongRecv = p.pongRecv.UnixMilli()
+	}
+	return pingSent, pongRecv, p.link.state == linkConnected
+}
@@ -0,0 +1,268 @@
+package cluster
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testNet connects buses in memory, with a fake clock.
+type testNet struct {
+	t     *testing.T
+	now   time.Time
+	buses map[string]*Bus // By bus address
+	order []string
+	down  map[string]bool
+}
+
+// testConn is the connection of a link to the link at the other end.
+type testConn struct {
+	remote     *Bus
+	remoteLink *Link
+}
+
+func newTestNet(t *testing.T) *testNet {
+	return &testNet{t: t, now: time.Unix(1700000000, 0), buses: map[string]*Bus{}, down: map[string]bool{}}
+}
+
+// add starts a node listening on 127.0.0.1:port, with its bus on port+10000.
+func (n *testNet) add(id string, port int, slots ...SlotRange) *Bus {
+	c := New(Node{ID: id, IP: "127.0.0.1", Port: port, Slots: slots})
+	b := NewBus(c, BusOptions{NodeTimeout: time.Second})
+	addr := "127.0.0.1:" + strconv.Itoa(port+10000)
+	n.buses[addr] = b
+	n.order = append(n.order, addr)
+	return b
+}
+
+// run advances the clock by d, ticking every bus every 100ms.
+func (n *testNet) run(d time.Duration) {
+	for end := n.now.Add(d); n.now.Before(end); {
+		n.now = n.now.Add(100 * time.Millisecond)
+		for _, addr := range n.order {
+			if n.down[addr] {
+				continue
+			}
+			b := n.buses[addr]
+			dial, send := b.Tick(n.now)
+			for _, l := range dial {
+				n.dial(b, l)
+			}
+			for _, m := range send {
+				if m.Data == nil {
+					n.close(b, m.Link)
+				} else {
+					n.deliver(b, m.Link, m.Data)
+				}
+			}
+		}
+	}
+}
+
+func (n *testNet) dial(b *Bus, l *Link) {
+	target := n.buses[l.Addr]
+	if target == nil || n.down[l.Addr] {
+		b.Disconnected(l)
+		return
+	}
+	in := target.Accept(&testConn{remote: b, remoteLink: l})
+	first, err := b.Connected(l, &testConn{remote: target, remoteLink: in}, n.now)
+	if err != nil {
+		target.Disconnected(in)
+		return
+	}
+	n.deliver(b, l, first)
+}
+
+func (n *testNet) deliver(from *Bus, l *Link, data []byte) {
+	conn, ok := l.Conn.(*testConn)
+	if !ok {
+		return
+	}
+	reply, err := conn.remote.Receive(conn.remoteLink, data, n.now)
+	if err != nil {
+		n.close(from, l)
+		return
+	}
+	if reply != nil {
+		n.deliver(conn.remote, conn.remoteLink, reply)
+	}
+}
+
+func (n *testNet) close(b *Bus, l *Link) {
+	if conn, ok := l.Conn.(*testConn); ok {
+		conn.remote.Disconnected(conn.remoteLink)
+	}
+	b.Disconnected(l)
+}
+
+// stop takes the node with the given bus port down, closing its links.
+func (n *testNet) stop(busPort int) {
+	addr := "127.0.0.1:" + strconv.Itoa(busPort)
+	n.down[addr] = true
+	stopped := n.buses[addr]
+	for _, b := range n.buses {
+		for _, p := range b.peers {
+			if conn, ok := p.link.Conn.(*testConn); ok && (conn.remote == stopped || b == stopped) {
+				n.close(b, p.link)
+			}
+		}
+	}
+}
+
+func (n *testNet) start(busPort int) {
+	delete(n.down, "127.0.0.1:"+strconv.Itoa(busPort))
+}
+
+func nodeState(t *testing.T, b *Bus, id string) NodeState {
+	t.Helper()
+	n, ok := b.Cluster().Node(id)
+	require.True(t, ok)
+	return n.State
+}
+
+// newTestBuses returns three primaries A, B and C, serving a third of the slots
+// each, that have met.
+func newTestBuses(t *testing.T) (*testNet, *Bus, *Bus, *Bus) {
+	net := newTestNet(t)
+	a := net.add(idA, 7000, SlotRange{0, 5460})
+	b := net.add(idB, 7001, SlotRange{5461, 10922})
+	c := net.add(idC, 7002, SlotRange{10923, 16383})
+	a.Meet("127.0.0.1", 17001)
+	a.Meet("127.0.0.1", 17002)
+	net.run(2 * time.Second)
+	return net, a, b, c
+}
+
+func TestBusMeet(t *testing.T) {
+	_, a, b, c := newTestBuses(t)
+
+	// B and C learned about each other from the gossip of A.
+	for _, bus := range []*Bus{a, b, c} {
+		assert.Len(t, bus.Cluster().Nodes(), 3)
+		for slot, id := range map[int]string{0: idA, 5461: idB, 16383: idC} {
+			owner, ok := bus.Cluster().SlotOwner(slot)
+			assert.True(t, ok)
+			assert.Equal(t, id, owner.ID)
+		}
+	}
+	info := run(t, c.Cluster(), "CLUSTER INFO")
+	assert.Contains(t, info, `cluster_state:ok\r\n`)
+	assert.Contains(t, info, `cluster_known_nodes:3\r\n`)
+
+	_, pong, connected := b.linkInfo(idC)
+	assert.NotZero(t, pong)
+	assert.True(t, connected)
+}
+
+func TestBusFailureDetection(t *testing.T) {
+	net, a, b, c := newTestBuses(t)
+	net.stop(17002)
+
+	// Unanswered pings make C PFAIL for A and B, then their failure reports
+	// make up a majority, which flags C FAIL.
+	net.run(600 * time.Millisecond)
+	assert.Equal(t, NodeOK, nodeState(t, a, idC))
+	net.run(1500 * time.Millisecond)
+	assert.Equal(t, NodeFail, nodeState(t, a, idC))
+	assert.Equal(t, NodeFail, nodeState(t, b, idC))
+	assert.Contains(t, string(a.Cluster().AppendNodes(nil)), idC+" 127.0.0.1:7002@17002 fail,master")
+	info := run(t, a.Cluster(), "CLUSTER INFO")
+	assert.Contains(t, info, `cluster_state:fail\r\n`)
+	assert.Contains(t, info, `cluster_slots_fail:5461\r\n`)
+
+	// C is back.
+	net.start(17002)
+	net.run(2 * time.Second)
+	assert.Equal(t, NodeOK, nodeState(t, a, idC))
+	assert.Equal(t, NodeOK, nodeState(t, b, idC))
+	assert.Equal(t, NodeOK, nodeState(t, c, idA))
+}
+
+func TestBusPFailWithoutQuorum(t *testing.T) {
+	net, a, _, _ := newTestBuses(t)
+
+	// Once C has failed, A is the only primary left to report B as failing,
+	// which is not a majority of the three primaries.
+	net.stop(17002)
+	net.run(2 * time.Second)
+	net.stop(17001)
+	net.run(3 * time.Second)
+	assert.Equal(t, NodeFail, nodeState(t, a, idC))
+	assert.Equal(t, NodePFail, nodeState(t, a, idB))
+	assert.Contains(t, string(a.Cluster().AppendNodes(nil)), idB+" 127.0.0.1:7001@17001 fail?,master")
+}
+
+func TestBusSlotEpochs(t *testing.T) {
+	net, a, b, c := newTestBuses(t)
+
+	// A imports slot 6000 from B: the end of the migration gives A a greater
+	// config epoch, so its claim wins everywhere.
+	assert.NoError(t, a.Cluster().SetImporting(6000, idB))
+	assert.NoError(t, b.Cluster().SetMigrating(6000, idA))
+	assert.NoError(t, a.Cluster().SetSlotNode(6000, idA))
+	net.run(time.Second)
+
+	for _, bus := range []*Bus{a, b, c} {
+		owner, _ := bus.Cluster().SlotOwner(6000)
+		assert.Equal(t, idA, owner.ID)
+		owner, _ = bus.Cluster().SlotOwner(6001)
+		assert.Equal(t, idB, owner.ID)
+	}
+	assert.NotContains(t, string(b.Cluster().AppendNodes(nil)), "->-")
+	assert.Contains(t, run(t, c.Cluster(), "CLUSTER INFO"), `cluster_current_epoch:1\r\n`)
+}
+
+func TestBusMeetCommand(t *testing.T) {
+	c := newTestCluster(t)
+	assert.Equal(t, "(error) ERR This instance has cluster bus disabled", run(t, c, "CLUSTER MEET 127.0.0.1 7001"))
+
+	bus := NewBus(c, BusOptions{})
+	tests := []struct {
+		command  string
+		expected string
+	}{
+		{"CLUSTER MEET 127.0.0.1 7004", "OK"},
+		{"CLUSTER MEET 127.0.0.1 7005 20000", "OK"},
+		{"CLUSTER MEET 127.0.0.1", "(error) ERR wrong number of arguments for 'cluster|meet' command"},
+		{"CLUSTER MEET localhost 7004", "(error) ERR Invalid node address specified: localhost:7004"},
+		{"CLUSTER MEET 127.0.0.1 x", "(error) ERR Invalid node address specified: 127.0.0.1:x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			assert.Equal(t, tt.expected, run(t, c, tt.command))
+		})
+	}
+
+	var addrs []string
+	for l := range bus.meets {
+		addrs = append(addrs, l.Addr)
+	}
+	assert.ElementsMatch(t, []string{"127.0.0.1:17004", "127.0.0.1:20000"}, addrs)
+}
+
+func TestBusReceiveErrors(t *testing.T) {
+	bus := NewBus(newTestCluster(t), BusOptions{})
+	l := bus.Accept(nil)
+	now := time.Now()
+
+	_, err := bus.Receive(l, []byte("*1\r\n$4\r\nping\r\n"), now)
+	assert.Error(t, err)
+	_, err = bus.Receive(l, resp.AppendAny(nil, busMessage{Type: "foo", ID: idB}), now)
+	assert.EqualError(t, err, `cluster: unknown bus message "foo"`)
+
+	// Pings of unknown nodes are answered, but do not add them.
+	reply, err := bus.Receive(l, resp.AppendAny(nil, busMessage{Type: "ping", ID: strings.Repeat("e", 40)}), now)
+	assert.NoError(t, err)
+	var m busMessage
+	assert.NoError(t, resp.Unmarshal(reply, &m))
+	assert.Equal(t, "pong", m.Type)
+	assert.Equal(t, idA, m.ID)
+	assert.Len(t, m.Slots, SlotCount/8)
+	assert.Len(t, bus.Cluster().Nodes(), 4)
+}
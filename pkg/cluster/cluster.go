@@ -0,0 +1,652 @@
+package cluster
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// Errors returned by Route, worded like Redis Cluster. They are resp.ReplyError
+// values, so resp.AppendErr writes them as they are.
+var (
+	// ErrCrossSlot is returned for a command whose keys are not all in the same
+	// hash slot.
+	ErrCrossSlot = &resp.ReplyError{Msg: "CROSSSLOT Keys in request don't hash to the same slot"}
+
+	// ErrTryAgain is returned for a multi-key command during a slot migration,
+	// when only some of its keys have been migrated yet.
+	ErrTryAgain = &resp.ReplyError{Msg: "TRYAGAIN Multiple keys request during rehashing of slot"}
+
+	// ErrClusterDown is returned for a command on a slot served by no node.
+	ErrClusterDown = &resp.ReplyError{Msg: "CLUSTERDOWN Hash slot not served"}
+)
+
+// SlotRange is an inclusive range of hash slots.
+type SlotRange struct {
+	Start int
+	End   int
+}
+
+// String returns the range as in CLUSTER NODES: "0-5460", or "5461" for a
+// single slot.
+func (r SlotRange) String() string {
+	if r.Start == r.End {
+		return strconv.Itoa(r.Start)
+	}
+	return strconv.Itoa(r.Start) + "-" + strconv.Itoa(r.End)
+}
+
+// valid reports whether r is a non-empty range of existing slots.
+func (r SlotRange) valid() bool {
+	return r.Start >= 0 && r.Start <= r.End && r.End < SlotCount
+}
+
+// Node describes a node of the cluster.
+type Node struct {
+	// ID is the unique name of the node, 40 hexadecimal characters. New
+	// generates one for the local node when it is empty.
+	ID string
+
+	// IP and Port are the address clients connect to.
+	IP   string
+	Port int
+
+	// BusPort is the port of the cluster bus. Zero means Port+10000, the Redis
+	// default.
+	BusPort int
+
+	// Hostname is announced to clients alongside the IP, if set.
+	Hostname string
+
+	// PrimaryID is the ID of the primary of a replica, and empty for a primary.
+	PrimaryID string
+
+	// Slots are the hash slots served by a primary.
+	Slots []SlotRange
+
+	// ConfigEpoch versions the slots claimed by a primary: when two nodes claim
+	// the same slot, the claim with the greater epoch wins.
+	ConfigEpoch uint64
+
+	// State is the health of the node, as detected by the cluster bus.
+	State NodeState
+}
+
+// NodeState is the health of a node, as detected by the cluster bus.
+type NodeState int
+
+const (
+	// NodeOK is a node that answers the pings of the local node.
+	NodeOK NodeState = iota
+
+	// NodePFail is a node that has not answered the pings of the local node
+	// for longer than the node timeout: it is possibly failing.
+	NodePFail
+
+	// NodeFail is a node that is unreachable from a majority of the primaries.
+	NodeFail
+)
+
+// String returns the state as in the messages of the cluster bus: "ok", "pfail"
+// or "fail".
+func (s NodeState) String() string {
+	switch s {
+	case NodePFail:
+		return "pfail"
+	case NodeFail:
+		return "fail"
+	}
+	return "ok"
+}
+
+// Addr returns the address of the node as "ip:port", the form used by MOVED
+// and ASK redirections.
+func (n *Node) Addr() string {
+	return n.IP + ":" + strconv.Itoa(n.Port)
+}
+
+// busPort returns the port of the cluster bus of the node.
+func (n *Node) busPort() int {
+	if n.BusPort != 0 {
+		return n.BusPort
+	}
+	return n.Port + 10000
+}
+
+// NewNodeID returns a random node ID of 40 hexadecimal characters.
+func NewNodeID() string {
+	var b [20]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// topology is an immutable view of the cluster. Commands are routed against the
+// current topology without taking a lock, and changes publish a new one.
+type topology struct {
+	myself *Node
+	nodes  []*Node // In the order they were added, myself included
+	byID   map[string]*Node
+	owner  [SlotCount]*Node
+
+	// migrating maps the slots being moved away from this node to their target,
+	// and importing the slots being moved to this node to their source.
+	migrating map[int]*Node
+	importing map[int]*Node
+
+	// currentEpoch is the greatest epoch seen in the cluster.
+	currentEpoch uint64
+}
+
+// clone returns a copy of t that can be modified. Nodes are shared, as they are
+// never modified once published.
+func (t *topology) clone() *topology {
+	c := &topology{
+		myself:       t.myself,
+		nodes:        append([]*Node(nil), t.nodes...),
+		byID:         make(map[string]*Node, len(t.byID)),
+		owner:        t.owner,
+		migrating:    make(map[int]*Node, len(t.migrating)),
+		importing:    make(map[int]*Node, len(t.importing)),
+		currentEpoch: t.currentEpoch,
+	}
+	for id, n := range t.byID {
+		c.byID[id] = n
+	}
+	for slot, n := range t.migrating {
+		c.migrating[slot] = n
+	}
+	for slot, n := range t.importing {
+		c.importing[slot] = n
+	}
+	return c
+}
+
+// replace swaps the node with the same ID as n for n, keeping its slots.
+func (t *topology) replace(n *Node) {
+	old := t.byID[n.ID]
+	t.byID[n.ID] = n
+	for i, m := range t.nodes {
+		if m == old {
+			t.nodes[i] = n
+		}
+	}
+	if t.myself == old {
+		t.myself = n
+	}
+	for slot, m := range t.owner {
+		if m == old {
+			t.owner[slot] = n
+		}
+	}
+	for slot, m := range t.migrating {
+		if m == old {
+			t.migrating[slot] = n
+		}
+	}
+	for slot, m := range t.importing {
+		if m == old {
+			t.importing[slot] = n
+		}
+	}
+}
+
+// slots returns the slot ranges served by n.
+func (t *topology) slots(n *Node) []SlotRange {
+	var ranges []SlotRange
+	for slot := 0; slot < SlotCount; slot++ {
+		if t.owner[slot] != n {
+			continue
+		}
+		if k := len(ranges) - 1; k >= 0 && ranges[k].End == slot-1 {
+			ranges[k].End = slot
+		} else {
+			ranges = append(ranges, SlotRange{slot, slot})
+		}
+	}
+	return ranges
+}
+
+// replicas returns the replicas of the primary n.
+func (t *topology) replicas(n *Node) []*Node {
+	var replicas []*Node
+	for _, m := range t.nodes {
+		if m.PrimaryID == n.ID {
+			replicas = append(replicas, m)
+		}
+	}
+	return replicas
+}
+
+// Cluster is the view of a Redis Cluster held by one of its nodes: the known
+// nodes and which of them serves each hash slot.
+//
+// The topology comes from static configuration through SetNodes, and can be
+// changed at run time through the other methods or with the CLUSTER ADDSLOTS,
+// DELSLOTS and SETSLOT commands. A Cluster is safe for concurrent use: commands
+// are routed against an immutable snapshot, so routing never waits for a change
+// in progress.
+type Cluster struct {
+	mu     sync.Mutex // Serializes changes to the topology
+	topo   atomic.Pointer[topology]
+	exists func(key []byte) bool
+	bus    *Bus // Cluster bus of the node, if any
+}
+
+// New returns a cluster that only knows the local node, myself, serving
+// myself.Slots. If myself.ID is empty a random ID is generated.
+//
+// Example:
+//
+//	c := cluster.New(cluster.Node{IP: "127.0.0.1", Port: 7000})
+//	_ = c.AssignSlots(c.Myself().ID, cluster.SlotRange{Start: 0, End: cluster.SlotCount - 1})
+func New(myself Node) *Cluster {
+	if myself.ID == "" {
+		myself.ID = NewNodeID()
+	}
+	c := &Cluster{}
+	me := myself
+	me.Slots = nil
+	t := &topology{
+		myself:    &me,
+		nodes:     []*Node{&me},
+		byID:      map[string]*Node{me.ID: &me},
+		migrating: map[int]*Node{},
+		importing: map[int]*Node{},
+	}
+	for _, r := range myself.Slots {
+		if r.valid() {
+			for slot := r.Start; slot <= r.End; slot++ {
+				t.owner[slot] = &me
+			}
+		}
+	}
+	c.topo.Store(t)
+	return c
+}
+
+// SetKeyExists installs the function used to find out whether a key exists in
+// the local dataset.
+//
+// It is only called for slots being migrated: a node migrating a slot serves
+// the keys it still has and sends clients to the target node, with an ASK
+// redirection, for the keys that have already been moved. Without it, every key
+// of a migrating slot is assumed to still be local.
+//
+// fn is called on the event loops of the server and must be safe for
+// concurrent use. SetKeyExists must be called before the server is started.
+func (c *Cluster) SetKeyExists(fn func(key []byte) bool) {
+	c.exists = fn
+}
+
+// update applies fn to a copy of the current topology and publishes the copy,
+// unless fn returns an error.
+func (c *Cluster) update(fn func(t *topology) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.topo.Load().clone()
+	if err := fn(t); err != nil {
+		return err
+	}
+	c.topo.Store(t)
+	return nil
+}
+
+// Myself returns the local node.
+func (c *Cluster) Myself() Node {
+	t := c.topo.Load()
+	n := *t.myself
+	n.Slots = t.slots(t.myself)
+	return n
+}
+
+// Nodes returns all known nodes, the local node included, with their slots.
+func (c *Cluster) Nodes() []Node {
+	t := c.topo.Load()
+	nodes := make([]Node, len(t.nodes))
+	for i, n := range t.nodes {
+		nodes[i] = *n
+		nodes[i].Slots = t.slots(n)
+	}
+	return nodes
+}
+
+// Node returns the node with the given ID.
+func (c *Cluster) Node(id string) (Node, bool) {
+	t := c.topo.Load()
+	n, ok := t.byID[id]
+	if !ok {
+		return Node{}, false
+	}
+	node := *n
+	node.Slots = t.slots(n)
+	return node, true
+}
+
+// SlotOwner returns the node serving slot, if any.
+func (c *Cluster) SlotOwner(slot int) (Node, bool) {
+	if slot < 0 || slot >= SlotCount {
+		return Node{}, false
+	}
+	t := c.topo.Load()
+	n := t.owner[slot]
+	if n == nil {
+		return Node{}, false
+	}
+	node := *n
+	node.Slots = t.slots(n)
+	return node, true
+}
+
+// SetNodes replaces the whole topology with nodes, typically read from static
+// configuration. The local node is identified by its ID; if it is not among
+// nodes it is kept, without slots. Ongoing slot migrations are cancelled.
+//
+// SetNodes returns an error, and leaves the topology unchanged, if an ID is
+// missing or duplicated, or if two primaries claim the same slot.
+func (c *Cluster) SetNodes(nodes []Node) error {
+	return c.update(func(t *topology) error {
+		me := t.myself
+		t.nodes = t.nodes[:0]
+		t.byID = make(map[string]*Node, len(nodes)+1)
+		t.owner = [SlotCount]*Node{}
+		t.migrating = map[int]*Node{}
+		t.importing = map[int]*Node{}
+		t.myself = nil
+		for i := range nodes {
+			n := nodes[i]
+			if n.ID == "" {
+				return errors.New("cluster: node without ID")
+			}
+			if _, ok := t.byID[n.ID]; ok {
+				return fmt.Errorf("cluster: duplicate node %s", n.ID)
+			}
+			n.Slots = nil
+			t.nodes = append(t.nodes, &n)
+			t.byID[n.ID] = &n
+			if n.ID == me.ID {
+				t.myself = &n
+			}
+			if err := t.assign(&n, nodes[i].Slots, false); err != nil {
+				return err
+			}
+		}
+		if t.myself == nil {
+			n := *me
+			t.myself = &n
+			t.nodes = append(t.nodes, &n)
+			t.byID[n.ID] = &n
+		}
+		return nil
+	})
+}
+
+// AddNode adds n to the cluster and assigns its slots to it. If a node with
+// the same ID is already known, its address and role are updated, and n.Slots
+// are assigned to it in addition to the slots it already serves.
+func (c *Cluster) AddNode(n Node) error {
+	if n.ID == "" {
+		return errors.New("cluster: node without ID")
+	}
+	return c.update(func(t *topology) error {
+		node := n
+		node.Slots = nil
+		if _, ok := t.byID[n.ID]; ok {
+			t.replace(&node)
+		} else {
+			t.nodes = append(t.nodes, &node)
+			t.byID[node.ID] = &node
+		}
+		return t.assign(&node, n.Slots, true)
+	})
+}
+
+// RemoveNode forgets the node with the given ID. The slots it served become
+// unassigned. The local node cannot be removed.
+func (c *Cluster) RemoveNode(id string) error {
+	return c.update(func(t *topology) error {
+		n, ok := t.byID[id]
+		if !ok {
+			return fmt.Errorf("Unknown node %s", id)
+		}
+		if n == t.myself {
+			return errors.New("I tried hard but I can't forget myself...")
+		}
+		delete(t.byID, id)
+		for i, m := range t.nodes {
+			if m == n {
+				t.nodes = append(t.nodes[:i], t.nodes[i+1:]...)
+				break
+			}
+		}
+		for slot, m := range t.owner {
+			if m == n {
+				t.owner[slot] = nil
+			}
+		}
+		for slot, m := range t.migrating {
+			if m == n {
+				delete(t.migrating, slot)
+			}
+		}
+		for slot, m := range t.importing {
+			if m == n {
+				delete(t.importing, slot)
+			}
+		}
+		return nil
+	})
+}
+
+// AssignSlots makes the node with the given ID serve the slots in ranges,
+// taking them over from any node that served them before.
+func (c *Cluster) AssignSlots(id string, ranges ...SlotRange) error {
+	return c.update(func(t *topology) error {
+		n, ok := t.byID[id]
+		if !ok {
+			return fmt.Errorf("I don't know about node %s", id)
+		}
+		return t.assign(n, ranges, true)
+	})
+}
+
+// assign makes n serve the slots in ranges. Unless steal is set, slots that
+// are already served by another node are an error.
+func (t *topology) assign(n *Node, ranges []SlotRange, steal bool) error {
+	for _, r := range ranges {
+		if !r.valid() {
+			return errors.New("Invalid or out of range slot")
+		}
+		for slot := r.Start; slot <= r.End; slot++ {
+			if !steal && t.owner[slot] != nil && t.owner[slot] != n {
+				return fmt.Errorf("cluster: slot %d is served by both %s and %s", slot, t.owner[slot].ID, n.ID)
+			}
+			t.owner[slot] = n
+		}
+	}
+	return nil
+}
+
+// UnassignSlots leaves the slots in ranges without a node to serve them.
+func (c *Cluster) UnassignSlots(ranges ...SlotRange) error {
+	return c.update(func(t *topology) error {
+		for _, r := range ranges {
+			if !r.valid() {
+				return errors.New("Invalid or out of range slot")
+			}
+			for slot := r.Start; slot <= r.End; slot++ {
+				t.owner[slot] = nil
+				delete(t.migrating, slot)
+				delete(t.importing, slot)
+			}
+		}
+		return nil
+	})
+}
+
+// SetMigrating marks slot, served by the local node, as being migrated to the
+// node with the given ID, like CLUSTER SETSLOT <slot> MIGRATING <id>.
+func (c *Cluster) SetMigrating(slot int, id string) error {
+	return c.update(func(t *topology) error {
+		n, err := t.slotTarget(slot, id)
+		if err != nil {
+			return err
+		}
+		if t.owner[slot] != t.myself {
+			return fmt.Errorf("I'm not the owner of hash slot %d", slot)
+		}
+		t.migrating[slot] = n
+		return nil
+	})
+}
+
+// SetImporting marks slot as being migrated from the node with the given ID to
+// the local node, like CLUSTER SETSLOT <slot> IMPORTING <id>.
+func (c *Cluster) SetImporting(slot int, id string) error {
+	return c.update(func(t *topology) error {
+		n, err := t.slotTarget(slot, id)
+		if err != nil {
+			return err
+		}
+		if t.owner[slot] == t.myself {
+			return fmt.Errorf("I'm already the owner of hash slot %d", slot)
+		}
+		t.importing[slot] = n
+		return nil
+	})
+}
+
+// SetStable ends any migration of slot, like CLUSTER SETSLOT <slot> STABLE.
+func (c *Cluster) SetStable(slot int) error {
+	return c.update(func(t *topology) error {
+		if slot < 0 || slot >= SlotCount {
+			return errors.New("Invalid or out of range slot")
+		}
+		delete(t.migrating, slot)
+		delete(t.importing, slot)
+		return nil
+	})
+}
+
+// SetSlotNode makes the node with the given ID serve slot and ends its
+// migration, like CLUSTER SETSLOT <slot> NODE <id> at the end of a migration.
+func (c *Cluster) SetSlotNode(slot int, id string) error {
+	return c.update(func(t *topology) error {
+		n, err := t.slotTarget(slot, id)
+		if err != nil {
+			return err
+		}
+		if n == t.myself && t.owner[slot] != n {
+			// Taking a slot over without a vote, at the end of a migration: the
+			// new claim must win over the claim of the previous owner.
+			t.bumpEpoch()
+			n = t.myself
+		}
+		t.owner[slot] = n
+		delete(t.migrating, slot)
+		delete(t.importing, slot)
+		return nil
+	})
+}
+
+// bumpEpoch gives the local node a new config epoch, greater than any other.
+func (t *topology) bumpEpoch() {
+	t.currentEpoch++
+	me := *t.myself
+	me.ConfigEpoch = t.currentEpoch
+	t.replace(&me)
+}
+
+// slotTarget validates slot and returns the node with the given ID.
+func (t *topology) slotTarget(slot int, id string) (*Node, error) {
+	if slot < 0 || slot >= SlotCount {
+		return nil, errors.New("Invalid or out of range slot")
+	}
+	n, ok := t.byID[id]
+	if !ok {
+		return nil, fmt.Errorf("I don't know about node %s", id)
+	}
+	return n, nil
+}
+
+// Route decides where a command on keys must be served, like Redis Cluster
+// does before running a command. It returns nil if the command is served by the
+// local node, and otherwise the error to reply with:
+//
+//   - a *resp.RedirectError with a MOVED redirection to the node serving the
+//     slot of the keys;
+//   - a *resp.RedirectError with an ASK redirection while the slot is migrated
+//     away from the local node and the keys have already been moved;
+//   - ErrCrossSlot if the keys are in different slots;
+//   - ErrTryAgain if a multi-key command is run while only some of its keys
+//     have been migrated;
+//   - ErrClusterDown if no node serves the slot.
+//
+// asking is set when the client sent ASKING before the command, which lets it
+// run on the node importing the slot. readonly is set when the client sent
+// READONLY and the command does not write, which lets it run on a replica of
+// the node serving the slot. A command without keys is always served locally.
+//
+// Example:
+//
+//	switch err := c.Route(keys, false, false); {
+//	case err == nil:
+//	    // run the command
+//	default:
+//	    out = resp.AppendErr(out, err) // e.g. "-MOVED 3999 127.0.0.1:6381\r\n"
+//	}
+func (c *Cluster) Route(keys [][]byte, asking, readonly bool) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	slot := Slot(keys[0])
+	for _, key := range keys[1:] {
+		if Slot(key) != slot {
+			return ErrCrossSlot
+		}
+	}
+
+	t := c.topo.Load()
+	n := t.owner[slot]
+	if n == nil {
+		return ErrClusterDown
+	}
+
+	target, migrating := t.migrating[slot]
+	migrating = migrating && n == t.myself
+	_, importing := t.importing[slot]
+	var missing int
+	if (migrating || importing) && c.exists != nil {
+		for _, key := range keys {
+			if !c.exists(key) {
+				missing++
+			}
+		}
+	}
+	if migrating && missing > 0 {
+		if missing < len(keys) {
+			return ErrTryAgain
+		}
+		return resp.Ask(slot, target.Addr())
+	}
+	if importing && asking {
+		if len(keys) > 1 && missing > 0 {
+			return ErrTryAgain
+		}
+		return nil
+	}
+	if n == t.myself {
+		return nil
+	}
+	if readonly && t.myself.PrimaryID == n.ID {
+		return nil
+	}
+	return resp.Moved(slot, n.Addr())
+}
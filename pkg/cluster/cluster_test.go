@@ -0,0 +1,263 @@
+package cluster
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	idA = strings.Repeat("a", 40)
+	idB = strings.Repeat("b", 40)
+	idC = strings.Repeat("c", 40)
+	idR = strings.Repeat("d", 40)
+)
+
+// newTestCluster returns the view of node A of a cluster of three primaries,
+// with a replica of A.
+func newTestCluster(t *testing.T) *Cluster {
+	c := New(Node{ID: idA, IP: "127.0.0.1", Port: 7000})
+	err := c.SetNodes([]Node{
+		{ID: idA, IP: "127.0.0.1", Port: 7000, Slots: []SlotRange{{0, 5460}}},
+		{ID: idB, IP: "127.0.0.1", Port: 7001, Slots: []SlotRange{{5461, 10922}}},
+		{ID: idC, IP: "127.0.0.1", Port: 7002, Hostname: "c.example", Slots: []SlotRange{{10923, 16383}}},
+		{ID: idR, IP: "127.0.0.1", Port: 7003, PrimaryID: idA},
+	})
+	assert.NoError(t, err)
+	return c
+}
+
+func keys(ks ...string) [][]byte {
+	var b [][]byte
+	for _, k := range ks {
+		b = append(b, []byte(k))
+	}
+	return b
+}
+
+func TestNew(t *testing.T) {
+	c := New(Node{IP: "127.0.0.1", Port: 7000, Slots: []SlotRange{{0, 99}}})
+	me := c.Myself()
+	assert.Len(t, me.ID, 40)
+	assert.Equal(t, []SlotRange{{0, 99}}, me.Slots)
+	assert.Equal(t, "127.0.0.1:7000", me.Addr())
+	assert.NotEqual(t, me.ID, New(Node{}).Myself().ID)
+}
+
+func TestSetNodes(t *testing.T) {
+	c := newTestCluster(t)
+	nodes := c.Nodes()
+	assert.Len(t, nodes, 4)
+	assert.Equal(t, []SlotRange{{5461, 10922}}, nodes[1].Slots)
+	assert.Nil(t, nodes[3].Slots)
+
+	owner, ok := c.SlotOwner(12182)
+	assert.True(t, ok)
+	assert.Equal(t, idC, owner.ID)
+
+	t.Run("myself kept", func(t *testing.T) {
+		c := New(Node{ID: idA, Port: 7000})
+		assert.NoError(t, c.SetNodes([]Node{{ID: idB, Slots: []SlotRange{{0, 16383}}}}))
+		assert.Len(t, c.Nodes(), 2)
+		assert.Equal(t, idA, c.Myself().ID)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		c := newTestCluster(t)
+		assert.Error(t, c.SetNodes([]Node{{ID: idA}, {ID: idA}}))
+		assert.Error(t, c.SetNodes([]Node{{}}))
+		assert.Error(t, c.SetNodes([]Node{
+			{ID: idA, Slots: []SlotRange{{0, 10}}},
+			{ID: idB, Slots: []SlotRange{{10, 20}}},
+		}))
+		assert.Error(t, c.SetNodes([]Node{{ID: idA, Slots: []SlotRange{{0, SlotCount}}}}))
+		// The topology is unchanged.
+		assert.Len(t, c.Nodes(), 4)
+	})
+}
+
+func TestTopologyChanges(t *testing.T) {
+	c := newTestCluster(t)
+
+	assert.NoError(t, c.AssignSlots(idB, SlotRange{0, 9}))
+	owner, _ := c.SlotOwner(5)
+	assert.Equal(t, idB, owner.ID)
+	assert.Equal(t, []SlotRange{{10, 5460}}, c.Myself().Slots)
+
+	assert.NoError(t, c.UnassignSlots(SlotRange{0, 9}))
+	_, ok := c.SlotOwner(5)
+	assert.False(t, ok)
+
+	// Updating a node keeps its slots.
+	assert.NoError(t, c.AddNode(Node{ID: idB, IP: "10.0.0.2", Port: 6379}))
+	owner, _ = c.SlotOwner(6000)
+	assert.Equal(t, "10.0.0.2:6379", owner.Addr())
+
+	assert.NoError(t, c.RemoveNode(idB))
+	_, ok = c.SlotOwner(6000)
+	assert.False(t, ok)
+	_, ok = c.Node(idB)
+	assert.False(t, ok)
+
+	assert.EqualError(t, c.RemoveNode(idA), "I tried hard but I can't forget myself...")
+	assert.EqualError(t, c.RemoveNode(idB), "Unknown node "+idB)
+	assert.EqualError(t, c.AssignSlots(idB, SlotRange{0, 1}), "I don't know about node "+idB)
+	assert.EqualError(t, c.AssignSlots(idA, SlotRange{5, 1}), "Invalid or out of range slot")
+	assert.EqualError(t, c.SetMigrating(12182, idC), "I'm not the owner of hash slot 12182")
+	assert.EqualError(t, c.SetImporting(10, idC), "I'm already the owner of hash slot 10")
+}
+
+func TestRoute(t *testing.T) {
+	moved := func(slot int, addr string) error { return resp.Moved(slot, addr) }
+
+	tests := []struct {
+		name     string
+		keys     [][]byte
+		asking   bool
+		readonly bool
+		expected error
+	}{
+		{"no keys", nil, false, false, nil},
+		{"local", keys("bar"), false, false, nil},
+		{"moved", keys("foo"), false, false, moved(12182, "127.0.0.1:7002")},
+		{"same slot", keys("{user1000}.a", "{user1000}.b"), false, false, nil},
+		{"cross slot", keys("foo", "bar"), false, false, ErrCrossSlot},
+		{"asking without import", keys("foo"), true, false, moved(12182, "127.0.0.1:7002")},
+	}
+	// The cluster is seen from A, which serves "bar" (slot 5061) and
+	// "user1000" (slot 3443).
+	c := newTestCluster(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, c.Route(tt.keys, tt.asking, tt.readonly))
+		})
+	}
+
+	t.Run("cluster down", func(t *testing.T) {
+		c := newTestCluster(t)
+		assert.NoError(t, c.UnassignSlots(SlotRange{12182, 12182}))
+		assert.Equal(t, ErrClusterDown, c.Route(keys("foo"), false, false))
+	})
+
+	t.Run("readonly replica", func(t *testing.T) {
+		r := New(Node{ID: idR})
+		assert.NoError(t, r.SetNodes(newTestCluster(t).Nodes()))
+		assert.Equal(t, moved(5061, "127.0.0.1:7000"), r.Route(keys("bar"), false, false))
+		assert.NoError(t, r.Route(keys("bar"), false, true))
+		// Only for slots of its own primary.
+		assert.Equal(t, moved(12182, "127.0.0.1:7002"), r.Route(keys("foo"), false, true))
+	})
+}
+
+func TestRouteMigration(t *testing.T) {
+	local := map[string]bool{"{a}1": true, "{a}2": true}
+	slot := Slot([]byte("{a}")) // 15495, served by C
+
+	// A imports the slot from C.
+	a := newTestCluster(t)
+	a.SetKeyExists(func(key []byte) bool { return local[string(key)] })
+	assert.NoError(t, a.SetImporting(slot, idC))
+
+	// C migrates the slot to A.
+	c := New(Node{ID: idC})
+	c.SetKeyExists(func(key []byte) bool { return local[string(key)] })
+	assert.NoError(t, c.SetNodes(a.Nodes()))
+	assert.NoError(t, c.SetMigrating(slot, idA))
+
+	ask := resp.Ask(slot, "127.0.0.1:7000")
+	moved := resp.Moved(slot, "127.0.0.1:7002")
+
+	tests := []struct {
+		name     string
+		node     *Cluster
+		keys     [][]byte
+		asking   bool
+		expected error
+	}{
+		{"source has key", c, keys("{a}1"), false, nil},
+		{"source has all keys", c, keys("{a}1", "{a}2"), false, nil},
+		{"source missing key", c, keys("{a}3"), false, ask},
+		{"source missing all keys", c, keys("{a}3", "{a}4"), false, ask},
+		{"source missing some keys", c, keys("{a}1", "{a}3"), false, ErrTryAgain},
+		{"target without asking", a, keys("{a}3"), false, moved},
+		{"target asking", a, keys("{a}3"), true, nil},
+		{"target asking some keys", a, keys("{a}1", "{a}3"), true, ErrTryAgain},
+		{"target asking all keys", a, keys("{a}1", "{a}2"), true, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.node.Route(tt.keys, tt.asking, false))
+		})
+	}
+
+	// The end of the migration.
+	assert.NoError(t, a.SetSlotNode(slot, idA))
+	assert.NoError(t, a.Route(keys("{a}3"), false, false))
+	assert.NoError(t, c.SetStable(slot))
+	assert.NoError(t, c.SetSlotNode(slot, idA))
+	assert.Equal(t, resp.Moved(slot, "127.0.0.1:7000"), c.Route(keys("{a}1"), false, false))
+}
+
+func TestRouteErrors(t *testing.T) {
+	c := newTestCluster(t)
+	err := c.Route(keys("foo"), false, false)
+	var redirect *resp.RedirectError
+	assert.True(t, errors.As(err, &redirect))
+	assert.Equal(t, "-MOVED 12182 127.0.0.1:7002\r\n", string(resp.AppendErr(nil, err)))
+	assert.Equal(t, "-CROSSSLOT Keys in request don't hash to the same slot\r\n",
+		string(resp.AppendErr(nil, c.Route(keys("foo", "bar"), false, false))))
+}
+
+func TestNodesRoundTrip(t *testing.T) {
+	c := newTestCluster(t)
+	assert.NoError(t, c.AssignSlots(idA, SlotRange{16383, 16383}))
+	assert.NoError(t, c.SetMigrating(100, idB))
+	assert.NoError(t, c.SetImporting(6000, idB))
+
+	text := string(c.AppendNodes(nil))
+	expected := idA + " 127.0.0.1:7000@17000 myself,master - 0 0 0 connected 0-5460 16383 [100->-" + idB + "] [6000-<-" + idB + "]\n" +
+		idB + " 127.0.0.1:7001@17001 master - 0 0 0 connected 5461-10922\n" +
+		idC + " 127.0.0.1:7002@17002,c.example master - 0 0 0 connected 10923-16382\n" +
+		idR + " 127.0.0.1:7003@17003 slave " + idA + " 0 0 0 connected\n"
+	assert.Equal(t, expected, text)
+
+	nodes, err := ParseNodes([]byte(text + "vars currentEpoch 0 lastVoteEpoch 0\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []Node{
+		{ID: idA, IP: "127.0.0.1", Port: 7000, BusPort: 17000, Slots: []SlotRange{{0, 5460}, {16383, 16383}}},
+		{ID: idB, IP: "127.0.0.1", Port: 7001, BusPort: 17001, Slots: []SlotRange{{5461, 10922}}},
+		{ID: idC, IP: "127.0.0.1", Port: 7002, BusPort: 17002, Hostname: "c.example", Slots: []SlotRange{{10923, 16382}}},
+		{ID: idR, IP: "127.0.0.1", Port: 7003, BusPort: 17003, PrimaryID: idA},
+	}, nodes)
+
+	other := New(Node{ID: idB})
+	assert.NoError(t, other.SetNodes(nodes))
+	owner, _ := other.SlotOwner(16383)
+	assert.Equal(t, idA, owner.ID)
+}
+
+func TestParseNodesErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"too few fields", idA + " 127.0.0.1:7000 master - 0 0 0\n"},
+		{"no port", idA + " 127.0.0.1 master - 0 0 0 connected\n"},
+		{"bad port", idA + " 127.0.0.1:x master - 0 0 0 connected\n"},
+		{"bad bus port", idA + " 127.0.0.1:7000@x master - 0 0 0 connected\n"},
+		{"bad slot", idA + " 127.0.0.1:7000 master - 0 0 0 connected x\n"},
+		{"bad range", idA + " 127.0.0.1:7000 master - 0 0 0 connected 10-5\n"},
+		{"out of range", idA + " 127.0.0.1:7000 master - 0 0 0 connected 16384\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseNodes([]byte(tt.input))
+			assert.Error(t, err)
+		})
+	}
+}
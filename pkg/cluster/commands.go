@@ -0,0 +1,427 @@
+package cluster
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// Command runs a CLUSTER command of a client and appends its reply to out.
+// args are the arguments of the command, starting with "CLUSTER".
+//
+// The following subcommands are supported:
+//
+//	CLUSTER KEYSLOT key
+//	CLUSTER MYID
+//	CLUSTER SLOTS
+//	CLUSTER SHARDS
+//	CLUSTER NODES
+//	CLUSTER INFO
+//	CLUSTER ADDSLOTS slot [slot ...]
+//	CLUSTER ADDSLOTSRANGE start end [start end ...]
+//	CLUSTER DELSLOTS slot [slot ...]
+//	CLUSTER DELSLOTSRANGE start end [start end ...]
+//	CLUSTER SETSLOT slot IMPORTING|MIGRATING|NODE id
+//	CLUSTER SETSLOT slot STABLE
+//	CLUSTER MEET ip port [cluster-bus-port]
+//
+// CLUSTER MEET requires a cluster bus, see NewBus.
+//
+// For any other subcommand, such as CLUSTER COUNTKEYSINSLOT, which needs to
+// look at the dataset, Command returns out unchanged and false, and the
+// application is expected to handle it.
+//
+// Example:
+//
+//	out, ok := c.Command([][]byte{[]byte("CLUSTER"), []byte("KEYSLOT"), []byte("foo")}, out)
+//	// ok == true, out == ":12182\r\n"
+func (c *Cluster) Command(args [][]byte, out []byte) ([]byte, bool) {
+	if len(args) < 2 {
+		return resp.AppendErr(out, resp.WrongArgs("cluster")), true
+	}
+	sub := strings.ToLower(string(args[1]))
+	arity, ok := subcommandArity[sub]
+	if !ok {
+		return out, false
+	}
+	if arity > 0 && len(args) != arity || arity < 0 && len(args) < -arity ||
+		strings.HasSuffix(sub, "range") && len(args)%2 != 0 {
+		return resp.AppendErr(out, resp.WrongArgs("cluster|"+sub)), true
+	}
+
+	var err error
+	switch sub {
+	case "keyslot":
+		return resp.AppendInt(out, int64(Slot(args[2]))), true
+	case "myid":
+		return resp.AppendBulkString(out, c.topo.Load().myself.ID), true
+	case "slots":
+		return c.AppendSlots(out), true
+	case "shards":
+		return c.AppendShards(out), true
+	case "nodes":
+		return resp.AppendBulk(out, c.AppendNodes(nil)), true
+	case "info":
+		return resp.AppendBulk(out, c.appendInfo(nil)), true
+	case "addslots", "delslots":
+		var ranges []SlotRange
+		ranges, err = parseSlots(args[2:], false)
+		if err == nil {
+			err = c.addSlots(ranges, sub == "delslots")
+		}
+	case "addslotsrange", "delslotsrange":
+		var ranges []SlotRange
+		ranges, err = parseSlots(args[2:], true)
+		if err == nil {
+			err = c.addSlots(ranges, sub == "delslotsrange")
+		}
+	case "setslot":
+		err = c.setSlot(args[2:])
+	case "meet":
+		err = c.meet(args[2:])
+	}
+	if err != nil {
+		return resp.AppendError(out, "ERR "+err.Error()), true
+	}
+	return resp.AppendString(out, "OK"), true
+}
+
+// subcommandArity is the arity of the supported CLUSTER subcommands, counting
+// "CLUSTER" and the subcommand. A negative arity is a minimum.
+var subcommandArity = map[string]int{
+	"keyslot":       3,
+	"myid":          2,
+	"slots":         2,
+	"shards":        2,
+	"nodes":         2,
+	"info":          2,
+	"addslots":      -3,
+	"addslotsrange": -4,
+	"delslots":      -3,
+	"delslotsrange": -4,
+	"setslot":       -4,
+	"meet":          -4,
+}
+
+// slotError is an error of a CLUSTER command, replied with the ERR code.
+type slotError string
+
+func (e slotError) Error() string { return string(e) }
+
+// errInvalidSlot is the error for a slot number that is not in [0, 16383].
+const errInvalidSlot = slotError("Invalid or out of range slot")
+
+// parseSlot parses a slot number.
+func parseSlot(arg []byte) (int, error) {
+	slot, err := strconv.Atoi(string(arg))
+	if err != nil || slot < 0 || slot >= SlotCount {
+		return 0, errInvalidSlot
+	}
+	return slot, nil
+}
+
+// parseSlots parses the slots of ADDSLOTS and DELSLOTS, or, if pairs is set,
+// the start and end pairs of ADDSLOTSRANGE and DELSLOTSRANGE.
+func parseSlots(args [][]byte, pairs bool) ([]SlotRange, error) {
+	var ranges []SlotRange
+	var seen [SlotCount]bool
+	for i := 0; i < len(args); i++ {
+		start, err := parseSlot(args[i])
+		if err != nil {
+			return nil, err
+		}
+		end := start
+		if pairs {
+			i++
+			if end, err = parseSlot(args[i]); err != nil {
+				return nil, err
+			}
+			if start > end {
+				return nil, slotError("start slot number " + strconv.Itoa(start) +
+					" is greater than end slot number " + strconv.Itoa(end))
+			}
+		}
+		for slot := start; slot <= end; slot++ {
+			if seen[slot] {
+				return nil, slotError("Slot " + strconv.Itoa(slot) + " specified multiple times")
+			}
+			seen[slot] = true
+		}
+		ranges = append(ranges, SlotRange{start, end})
+	}
+	return ranges, nil
+}
+
+// addSlots assigns the slots in ranges to the local node, or unassigns them if
+// del is set, failing if any of them is not free, or not assigned.
+func (c *Cluster) addSlots(ranges []SlotRange, del bool) error {
+	return c.update(func(t *topology) error {
+		for _, r := range ranges {
+			for slot := r.Start; slot <= r.End; slot++ {
+				switch {
+				case !del && t.owner[slot] != nil:
+					return slotError("Slot " + strconv.Itoa(slot) + " is already busy")
+				case del && t.owner[slot] == nil:
+					return slotError("Slot " + strconv.Itoa(slot) + " is already unassigned")
+				}
+			}
+		}
+		for _, r := range ranges {
+			for slot := r.Start; slot <= r.End; slot++ {
+				if del {
+					t.owner[slot] = nil
+					delete(t.importing, slot)
+					delete(t.migrating, slot)
+				} else {
+					t.owner[slot] = t.myself
+					delete(t.importing, slot)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// setSlot runs CLUSTER SETSLOT with args following the subcommand.
+func (c *Cluster) setSlot(args [][]byte) error {
+	slot, err := parseSlot(args[0])
+	if err != nil {
+		return err
+	}
+	action := strings.ToLower(string(args[1]))
+	if action == "stable" && len(args) == 2 {
+		return c.SetStable(slot)
+	}
+	if len(args) != 3 {
+		return slotError("Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+	}
+	id := string(args[2])
+	switch action {
+	case "migrating":
+		return c.SetMigrating(slot, id)
+	case "importing":
+		return c.SetImporting(slot, id)
+	case "node":
+		return c.SetSlotNode(slot, id)
+	}
+	return slotError("Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+}
+
+// meet runs CLUSTER MEET with args following the subcommand.
+func (c *Cluster) meet(args [][]byte) error {
+	if c.bus == nil {
+		return slotError("This instance has cluster bus disabled")
+	}
+	if len(args) > 3 {
+		return slotError("Invalid CLUSTER MEET arguments. Try CLUSTER HELP")
+	}
+	ip := string(args[0])
+	port, err := strconv.Atoi(string(args[1]))
+	busPort := port + 10000
+	if len(args) == 3 && err == nil {
+		busPort, err = strconv.Atoi(string(args[2]))
+	}
+	if err != nil || net.ParseIP(ip) == nil || port <= 0 || port > 65535 || busPort <= 0 || busPort > 65535 {
+		return slotError("Invalid node address specified: " + ip + ":" + string(args[1]))
+	}
+	c.bus.Meet(ip, busPort)
+	return nil
+}
+
+// AppendSlots appends the reply of CLUSTER SLOTS to out: for every range of
+// consecutive slots served by the same primary, the range followed by the
+// primary and its replicas.
+//
+// Example reply for a node at 127.0.0.1:7000 serving all slots:
+//
+//	127.0.0.1:7000> CLUSTER SLOTS
+//	1) 1) (integer) 0
+//	   2) (integer) 16383
+//	   3) 1) "127.0.0.1"
+//	      2) (integer) 7000
+//	      3) "e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca"
+//	      4) (empty array)
+func (c *Cluster) AppendSlots(out []byte) []byte {
+	t := c.topo.Load()
+	type run struct {
+		SlotRange
+		n *Node
+	}
+	var runs []run
+	for slot := 0; slot < SlotCount; slot++ {
+		n := t.owner[slot]
+		if n == nil {
+			continue
+		}
+		if k := len(runs) - 1; k >= 0 && runs[k].n == n && runs[k].End == slot-1 {
+			runs[k].End = slot
+		} else {
+			runs = append(runs, run{SlotRange{slot, slot}, n})
+		}
+	}
+
+	out = resp.AppendArray(out, len(runs))
+	for _, r := range runs {
+		replicas := t.replicas(r.n)
+		out = resp.AppendArray(out, 3+len(replicas))
+		out = resp.AppendInt(out, int64(r.Start))
+		out = resp.AppendInt(out, int64(r.End))
+		out = appendSlotsNode(out, r.n)
+		for _, replica := range replicas {
+			out = appendSlotsNode(out, replica)
+		}
+	}
+	return out
+}
+
+// appendSlotsNode appends a node as listed by CLUSTER SLOTS.
+func appendSlotsNode(out []byte, n *Node) []byte {
+	out = resp.AppendArray(out, 4)
+	out = resp.AppendBulkString(out, n.IP)
+	out = resp.AppendInt(out, int64(n.Port))
+	out = resp.AppendBulkString(out, n.ID)
+	if n.Hostname == "" {
+		return resp.AppendArray(out, 0)
+	}
+	out = resp.AppendArray(out, 2)
+	out = resp.AppendBulkString(out, "hostname")
+	return resp.AppendBulkString(out, n.Hostname)
+}
+
+// AppendShards appends the reply of CLUSTER SHARDS to out: one entry for every
+// primary, with the slots it serves and the primary and its replicas.
+//
+// Example reply for a node at 127.0.0.1:7000 serving all slots:
+//
+//	127.0.0.1:7000> CLUSTER SHARDS
+//	1) 1) "slots"
+//	   2) 1) (integer) 0
+//	      2) (integer) 16383
+//	   3) "nodes"
+//	   4) 1)  1) "id"
+//	          2) "e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca"
+//	          3) "port"
+//	          4) (integer) 7000
+//	          5) "ip"
+//	          6) "127.0.0.1"
+//	          7) "endpoint"
+//	          8) "127.0.0.1"
+//	          9) "role"
+//	         10) "master"
+//	         11) "replication-offset"
+//	         12) (integer) 0
+//	         13) "health"
+//	         14) "online"
+func (c *Cluster) AppendShards(out []byte) []byte {
+	t := c.topo.Load()
+	var primaries []*Node
+	for _, n := range t.nodes {
+		if n.PrimaryID == "" {
+			primaries = append(primaries, n)
+		}
+	}
+
+	out = resp.AppendArray(out, len(primaries))
+	for _, n := range primaries {
+		out = resp.AppendArray(out, 4)
+		out = resp.AppendBulkString(out, "slots")
+		ranges := t.slots(n)
+		out = resp.AppendArray(out, 2*len(ranges))
+		for _, r := range ranges {
+			out = resp.AppendInt(out, int64(r.Start))
+			out = resp.AppendInt(out, int64(r.End))
+		}
+		out = resp.AppendBulkString(out, "nodes")
+		replicas := t.replicas(n)
+		out = resp.AppendArray(out, 1+len(replicas))
+		out = appendShardsNode(out, n)
+		for _, replica := range replicas {
+			out = appendShardsNode(out, replica)
+		}
+	}
+	return out
+}
+
+// appendShardsNode appends a node as listed by CLUSTER SHARDS.
+func appendShardsNode(out []byte, n *Node) []byte {
+	fields := 7
+	if n.Hostname != "" {
+		fields++
+	}
+	out = resp.AppendArray(out, 2*fields)
+	out = resp.AppendBulkString(out, "id")
+	out = resp.AppendBulkString(out, n.ID)
+	out = resp.AppendBulkString(out, "port")
+	out = resp.AppendInt(out, int64(n.Port))
+	out = resp.AppendBulkString(out, "ip")
+	out = resp.AppendBulkString(out, n.IP)
+	out = resp.AppendBulkString(out, "endpoint")
+	out = resp.AppendBulkString(out, n.IP)
+	if n.Hostname != "" {
+		out = resp.AppendBulkString(out, "hostname")
+		out = resp.AppendBulkString(out, n.Hostname)
+	}
+	out = resp.AppendBulkString(out, "role")
+	if n.PrimaryID == "" {
+		out = resp.AppendBulkString(out, "master")
+	} else {
+		out = resp.AppendBulkString(out, "replica")
+	}
+	out = resp.AppendBulkString(out, "replication-offset")
+	out = resp.AppendInt(out, 0)
+	out = resp.AppendBulkString(out, "health")
+	if n.State == NodeFail {
+		return resp.AppendBulkString(out, "fail")
+	}
+	return resp.AppendBulkString(out, "online")
+}
+
+// appendInfo appends the text of CLUSTER INFO to b.
+func (c *Cluster) appendInfo(b []byte) []byte {
+	t := c.topo.Load()
+	var assigned, pfail, fail int
+	for _, n := range t.owner {
+		if n == nil {
+			continue
+		}
+		assigned++
+		switch n.State {
+		case NodePFail:
+			pfail++
+		case NodeFail:
+			fail++
+		}
+	}
+	var size int
+	for _, n := range t.nodes {
+		if n.PrimaryID == "" && len(t.slots(n)) > 0 {
+			size++
+		}
+	}
+	state := "ok"
+	if assigned < SlotCount || fail > 0 {
+		state = "fail"
+	}
+	b = append(b, "cluster_enabled:1\r\ncluster_state:"...)
+	b = append(b, state...)
+	b = appendInfoField(b, "cluster_slots_assigned", assigned)
+	b = appendInfoField(b, "cluster_slots_ok", assigned-pfail-fail)
+	b = appendInfoField(b, "cluster_slots_pfail", pfail)
+	b = appendInfoField(b, "cluster_slots_fail", fail)
+	b = appendInfoField(b, "cluster_known_nodes", len(t.nodes))
+	b = appendInfoField(b, "cluster_size", size)
+	b = appendInfoField(b, "cluster_current_epoch", int(t.currentEpoch))
+	b = appendInfoField(b, "cluster_my_epoch", int(t.myself.ConfigEpoch))
+	return append(b, "\r\n"...)
+}
+
+// appendInfoField appends the end of the previous line and a "name:value" line
+// of CLUSTER INFO.
+func appendInfoField(b []byte, name string, value int) []byte {
+	b = append(b, "\r\n"...)
+	b = append(b, name...)
+	b = append(b, ':')
+	return strconv.AppendInt(b, int64(value), 10)
+}
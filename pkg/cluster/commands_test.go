@@ -0,0 +1,180 @@
+package cluster
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+	"github.com/stretchr/testify/assert"
+)
+
+// run runs a CLUSTER command and returns its reply as printed by redis-cli.
+func run(t *testing.T, c *Cluster, command string) string {
+	t.Helper()
+	args := keys(strings.Fields(command)...)
+	out, ok := c.Command(args, nil)
+	assert.True(t, ok, command)
+	vals, err := resp.ParseValues(out)
+	assert.NoError(t, err)
+	assert.Len(t, vals, 1)
+	return vals[0].String()
+}
+
+func TestCommand(t *testing.T) {
+	c := newTestCluster(t)
+
+	tests := []struct {
+		command  string
+		expected string
+	}{
+		{"CLUSTER KEYSLOT foo", "(integer) 12182"},
+		{"cluster keyslot {user1000}.name", "(integer) 3443"},
+		{"CLUSTER MYID", `"` + idA + `"`},
+		{"CLUSTER", "(error) ERR wrong number of arguments for 'cluster' command"},
+		{"CLUSTER KEYSLOT", "(error) ERR wrong number of arguments for 'cluster|keyslot' command"},
+		{"CLUSTER MYID x", "(error) ERR wrong number of arguments for 'cluster|myid' command"},
+		{
+			"CLUSTER SLOTS",
+			"1) 1) (integer) 0\n" +
+				"   2) (integer) 5460\n" +
+				"   3) 1) \"127.0.0.1\"\n" +
+				"      2) (integer) 7000\n" +
+				"      3) \"" + idA + "\"\n" +
+				"      4) (empty array)\n" +
+				"   4) 1) \"127.0.0.1\"\n" +
+				"      2) (integer) 7003\n" +
+				"      3) \"" + idR + "\"\n" +
+				"      4) (empty array)\n" +
+				"2) 1) (integer) 5461\n" +
+				"   2) (integer) 10922\n" +
+				"   3) 1) \"127.0.0.1\"\n" +
+				"      2) (integer) 7001\n" +
+				"      3) \"" + idB + "\"\n" +
+				"      4) (empty array)\n" +
+				"3) 1) (integer) 10923\n" +
+				"   2) (integer) 16383\n" +
+				"   3) 1) \"127.0.0.1\"\n" +
+				"      2) (integer) 7002\n" +
+				"      3) \"" + idC + "\"\n" +
+				"      4) 1) \"hostname\"\n" +
+				"         2) \"c.example\"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			assert.Equal(t, tt.expected, run(t, c, tt.command))
+		})
+	}
+
+	t.Run("unsupported", func(t *testing.T) {
+		out, ok := c.Command(keys("CLUSTER", "COUNTKEYSINSLOT", "1"), []byte("+x\r\n"))
+		assert.False(t, ok)
+		assert.Equal(t, "+x\r\n", string(out))
+	})
+}
+
+func TestCommandShards(t *testing.T) {
+	c := New(Node{ID: idA, IP: "127.0.0.1", Port: 7000})
+	assert.NoError(t, c.SetNodes([]Node{
+		{ID: idA, IP: "127.0.0.1", Port: 7000, Slots: []SlotRange{{0, 99}, {200, 299}}},
+		{ID: idR, IP: "127.0.0.1", Port: 7003, Hostname: "r.example", PrimaryID: idA},
+	}))
+
+	expected := "1) 1) \"slots\"\n" +
+		"   2) 1) (integer) 0\n" +
+		"      2) (integer) 99\n" +
+		"      3) (integer) 200\n" +
+		"      4) (integer) 299\n" +
+		"   3) \"nodes\"\n" +
+		"   4) 1)  1) \"id\"\n" +
+		"          2) \"" + idA + "\"\n" +
+		"          3) \"port\"\n" +
+		"          4) (integer) 7000\n" +
+		"          5) \"ip\"\n" +
+		"          6) \"127.0.0.1\"\n" +
+		"          7) \"endpoint\"\n" +
+		"          8) \"127.0.0.1\"\n" +
+		"          9) \"role\"\n" +
+		"         10) \"master\"\n" +
+		"         11) \"replication-offset\"\n" +
+		"         12) (integer) 0\n" +
+		"         13) \"health\"\n" +
+		"         14) \"online\"\n" +
+		"      2)  1) \"id\"\n" +
+		"          2) \"" + idR + "\"\n" +
+		"          3) \"port\"\n" +
+		"          4) (integer) 7003\n" +
+		"          5) \"ip\"\n" +
+		"          6) \"127.0.0.1\"\n" +
+		"          7) \"endpoint\"\n" +
+		"          8) \"127.0.0.1\"\n" +
+		"          9) \"hostname\"\n" +
+		"         10) \"r.example\"\n" +
+		"         11) \"role\"\n" +
+		"         12) \"replica\"\n" +
+		"         13) \"replication-offset\"\n" +
+		"         14) (integer) 0\n" +
+		"         15) \"health\"\n" +
+		"         16) \"online\""
+	assert.Equal(t, expected, run(t, c, "CLUSTER SHARDS"))
+}
+
+func TestCommandNodesAndInfo(t *testing.T) {
+	c := newTestCluster(t)
+	assert.Equal(t, resp.NewValue(resp.RESP{Type: resp.Bulk, Data: c.AppendNodes(nil)}).String(), run(t, c, "CLUSTER NODES"))
+
+	info := run(t, c, "CLUSTER INFO")
+	assert.Contains(t, info, `cluster_state:ok\r\n`)
+	assert.Contains(t, info, `cluster_slots_assigned:16384\r\n`)
+	assert.Contains(t, info, `cluster_known_nodes:4\r\n`)
+	assert.Contains(t, info, `cluster_size:3\r\n`)
+
+	assert.NoError(t, c.UnassignSlots(SlotRange{0, 0}))
+	info = run(t, c, "CLUSTER INFO")
+	assert.Contains(t, info, `cluster_state:fail\r\n`)
+	assert.Contains(t, info, `cluster_slots_assigned:16383\r\n`)
+}
+
+func TestCommandSlotChanges(t *testing.T) {
+	c := New(Node{ID: idA, IP: "127.0.0.1", Port: 7000})
+	assert.NoError(t, c.AddNode(Node{ID: idB, IP: "127.0.0.1", Port: 7001, Slots: []SlotRange{{100, 199}}}))
+
+	tests := []struct {
+		command  string
+		expected string
+	}{
+		{"CLUSTER ADDSLOTS 0 1 2", "OK"},
+		{"CLUSTER ADDSLOTSRANGE 10 19 30 39", "OK"},
+		{"CLUSTER ADDSLOTS 2", "(error) ERR Slot 2 is already busy"},
+		{"CLUSTER ADDSLOTS 150", "(error) ERR Slot 150 is already busy"},
+		{"CLUSTER ADDSLOTS 5 5", "(error) ERR Slot 5 specified multiple times"},
+		{"CLUSTER ADDSLOTS 16384", "(error) ERR Invalid or out of range slot"},
+		{"CLUSTER ADDSLOTS x", "(error) ERR Invalid or out of range slot"},
+		{"CLUSTER ADDSLOTSRANGE 5 1", "(error) ERR start slot number 5 is greater than end slot number 1"},
+		{"CLUSTER ADDSLOTSRANGE 1 2 3", "(error) ERR wrong number of arguments for 'cluster|addslotsrange' command"},
+		{"CLUSTER DELSLOTS 1", "OK"},
+		{"CLUSTER DELSLOTS 1", "(error) ERR Slot 1 is already unassigned"},
+		{"CLUSTER DELSLOTSRANGE 30 39", "OK"},
+		{"CLUSTER SETSLOT 0 MIGRATING " + idB, "OK"},
+		{"CLUSTER SETSLOT 150 IMPORTING " + idB, "OK"},
+		{"CLUSTER SETSLOT 150 MIGRATING " + idB, "(error) ERR I'm not the owner of hash slot 150"},
+		{"CLUSTER SETSLOT 0 IMPORTING " + idB, "(error) ERR I'm already the owner of hash slot 0"},
+		{"CLUSTER SETSLOT 0 MIGRATING " + idC, "(error) ERR I don't know about node " + idC},
+		{"CLUSTER SETSLOT 0 FOO " + idB, "(error) ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP"},
+		{"CLUSTER SETSLOT 0 STABLE x", "(error) ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP"},
+		{"CLUSTER SETSLOT 0 STABLE", "OK"},
+		{"CLUSTER SETSLOT 150 NODE " + idA, "OK"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			assert.Equal(t, tt.expected, run(t, c, tt.command))
+		})
+	}
+
+	assert.Equal(t, []SlotRange{{0, 0}, {2, 2}, {10, 19}, {150, 150}}, c.Myself().Slots)
+	// Taking slot 150 over gave A a new config epoch.
+	assert.Equal(t, idA+" 127.0.0.1:7000@17000 myself,master - 0 0 1 connected 0 2 10-19 150\n"+
+		idB+" 127.0.0.1:7001@17001 master - 0 0 0 connected 100-149 151-199\n", string(c.AppendNodes(nil)))
+}
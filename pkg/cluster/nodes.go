@@ -0,0 +1,176 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// AppendNodes appends the reply text of CLUSTER NODES to b, one line per node:
+//
+//	<id> <ip:port@busport[,hostname]> <flags> <primary> <ping-sent> <pong-recv> <config-epoch> <link-state> <slot> ...
+//
+// The line of the local node also lists the slots being migrated, as
+// "[slot->-target]" and "[slot-<-source]". The same format is used by the
+// nodes.conf file of Redis Cluster, and can be read back with ParseNodes.
+//
+// Example:
+//
+//	e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 127.0.0.1:7000@17000 myself,master - 0 0 0 connected 0-16383
+func (c *Cluster) AppendNodes(b []byte) []byte {
+	t := c.topo.Load()
+	for _, n := range t.nodes {
+		b = append(b, n.ID...)
+		b = append(b, ' ')
+		b = append(b, n.IP...)
+		b = append(b, ':')
+		b = strconv.AppendInt(b, int64(n.Port), 10)
+		b = append(b, '@')
+		b = strconv.AppendInt(b, int64(n.busPort()), 10)
+		if n.Hostname != "" {
+			b = append(b, ',')
+			b = append(b, n.Hostname...)
+		}
+		b = append(b, ' ')
+		if n == t.myself {
+			b = append(b, "myself,"...)
+		}
+		switch n.State {
+		case NodePFail:
+			b = append(b, "fail?,"...)
+		case NodeFail:
+			b = append(b, "fail,"...)
+		}
+		if n.PrimaryID == "" {
+			b = append(b, "master - "...)
+		} else {
+			b = append(b, "slave "...)
+			b = append(b, n.PrimaryID...)
+			b = append(b, ' ')
+		}
+		var pingSent, pongRecv int64
+		connected := true
+		if n != t.myself && c.bus != nil {
+			pingSent, pongRecv, connected = c.bus.linkInfo(n.ID)
+		}
+		b = strconv.AppendInt(b, pingSent, 10)
+		b = append(b, ' ')
+		b = strconv.AppendInt(b, pongRecv, 10)
+		b = append(b, ' ')
+		b = strconv.AppendUint(b, n.ConfigEpoch, 10)
+		if connected {
+			b = append(b, " connected"...)
+		} else {
+			b = append(b, " disconnected"...)
+		}
+		for _, r := range t.slots(n) {
+			b = append(b, ' ')
+			b = append(b, r.String()...)
+		}
+		if n == t.myself {
+			for slot := 0; slot < SlotCount; slot++ {
+				if target, ok := t.migrating[slot]; ok {
+					b = fmt.Appendf(b, " [%d->-%s]", slot, target.ID)
+				}
+				if source, ok := t.importing[slot]; ok {
+					b = fmt.Appendf(b, " [%d-<-%s]", slot, source.ID)
+				}
+			}
+		}
+		b = append(b, '\n')
+	}
+	return b
+}
+
+// ParseNodes reads nodes in the format of CLUSTER NODES and nodes.conf, so that
+// a cluster can be configured from a static file shared by all its nodes:
+//
+//	c := cluster.New(cluster.Node{ID: myID, IP: "10.0.0.1", Port: 6379})
+//	nodes, err := cluster.ParseNodes(conf)
+//	if err == nil {
+//	    err = c.SetNodes(nodes)
+//	}
+//
+// The ping and link fields are ignored, and so are the flags other than
+// "master" and "slave", and the slots being migrated. Blank lines and "vars"
+// lines are skipped.
+func ParseNodes(data []byte) ([]Node, error) {
+	var nodes []Node
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || fields[0] == "vars" {
+			continue
+		}
+		n, err := parseNode(fields)
+		if err != nil {
+			return nil, fmt.Errorf("cluster: line %d: %w", line, err)
+		}
+		nodes = append(nodes, n)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// parseNode parses the fields of a CLUSTER NODES line.
+func parseNode(fields []string) (Node, error) {
+	if len(fields) < 8 {
+		return Node{}, fmt.Errorf("expected at least 8 fields, got %d", len(fields))
+	}
+	n := Node{ID: fields[0]}
+
+	addr, hostname, _ := strings.Cut(fields[1], ",")
+	n.Hostname = hostname
+	addr, bus, hasBus := strings.Cut(addr, "@")
+	i := strings.LastIndexByte(addr, ':')
+	if i < 0 {
+		return Node{}, fmt.Errorf("invalid address %q", fields[1])
+	}
+	n.IP = addr[:i]
+	var err error
+	if n.Port, err = strconv.Atoi(addr[i+1:]); err != nil {
+		return Node{}, fmt.Errorf("invalid port in %q", fields[1])
+	}
+	if hasBus {
+		if n.BusPort, err = strconv.Atoi(bus); err != nil {
+			return Node{}, fmt.Errorf("invalid bus port in %q", fields[1])
+		}
+	}
+
+	for _, flag := range strings.Split(fields[2], ",") {
+		if flag == "slave" && fields[3] != "-" {
+			n.PrimaryID = fields[3]
+		}
+	}
+
+	if n.ConfigEpoch, err = strconv.ParseUint(fields[6], 10, 64); err != nil {
+		return Node{}, fmt.Errorf("invalid config epoch %q", fields[6])
+	}
+
+	for _, s := range fields[8:] {
+		if strings.HasPrefix(s, "[") {
+			continue
+		}
+		start, end, isRange := strings.Cut(s, "-")
+		r := SlotRange{}
+		if r.Start, err = strconv.Atoi(start); err != nil {
+			return Node{}, fmt.Errorf("invalid slot %q", s)
+		}
+		r.End = r.Start
+		if isRange {
+			if r.End, err = strconv.Atoi(end); err != nil {
+				return Node{}, fmt.Errorf("invalid slot range %q", s)
+			}
+		}
+		if !r.valid() {
+			return Node{}, fmt.Errorf("invalid slot range %q", s)
+		}
+		n.Slots = append(n.Slots, r)
+	}
+	return n, nil
+}
@@ -0,0 +1,86 @@
+// Package cluster implements the client-facing side of the Redis Cluster
+// protocol for RedHub servers.
+//
+// Redis Cluster splits the keyspace into 16384 hash slots. Every key belongs to
+// the slot given by the CRC16 of the key modulo 16384, and every slot is served
+// by one primary node. A node that receives a command for a slot it does not
+// serve answers with a -MOVED redirection to the right node, and during a slot
+// migration with an -ASK redirection to the node importing it. Cluster-aware
+// clients learn the topology with CLUSTER SLOTS, CLUSTER SHARDS or CLUSTER NODES
+// and then send each command to the right node directly.
+//
+// A Cluster holds the slot-to-node map of one node. It answers the CLUSTER
+// commands and decides, from the keys of a command, whether the command is
+// served locally or redirected:
+//
+//	c := cluster.New(cluster.Node{IP: "10.0.0.1", Port: 6379})
+//	err := c.SetNodes([]cluster.Node{
+//	    {ID: c.Myself().ID, IP: "10.0.0.1", Port: 6379, Slots: []cluster.SlotRange{{0, 8191}}},
+//	    {ID: otherID, IP: "10.0.0.2", Port: 6379, Slots: []cluster.SlotRange{{8192, 16383}}},
+//	})
+//
+//	err = c.Route([][]byte{[]byte("foo")}, false, false)
+//	// *resp.RedirectError "MOVED 12182 10.0.0.2:6379"
+//
+// redhub.RedHub.SetCluster wires a Cluster into a server, so that commands are
+// redirected before the handler runs.
+package cluster
+
+// SlotCount is the number of hash slots of a Redis Cluster.
+const SlotCount = 16384
+
+// crc16tab is the lookup table of the CRC16-CCITT (XMODEM) checksum used by
+// Redis Cluster: polynomial 0x1021, initial value 0.
+var crc16tab = func() (tab [256]uint16) {
+	for i := range tab {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		tab[i] = crc
+	}
+	return tab
+}()
+
+// crc16 returns the CRC16-CCITT (XMODEM) checksum of b.
+func crc16(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc = crc<<8 ^ crc16tab[byte(crc>>8)^c]
+	}
+	return crc
+}
+
+// Slot returns the hash slot of key, like CLUSTER KEYSLOT.
+//
+// If the key contains a hash tag, a non-empty substring between the first "{"
+// and the first "}" after it, only the hash tag is hashed. Keys with the same
+// hash tag are therefore always in the same slot, which lets a multi-key
+// command operate on them.
+//
+// Example:
+//
+//	cluster.Slot([]byte("foo"))             // 12182
+//	cluster.Slot([]byte("{user1000}.name")) // 3443, the slot of "user1000"
+//	cluster.Slot([]byte("foo{}{bar}"))      // 8363, the whole key is hashed
+func Slot(key []byte) int {
+	for i, c := range key {
+		if c != '{' {
+			continue
+		}
+		for j := i + 1; j < len(key); j++ {
+			if key[j] == '}' {
+				if j > i+1 {
+					key = key[i+1 : j]
+				}
+				break
+			}
+		}
+		break
+	}
+	return int(crc16(key) & (SlotCount - 1))
+}
@@ -0,0 +1,50 @@
+package cluster
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlot(t *testing.T) {
+	tests := []struct {
+		key      string
+		expected int
+	}{
+		// CRC16/XMODEM check value: 0x31c3 % 16384
+		{"123456789", 12739},
+		{"foo", 12182},
+		{"somekey", 11058},
+		{"", 0},
+
+		// Hash tags
+		{"foo{hash_tag}", 2515},
+		{"somekey{hash_tag}", 2515},
+		{"{user1000}.name", 3443},
+		{"user1000", 3443},
+		{"foo{{bar}}zap", 4015}, // hashes "{bar"
+		{"{bar", 4015},          // no closing brace, the whole key is hashed
+		{"foo{}{bar}", 8363},    // empty tag, the whole key is hashed
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			assert.Equal(t, tt.expected, Slot([]byte(tt.key)))
+		})
+	}
+}
+
+func TestSlotZeroAllocs(t *testing.T) {
+	key := []byte("{user1000}.following")
+	allocs := testing.AllocsPerRun(100, func() {
+		Slot(key)
+	})
+	assert.Equal(t, 0.0, allocs)
+}
+
+func BenchmarkSlot(b *testing.B) {
+	key := []byte("user:1000:profile")
+	for i := 0; i < b.N; i++ {
+		Slot(key)
+	}
+}
@@ -0,0 +1,331 @@
+// Package proxy turns a RedHub server into a proxy in front of upstream RESP
+// servers, such as Redis: commands are forwarded to the upstreams and their
+// replies relayed back to the clients, in order.
+//
+// A Handler sees every command first, and can rewrite it, deny it or answer it
+// locally, which covers the many "Redis, plus a bit" use cases. A Router picks
+// the upstream of each command, for example by hashing its key with KeyHash.
+//
+// Example:
+//
+//	p, err := proxy.New(proxy.Options{
+//	    Upstreams: []string{"10.0.0.1:6379", "10.0.0.2:6379"},
+//	    Router:    proxy.KeyHash(redhub.RedisCommands...),
+//	    Handler: func(cmd resp.Command, out []byte) (resp.Command, []byte, proxy.Verdict) {
+//	        if strings.EqualFold(string(cmd.Args[0]), "flushall") {
+//	            return cmd, resp.AppendError(out, "ERR FLUSHALL is disabled"), proxy.Reply
+//	        }
+//	        return cmd, out, proxy.Forward
+//	    },
+//	})
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	defer p.Close()
+//	rh := redhub.NewRedHub(onOpened, onClosed, nil)
+//	rh.SetReplyHandler(p.ReplyHandler)
+//	rh.SetPipelinedReplies(true)
+//	log.Fatal(redhub.ListenAndServe("tcp://0.0.0.0:6380", redhub.Options{Multicore: true}, rh))
+package proxy
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/IceFireDB/redhub"
+	"github.com/IceFireDB/redhub/pkg/cluster"
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// DefaultDialTimeout is the default Options.DialTimeout.
+const DefaultDialTimeout = 5 * time.Second
+
+// DefaultTimeout is the default Options.Timeout.
+const DefaultTimeout = 10 * time.Second
+
+// ErrClosed is the error of the commands forwarded after, or while, the proxy
+// is closed.
+var ErrClosed = errors.New("proxy: closed")
+
+// UpstreamError is the error of a command whose upstream could not be reached,
+// or whose connection was lost before the reply arrived.
+type UpstreamError struct {
+	Addr string
+	Err  error
+}
+
+func (e *UpstreamError) Error() string {
+	return "upstream " + e.Addr + ": " + e.Err.Error()
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// Verdict tells the proxy what to do with a command once its Handler has run.
+type Verdict int
+
+const (
+	// Forward forwards the command returned by the handler to its upstream.
+	Forward Verdict = iota
+
+	// Reply answers the command with the reply appended to out by the handler,
+	// without forwarding it.
+	Reply
+)
+
+// Handler is called for every command before it is forwarded. It returns the
+// command to forward, which may be cmd rewritten, or appends a reply to out
+// and returns Reply to deny the command or handle it locally.
+//
+// cmd.Args reference the input buffer of the connection: a rewritten command
+// may replace them, but must not modify them in place. Handler runs on the
+// event loop of the client and must not block.
+type Handler func(cmd resp.Command, out []byte) (resp.Command, []byte, Verdict)
+
+// Router picks the upstream of a command: it returns an index into
+// Options.Upstreams, of which there are n.
+type Router func(cmd resp.Command, n int) int
+
+// Options configures a Proxy.
+type Options struct {
+	// Upstreams are the addresses of the upstream servers, "host:port".
+	Upstreams []string
+
+	// PoolSize is the number of connections to each upstream. The commands of
+	// all clients are pipelined over them. The commands a client pipelines may
+	// be spread over several connections, where the upstream can run them out
+	// of order: keep the default when clients pipeline commands that depend on
+	// each other, such as a SET and a GET of the same key. Default: 1
+	PoolSize int
+
+	// DialTimeout bounds the time to connect to an upstream.
+	// Default: DefaultDialTimeout
+	DialTimeout time.Duration
+
+	// Timeout bounds the time to write commands to an upstream, and the time
+	// waited for its next reply while replies are pending. An upstream that
+	// exceeds it is disconnected, failing the commands waiting for their
+	// replies, and is dialed again for the next commands.
+	// Default: DefaultTimeout
+	Timeout time.Duration
+
+	// Username and Password authenticate every upstream connection with AUTH,
+	// when Password is set.
+	Username string
+	Password string
+
+	// DB is the database selected on every upstream connection.
+	DB int
+
+	// Router picks the upstream of each command.
+	// Default: round robin over the upstreams
+	Router Router
+
+	// Handler sees every command before it is forwarded, if set.
+	Handler Handler
+}
+
+// Proxy forwards commands to a pool of upstream RESP servers. It is safe for
+// concurrent use.
+//
+// Connections to the upstreams are shared by all the clients, so commands that
+// change the state of a connection (SELECT, AUTH, HELLO, MULTI, WATCH,
+// SUBSCRIBE, MONITOR...) and blocking commands are refused, unless the Handler
+// answers them. QUIT is answered by the proxy itself.
+type Proxy struct {
+	opts  Options
+	pools [][]*upstream // Connections to each upstream
+	next  atomic.Uint64 // Round robin over the upstreams and their connections
+}
+
+// New returns a proxy to opts.Upstreams. The upstreams are connected lazily,
+// when the first command is forwarded to them, and reconnected after an error.
+func New(opts Options) (*Proxy, error) {
+	if len(opts.Upstreams) == 0 {
+		return nil, errors.New("proxy: no upstreams")
+	}
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 1
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = DefaultDialTimeout
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	p := &Proxy{opts: opts}
+	for _, addr := range opts.Upstreams {
+		pool := make([]*upstream, opts.PoolSize)
+		for i := range pool {
+			pool[i] = newUpstream(addr, &p.opts)
+		}
+		p.pools = append(p.pools, pool)
+	}
+	return p, nil
+}
+
+// Close closes the connections to the upstreams. Commands waiting for their
+// replies fail with ErrClosed.
+func (p *Proxy) Close() error {
+	for _, pool := range p.pools {
+		for _, u := range pool {
+			u.close()
+		}
+	}
+	return nil
+}
+
+// ReplyHandler is a redhub.ReplyHandler that serves every command through the
+// proxy, to be installed with SetReplyHandler, along with SetPipelinedReplies.
+// The commands received from a client are then all queued at once, forwarded
+// together, and their replies relayed in order as they arrive; the commands
+// of concurrent clients are pipelined together on the upstream connections
+// too. Without SetPipelinedReplies, the commands of a client are forwarded
+// one at a time, each waiting for the reply of the previous one.
+func (p *Proxy) ReplyHandler(cmd resp.Command, out []byte) ([]byte, redhub.ReplyStreamer, redhub.Action) {
+	if p.opts.Handler != nil {
+		var verdict Verdict
+		if cmd, out, verdict = p.opts.Handler(cmd, out); verdict == Reply {
+			return out, nil, redhub.None
+		}
+	}
+	if len(cmd.Args) == 0 {
+		return resp.AppendError(out, "ERR empty command"), nil, redhub.None
+	}
+	if out, handled, action := p.local(cmd, out); handled {
+		return out, nil, action
+	}
+	c := p.upstream(cmd).send(cmd)
+	return out, func(w *redhub.ReplyWriter) error {
+		// The streamers run once the commands received have all been queued.
+		p.flush()
+		reply, err := c.wait()
+		if err != nil {
+			reply = resp.AppendError(nil, "ERR "+err.Error())
+		}
+		_, err = w.Write(reply)
+		return err
+	}, redhub.None
+}
+
+// Do forwards cmd to its upstream, bypassing the Handler, and returns the raw
+// RESP reply. An error reply of the upstream is returned as a reply, not as
+// an error.
+func (p *Proxy) Do(cmd resp.Command) ([]byte, error) {
+	if len(cmd.Args) == 0 {
+		return nil, errors.New("proxy: empty command")
+	}
+	u := p.upstream(cmd)
+	c := u.send(cmd)
+	u.flush()
+	return c.wait()
+}
+
+// flush forwards the commands queued on every upstream.
+func (p *Proxy) flush() {
+	for _, pool := range p.pools {
+		for _, u := range pool {
+			u.flush()
+		}
+	}
+}
+
+// upstream returns the connection to forward cmd on.
+func (p *Proxy) upstream(cmd resp.Command) *upstream {
+	n := p.next.Add(1)
+	i := int(n % uint64(len(p.pools)))
+	if p.opts.Router != nil {
+		i = p.opts.Router(cmd, len(p.pools))
+		if i < 0 || i >= len(p.pools) {
+			i = 0
+		}
+	}
+	pool := p.pools[i]
+	return pool[int(n/uint64(len(p.pools)))%len(pool)]
+}
+
+// local answers the commands that cannot be forwarded on shared connections.
+func (p *Proxy) local(cmd resp.Command, out []byte) ([]byte, bool, redhub.Action) {
+	var buf [16]byte
+	name := cmd.Args[0]
+	if len(name) > len(buf) {
+		return out, false, redhub.None
+	}
+	for i, c := range name {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		buf[i] = c
+	}
+	lower := buf[:len(name)]
+	if string(lower) == "quit" {
+		return resp.AppendString(out, "OK"), true, redhub.Close
+	}
+	if _, ok := unsupported[string(lower)]; ok {
+		return resp.AppendError(out, "ERR command '"+string(lower)+"' is not supported by the proxy"), true, redhub.None
+	}
+	return out, false, redhub.None
+}
+
+// unsupported are the commands that change the state of a connection, or
+// block it, and so cannot be forwarded on connections shared by all clients.
+var unsupported = map[string]struct{}{
+	"auth": {}, "hello": {}, "select": {}, "reset": {}, "client": {},
+	"multi": {}, "exec": {}, "discard": {}, "watch": {}, "unwatch": {},
+	"subscribe": {}, "unsubscribe": {}, "psubscribe": {}, "punsubscribe": {},
+	"ssubscribe": {}, "sunsubscribe": {}, "monitor": {}, "sync": {}, "psync": {},
+	"blpop": {}, "brpop": {}, "brpoplpush": {}, "blmove": {}, "blmpop": {},
+	"bzpopmin": {}, "bzpopmax": {}, "bzmpop": {}, "wait": {}, "waitaof": {},
+}
+
+// KeyHash returns a Router that sends all the commands on a key to the same
+// upstream, by hashing the key like Redis Cluster does, so that keys with the
+// same {hashtag} also share an upstream. The keys of a command are found with
+// its spec in specs, or are its first argument if it has no spec. Commands
+// without keys go to the first upstream, and commands with several keys to
+// the upstream of the first key.
+//
+// Example:
+//
+//	router := proxy.KeyHash(redhub.RedisCommands...)
+func KeyHash(specs ...redhub.CommandSpec) Router {
+	table := make(map[string]redhub.CommandSpec, len(specs))
+	for _, spec := range specs {
+		table[strings.ToLower(spec.Name)] = spec
+	}
+	return func(cmd resp.Command, n int) int {
+		key := firstKey(table, cmd.Args)
+		if key == nil {
+			return 0
+		}
+		return cluster.Slot(key) % n
+	}
+}
+
+// firstKey returns the first key of the command args, or nil.
+func firstKey(table map[string]redhub.CommandSpec, args [][]byte) []byte {
+	var buf [64]byte
+	name := args[0]
+	if len(name) <= len(buf) {
+		for i, c := range name {
+			if 'A' <= c && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			buf[i] = c
+		}
+		if spec, ok := table[string(buf[:len(name)])]; ok {
+			var keys [1][]byte
+			if k := spec.AppendKeys(keys[:0], args); len(k) > 0 {
+				return k[0]
+			}
+			return nil
+		}
+	}
+	if len(args) > 1 {
+		return args[1]
+	}
+	return nil
+}
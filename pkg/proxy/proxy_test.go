@@ -0,0 +1,427 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IceFireDB/redhub"
+	"github.com/IceFireDB/redhub/pkg/resp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func command(args ...string) resp.Command {
+	cmd := resp.Command{}
+	for _, arg := range args {
+		cmd.Args = append(cmd.Args, []byte(arg))
+	}
+	return cmd
+}
+
+func TestKeyHash(t *testing.T) {
+	router := KeyHash(redhub.RedisCommands...)
+
+	// "foo" is in slot 12182, "bar" in slot 5061.
+	tests := []struct {
+		name     string
+		args     []string
+		expected int
+	}{
+		{"key", []string{"GET", "foo"}, 12182 % 3},
+		{"case insensitive", []string{"get", "bar"}, 5061 % 3},
+		{"first key", []string{"MSET", "bar", "1", "foo", "2"}, 5061 % 3},
+		{"hashtag", []string{"SET", "{foo}bar", "1"}, 12182 % 3},
+		{"keyless command", []string{"PING", "foo"}, 0},
+		{"unknown command", []string{"FOO", "foo"}, 12182 % 3},
+		{"unknown command without arguments", []string{"FOO"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, router(command(tt.args...), 3))
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(Options{})
+	assert.EqualError(t, err, "proxy: no upstreams")
+
+	p, err := New(Options{Upstreams: []string{"127.0.0.1:1", "127.0.0.1:2"}, PoolSize: 2})
+	require.NoError(t, err)
+	assert.Len(t, p.pools, 2)
+	assert.Len(t, p.pools[0], 2)
+	assert.Equal(t, DefaultDialTimeout, p.opts.DialTimeout)
+
+	// The default router spreads commands over upstreams and connections.
+	seen := map[*upstream]bool{}
+	for i := 0; i < 4; i++ {
+		seen[p.upstream(command("PING"))] = true
+	}
+	assert.Len(t, seen, 4)
+
+	assert.NoError(t, p.Close())
+	_, err = p.Do(command("PING"))
+	assert.ErrorIs(t, err, ErrClosed)
+}
+
+func TestReplyHandler_Local(t *testing.T) {
+	p, err := New(Options{
+		Upstreams: []string{"127.0.0.1:1"},
+		Handler: func(cmd resp.Command, out []byte) (resp.Command, []byte, Verdict) {
+			if strings.EqualFold(string(cmd.Args[0]), "flushall") {
+				return cmd, resp.AppendError(out, "ERR FLUSHALL is disabled"), Reply
+			}
+			return cmd, out, Forward
+		},
+	})
+	require.NoError(t, err)
+	defer p.Close()
+
+	tests := []struct {
+		args     []string
+		expected string
+		action   redhub.Action
+	}{
+		{[]string{"FLUSHALL"}, "-ERR FLUSHALL is disabled\r\n", redhub.None},
+		{[]string{"SELECT", "1"}, "-ERR command 'select' is not supported by the proxy\r\n", redhub.None},
+		{[]string{"Subscribe", "ch"}, "-ERR command 'subscribe' is not supported by the proxy\r\n", redhub.None},
+		{[]string{"BLPOP", "list", "0"}, "-ERR command 'blpop' is not supported by the proxy\r\n", redhub.None},
+		{[]string{"QUIT"}, "+OK\r\n", redhub.Close},
+	}
+	for _, tt := range tests {
+		t.Run(tt.args[0], func(t *testing.T) {
+			out, streamer, action := p.ReplyHandler(command(tt.args...), nil)
+			assert.Nil(t, streamer)
+			assert.Equal(t, tt.expected, string(out))
+			assert.Equal(t, tt.action, action)
+		})
+	}
+}
+
+func TestUpstreamDown(t *testing.T) {
+	p, err := New(Options{Upstreams: []string{"127.0.0.1:1"}, DialTimeout: time.Second})
+	require.NoError(t, err)
+	defer p.Close()
+
+	_, err = p.Do(command("PING"))
+	var upstreamErr *UpstreamError
+	require.True(t, errors.As(err, &upstreamErr))
+	assert.Equal(t, "127.0.0.1:1", upstreamErr.Addr)
+	assert.True(t, strings.HasPrefix(err.Error(), "upstream 127.0.0.1:1: "))
+}
+
+func TestUpstreamLost(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		// The first connection is lost before replying, the second one
+		// answers PONG.
+		for i := 0; ; i++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if _, err := resp.NewReader(conn).ReadValue(); err == nil && i > 0 {
+				_, _ = conn.Write([]byte("+PONG\r\n"))
+			}
+			conn.Close()
+		}
+	}()
+
+	p, err := New(Options{Upstreams: []string{ln.Addr().String()}})
+	require.NoError(t, err)
+	defer p.Close()
+
+	_, err = p.Do(command("PING"))
+	var upstreamErr *UpstreamError
+	require.True(t, errors.As(err, &upstreamErr))
+	assert.Equal(t, ln.Addr().String(), upstreamErr.Addr)
+
+	// The next command reconnects.
+	reply, err := p.Do(command("PING"))
+	assert.NoError(t, err)
+	assert.Equal(t, "+PONG\r\n", string(reply))
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	var accepted sync.WaitGroup
+	accepted.Add(2)
+	go func() {
+		// The first connection answers the first PING only, the second one
+		// answers every PING.
+		for i := 0; ; i++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Done()
+			go func(i int, conn net.Conn) {
+				defer conn.Close()
+				r := resp.NewReader(conn)
+				for j := 0; ; j++ {
+					if _, err := r.ReadValue(); err != nil {
+						return
+					}
+					if i > 0 || j == 0 {
+						_, _ = conn.Write([]byte("+PONG\r\n"))
+					}
+				}
+			}(i, conn)
+		}
+	}()
+
+	p, err := New(Options{Upstreams: []string{ln.Addr().String()}, Timeout: 100 * time.Millisecond})
+	require.NoError(t, err)
+	defer p.Close()
+
+	// An idle connection is not timed out.
+	reply, err := p.Do(command("PING"))
+	require.NoError(t, err)
+	assert.Equal(t, "+PONG\r\n", string(reply))
+	time.Sleep(300 * time.Millisecond)
+
+	start := time.Now()
+	_, err = p.Do(command("PING"))
+	var upstreamErr *UpstreamError
+	require.True(t, errors.As(err, &upstreamErr))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// The next command reconnects.
+	reply, err = p.Do(command("PING"))
+	assert.NoError(t, err)
+	assert.Equal(t, "+PONG\r\n", string(reply))
+	accepted.Wait()
+}
+
+// startUpstream serves a small key-value store on port, standing in for Redis.
+// Every reply to GET is prefixed with the port, which tells the upstreams apart.
+func startUpstream(port int) *redhub.RedHub {
+	var mu sync.Mutex
+	data := map[string]string{}
+	rh := redhub.NewRedHub(
+		func(c *redhub.Conn) ([]byte, redhub.Action) { return nil, redhub.None },
+		func(c *redhub.Conn, err error) redhub.Action { return redhub.None },
+		func(cmd resp.Command, out []byte) ([]byte, redhub.Action) {
+			mu.Lock()
+			defer mu.Unlock()
+			switch strings.ToLower(string(cmd.Args[0])) {
+			case "auth":
+				if string(cmd.Args[len(cmd.Args)-1]) != "secret" {
+					return resp.AppendError(out, "WRONGPASS invalid username-password pair"), redhub.None
+				}
+				return resp.AppendOK(out), redhub.None
+			case "select", "ping":
+				return resp.AppendString(out, "OK"), redhub.None
+			case "set":
+				data[string(cmd.Args[1])] = string(cmd.Args[2])
+				return resp.AppendOK(out), redhub.None
+			case "get":
+				v, ok := data[string(cmd.Args[1])]
+				if !ok {
+					return resp.AppendNull(out), redhub.None
+				}
+				return resp.AppendBulkString(out, strconv.Itoa(port)+":"+v), redhub.None
+			}
+			return resp.AppendError(out, "ERR unknown command '"+string(cmd.Args[0])+"'"), redhub.None
+		},
+	)
+	go func() {
+		_ = redhub.ListenAndServe("tcp://127.0.0.1:"+strconv.Itoa(port), redhub.Options{}, rh)
+	}()
+	return rh
+}
+
+func TestProxy_Pipelined(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	// The upstream only answers once it has received the three commands, so
+	// they must be forwarded without waiting for each other's replies.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := resp.NewReader(conn)
+		var out []byte
+		for i := 0; i < 3; i++ {
+			cmd, err := r.ReadCommand()
+			if err != nil {
+				return
+			}
+			out = resp.AppendBulk(out, cmd.Args[1])
+		}
+		_, _ = conn.Write(out)
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	p, err := New(Options{
+		Upstreams: []string{ln.Addr().String()},
+		Handler: func(cmd resp.Command, out []byte) (resp.Command, []byte, Verdict) {
+			if strings.EqualFold(string(cmd.Args[0]), "hello") {
+				return cmd, resp.AppendBulkString(out, "from the proxy"), Reply
+			}
+			return cmd, out, Forward
+		},
+	})
+	require.NoError(t, err)
+	defer p.Close()
+
+	rh := redhub.NewRedHub(
+		func(c *redhub.Conn) ([]byte, redhub.Action) { return nil, redhub.None },
+		func(c *redhub.Conn, err error) redhub.Action { return redhub.None },
+		nil,
+	)
+	rh.SetReplyHandler(p.ReplyHandler)
+	rh.SetPipelinedReplies(true)
+	sock := filepath.Join(t.TempDir(), "proxy.sock")
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- redhub.ListenAndServe("unix://"+sock, redhub.Options{}, rh)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	defer func() {
+		assert.NoError(t, rh.Close())
+		<-serverErr
+	}()
+
+	conn, err := net.DialTimeout("unix", sock, time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ECHO a\r\nHELLO\r\nECHO b\r\nECHO c\r\nQUIT\r\n"))
+	require.NoError(t, err)
+
+	// The replies, forwarded or local, are in order.
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	reply, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "$1\r\na\r\n$14\r\nfrom the proxy\r\n$1\r\nb\r\n$1\r\nc\r\n+OK\r\n", string(reply))
+}
+
+func TestProxy_Integration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	upstreams := []*redhub.RedHub{startUpstream(16431), startUpstream(16432)}
+	p, err := New(Options{
+		Upstreams: []string{"127.0.0.1:16431", "127.0.0.1:16432"},
+		PoolSize:  2,
+		Password:  "secret",
+		DB:        1,
+		Router:    KeyHash(redhub.RedisCommands...),
+		Handler: func(cmd resp.Command, out []byte) (resp.Command, []byte, Verdict) {
+			switch strings.ToLower(string(cmd.Args[0])) {
+			case "hello":
+				return cmd, resp.AppendBulkString(out, "from the proxy"), Reply
+			case "getx":
+				// GETX is a GET of the key suffixed with ":x".
+				return resp.Command{Args: [][]byte{[]byte("GET"), append(append([]byte(nil), cmd.Args[1]...), ":x"...)}}, out, Forward
+			}
+			return cmd, out, Forward
+		},
+	})
+	require.NoError(t, err)
+
+	rh := redhub.NewRedHub(
+		func(c *redhub.Conn) ([]byte, redhub.Action) { return nil, redhub.None },
+		func(c *redhub.Conn, err error) redhub.Action { return redhub.None },
+		nil,
+	)
+	rh.SetReplyHandler(p.ReplyHandler)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- redhub.ListenAndServe("tcp://127.0.0.1:16433", redhub.Options{Multicore: true}, rh)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:16433", time.Second)
+	require.NoError(t, err)
+	r := resp.NewReader(conn)
+	roundTrip := func(commands ...[]string) []string {
+		var req []byte
+		for _, args := range commands {
+			req = resp.AppendArray(req, len(args))
+			for _, arg := range args {
+				req = resp.AppendBulkString(req, arg)
+			}
+		}
+		_, err := conn.Write(req)
+		require.NoError(t, err)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+		var replies []string
+		for range commands {
+			v, err := r.ReadValue()
+			require.NoError(t, err)
+			replies = append(replies, string(v.Data))
+		}
+		return replies
+	}
+
+	// "foo" is in slot 12182, which routes it to the first upstream, and
+	// "bar" in slot 5061, which routes it to the second one. Local replies and
+	// forwarded replies arrive in the order of the pipeline.
+	assert.Equal(t, []string{"OK", "OK", "OK", "16431:1", "from the proxy", "16432:2", "16431:3", ""},
+		roundTrip(
+			[]string{"SET", "foo", "1"},
+			[]string{"SET", "bar", "2"},
+			[]string{"SET", "foo:x", "3"},
+			[]string{"GET", "foo"},
+			[]string{"HELLO"},
+			[]string{"GET", "bar"},
+			[]string{"GETX", "foo"},
+			[]string{"GET", "baz"},
+		))
+	assert.Equal(t, []string{"ERR unknown command 'FOO'", "ERR command 'multi' is not supported by the proxy"},
+		roundTrip([]string{"FOO"}, []string{"MULTI"}))
+
+	// Concurrent clients share the upstream connections.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := "key" + strconv.Itoa(i)
+			reply, err := p.Do(command("SET", key, strconv.Itoa(i)))
+			assert.NoError(t, err)
+			assert.Equal(t, "+OK\r\n", string(reply))
+			reply, err = p.Do(command("GET", key))
+			assert.NoError(t, err)
+			assert.True(t, strings.HasSuffix(string(reply), ":"+strconv.Itoa(i)+"\r\n"), string(reply))
+		}(i)
+	}
+	wg.Wait()
+
+	// The client closes first, which leaves the ports of the servers free for
+	// the next run.
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, rh.Close())
+	select {
+	case err := <-serverErr:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Error("Server did not stop within timeout")
+	}
+	assert.NoError(t, p.Close())
+	for _, upstream := range upstreams {
+		assert.NoError(t, upstream.Close())
+	}
+}
@@ -0,0 +1,313 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// call is a command forwarded to an upstream, waiting for its reply.
+type call struct {
+	reply []byte // Complete RESP reply, owned by the call
+	err   error
+	done  chan struct{}
+}
+
+func newCall() *call {
+	return &call{done: make(chan struct{})}
+}
+
+// finish completes the call with its reply or an error.
+func (c *call) finish(reply []byte, err error) {
+	c.reply, c.err = reply, err
+	close(c.done)
+}
+
+// wait blocks until the call is complete and returns its reply.
+func (c *call) wait() ([]byte, error) {
+	<-c.done
+	return c.reply, c.err
+}
+
+// upstream is one connection to an upstream server, shared by all the clients
+// routed to it. Commands are queued by send without blocking, and written in
+// batches by the writer goroutine once flush is called, so that the commands
+// pipelined by a client and those of concurrent clients are written together;
+// the reader goroutine of the session matches the replies to the calls in
+// order.
+type upstream struct {
+	addr string
+	opts *Options
+
+	mu     sync.Mutex
+	buf    []byte  // Encoded commands waiting to be written
+	calls  []*call // Calls of the commands in buf
+	closed bool
+
+	queued atomic.Bool // Whether commands were queued since the last flush
+
+	wake    chan struct{}
+	done    chan struct{} // Closed by close
+	stopped chan struct{} // Closed by the writer once it has closed the session
+}
+
+func newUpstream(addr string, opts *Options) *upstream {
+	u := &upstream{
+		addr:    addr,
+		opts:    opts,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go u.writer()
+	return u
+}
+
+// send queues cmd to be forwarded by the next flush and returns its call.
+func (u *upstream) send(cmd resp.Command) *call {
+	c := newCall()
+	u.mu.Lock()
+	if u.closed {
+		u.mu.Unlock()
+		c.finish(nil, ErrClosed)
+		return c
+	}
+	u.buf = appendCommand(u.buf, cmd.Args)
+	u.calls = append(u.calls, c)
+	u.mu.Unlock()
+	u.queued.Store(true)
+	return c
+}
+
+// flush wakes the writer if commands were queued since the last flush.
+func (u *upstream) flush() {
+	if !u.queued.Swap(false) {
+		return
+	}
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+}
+
+// close fails the queued calls and stops the writer, and waits for it to close
+// the session.
+func (u *upstream) close() {
+	u.mu.Lock()
+	if u.closed {
+		u.mu.Unlock()
+		<-u.stopped
+		return
+	}
+	u.closed = true
+	calls := u.calls
+	u.buf, u.calls = nil, nil
+	u.mu.Unlock()
+	for _, c := range calls {
+		c.finish(nil, ErrClosed)
+	}
+	close(u.done)
+	<-u.stopped
+}
+
+// writer writes the queued commands, dialing the upstream when there is no
+// healthy session.
+func (u *upstream) writer() {
+	defer close(u.stopped)
+	var s *session
+	var spare []byte
+	for {
+		select {
+		case <-u.wake:
+		case <-u.done:
+			if s != nil {
+				s.fail(ErrClosed)
+			}
+			return
+		}
+
+		u.mu.Lock()
+		buf, calls := u.buf, u.calls
+		u.buf, u.calls = spare[:0], nil
+		u.mu.Unlock()
+		if len(calls) == 0 {
+			spare = buf
+			continue
+		}
+
+		if s == nil || s.failed() {
+			var err error
+			if s, err = u.dial(); err != nil {
+				err = &UpstreamError{Addr: u.addr, Err: err}
+				for _, c := range calls {
+					c.finish(nil, err)
+				}
+				spare = buf
+				continue
+			}
+		}
+		// The calls are queued before their commands are written, so that the
+		// reader always finds the call of a reply.
+		if s.push(calls) {
+			_ = s.conn.SetWriteDeadline(time.Now().Add(u.opts.Timeout))
+			if _, err := s.conn.Write(buf); err != nil {
+				s.fail(err)
+			}
+		}
+		spare = buf
+	}
+}
+
+// dial connects to the upstream, authenticates and selects the database, and
+// starts the reader of the new session.
+func (u *upstream) dial() (*session, error) {
+	conn, err := net.DialTimeout("tcp", u.addr, u.opts.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	var setup [][][]byte
+	if u.opts.Password != "" {
+		if u.opts.Username != "" {
+			setup = append(setup, [][]byte{[]byte("AUTH"), []byte(u.opts.Username), []byte(u.opts.Password)})
+		} else {
+			setup = append(setup, [][]byte{[]byte("AUTH"), []byte(u.opts.Password)})
+		}
+	}
+	if u.opts.DB != 0 {
+		setup = append(setup, [][]byte{[]byte("SELECT"), []byte(strconv.Itoa(u.opts.DB))})
+	}
+
+	r := resp.NewReader(conn)
+	if len(setup) > 0 {
+		_ = conn.SetDeadline(time.Now().Add(u.opts.Timeout))
+		var b []byte
+		for _, args := range setup {
+			b = appendCommand(b, args)
+		}
+		if _, err := conn.Write(b); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		for range setup {
+			v, err := r.ReadValue()
+			if err == nil && v.Type == resp.Error {
+				err = resp.ParseError(string(v.Data))
+			}
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		_ = conn.SetDeadline(time.Time{})
+	}
+
+	s := &session{conn: conn, addr: u.addr, timeout: u.opts.Timeout}
+	go s.reader(r)
+	return s, nil
+}
+
+// session is an established connection to an upstream. While replies are
+// pending, the connection has a read deadline, extended by each reply; it has
+// none while idle.
+type session struct {
+	conn    net.Conn
+	addr    string
+	timeout time.Duration // Options.Timeout
+
+	mu      sync.Mutex
+	pending []*call // Calls written and waiting for their replies, in order
+	err     error   // Why the session failed, if it did
+}
+
+// push queues calls for their replies. It reports false, after failing the
+// calls, if the session has failed.
+func (s *session) push(calls []*call) bool {
+	s.mu.Lock()
+	err := s.err
+	if err == nil {
+		if len(s.pending) == 0 {
+			_ = s.conn.SetReadDeadline(time.Now().Add(s.timeout))
+		}
+		s.pending = append(s.pending, calls...)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		for _, c := range calls {
+			c.finish(nil, err)
+		}
+		return false
+	}
+	return true
+}
+
+// failed reports whether the session has failed.
+func (s *session) failed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err != nil
+}
+
+// fail closes the session and fails its pending calls.
+func (s *session) fail(err error) {
+	if err != ErrClosed {
+		err = &UpstreamError{Addr: s.addr, Err: err}
+	}
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	pending := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	_ = s.conn.Close()
+	for _, c := range pending {
+		c.finish(nil, err)
+	}
+}
+
+// reader completes the pending calls with the replies of the upstream.
+func (s *session) reader(r *resp.Reader) {
+	for {
+		v, err := r.ReadValue()
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		s.mu.Lock()
+		if len(s.pending) == 0 {
+			s.mu.Unlock()
+			s.fail(errUnexpectedReply)
+			return
+		}
+		c := s.pending[0]
+		s.pending[0] = nil
+		s.pending = s.pending[1:]
+		if len(s.pending) == 0 {
+			_ = s.conn.SetReadDeadline(time.Time{})
+		} else {
+			_ = s.conn.SetReadDeadline(time.Now().Add(s.timeout))
+		}
+		s.mu.Unlock()
+		c.finish(append([]byte(nil), v.Raw...), nil)
+	}
+}
+
+// errUnexpectedReply is the error of a session that received a reply without
+// having sent a command.
+var errUnexpectedReply = errors.New("unexpected reply")
+
+// appendCommand appends args to b as a RESP array of bulk strings.
+func appendCommand(b []byte, args [][]byte) []byte {
+	b = resp.AppendArray(b, len(args))
+	for _, arg := range args {
+		b = resp.AppendBulk(b, arg)
+	}
+	return b
+}
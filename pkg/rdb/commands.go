@@ -0,0 +1,157 @@
+package rdb
+
+import (
+	"strconv"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// commandItems is the most elements that Commands puts in one command, like
+// the AOF rewrite of Redis, so that large keys do not make huge commands.
+const commandItems = 64
+
+// CommandFunc receives the commands that recreate the content of an RDB file,
+// with the database they apply to.
+type CommandFunc func(db int, cmd resp.Command) error
+
+// Commands returns a Visitor that converts the keys of an RDB file to the
+// commands that recreate them, the way Redis rewrites its AOF, and calls fn
+// for each command:
+//
+//   - strings with SET
+//   - lists with RPUSH, sets with SADD, sorted sets with ZADD and hashes with
+//     HSET, with up to 64 elements per command
+//   - streams with XADD, XSETID, XGROUP CREATE, XGROUP CREATECONSUMER and
+//     XCLAIM for the pending entries of their consumer groups
+//   - expiries with PEXPIREAT
+//   - functions with FUNCTION LOAD
+//
+// Auxiliary fields are ignored. The commands are in the Redis kind, with Raw
+// set to their RESP encoding.
+func Commands(fn CommandFunc) Visitor {
+	return commandVisitor{fn: fn}
+}
+
+type commandVisitor struct {
+	fn CommandFunc
+}
+
+// emit calls fn for the command made of args.
+func (v commandVisitor) emit(db int, args ...[]byte) error {
+	raw := resp.AppendArray(nil, len(args))
+	for _, arg := range args {
+		raw = resp.AppendBulk(raw, arg)
+	}
+	return v.fn(db, resp.Command{Raw: raw, Args: args, Kind: resp.Redis})
+}
+
+// emitItems emits the commands name key items..., with up to commandItems
+// items, of width arguments each, per command, then the expiry of key.
+func (v commandVisitor) emitItems(name string, key Key, width int, items [][]byte) error {
+	for i := 0; i < len(items); i += commandItems * width {
+		chunk := items[i:min(i+commandItems*width, len(items))]
+		args := make([][]byte, 0, 2+len(chunk))
+		args = append(args, []byte(name), key.Name)
+		if err := v.emit(key.DB, append(args, chunk...)...); err != nil {
+			return err
+		}
+	}
+	return v.expire(key)
+}
+
+func (v commandVisitor) expire(key Key) error {
+	if key.Expiry == 0 {
+		return nil
+	}
+	return v.emit(key.DB, []byte("PEXPIREAT"), key.Name, strconv.AppendInt(nil, key.Expiry, 10))
+}
+
+func (v commandVisitor) Aux(key, value []byte) error {
+	return nil
+}
+
+func (v commandVisitor) Function(code []byte) error {
+	return v.emit(0, []byte("FUNCTION"), []byte("LOAD"), code)
+}
+
+func (v commandVisitor) String(key Key, value []byte) error {
+	if err := v.emit(key.DB, []byte("SET"), key.Name, value); err != nil {
+		return err
+	}
+	return v.expire(key)
+}
+
+func (v commandVisitor) List(key Key, elems [][]byte) error {
+	return v.emitItems("RPUSH", key, 1, elems)
+}
+
+func (v commandVisitor) Set(key Key, members [][]byte) error {
+	return v.emitItems("SADD", key, 1, members)
+}
+
+func (v commandVisitor) SortedSet(key Key, members []ZMember) error {
+	items := make([][]byte, 0, 2*len(members))
+	for _, m := range members {
+		items = append(items, appendScore(nil, m.Score), m.Member)
+	}
+	return v.emitItems("ZADD", key, 2, items)
+}
+
+func (v commandVisitor) Hash(key Key, fields []HashField) error {
+	items := make([][]byte, 0, 2*len(fields))
+	for _, f := range fields {
+		items = append(items, f.Field, f.Value)
+	}
+	return v.emitItems("HSET", key, 2, items)
+}
+
+func (v commandVisitor) Stream(key Key, s *Stream) error {
+	id := func(id StreamID) []byte {
+		return []byte(id.String())
+	}
+	db := key.DB
+	if len(s.Entries) == 0 {
+		// XADD creates the stream, which MAXLEN 0 then empties.
+		if err := v.emit(db, []byte("XADD"), key.Name, []byte("MAXLEN"), []byte("0"),
+			id(s.LastID), []byte("x"), []byte("y")); err != nil {
+			return err
+		}
+	}
+	for _, e := range s.Entries {
+		args := append([][]byte{[]byte("XADD"), key.Name, id(e.ID)}, e.Fields...)
+		if err := v.emit(db, args...); err != nil {
+			return err
+		}
+	}
+	if err := v.emit(db, []byte("XSETID"), key.Name, id(s.LastID),
+		[]byte("ENTRIESADDED"), strconv.AppendUint(nil, s.EntriesAdded, 10),
+		[]byte("MAXDELETEDID"), id(s.MaxDeletedID)); err != nil {
+		return err
+	}
+
+	for _, g := range s.Groups {
+		if err := v.emit(db, []byte("XGROUP"), []byte("CREATE"), key.Name, g.Name, id(g.LastID),
+			[]byte("ENTRIESREAD"), strconv.AppendInt(nil, g.EntriesRead, 10)); err != nil {
+			return err
+		}
+		pending := make(map[StreamID]StreamPending, len(g.Pending))
+		for _, p := range g.Pending {
+			pending[p.ID] = p
+		}
+		for _, c := range g.Consumers {
+			if err := v.emit(db, []byte("XGROUP"), []byte("CREATECONSUMER"), key.Name, g.Name, c.Name); err != nil {
+				return err
+			}
+			for _, pid := range c.Pending {
+				p := pending[pid]
+				if err := v.emit(db, []byte("XCLAIM"), key.Name, g.Name, c.Name, []byte("0"), id(pid),
+					[]byte("TIME"), strconv.AppendInt(nil, p.DeliveryTime, 10),
+					[]byte("RETRYCOUNT"), strconv.AppendUint(nil, p.DeliveryCount, 10),
+					[]byte("JUSTID"), []byte("FORCE")); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return v.expire(key)
+}
@@ -0,0 +1,69 @@
+package rdb
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommands(t *testing.T) {
+	var members [][]byte
+	for i := 0; i < 100; i++ {
+		members = append(members, []byte("m"+strconv.Itoa(i)))
+	}
+	b := encodeAll(t, EncoderOptions{}, func(e *Encoder) {
+		require.NoError(t, e.Aux([]byte("redis-ver"), []byte("7.2.0")))
+		require.NoError(t, e.String(Key{Name: []byte("foo"), Expiry: 1900000000000}, []byte("bar")))
+		require.NoError(t, e.List(Key{Name: []byte("list"), DB: 1}, [][]byte{[]byte("a"), []byte("b")}))
+		require.NoError(t, e.Set(Key{Name: []byte("set"), DB: 1}, members))
+		require.NoError(t, e.SortedSet(Key{Name: []byte("zset"), DB: 1}, []ZMember{{Member: []byte("a"), Score: 1.5}}))
+		require.NoError(t, e.Hash(Key{Name: []byte("hash"), DB: 1}, []HashField{{Field: []byte("f"), Value: []byte("v")}}))
+		require.NoError(t, e.Stream(Key{Name: []byte("s"), DB: 1}, &Stream{
+			Entries:      []StreamEntry{{ID: StreamID{Ms: 1, Seq: 0}, Fields: [][]byte{[]byte("k"), []byte("v")}}},
+			Length:       1,
+			LastID:       StreamID{Ms: 1, Seq: 0},
+			EntriesAdded: 1,
+			Groups: []StreamGroup{{
+				Name:        []byte("g"),
+				LastID:      StreamID{Ms: 1, Seq: 0},
+				EntriesRead: 1,
+				Pending:     []StreamPending{{ID: StreamID{Ms: 1, Seq: 0}, DeliveryTime: 1000, DeliveryCount: 1}},
+				Consumers:   []StreamConsumer{{Name: []byte("c"), Pending: []StreamID{{Ms: 1, Seq: 0}}}},
+			}},
+		}))
+	})
+
+	var cmds []string
+	err := Decode(bytes.NewReader(b), Commands(func(db int, cmd resp.Command) error {
+		args := toStrings(cmd.Args)
+		if len(args) > 6 {
+			args = append(args[:6], "...")
+		}
+		cmds = append(cmds, strconv.Itoa(db)+" "+strings.Join(args, " "))
+
+		parsed, _, err := resp.ReadCommand(cmd.Raw, nil)
+		require.NoError(t, err)
+		assert.Equal(t, cmd.Args, parsed.Args)
+		return nil
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"0 SET foo bar",
+		"0 PEXPIREAT foo 1900000000000",
+		"1 RPUSH list a b",
+		"1 SADD set m0 m1 m2 m3 ...",
+		"1 SADD set m64 m65 m66 m67 ...",
+		"1 ZADD zset 1.5 a",
+		"1 HSET hash f v",
+		"1 XADD s 1-0 k v",
+		"1 XSETID s 1-0 ENTRIESADDED 1 MAXDELETEDID ...",
+		"1 XGROUP CREATE s g 1-0 ENTRIESREAD ...",
+		"1 XGROUP CREATECONSUMER s g c",
+		"1 XCLAIM s g c 0 1-0 ...",
+	}, cmds)
+}
@@ -0,0 +1,16 @@
+package rdb
+
+import "hash/crc64"
+
+// crcTable is the table of the CRC-64-Jones polynomial, in the reflected form
+// that hash/crc64 expects, which Redis checksums RDB files with.
+var crcTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// crcUpdate returns the Redis CRC64 of the data whose checksum is crc,
+// followed by p. The checksum of no data is 0.
+//
+// Redis starts from 0 and does not invert the result, while hash/crc64 inverts
+// both, so both ends are inverted back.
+func crcUpdate(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crcTable, p)
+}
@@ -0,0 +1,575 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Encodings of the special strings, with the two high bits of their length
+// set.
+const (
+	encInt8  = 0
+	encInt16 = 1
+	encInt32 = 2
+	encLZF   = 3
+)
+
+// Opcodes of the values of modules.
+const (
+	moduleOpEOF    = 0
+	moduleOpSInt   = 1
+	moduleOpUInt   = 2
+	moduleOpFloat  = 3
+	moduleOpDouble = 4
+	moduleOpString = 5
+)
+
+// Encodings of the nodes of a quicklist of RDB version 10 and later.
+const (
+	quicklistPlain  = 1
+	quicklistPacked = 2
+)
+
+// readChunk is the most that a decoder allocates ahead of reading a string,
+// so that a corrupted length does not exhaust the memory.
+const readChunk = 1 << 16
+
+// Decode reads an RDB file from r and calls v for its auxiliary fields,
+// functions and keys, in file order. It stops at the end of the file, after
+// checking its checksum, and reads no further from r. Decode returns the first
+// error returned by v.
+func Decode(r io.Reader, v Visitor) error {
+	d := &decoder{r: bufio.NewReader(r), v: v}
+	return d.decode()
+}
+
+type decoder struct {
+	r       *bufio.Reader
+	v       Visitor
+	version int
+	crc     uint64
+}
+
+func (d *decoder) decode() error {
+	header, err := d.read(9)
+	if err != nil {
+		return err
+	}
+	if string(header[:5]) != "REDIS" {
+		return errors.New("rdb: not an RDB file")
+	}
+	d.version, err = strconv.Atoi(string(header[5:]))
+	if err != nil || d.version < MinVersion || d.version > MaxVersion {
+		return fmt.Errorf("rdb: unsupported version %q", header[5:])
+	}
+
+	key := Key{}
+	for {
+		op, err := d.readByte()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case opAux:
+			k, err := d.readString()
+			if err != nil {
+				return err
+			}
+			value, err := d.readString()
+			if err != nil {
+				return err
+			}
+			if err := d.v.Aux(k, value); err != nil {
+				return err
+			}
+		case opModuleAux:
+			if err := d.skipModuleAux(); err != nil {
+				return err
+			}
+		case opFunction2:
+			code, err := d.readString()
+			if err != nil {
+				return err
+			}
+			if err := d.v.Function(code); err != nil {
+				return err
+			}
+		case opSelectDB:
+			db, err := d.readLen()
+			if err != nil {
+				return err
+			}
+			if db > math.MaxInt32 {
+				return fmt.Errorf("rdb: invalid database %d", db)
+			}
+			key.DB = int(db)
+		case opResizeDB:
+			if _, err := d.readLen(); err != nil {
+				return err
+			}
+			if _, err := d.readLen(); err != nil {
+				return err
+			}
+		case opExpireMs:
+			b, err := d.read(8)
+			if err != nil {
+				return err
+			}
+			key.Expiry = int64(binary.LittleEndian.Uint64(b))
+		case opExpire:
+			b, err := d.read(4)
+			if err != nil {
+				return err
+			}
+			key.Expiry = int64(int32(binary.LittleEndian.Uint32(b))) * 1000
+		case opIdle:
+			if _, err := d.readLen(); err != nil {
+				return err
+			}
+		case opFreq:
+			if _, err := d.readByte(); err != nil {
+				return err
+			}
+		case opEOF:
+			return d.checkChecksum()
+		default:
+			key.Name, err = d.readString()
+			if err != nil {
+				return err
+			}
+			if err := d.readValue(op, key); err != nil {
+				return err
+			}
+			key.Expiry = 0
+		}
+	}
+}
+
+// checkChecksum reads the checksum at the end of the file. A checksum of 0
+// means that the file was written without one.
+func (d *decoder) checkChecksum() error {
+	crc := d.crc
+	b, err := d.read(8)
+	if err != nil {
+		return err
+	}
+	if sum := binary.LittleEndian.Uint64(b); sum != 0 && sum != crc {
+		return ErrChecksum
+	}
+	return nil
+}
+
+// read reads the next n bytes.
+func (d *decoder) read(n int) ([]byte, error) {
+	b := make([]byte, 0, min(n, readChunk))
+	for len(b) < n {
+		m := min(n-len(b), readChunk)
+		if cap(b)-len(b) < m {
+			b = append(b, make([]byte, m)...)[:len(b)]
+		}
+		if _, err := io.ReadFull(d.r, b[len(b):len(b)+m]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		b = b[:len(b)+m]
+	}
+	d.crc = crcUpdate(d.crc, b)
+	return b, nil
+}
+
+func (d *decoder) readByte() (byte, error) {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	d.crc = crcUpdate(d.crc, []byte{c})
+	return c, nil
+}
+
+// readLenEnc reads a length. If the two high bits of its first byte are set,
+// it is instead the encoding of a special string, and encoded is true.
+func (d *decoder) readLenEnc() (n uint64, encoded bool, err error) {
+	c, err := d.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch c >> 6 {
+	case 0:
+		return uint64(c & 0x3F), false, nil
+	case 1:
+		c2, err := d.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(c&0x3F)<<8 | uint64(c2), false, nil
+	case 2:
+		switch c {
+		case 0x80:
+			b, err := d.read(4)
+			if err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(b)), false, nil
+		case 0x81:
+			b, err := d.read(8)
+			if err != nil {
+				return 0, false, err
+			}
+			return binary.BigEndian.Uint64(b), false, nil
+		}
+		return 0, false, fmt.Errorf("rdb: invalid length encoding 0x%02x", c)
+	default:
+		return uint64(c & 0x3F), true, nil
+	}
+}
+
+func (d *decoder) readLen() (uint64, error) {
+	n, encoded, err := d.readLenEnc()
+	if err == nil && encoded {
+		err = errors.New("rdb: unexpected string encoding")
+	}
+	return n, err
+}
+
+// readCount reads the number of elements of a collection.
+func (d *decoder) readCount() (int, error) {
+	n, err := d.readLen()
+	if err != nil {
+		return 0, err
+	}
+	if n > math.MaxInt32 {
+		return 0, fmt.Errorf("rdb: invalid length %d", n)
+	}
+	return int(n), nil
+}
+
+func (d *decoder) readString() ([]byte, error) {
+	n, encoded, err := d.readLenEnc()
+	if err != nil {
+		return nil, err
+	}
+	if !encoded {
+		if n > math.MaxInt32 {
+			return nil, fmt.Errorf("rdb: invalid string length %d", n)
+		}
+		return d.read(int(n))
+	}
+	switch n {
+	case encInt8:
+		c, err := d.readByte()
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int8(c)), 10), nil
+	case encInt16, encInt32:
+		b, err := d.read(2 << (n - 1))
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, leInt(b), 10), nil
+	case encLZF:
+		clen, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		ulen, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		if clen > math.MaxInt32 || ulen > math.MaxInt32 || ulen > clen*lzfMaxRef {
+			return nil, errLZF
+		}
+		in, err := d.read(int(clen))
+		if err != nil {
+			return nil, err
+		}
+		return lzfDecompress(in, int(ulen))
+	}
+	return nil, fmt.Errorf("rdb: invalid string encoding %d", n)
+}
+
+// readDouble reads a score of the first sorted set encoding, as a string
+// prefixed by its length, where lengths 253, 254 and 255 stand for NaN, +inf
+// and -inf.
+func (d *decoder) readDouble() (float64, error) {
+	n, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	b, err := d.read(int(n))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(b), 64)
+}
+
+func (d *decoder) readBinaryDouble() (float64, error) {
+	b, err := d.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+}
+
+// readMillis reads a Unix time in milliseconds.
+func (d *decoder) readMillis() (int64, error) {
+	b, err := d.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(b)), nil
+}
+
+// readStrings reads n strings.
+func (d *decoder) readStrings(n int) ([][]byte, error) {
+	elems := make([][]byte, 0, min(n, readChunk))
+	for i := 0; i < n; i++ {
+		s, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, s)
+	}
+	return elems, nil
+}
+
+// readEncoded reads a string holding a ziplist, listpack or intset and returns
+// its entries.
+func (d *decoder) readEncoded(entries func([]byte) ([][]byte, error)) ([][]byte, error) {
+	b, err := d.readString()
+	if err != nil {
+		return nil, err
+	}
+	return entries(b)
+}
+
+func (d *decoder) readValue(typ byte, key Key) error {
+	switch typ {
+	case typeString:
+		value, err := d.readString()
+		if err != nil {
+			return err
+		}
+		return d.v.String(key, value)
+
+	case typeList, typeSet:
+		n, err := d.readCount()
+		if err != nil {
+			return err
+		}
+		elems, err := d.readStrings(n)
+		if err != nil {
+			return err
+		}
+		if typ == typeList {
+			return d.v.List(key, elems)
+		}
+		return d.v.Set(key, elems)
+
+	case typeListZiplist:
+		elems, err := d.readEncoded(ziplistEntries)
+		if err != nil {
+			return err
+		}
+		return d.v.List(key, elems)
+
+	case typeListQuicklist, typeListQuicklist2:
+		n, err := d.readCount()
+		if err != nil {
+			return err
+		}
+		var elems [][]byte
+		for i := 0; i < n; i++ {
+			container := uint64(quicklistPacked)
+			if typ == typeListQuicklist2 {
+				if container, err = d.readLen(); err != nil {
+					return err
+				}
+			}
+			node, err := d.readString()
+			if err != nil {
+				return err
+			}
+			var entries [][]byte
+			switch {
+			case container == quicklistPlain:
+				entries = [][]byte{node}
+			case container != quicklistPacked:
+				return fmt.Errorf("rdb: invalid quicklist container %d", container)
+			case typ == typeListQuicklist2:
+				entries, err = listpackEntries(node)
+			default:
+				entries, err = ziplistEntries(node)
+			}
+			if err != nil {
+				return err
+			}
+			elems = append(elems, entries...)
+		}
+		return d.v.List(key, elems)
+
+	case typeSetIntset, typeSetListpack:
+		decode := intsetEntries
+		if typ == typeSetListpack {
+			decode = listpackEntries
+		}
+		members, err := d.readEncoded(decode)
+		if err != nil {
+			return err
+		}
+		return d.v.Set(key, members)
+
+	case typeZSet, typeZSet2:
+		n, err := d.readCount()
+		if err != nil {
+			return err
+		}
+		members := make([]ZMember, 0, min(n, readChunk))
+		for i := 0; i < n; i++ {
+			member, err := d.readString()
+			if err != nil {
+				return err
+			}
+			var score float64
+			if typ == typeZSet2 {
+				score, err = d.readBinaryDouble()
+			} else {
+				score, err = d.readDouble()
+			}
+			if err != nil {
+				return err
+			}
+			members = append(members, ZMember{Member: member, Score: score})
+		}
+		return d.v.SortedSet(key, members)
+
+	case typeZSetZiplist, typeZSetListpack:
+		decode := ziplistEntries
+		if typ == typeZSetListpack {
+			decode = listpackEntries
+		}
+		entries, err := d.readEncoded(decode)
+		if err != nil {
+			return err
+		}
+		if len(entries)%2 != 0 {
+			return errors.New("rdb: invalid sorted set")
+		}
+		members := make([]ZMember, 0, len(entries)/2)
+		for i := 0; i < len(entries); i += 2 {
+			score, err := strconv.ParseFloat(string(entries[i+1]), 64)
+			if err != nil {
+				return errors.New("rdb: invalid sorted set score")
+			}
+			members = append(members, ZMember{Member: entries[i], Score: score})
+		}
+		return d.v.SortedSet(key, members)
+
+	case typeHash:
+		n, err := d.readCount()
+		if err != nil {
+			return err
+		}
+		fields := make([]HashField, 0, min(n, readChunk))
+		for i := 0; i < n; i++ {
+			field, err := d.readString()
+			if err != nil {
+				return err
+			}
+			value, err := d.readString()
+			if err != nil {
+				return err
+			}
+			fields = append(fields, HashField{Field: field, Value: value})
+		}
+		return d.v.Hash(key, fields)
+
+	case typeHashZiplist, typeHashListpack:
+		decode := ziplistEntries
+		if typ == typeHashListpack {
+			decode = listpackEntries
+		}
+		entries, err := d.readEncoded(decode)
+		if err != nil {
+			return err
+		}
+		if len(entries)%2 != 0 {
+			return errors.New("rdb: invalid hash")
+		}
+		fields := make([]HashField, 0, len(entries)/2)
+		for i := 0; i < len(entries); i += 2 {
+			fields = append(fields, HashField{Field: entries[i], Value: entries[i+1]})
+		}
+		return d.v.Hash(key, fields)
+
+	case typeStreamListpacks, typeStreamListpacks2, typeStreamListpacks3:
+		stream, err := d.readStream(typ)
+		if err != nil {
+			return err
+		}
+		return d.v.Stream(key, stream)
+
+	case typeModule, typeModule2:
+		return errors.New("rdb: module values are not supported")
+	}
+	return fmt.Errorf("rdb: unsupported value type %d", typ)
+}
+
+// skipModuleAux skips the auxiliary data of a module: its ID, when it was
+// written, and values tagged with their type.
+func (d *decoder) skipModuleAux() error {
+	if _, err := d.readLen(); err != nil {
+		return err
+	}
+	when, err := d.readLen()
+	if err != nil {
+		return err
+	}
+	if when != moduleOpUInt {
+		return errors.New("rdb: invalid module auxiliary data")
+	}
+	if _, err := d.readLen(); err != nil {
+		return err
+	}
+	for {
+		op, err := d.readLen()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case moduleOpEOF:
+			return nil
+		case moduleOpSInt, moduleOpUInt:
+			_, err = d.readLen()
+		case moduleOpFloat:
+			_, err = d.read(4)
+		case moduleOpDouble:
+			_, err = d.read(8)
+		case moduleOpString:
+			_, err = d.readString()
+		default:
+			return errors.New("rdb: invalid module auxiliary data")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
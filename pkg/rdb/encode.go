@@ -0,0 +1,419 @@
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+)
+
+// The limits under which an Encoder writes collections in their compact
+// encodings, the defaults of the *-max-listpack-entries, *-max-listpack-value
+// and set-max-intset-entries settings of Redis.
+const (
+	compactMaxEntries = 128
+	compactMaxValue   = 64
+	intsetMaxEntries  = 512
+
+	// quicklistNodeMaxSize is the most bytes of elements that an Encoder puts
+	// in a node of a quicklist, like list-max-listpack-size -2.
+	quicklistNodeMaxSize = 8 << 10
+)
+
+// minCompressLen is the length under which strings are not worth compressing.
+const minCompressLen = 20
+
+// ErrEncoderClosed is returned by the methods of an Encoder after Close.
+var ErrEncoderClosed = errors.New("rdb: encoder closed")
+
+// EncoderOptions configures an Encoder.
+type EncoderOptions struct {
+	// Version is the RDB version to write, from MinVersion to MaxVersion. The
+	// default is Version.
+	Version int
+
+	// Compress compresses strings with LZF, like rdbcompression.
+	Compress bool
+}
+
+// Encoder writes an RDB file. It is a Visitor, whose methods write their
+// arguments: auxiliary fields, functions and keys. Keys are written in the
+// encodings that Redis would use for them, in the database of the key.
+//
+// The first error writing to the underlying writer is returned by all later
+// calls. Close must be called to finish the file.
+type Encoder struct {
+	w       *bufio.Writer
+	version int
+	opts    EncoderOptions
+	crc     uint64
+	db      int
+	started bool // Whether a key was written, and db selected
+	header  bool
+	closed  bool
+	err     error
+	buf     []byte
+}
+
+var _ Visitor = (*Encoder)(nil)
+
+// NewEncoder returns an Encoder that writes an RDB file to w, starting with
+// its header on the first call.
+func NewEncoder(w io.Writer, opts EncoderOptions) *Encoder {
+	e := &Encoder{w: bufio.NewWriter(w), version: opts.Version, opts: opts}
+	if e.version == 0 {
+		e.version = Version
+	}
+	if e.version < MinVersion || e.version > MaxVersion {
+		e.err = fmt.Errorf("rdb: unsupported version %d", e.version)
+	}
+	return e
+}
+
+// begin writes the header of the file, before the first record, and reports
+// whether the encoder can write.
+func (e *Encoder) begin() bool {
+	if e.closed && e.err == nil {
+		e.err = ErrEncoderClosed
+	}
+	if e.err != nil {
+		return false
+	}
+	if !e.header {
+		e.header = true
+		e.write(fmt.Appendf(nil, "REDIS%04d", e.version))
+	}
+	return e.err == nil
+}
+
+// beginKey begins writing a key of type typ.
+func (e *Encoder) beginKey(key Key, typ byte) bool {
+	if !e.begin() {
+		return false
+	}
+	if !e.started || key.DB != e.db {
+		e.started = true
+		e.db = key.DB
+		e.writeByte(opSelectDB)
+		e.writeLen(uint64(key.DB))
+	}
+	if key.Expiry != 0 {
+		e.writeByte(opExpireMs)
+		e.writeMillis(key.Expiry)
+	}
+	e.writeByte(typ)
+	e.writeString(key.Name)
+	return e.err == nil
+}
+
+// Aux writes an auxiliary field.
+func (e *Encoder) Aux(key, value []byte) error {
+	if e.begin() {
+		e.writeByte(opAux)
+		e.writeString(key)
+		e.writeString(value)
+	}
+	return e.err
+}
+
+// Function writes the code of a library of functions. It requires RDB version
+// 10 or later.
+func (e *Encoder) Function(code []byte) error {
+	if e.begin() {
+		if e.version < 10 {
+			return fmt.Errorf("rdb: functions require RDB version 10, not %d", e.version)
+		}
+		e.writeByte(opFunction2)
+		e.writeString(code)
+	}
+	return e.err
+}
+
+// String writes a string key.
+func (e *Encoder) String(key Key, value []byte) error {
+	if e.beginKey(key, typeString) {
+		e.writeString(value)
+	}
+	return e.err
+}
+
+// List writes a list key, as a quicklist of listpacks, or of ziplists for RDB
+// version 9.
+func (e *Encoder) List(key Key, elems [][]byte) error {
+	typ := byte(typeListQuicklist2)
+	if e.version < 10 {
+		typ = typeListQuicklist
+	}
+	if !e.beginKey(key, typ) {
+		return e.err
+	}
+	var nodes [][][]byte
+	for i := 0; i < len(elems); {
+		j, size := i, 0
+		for j < len(elems) && j-i < compactMaxEntries && (j == i || size+len(elems[j]) <= quicklistNodeMaxSize) {
+			size += len(elems[j])
+			j++
+		}
+		nodes = append(nodes, elems[i:j])
+		i = j
+	}
+	e.writeLen(uint64(len(nodes)))
+	for _, node := range nodes {
+		if typ == typeListQuicklist2 {
+			e.writeLen(quicklistPacked)
+			e.buf = appendListpack(e.buf[:0], node)
+			e.writeString(e.buf)
+		} else {
+			e.buf = appendZiplist(e.buf[:0], node)
+			e.writeString(e.buf)
+		}
+	}
+	return e.err
+}
+
+// Set writes a set key, as an intset if its members are few integers, as a
+// listpack if they are few and short and the RDB version is 11, and as a
+// plain set otherwise.
+func (e *Encoder) Set(key Key, members [][]byte) error {
+	if ints, ok := intsetMembers(members); ok {
+		if e.beginKey(key, typeSetIntset) {
+			e.buf = appendIntset(e.buf[:0], ints)
+			e.writeString(e.buf)
+		}
+		return e.err
+	}
+	if e.version >= 11 && len(members) <= compactMaxEntries && shortValues(members) {
+		if e.beginKey(key, typeSetListpack) {
+			e.buf = appendListpack(e.buf[:0], members)
+			e.writeString(e.buf)
+		}
+		return e.err
+	}
+	if e.beginKey(key, typeSet) {
+		e.writeLen(uint64(len(members)))
+		for _, m := range members {
+			e.writeString(m)
+		}
+	}
+	return e.err
+}
+
+// SortedSet writes a sorted set key, as a listpack, or a ziplist for RDB
+// version 9, if its members are few and short, and with binary scores
+// otherwise.
+func (e *Encoder) SortedSet(key Key, members []ZMember) error {
+	compact := len(members) <= compactMaxEntries
+	for i := 0; compact && i < len(members); i++ {
+		compact = len(members[i].Member) <= compactMaxValue
+	}
+	if !compact {
+		if e.beginKey(key, typeZSet2) {
+			e.writeLen(uint64(len(members)))
+			for _, m := range members {
+				e.writeString(m.Member)
+				e.writeDouble(m.Score)
+			}
+		}
+		return e.err
+	}
+
+	// Compact sorted sets are kept ordered by score, then member.
+	sorted := slices.Clone(members)
+	slices.SortStableFunc(sorted, func(a, b ZMember) int {
+		if a.Score != b.Score {
+			if a.Score < b.Score {
+				return -1
+			}
+			return 1
+		}
+		return bytes.Compare(a.Member, b.Member)
+	})
+	entries := make([][]byte, 0, 2*len(sorted))
+	for _, m := range sorted {
+		entries = append(entries, m.Member, appendScore(nil, m.Score))
+	}
+	if e.version < 10 {
+		if e.beginKey(key, typeZSetZiplist) {
+			e.buf = appendZiplist(e.buf[:0], entries)
+			e.writeString(e.buf)
+		}
+	} else if e.beginKey(key, typeZSetListpack) {
+		e.buf = appendListpack(e.buf[:0], entries)
+		e.writeString(e.buf)
+	}
+	return e.err
+}
+
+// Hash writes a hash key, as a listpack, or a ziplist for RDB version 9, if
+// its fields are few and short, and as a plain hash otherwise.
+func (e *Encoder) Hash(key Key, fields []HashField) error {
+	entries := make([][]byte, 0, 2*len(fields))
+	for _, f := range fields {
+		entries = append(entries, f.Field, f.Value)
+	}
+	if len(fields) > compactMaxEntries || !shortValues(entries) {
+		if e.beginKey(key, typeHash) {
+			e.writeLen(uint64(len(fields)))
+			for _, f := range fields {
+				e.writeString(f.Field)
+				e.writeString(f.Value)
+			}
+		}
+		return e.err
+	}
+	if e.version < 10 {
+		if e.beginKey(key, typeHashZiplist) {
+			e.buf = appendZiplist(e.buf[:0], entries)
+			e.writeString(e.buf)
+		}
+	} else if e.beginKey(key, typeHashListpack) {
+		e.buf = appendListpack(e.buf[:0], entries)
+		e.writeString(e.buf)
+	}
+	return e.err
+}
+
+// Stream writes a stream key, with listpacks of up to 100 entries.
+func (e *Encoder) Stream(key Key, stream *Stream) error {
+	typ := byte(typeStreamListpacks3)
+	switch e.version {
+	case 9:
+		typ = typeStreamListpacks
+	case 10:
+		typ = typeStreamListpacks2
+	}
+	if e.beginKey(key, typ) {
+		e.writeStream(typ, stream)
+	}
+	return e.err
+}
+
+// Close writes the end of the file and its checksum, and flushes it to the
+// underlying writer, which it does not close.
+func (e *Encoder) Close() error {
+	if e.begin() {
+		e.writeByte(opEOF)
+		e.writeMillis(int64(e.crc))
+		if e.err == nil {
+			e.err = e.w.Flush()
+		}
+	}
+	e.closed = true
+	return e.err
+}
+
+// shortValues reports whether elems are short enough for a compact encoding.
+func shortValues(elems [][]byte) bool {
+	for _, elem := range elems {
+		if len(elem) > compactMaxValue {
+			return false
+		}
+	}
+	return true
+}
+
+// appendScore appends the score f to b, the way Redis formats it, with inf and
+// -inf for infinities.
+func appendScore(b []byte, f float64) []byte {
+	switch {
+	case math.IsInf(f, 1):
+		return append(b, "inf"...)
+	case math.IsInf(f, -1):
+		return append(b, "-inf"...)
+	}
+	return strconv.AppendFloat(b, f, 'g', -1, 64)
+}
+
+// intsetMembers returns the members of a set, sorted, if they fit an intset.
+func intsetMembers(members [][]byte) ([]int64, bool) {
+	if len(members) > intsetMaxEntries {
+		return nil, false
+	}
+	ints := make([]int64, 0, len(members))
+	for _, m := range members {
+		v, ok := parseInt64(m)
+		if !ok {
+			return nil, false
+		}
+		ints = append(ints, v)
+	}
+	slices.Sort(ints)
+	return ints, true
+}
+
+func (e *Encoder) write(b []byte) {
+	if e.err != nil {
+		return
+	}
+	e.crc = crcUpdate(e.crc, b)
+	_, e.err = e.w.Write(b)
+}
+
+func (e *Encoder) writeByte(c byte) {
+	e.write([]byte{c})
+}
+
+func (e *Encoder) writeLen(n uint64) {
+	var b [9]byte
+	switch {
+	case n < 1<<6:
+		b[0] = byte(n)
+		e.write(b[:1])
+	case n < 1<<14:
+		b[0], b[1] = 0x40|byte(n>>8), byte(n)
+		e.write(b[:2])
+	case n <= math.MaxUint32:
+		b[0] = 0x80
+		binary.BigEndian.PutUint32(b[1:], uint32(n))
+		e.write(b[:5])
+	default:
+		b[0] = 0x81
+		binary.BigEndian.PutUint64(b[1:], n)
+		e.write(b[:9])
+	}
+}
+
+func (e *Encoder) writeDouble(f float64) {
+	e.writeMillis(int64(math.Float64bits(f)))
+}
+
+func (e *Encoder) writeMillis(ms int64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(ms))
+	e.write(b[:])
+}
+
+// writeString writes s as an integer if it is the canonical representation of
+// a 32 bit one, compressed if that is enabled and saves space, and as is
+// otherwise.
+func (e *Encoder) writeString(s []byte) {
+	if len(s) <= 11 {
+		if v, ok := parseInt64(s); ok && v >= math.MinInt32 && v <= math.MaxInt32 {
+			switch {
+			case v >= math.MinInt8 && v <= math.MaxInt8:
+				e.write([]byte{0xC0 | encInt8, byte(v)})
+			case v >= math.MinInt16 && v <= math.MaxInt16:
+				e.write([]byte{0xC0 | encInt16, byte(v), byte(v >> 8)})
+			default:
+				e.write(binary.LittleEndian.AppendUint32([]byte{0xC0 | encInt32}, uint32(v)))
+			}
+			return
+		}
+	}
+	if e.opts.Compress && len(s) > minCompressLen {
+		if c := lzfCompress(s); c != nil {
+			e.writeByte(0xC0 | encLZF)
+			e.writeLen(uint64(len(c)))
+			e.writeLen(uint64(len(s)))
+			e.write(c)
+			return
+		}
+	}
+	e.writeLen(uint64(len(s)))
+	e.write(s)
+}
@@ -0,0 +1,376 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+var (
+	errListpack = errors.New("rdb: invalid listpack")
+	errZiplist  = errors.New("rdb: invalid ziplist")
+	errIntset   = errors.New("rdb: invalid intset")
+)
+
+// listpackEntries returns the entries of a listpack, which Redis 7.0 and later
+// use for small lists, sets, sorted sets, hashes and the nodes of streams.
+//
+// A listpack is its total size in bytes (4 bytes) and number of entries (2
+// bytes), the entries and an 0xFF terminator. Each entry is an encoding byte,
+// which may hold a small integer or the length of a string, the data, and the
+// size of the encoding and data, so that the listpack can be walked backwards.
+func listpackEntries(lp []byte) ([][]byte, error) {
+	if len(lp) < 7 || int(binary.LittleEndian.Uint32(lp)) != len(lp) || lp[len(lp)-1] != 0xFF {
+		return nil, errListpack
+	}
+	n := int(binary.LittleEndian.Uint16(lp[4:]))
+	entries := make([][]byte, 0, n)
+	for i := 6; lp[i] != 0xFF; {
+		b := lp[i]
+		var size, hdr int
+		var entry []byte
+		switch {
+		case b&0x80 == 0: // 7 bit unsigned integer
+			size, entry = 1, strconv.AppendInt(nil, int64(b), 10)
+		case b&0xC0 == 0x80: // 6 bit length string
+			hdr, size = 1, 1+int(b&0x3F)
+		case b&0xE0 == 0xC0: // 13 bit signed integer
+			if i+2 > len(lp) {
+				return nil, errListpack
+			}
+			v := int64(b&0x1F)<<8 | int64(lp[i+1])
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			size, entry = 2, strconv.AppendInt(nil, v, 10)
+		case b&0xF0 == 0xE0: // 12 bit length string
+			if i+2 > len(lp) {
+				return nil, errListpack
+			}
+			hdr = 2
+			size = hdr + (int(b&0x0F)<<8 | int(lp[i+1]))
+		case b == 0xF0: // 32 bit length string
+			if i+5 > len(lp) {
+				return nil, errListpack
+			}
+			l := binary.LittleEndian.Uint32(lp[i+1:])
+			if uint64(l) > uint64(len(lp)) {
+				return nil, errListpack
+			}
+			hdr = 5
+			size = hdr + int(l)
+		case b >= 0xF1 && b <= 0xF4: // 16, 24, 32 and 64 bit signed integers
+			width := [...]int{2, 3, 4, 8}[b-0xF1]
+			if i+1+width > len(lp) {
+				return nil, errListpack
+			}
+			size, entry = 1+width, strconv.AppendInt(nil, leInt(lp[i+1:i+1+width]), 10)
+		default:
+			return nil, errListpack
+		}
+		end := i + size
+		if end > len(lp)-1 {
+			return nil, errListpack
+		}
+		if entry == nil {
+			entry = append([]byte{}, lp[i+hdr:end]...)
+		}
+		entries = append(entries, entry)
+		i = end + backlenSize(size)
+		if i > len(lp)-1 {
+			return nil, errListpack
+		}
+	}
+	if n != 0xFFFF && n != len(entries) {
+		return nil, errListpack
+	}
+	return entries, nil
+}
+
+// leInt returns the little-endian signed integer b, of 1 to 8 bytes.
+func leInt(b []byte) int64 {
+	var u uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		u = u<<8 | uint64(b[i])
+	}
+	shift := 64 - 8*uint(len(b))
+	return int64(u<<shift) >> shift
+}
+
+// backlenSize returns the number of bytes that the back length of a listpack
+// entry of size bytes takes.
+func backlenSize(size int) int {
+	switch {
+	case size <= 127:
+		return 1
+	case size < 16383:
+		return 2
+	case size < 2097151:
+		return 3
+	case size < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// appendListpack appends a listpack of entries to b.
+func appendListpack(b []byte, entries [][]byte) []byte {
+	start := len(b)
+	b = append(b, 0, 0, 0, 0, 0, 0)
+	for _, e := range entries {
+		b = appendListpackEntry(b, e)
+	}
+	b = append(b, 0xFF)
+	binary.LittleEndian.PutUint32(b[start:], uint32(len(b)-start))
+	n := len(entries)
+	if n > 0xFFFF {
+		n = 0xFFFF // Unknown, the entries have to be counted
+	}
+	binary.LittleEndian.PutUint16(b[start+4:], uint16(n))
+	return b
+}
+
+// appendListpackEntry appends the listpack entry e to b, as an integer if it
+// is the canonical representation of one.
+func appendListpackEntry(b []byte, e []byte) []byte {
+	start := len(b)
+	if v, ok := parseInt64(e); ok {
+		switch {
+		case v >= 0 && v <= 127:
+			b = append(b, byte(v))
+		case v >= -4096 && v <= 4095:
+			u := uint64(v) & 0x1FFF
+			b = append(b, 0xC0|byte(u>>8), byte(u))
+		case v >= -1<<15 && v < 1<<15:
+			b = append(b, 0xF1, byte(v), byte(v>>8))
+		case v >= -1<<23 && v < 1<<23:
+			b = append(b, 0xF2, byte(v), byte(v>>8), byte(v>>16))
+		case v >= -1<<31 && v < 1<<31:
+			b = append(b, 0xF3)
+			b = binary.LittleEndian.AppendUint32(b, uint32(v))
+		default:
+			b = append(b, 0xF4)
+			b = binary.LittleEndian.AppendUint64(b, uint64(v))
+		}
+	} else {
+		switch l := len(e); {
+		case l < 64:
+			b = append(b, 0x80|byte(l))
+		case l < 4096:
+			b = append(b, 0xE0|byte(l>>8), byte(l))
+		default:
+			b = append(b, 0xF0)
+			b = binary.LittleEndian.AppendUint32(b, uint32(l))
+		}
+		b = append(b, e...)
+	}
+	return appendBacklen(b, len(b)-start)
+}
+
+// appendBacklen appends the back length of a listpack entry of size bytes to
+// b: 7 bits per byte, most significant first, with the high bit set on all
+// bytes but the first.
+func appendBacklen(b []byte, size int) []byte {
+	n := backlenSize(size)
+	for i := n - 1; i >= 0; i-- {
+		c := byte(size>>(7*uint(i))) & 0x7F
+		if i != n-1 {
+			c |= 0x80
+		}
+		b = append(b, c)
+	}
+	return b
+}
+
+// ziplistEntries returns the entries of a ziplist, which RDB version 9 uses
+// for small lists, sorted sets and hashes.
+//
+// A ziplist is its total size in bytes (4 bytes), the offset of its last entry
+// (4 bytes) and number of entries (2 bytes), the entries and an 0xFF
+// terminator. Each entry is the size of the previous entry, an encoding, which
+// may hold a small integer or the length of a string, and the data.
+func ziplistEntries(zl []byte) ([][]byte, error) {
+	if len(zl) < 11 || int(binary.LittleEndian.Uint32(zl)) != len(zl) || zl[len(zl)-1] != 0xFF {
+		return nil, errZiplist
+	}
+	n := int(binary.LittleEndian.Uint16(zl[8:]))
+	entries := make([][]byte, 0, n)
+	for i := 10; zl[i] != 0xFF; {
+		if zl[i] == 0xFE {
+			i += 5
+		} else {
+			i++
+		}
+		if i >= len(zl)-1 {
+			return nil, errZiplist
+		}
+		b := zl[i]
+		var l, hdr int
+		var entry []byte
+		switch {
+		case b>>6 == 0:
+			hdr, l = 1, int(b&0x3F)
+		case b>>6 == 1:
+			if i+2 > len(zl) {
+				return nil, errZiplist
+			}
+			hdr, l = 2, int(b&0x3F)<<8|int(zl[i+1])
+		case b == 0x80:
+			if i+5 > len(zl) {
+				return nil, errZiplist
+			}
+			u := binary.BigEndian.Uint32(zl[i+1:])
+			if uint64(u) > uint64(len(zl)) {
+				return nil, errZiplist
+			}
+			hdr, l = 5, int(u)
+		case b == 0xC0, b == 0xD0, b == 0xE0, b == 0xF0, b == 0xFE:
+			width := ziplistIntWidth(b)
+			if i+1+width > len(zl) {
+				return nil, errZiplist
+			}
+			hdr, entry = 1+width, strconv.AppendInt(nil, leInt(zl[i+1:i+1+width]), 10)
+		case b >= 0xF1 && b <= 0xFD: // 4 bit immediate integer, from 0 to 12
+			hdr, entry = 1, strconv.AppendInt(nil, int64(b&0x0F)-1, 10)
+		default:
+			return nil, errZiplist
+		}
+		end := i + hdr + l
+		if end > len(zl)-1 {
+			return nil, errZiplist
+		}
+		if entry == nil {
+			entry = append([]byte{}, zl[i+hdr:end]...)
+		}
+		entries = append(entries, entry)
+		i = end
+	}
+	if n != 0xFFFF && n != len(entries) {
+		return nil, errZiplist
+	}
+	return entries, nil
+}
+
+// ziplistIntWidth returns the size of the integer of the ziplist encoding b.
+func ziplistIntWidth(b byte) int {
+	switch b {
+	case 0xC0:
+		return 2
+	case 0xD0:
+		return 4
+	case 0xE0:
+		return 8
+	case 0xF0:
+		return 3
+	default:
+		return 1
+	}
+}
+
+// appendZiplist appends a ziplist of entries to b.
+func appendZiplist(b []byte, entries [][]byte) []byte {
+	start := len(b)
+	b = append(b, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	prev, tail := 0, 10
+	for _, e := range entries {
+		tail = len(b) - start
+		entryStart := len(b)
+		if prev < 254 {
+			b = append(b, byte(prev))
+		} else {
+			b = append(b, 0xFE)
+			b = binary.LittleEndian.AppendUint32(b, uint32(prev))
+		}
+		if v, ok := parseInt64(e); ok {
+			switch {
+			case v >= 0 && v <= 12:
+				b = append(b, 0xF1+byte(v))
+			case v >= -1<<7 && v < 1<<7:
+				b = append(b, 0xFE, byte(v))
+			case v >= -1<<15 && v < 1<<15:
+				b = append(b, 0xC0, byte(v), byte(v>>8))
+			case v >= -1<<23 && v < 1<<23:
+				b = append(b, 0xF0, byte(v), byte(v>>8), byte(v>>16))
+			case v >= -1<<31 && v < 1<<31:
+				b = append(b, 0xD0)
+				b = binary.LittleEndian.AppendUint32(b, uint32(v))
+			default:
+				b = append(b, 0xE0)
+				b = binary.LittleEndian.AppendUint64(b, uint64(v))
+			}
+		} else {
+			switch l := len(e); {
+			case l < 64:
+				b = append(b, byte(l))
+			case l < 16384:
+				b = append(b, 0x40|byte(l>>8), byte(l))
+			default:
+				b = append(b, 0x80)
+				b = binary.BigEndian.AppendUint32(b, uint32(l))
+			}
+			b = append(b, e...)
+		}
+		prev = len(b) - entryStart
+	}
+	b = append(b, 0xFF)
+	binary.LittleEndian.PutUint32(b[start:], uint32(len(b)-start))
+	binary.LittleEndian.PutUint32(b[start+4:], uint32(tail))
+	n := len(entries)
+	if n > 0xFFFF {
+		n = 0xFFFF
+	}
+	binary.LittleEndian.PutUint16(b[start+8:], uint16(n))
+	return b
+}
+
+// intsetEntries returns the members of an intset, a sorted array of integers
+// of 2, 4 or 8 bytes, which Redis uses for small sets of integers.
+func intsetEntries(is []byte) ([][]byte, error) {
+	if len(is) < 8 {
+		return nil, errIntset
+	}
+	width := int(binary.LittleEndian.Uint32(is))
+	n := uint64(binary.LittleEndian.Uint32(is[4:]))
+	if (width != 2 && width != 4 && width != 8) || uint64(len(is)-8) != n*uint64(width) {
+		return nil, errIntset
+	}
+	entries := make([][]byte, 0, n)
+	for i := 8; i < len(is); i += width {
+		entries = append(entries, strconv.AppendInt(nil, leInt(is[i:i+width]), 10))
+	}
+	return entries, nil
+}
+
+// appendIntset appends an intset of the sorted integers vs to b.
+func appendIntset(b []byte, vs []int64) []byte {
+	width := 2
+	for _, v := range vs {
+		if v < -1<<31 || v >= 1<<31 {
+			width = 8
+			break
+		}
+		if v < -1<<15 || v >= 1<<15 {
+			width = 4
+		}
+	}
+	b = binary.LittleEndian.AppendUint32(b, uint32(width))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(vs)))
+	for _, v := range vs {
+		for i := 0; i < width; i++ {
+			b = append(b, byte(v>>(8*uint(i))))
+		}
+	}
+	return b
+}
+
+// parseInt64 parses b as an integer if b is its canonical decimal
+// representation, so that formatting the integer gives b back, the way Redis
+// decides to encode strings as integers.
+func parseInt64(b []byte) (int64, bool) {
+	if len(b) == 0 || len(b) > 20 || (b[0] == '0' && len(b) > 1) || (b[0] == '-' && (len(b) == 1 || b[1] == '0')) {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(string(b), 10, 64)
+	return v, err == nil
+}
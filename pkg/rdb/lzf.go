@@ -0,0 +1,153 @@
+package rdb
+
+import "errors"
+
+var errLZF = errors.New("rdb: invalid LZF data")
+
+// lzfDecompress decompresses the LZF data in into a buffer of n bytes, the
+// length of the uncompressed data.
+//
+// LZF data is a sequence of literal runs and back references. A control byte
+// below 32 starts a run of that many plus one literal bytes. Otherwise, its top
+// 3 bits are the length of a back reference minus 2, or 7 when an extra length
+// byte follows, and its low 5 bits with the next byte are the distance back
+// minus one.
+func lzfDecompress(in []byte, n int) ([]byte, error) {
+	out := make([]byte, 0, n)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 1<<5 {
+			ctrl++
+			if i+ctrl > len(in) || len(out)+ctrl > n {
+				return nil, errLZF
+			}
+			out = append(out, in[i:i+ctrl]...)
+			i += ctrl
+			continue
+		}
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(in) {
+				return nil, errLZF
+			}
+			length += int(in[i])
+			i++
+		}
+		length += 2
+		if i >= len(in) {
+			return nil, errLZF
+		}
+		ref := len(out) - ((ctrl&0x1f)<<8 | int(in[i])) - 1
+		i++
+		if ref < 0 || len(out)+length > n {
+			return nil, errLZF
+		}
+		// The reference may overlap the bytes it produces.
+		for j := 0; j < length; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != n {
+		return nil, errLZF
+	}
+	return out, nil
+}
+
+const (
+	lzfHashLog  = 14
+	lzfMaxLit   = 1 << 5
+	lzfMaxOff   = 1 << 13
+	lzfMaxRef   = (1 << 8) + (1 << 3)
+	lzfHashSize = 1 << lzfHashLog
+)
+
+// lzfCompress compresses in with LZF, the way Redis does. It returns nil if the
+// compressed data would not be shorter than in.
+func lzfCompress(in []byte) []byte {
+	if len(in) < 4 {
+		return nil
+	}
+	var table [lzfHashSize]int32 // Last position+1 of each 3-byte hash
+	hash := func(i int) int {
+		v := uint32(in[i])<<16 | uint32(in[i+1])<<8 | uint32(in[i+2])
+		return int((v * 2654435761) >> (32 - lzfHashLog))
+	}
+	out := make([]byte, 0, len(in))
+	lit := 0 // Length of the pending literal run
+	out = append(out, 0)
+	flushLit := func() {
+		// Terminates the literal run, whose control byte is at len-lit-1.
+		out[len(out)-lit-1] = byte(lit - 1)
+	}
+
+	i := 0
+	for i+2 < len(in) {
+		h := hash(i)
+		ref := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		off := i - ref - 1
+		if ref >= 0 && off < lzfMaxOff && in[ref] == in[i] && in[ref+1] == in[i+1] && in[ref+2] == in[i+2] {
+			length := 3
+			maxLen := len(in) - i
+			if maxLen > lzfMaxRef {
+				maxLen = lzfMaxRef
+			}
+			for length < maxLen && in[ref+length] == in[i+length] {
+				length++
+			}
+			if lit > 0 {
+				flushLit()
+			} else {
+				out = out[:len(out)-1] // No literal run before the reference
+			}
+			l := length - 2
+			if l < 7 {
+				out = append(out, byte(off>>8)|byte(l<<5))
+			} else {
+				out = append(out, byte(off>>8)|7<<5, byte(l-7))
+			}
+			out = append(out, byte(off))
+			if len(out) >= len(in) {
+				return nil
+			}
+			// Start the next literal run.
+			out = append(out, 0)
+			lit = 0
+			for j := i + 1; j < i+length && j+2 < len(in); j++ {
+				table[hash(j)] = int32(j + 1)
+			}
+			i += length
+			continue
+		}
+		out = append(out, in[i])
+		lit++
+		i++
+		if lit == lzfMaxLit {
+			flushLit()
+			out = append(out, 0)
+			lit = 0
+		}
+		if len(out) >= len(in) {
+			return nil
+		}
+	}
+	for ; i < len(in); i++ {
+		out = append(out, in[i])
+		lit++
+		if lit == lzfMaxLit {
+			flushLit()
+			out = append(out, 0)
+			lit = 0
+		}
+	}
+	if lit > 0 {
+		flushLit()
+	} else {
+		out = out[:len(out)-1]
+	}
+	if len(out) >= len(in) {
+		return nil
+	}
+	return out
+}
@@ -0,0 +1,236 @@
+// Package rdb reads and writes RDB files, the snapshot format of Redis, which
+// servers persist their dataset with and send to their replicas for a full
+// resynchronization.
+//
+// The package supports RDB versions 9 to 11, written by Redis 5.0 to 7.2:
+// strings, lists, sets, sorted sets, hashes and streams, in their plain
+// encodings and in the compact ones (listpack, ziplist, intset, quicklist),
+// with expiries, LZF compressed strings, auxiliary fields, functions and the
+// CRC64 checksum. Module values are not supported.
+//
+// Both directions are streams of keys. Decode reads a file and calls a Visitor
+// for each key, without loading the whole dataset in memory, and an Encoder
+// writes keys one at a time. An Encoder is itself a Visitor, so decoding into
+// an encoder converts a file to another version:
+//
+//	f, err := os.Open("dump.rdb")
+//	if err != nil {
+//	    return err
+//	}
+//	defer f.Close()
+//	err = rdb.Decode(f, rdb.Commands(func(db int, cmd resp.Command) error {
+//	    _, _ = handler(cmd, nil) // SET, RPUSH, SADD, ZADD, HSET, XADD, PEXPIREAT...
+//	    return nil
+//	}))
+//
+// and:
+//
+//	enc := rdb.NewEncoder(w, rdb.EncoderOptions{Compress: true})
+//	_ = enc.Aux([]byte("redis-ver"), []byte("7.2.0"))
+//	_ = enc.String(rdb.Key{Name: []byte("foo")}, []byte("bar"))
+//	_ = enc.Hash(rdb.Key{Name: []byte("user:1"), Expiry: expiry}, []rdb.HashField{
+//	    {Field: []byte("name"), Value: []byte("Ada")},
+//	})
+//	err := enc.Close() // writes the end of the file and its checksum
+package rdb
+
+import (
+	"errors"
+	"strconv"
+)
+
+const (
+	// MinVersion and MaxVersion are the RDB versions that the package supports.
+	MinVersion = 9
+	MaxVersion = 11
+
+	// Version is the default RDB version of an Encoder, the version of Redis 7.2.
+	Version = MaxVersion
+)
+
+// Opcodes of the RDB format.
+const (
+	opFunction2 = 0xF5
+	opModuleAux = 0xF7
+	opIdle      = 0xF8
+	opFreq      = 0xF9
+	opAux       = 0xFA
+	opResizeDB  = 0xFB
+	opExpireMs  = 0xFC
+	opExpire    = 0xFD
+	opSelectDB  = 0xFE
+	opEOF       = 0xFF
+)
+
+// Value types of the RDB format.
+const (
+	typeString           = 0
+	typeList             = 1
+	typeSet              = 2
+	typeZSet             = 3
+	typeHash             = 4
+	typeZSet2            = 5
+	typeModule           = 6
+	typeModule2          = 7
+	typeHashZipmap       = 9
+	typeListZiplist      = 10
+	typeSetIntset        = 11
+	typeZSetZiplist      = 12
+	typeHashZiplist      = 13
+	typeListQuicklist    = 14
+	typeStreamListpacks  = 15
+	typeHashListpack     = 16
+	typeZSetListpack     = 17
+	typeListQuicklist2   = 18
+	typeStreamListpacks2 = 19
+	typeSetListpack      = 20
+	typeStreamListpacks3 = 21
+)
+
+// ErrChecksum is returned by Decode when the CRC64 checksum at the end of a
+// file does not match its content.
+var ErrChecksum = errors.New("rdb: checksum mismatch")
+
+// Key identifies a key and its metadata.
+type Key struct {
+	// DB is the database of the key.
+	DB int
+
+	// Name is the name of the key.
+	Name []byte
+
+	// Expiry is the expiration time of the key, in Unix milliseconds, or 0 if
+	// the key does not expire.
+	Expiry int64
+}
+
+// ZMember is a member of a sorted set.
+type ZMember struct {
+	Member []byte
+	Score  float64
+}
+
+// HashField is a field of a hash.
+type HashField struct {
+	Field []byte
+	Value []byte
+}
+
+// StreamID is the ID of a stream entry, "<ms>-<seq>".
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+// String returns the ID as "<ms>-<seq>".
+func (id StreamID) String() string {
+	return strconv.FormatUint(id.Ms, 10) + "-" + strconv.FormatUint(id.Seq, 10)
+}
+
+// StreamEntry is an entry of a stream.
+type StreamEntry struct {
+	ID StreamID
+
+	// Fields holds the fields and values of the entry, interleaved.
+	Fields [][]byte
+}
+
+// Stream is a stream with its metadata and consumer groups.
+type Stream struct {
+	// Entries are the entries of the stream, in ID order.
+	Entries []StreamEntry
+
+	// Length is the number of entries, and LastID the last ID generated.
+	Length uint64
+	LastID StreamID
+
+	// FirstID, MaxDeletedID and EntriesAdded are only stored by RDB version 10
+	// and later.
+	FirstID      StreamID
+	MaxDeletedID StreamID
+	EntriesAdded uint64
+
+	Groups []StreamGroup
+}
+
+// StreamGroup is a consumer group of a stream.
+type StreamGroup struct {
+	Name   []byte
+	LastID StreamID
+
+	// EntriesRead is the logical read counter of the group, or -1 if unknown.
+	// It is only stored by RDB version 10 and later.
+	EntriesRead int64
+
+	// Pending are the entries delivered to the consumers of the group but not
+	// acknowledged yet.
+	Pending   []StreamPending
+	Consumers []StreamConsumer
+}
+
+// StreamPending is an entry of the pending entries list of a consumer group.
+type StreamPending struct {
+	ID StreamID
+
+	// DeliveryTime is the last delivery time, in Unix milliseconds.
+	DeliveryTime  int64
+	DeliveryCount uint64
+}
+
+// StreamConsumer is a consumer of a consumer group.
+type StreamConsumer struct {
+	Name []byte
+
+	// SeenTime is the last time the consumer was seen, and ActiveTime the last
+	// time it read successfully, in Unix milliseconds. ActiveTime is only
+	// stored by RDB version 11 and later.
+	SeenTime   int64
+	ActiveTime int64
+
+	// Pending are the IDs of the entries of the pending entries list of the
+	// group delivered to the consumer.
+	Pending []StreamID
+}
+
+// Visitor receives the content of an RDB file from Decode, in file order. The
+// slices passed to its methods are not reused by the decoder and may be kept.
+// Decode stops at the first error returned by a method.
+type Visitor interface {
+	// Aux is called for each auxiliary field, such as redis-ver or ctime.
+	Aux(key, value []byte) error
+
+	// Function is called for each library of functions, with its code.
+	Function(code []byte) error
+
+	String(key Key, value []byte) error
+	List(key Key, elems [][]byte) error
+	Set(key Key, members [][]byte) error
+	SortedSet(key Key, members []ZMember) error
+	Hash(key Key, fields []HashField) error
+	Stream(key Key, stream *Stream) error
+}
+
+// NopVisitor is a Visitor that ignores everything. Embed it in a visitor that
+// only cares about some types.
+//
+// Example:
+//
+//	type stringCounter struct {
+//	    rdb.NopVisitor
+//	    n int
+//	}
+//
+//	func (c *stringCounter) String(key rdb.Key, value []byte) error {
+//	    c.n++
+//	    return nil
+//	}
+type NopVisitor struct{}
+
+func (NopVisitor) Aux(key, value []byte) error                { return nil }
+func (NopVisitor) Function(code []byte) error                 { return nil }
+func (NopVisitor) String(key Key, value []byte) error         { return nil }
+func (NopVisitor) List(key Key, elems [][]byte) error         { return nil }
+func (NopVisitor) Set(key Key, members [][]byte) error        { return nil }
+func (NopVisitor) SortedSet(key Key, members []ZMember) error { return nil }
+func (NopVisitor) Hash(key Key, fields []HashField) error     { return nil }
+func (NopVisitor) Stream(key Key, stream *Stream) error       { return nil }
@@ -0,0 +1,431 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recorder is a Visitor that keeps what it visits.
+type recorder struct {
+	aux       [][2]string
+	functions []string
+	strings   map[string]string
+	lists     map[string][]string
+	sets      map[string][]string
+	zsets     map[string][]ZMember
+	hashes    map[string][]HashField
+	streams   map[string]*Stream
+	keys      []Key
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		strings: map[string]string{},
+		lists:   map[string][]string{},
+		sets:    map[string][]string{},
+		zsets:   map[string][]ZMember{},
+		hashes:  map[string][]HashField{},
+		streams: map[string]*Stream{},
+	}
+}
+
+func toStrings(b [][]byte) []string {
+	s := make([]string, len(b))
+	for i := range b {
+		s[i] = string(b[i])
+	}
+	return s
+}
+
+func (r *recorder) Aux(key, value []byte) error {
+	r.aux = append(r.aux, [2]string{string(key), string(value)})
+	return nil
+}
+
+func (r *recorder) Function(code []byte) error {
+	r.functions = append(r.functions, string(code))
+	return nil
+}
+
+func (r *recorder) String(key Key, value []byte) error {
+	r.keys = append(r.keys, key)
+	r.strings[string(key.Name)] = string(value)
+	return nil
+}
+
+func (r *recorder) List(key Key, elems [][]byte) error {
+	r.keys = append(r.keys, key)
+	r.lists[string(key.Name)] = toStrings(elems)
+	return nil
+}
+
+func (r *recorder) Set(key Key, members [][]byte) error {
+	r.keys = append(r.keys, key)
+	r.sets[string(key.Name)] = toStrings(members)
+	return nil
+}
+
+func (r *recorder) SortedSet(key Key, members []ZMember) error {
+	r.keys = append(r.keys, key)
+	r.zsets[string(key.Name)] = members
+	return nil
+}
+
+func (r *recorder) Hash(key Key, fields []HashField) error {
+	r.keys = append(r.keys, key)
+	r.hashes[string(key.Name)] = fields
+	return nil
+}
+
+func (r *recorder) Stream(key Key, stream *Stream) error {
+	r.keys = append(r.keys, key)
+	r.streams[string(key.Name)] = stream
+	return nil
+}
+
+func TestCRC64(t *testing.T) {
+	// The check value of the test of crc64.c in Redis.
+	assert.Equal(t, uint64(0xe9c6d914c4b8d9ca), crcUpdate(0, []byte("123456789")))
+	assert.Equal(t, uint64(0xe9c6d914c4b8d9ca), crcUpdate(crcUpdate(0, []byte("1234")), []byte("56789")))
+}
+
+func TestDecodeRedis(t *testing.T) {
+	// An empty dataset saved by Redis 7.2.
+	b, err := hex.DecodeString("524544495330303131fa0972656469732d76657205372e322e30" +
+		"fa0a72656469732d62697473c040fa056374696d65c26d08bc65fa08757365642d6d656dc2b0c41000" +
+		"fa08616f662d62617365c000fff06e3bfec0ff5aa2")
+	require.NoError(t, err)
+
+	r := newRecorder()
+	require.NoError(t, Decode(bytes.NewReader(b), r))
+	assert.Equal(t, [][2]string{
+		{"redis-ver", "7.2.0"},
+		{"redis-bits", "64"},
+		{"ctime", "1706821741"},
+		{"used-mem", "1098928"},
+		{"aof-base", "0"},
+	}, r.aux)
+	assert.Empty(t, r.keys)
+
+	b[22] ^= 1 // In redis-ver
+	assert.ErrorIs(t, Decode(bytes.NewReader(b), newRecorder()), ErrChecksum)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"not rdb", "HELLO0011\xff", "not an RDB file"},
+		{"old version", "REDIS0006\xff", "unsupported version"},
+		{"new version", "REDIS0012\xff", "unsupported version"},
+		{"truncated", "REDIS0011\xfa\x03ab", io.ErrUnexpectedEOF.Error()},
+		{"no eof", "REDIS0011", io.ErrUnexpectedEOF.Error()},
+		{"bad type", "REDIS0011\x42\x01k", "unsupported value type"},
+		{"module", "REDIS0011\x07\x01k", "module values"},
+		{"bad length", "REDIS0011\x00\x82", "invalid length encoding"},
+		{"bad listpack", "REDIS0011\x10\x01k\x03abc", "invalid listpack"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Decode(strings.NewReader(tt.data), NopVisitor{})
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.err)
+		})
+	}
+}
+
+// testStream returns a stream of two listpacks, without deleted entries, and a
+// consumer group with a pending entry.
+func testStream() *Stream {
+	s := &Stream{
+		Length:       150,
+		LastID:       StreamID{Ms: 1700000000149, Seq: 0},
+		FirstID:      StreamID{Ms: 1700000000000, Seq: 0},
+		MaxDeletedID: StreamID{Ms: 0, Seq: 0},
+		EntriesAdded: 150,
+	}
+	for i := 0; i < 150; i++ {
+		fields := [][]byte{[]byte("temp"), []byte(strconv.Itoa(20 + i%5))}
+		if i%7 == 0 {
+			fields = append(fields, []byte("note"), []byte("sample "+strconv.Itoa(i)))
+		}
+		s.Entries = append(s.Entries, StreamEntry{
+			ID:     StreamID{Ms: 1700000000000 + uint64(i), Seq: uint64(i % 3)},
+			Fields: fields,
+		})
+	}
+	s.LastID = s.Entries[149].ID
+	s.Groups = []StreamGroup{{
+		Name:        []byte("workers"),
+		LastID:      s.Entries[10].ID,
+		EntriesRead: 11,
+		Pending:     []StreamPending{{ID: s.Entries[10].ID, DeliveryTime: 1700000001000, DeliveryCount: 2}},
+		Consumers: []StreamConsumer{{
+			Name:       []byte("alice"),
+			SeenTime:   1700000002000,
+			ActiveTime: 1700000001000,
+			Pending:    []StreamID{s.Entries[10].ID},
+		}},
+	}}
+	return s
+}
+
+func encodeAll(t *testing.T, opts EncoderOptions, fn func(e *Encoder)) []byte {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, opts)
+	fn(e)
+	require.NoError(t, e.Close())
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	long := strings.Repeat("abcdefgh", 100)
+	var bigList, bigSet [][]byte
+	for i := 0; i < 1000; i++ {
+		bigList = append(bigList, []byte("element-"+strconv.Itoa(i)))
+		bigSet = append(bigSet, []byte("m"+strconv.Itoa(i)))
+	}
+	var bigHash []HashField
+	var bigZSet []ZMember
+	for i := 0; i < 200; i++ {
+		bigHash = append(bigHash, HashField{Field: []byte("f" + strconv.Itoa(i)), Value: []byte(strconv.Itoa(i))})
+		bigZSet = append(bigZSet, ZMember{Member: []byte("z" + strconv.Itoa(i)), Score: float64(i) / 3})
+	}
+	ints := [][]byte{[]byte("-100000"), []byte("3"), []byte("70000"), []byte("-2")}
+	wideInts := [][]byte{[]byte("1"), []byte("-9223372036854775808"), []byte("9223372036854775807")}
+	listInts := [][]byte{
+		[]byte("0"), []byte("12"), []byte("13"), []byte("127"), []byte("128"), []byte("-1"),
+		[]byte("-4096"), []byte("4095"), []byte("-32768"), []byte("32767"), []byte("8388607"),
+		[]byte("-8388608"), []byte("2147483647"), []byte("-2147483648"), []byte("4294967296"),
+		[]byte("007"), []byte("-0"), []byte(""), []byte(long),
+	}
+	zset := []ZMember{
+		{Member: []byte("b"), Score: 2},
+		{Member: []byte("a"), Score: 2},
+		{Member: []byte("c"), Score: -1.5},
+		{Member: []byte("inf"), Score: math.Inf(1)},
+		{Member: []byte("ninf"), Score: math.Inf(-1)},
+		{Member: []byte("pi"), Score: math.Pi},
+	}
+	hash := []HashField{{Field: []byte("name"), Value: []byte("Ada")}, {Field: []byte("age"), Value: []byte("36")}}
+
+	for version := MinVersion; version <= MaxVersion; version++ {
+		for _, compress := range []bool{false, true} {
+			t.Run(fmt.Sprintf("v%d/compress=%v", version, compress), func(t *testing.T) {
+				b := encodeAll(t, EncoderOptions{Version: version, Compress: compress}, func(e *Encoder) {
+					require.NoError(t, e.Aux([]byte("redis-ver"), []byte("7.2.0")))
+					if version >= 10 {
+						require.NoError(t, e.Function([]byte("#!lua name=lib\nredis.register_function('f', function() return 1 end)")))
+					}
+					require.NoError(t, e.String(Key{Name: []byte("str")}, []byte("bar")))
+					require.NoError(t, e.String(Key{Name: []byte("int"), Expiry: 1900000000123}, []byte("-12345")))
+					require.NoError(t, e.String(Key{Name: []byte("long")}, []byte(long)))
+					require.NoError(t, e.List(Key{Name: []byte("list")}, listInts))
+					require.NoError(t, e.List(Key{Name: []byte("biglist")}, bigList))
+					require.NoError(t, e.Set(Key{Name: []byte("ints")}, ints))
+					require.NoError(t, e.Set(Key{Name: []byte("wideints")}, wideInts))
+					require.NoError(t, e.Set(Key{Name: []byte("set")}, [][]byte{[]byte("x"), []byte("y")}))
+					require.NoError(t, e.Set(Key{Name: []byte("bigset")}, bigSet))
+					require.NoError(t, e.SortedSet(Key{Name: []byte("zset")}, zset))
+					require.NoError(t, e.SortedSet(Key{Name: []byte("bigzset")}, bigZSet))
+					require.NoError(t, e.Hash(Key{Name: []byte("hash"), DB: 3}, hash))
+					require.NoError(t, e.Hash(Key{Name: []byte("bighash"), DB: 3}, bigHash))
+					require.NoError(t, e.Stream(Key{Name: []byte("stream"), DB: 3, Expiry: 1900000000000}, testStream()))
+					require.NoError(t, e.Stream(Key{Name: []byte("empty")}, &Stream{LastID: StreamID{Ms: 5, Seq: 1}}))
+				})
+				assert.Equal(t, fmt.Sprintf("REDIS%04d", version), string(b[:9]))
+
+				r := newRecorder()
+				require.NoError(t, Decode(bytes.NewReader(b), r))
+				assert.Equal(t, [][2]string{{"redis-ver", "7.2.0"}}, r.aux)
+				if version >= 10 {
+					assert.Len(t, r.functions, 1)
+				}
+				assert.Equal(t, "bar", r.strings["str"])
+				assert.Equal(t, "-12345", r.strings["int"])
+				assert.Equal(t, long, r.strings["long"])
+				assert.Equal(t, toStrings(listInts), r.lists["list"])
+				assert.Equal(t, toStrings(bigList), r.lists["biglist"])
+				assert.Equal(t, []string{"-100000", "-2", "3", "70000"}, r.sets["ints"])
+				assert.ElementsMatch(t, toStrings(wideInts), r.sets["wideints"])
+				assert.ElementsMatch(t, []string{"x", "y"}, r.sets["set"])
+				assert.ElementsMatch(t, toStrings(bigSet), r.sets["bigset"])
+				assert.Equal(t, []ZMember{
+					{Member: []byte("ninf"), Score: math.Inf(-1)},
+					{Member: []byte("c"), Score: -1.5},
+					{Member: []byte("a"), Score: 2},
+					{Member: []byte("b"), Score: 2},
+					{Member: []byte("pi"), Score: math.Pi},
+					{Member: []byte("inf"), Score: math.Inf(1)},
+				}, r.zsets["zset"])
+				assert.Equal(t, bigZSet, r.zsets["bigzset"])
+				assert.Equal(t, hash, r.hashes["hash"])
+				assert.Equal(t, bigHash, r.hashes["bighash"])
+
+				want := testStream()
+				if version < 10 {
+					want.FirstID, want.MaxDeletedID, want.EntriesAdded = StreamID{}, StreamID{}, 0
+					want.Groups[0].EntriesRead = -1
+				}
+				if version < 11 {
+					want.Groups[0].Consumers[0].ActiveTime = 0
+				}
+				assert.Equal(t, want, r.streams["stream"])
+				assert.Equal(t, StreamID{Ms: 5, Seq: 1}, r.streams["empty"].LastID)
+				assert.Empty(t, r.streams["empty"].Entries)
+
+				for _, key := range r.keys {
+					switch string(key.Name) {
+					case "int":
+						assert.Equal(t, int64(1900000000123), key.Expiry)
+					case "stream":
+						assert.Equal(t, int64(1900000000000), key.Expiry)
+						assert.Equal(t, 3, key.DB)
+					case "hash", "bighash":
+						assert.Equal(t, 3, key.DB)
+					case "empty":
+						assert.Equal(t, 0, key.DB)
+					default:
+						assert.Zero(t, key.Expiry, string(key.Name))
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestEncoderCompress(t *testing.T) {
+	value := []byte(strings.Repeat("redhub ", 1000))
+	plain := encodeAll(t, EncoderOptions{}, func(e *Encoder) {
+		require.NoError(t, e.String(Key{Name: []byte("k")}, value))
+	})
+	compressed := encodeAll(t, EncoderOptions{Compress: true}, func(e *Encoder) {
+		require.NoError(t, e.String(Key{Name: []byte("k")}, value))
+	})
+	assert.Less(t, len(compressed), len(plain)/10)
+
+	r := newRecorder()
+	require.NoError(t, Decode(bytes.NewReader(compressed), r))
+	assert.Equal(t, string(value), r.strings["k"])
+}
+
+func TestEncoderEncodings(t *testing.T) {
+	typeOf := func(version int, fn func(e *Encoder)) byte {
+		b := encodeAll(t, EncoderOptions{Version: version}, fn)
+		// Header, SELECTDB 0, then the type of the first key.
+		return b[11]
+	}
+	small := [][]byte{[]byte("a"), []byte("b")}
+	assert.Equal(t, byte(typeListQuicklist), typeOf(9, func(e *Encoder) { _ = e.List(Key{}, small) }))
+	assert.Equal(t, byte(typeListQuicklist2), typeOf(10, func(e *Encoder) { _ = e.List(Key{}, small) }))
+	assert.Equal(t, byte(typeSet), typeOf(10, func(e *Encoder) { _ = e.Set(Key{}, small) }))
+	assert.Equal(t, byte(typeSetListpack), typeOf(11, func(e *Encoder) { _ = e.Set(Key{}, small) }))
+	assert.Equal(t, byte(typeSetIntset), typeOf(11, func(e *Encoder) { _ = e.Set(Key{}, [][]byte{[]byte("1")}) }))
+	zs := []ZMember{{Member: []byte("a"), Score: 1}}
+	assert.Equal(t, byte(typeZSetZiplist), typeOf(9, func(e *Encoder) { _ = e.SortedSet(Key{}, zs) }))
+	assert.Equal(t, byte(typeZSetListpack), typeOf(10, func(e *Encoder) { _ = e.SortedSet(Key{}, zs) }))
+	hs := []HashField{{Field: []byte("f"), Value: []byte(strings.Repeat("v", 65))}}
+	assert.Equal(t, byte(typeHash), typeOf(11, func(e *Encoder) { _ = e.Hash(Key{}, hs) }))
+	assert.Equal(t, byte(typeStreamListpacks), typeOf(9, func(e *Encoder) { _ = e.Stream(Key{}, &Stream{}) }))
+	assert.Equal(t, byte(typeStreamListpacks3), typeOf(11, func(e *Encoder) { _ = e.Stream(Key{}, &Stream{}) }))
+}
+
+func TestEncoderErrors(t *testing.T) {
+	e := NewEncoder(io.Discard, EncoderOptions{Version: 8})
+	assert.ErrorContains(t, e.String(Key{}, nil), "unsupported version")
+
+	e = NewEncoder(io.Discard, EncoderOptions{Version: 9})
+	assert.ErrorContains(t, e.Function([]byte("code")), "RDB version 10")
+	require.NoError(t, e.Close())
+	assert.ErrorIs(t, e.String(Key{}, nil), ErrEncoderClosed)
+}
+
+func TestEncoderIsVisitor(t *testing.T) {
+	// Decoding into an encoder converts a file to another version.
+	v11 := encodeAll(t, EncoderOptions{}, func(e *Encoder) {
+		require.NoError(t, e.Hash(Key{Name: []byte("h")}, []HashField{{Field: []byte("a"), Value: []byte("1")}}))
+		require.NoError(t, e.Stream(Key{Name: []byte("s")}, testStream()))
+	})
+	var v9 bytes.Buffer
+	e := NewEncoder(&v9, EncoderOptions{Version: 9})
+	require.NoError(t, Decode(bytes.NewReader(v11), e))
+	require.NoError(t, e.Close())
+
+	r := newRecorder()
+	require.NoError(t, Decode(&v9, r))
+	assert.Equal(t, []HashField{{Field: []byte("a"), Value: []byte("1")}}, r.hashes["h"])
+	assert.Equal(t, testStream().Entries, r.streams["s"].Entries)
+}
+
+func TestLZF(t *testing.T) {
+	inputs := []string{
+		"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+		strings.Repeat("abc", 500),
+		strings.Repeat("The quick brown fox jumps over the lazy dog. ", 50),
+		strings.Repeat("0123456789abcdefghijklmnopqrstuvwxyz", 10) + strings.Repeat("x", 300),
+	}
+	for _, in := range inputs {
+		c := lzfCompress([]byte(in))
+		require.NotNil(t, c)
+		assert.Less(t, len(c), len(in))
+		out, err := lzfDecompress(c, len(in))
+		require.NoError(t, err)
+		assert.Equal(t, in, string(out))
+	}
+	assert.Nil(t, lzfCompress([]byte("abcdefghijklmnopqrstuvwxyz")))
+
+	_, err := lzfDecompress([]byte{0x20, 0x00}, 3)
+	assert.Error(t, err)
+	_, err = lzfDecompress([]byte{0x02, 'a', 'b'}, 3)
+	assert.Error(t, err)
+}
+
+func TestListpackZiplist(t *testing.T) {
+	entries := [][]byte{
+		[]byte("0"), []byte("127"), []byte("-4096"), []byte("4095"), []byte("-32768"),
+		[]byte("8388607"), []byte("-2147483648"), []byte("9223372036854775807"), []byte("12"),
+		[]byte("-128"), []byte("x"), []byte(strings.Repeat("y", 100)), []byte(strings.Repeat("z", 5000)),
+		[]byte(strings.Repeat("w", 20000)), []byte("01"), []byte(""),
+	}
+	lp, err := listpackEntries(appendListpack(nil, entries))
+	require.NoError(t, err)
+	assert.Equal(t, entries, lp)
+	zl, err := ziplistEntries(appendZiplist(nil, entries))
+	require.NoError(t, err)
+	assert.Equal(t, entries, zl)
+
+	// The listpack of ["a", 1024] written by Redis.
+	lp, err = listpackEntries([]byte("\x0d\x00\x00\x00\x02\x00\x81a\x02\xc4\x00\x02\xff"))
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("1024")}, lp)
+
+	for _, b := range [][]byte{nil, []byte("\x07\x00\x00\x00\x01\x00\xff"), []byte("\x09\x00\x00\x00\x01\x00\x85a\xff")} {
+		_, err := listpackEntries(b)
+		assert.Error(t, err, "%q", b)
+	}
+}
+
+func TestIntset(t *testing.T) {
+	for _, vs := range [][]int64{{1, 2, 3}, {-40000, 1}, {math.MinInt64, 0, math.MaxInt64}} {
+		entries, err := intsetEntries(appendIntset(nil, vs))
+		require.NoError(t, err)
+		want := make([][]byte, len(vs))
+		for i, v := range vs {
+			want[i] = strconv.AppendInt(nil, v, 10)
+		}
+		assert.Equal(t, want, entries)
+	}
+	_, err := intsetEntries([]byte("\x02\x00\x00\x00\x02\x00\x00\x00\x01\x00"))
+	assert.Error(t, err)
+}
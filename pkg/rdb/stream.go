@@ -0,0 +1,331 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// Flags of the entries of a stream listpack.
+const (
+	streamFlagDeleted    = 1
+	streamFlagSameFields = 2
+)
+
+// streamNodeMaxEntries is the most entries that an Encoder puts in a listpack
+// of a stream, the default stream-node-max-entries of Redis.
+const streamNodeMaxEntries = 100
+
+var errStream = errors.New("rdb: invalid stream")
+
+// readStream reads a stream of type typ: its listpacks, each keyed by the ID
+// of its first entry, its metadata and its consumer groups.
+func (d *decoder) readStream(typ byte) (*Stream, error) {
+	s := &Stream{}
+	nodes, err := d.readCount()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < nodes; i++ {
+		nodeKey, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		if len(nodeKey) != 16 {
+			return nil, errStream
+		}
+		lp, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		entries, err := listpackEntries(lp)
+		if err != nil {
+			return nil, err
+		}
+		if s.Entries, err = appendStreamEntries(s.Entries, streamIDFrom(nodeKey), entries); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.Length, err = d.readLen(); err != nil {
+		return nil, err
+	}
+	if s.LastID, err = d.readStreamID(); err != nil {
+		return nil, err
+	}
+	if typ >= typeStreamListpacks2 {
+		if s.FirstID, err = d.readStreamID(); err != nil {
+			return nil, err
+		}
+		if s.MaxDeletedID, err = d.readStreamID(); err != nil {
+			return nil, err
+		}
+		if s.EntriesAdded, err = d.readLen(); err != nil {
+			return nil, err
+		}
+	}
+
+	groups, err := d.readCount()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < groups; i++ {
+		g := StreamGroup{EntriesRead: -1}
+		if g.Name, err = d.readString(); err != nil {
+			return nil, err
+		}
+		if g.LastID, err = d.readStreamID(); err != nil {
+			return nil, err
+		}
+		if typ >= typeStreamListpacks2 {
+			n, err := d.readLen()
+			if err != nil {
+				return nil, err
+			}
+			g.EntriesRead = int64(n)
+		}
+
+		pending, err := d.readCount()
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < pending; j++ {
+			b, err := d.read(16)
+			if err != nil {
+				return nil, err
+			}
+			p := StreamPending{ID: streamIDFrom(b)}
+			if p.DeliveryTime, err = d.readMillis(); err != nil {
+				return nil, err
+			}
+			if p.DeliveryCount, err = d.readLen(); err != nil {
+				return nil, err
+			}
+			g.Pending = append(g.Pending, p)
+		}
+
+		consumers, err := d.readCount()
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < consumers; j++ {
+			c := StreamConsumer{}
+			if c.Name, err = d.readString(); err != nil {
+				return nil, err
+			}
+			if c.SeenTime, err = d.readMillis(); err != nil {
+				return nil, err
+			}
+			if typ >= typeStreamListpacks3 {
+				if c.ActiveTime, err = d.readMillis(); err != nil {
+					return nil, err
+				}
+			}
+			n, err := d.readCount()
+			if err != nil {
+				return nil, err
+			}
+			for k := 0; k < n; k++ {
+				b, err := d.read(16)
+				if err != nil {
+					return nil, err
+				}
+				c.Pending = append(c.Pending, streamIDFrom(b))
+			}
+			g.Consumers = append(g.Consumers, c)
+		}
+		s.Groups = append(s.Groups, g)
+	}
+	return s, nil
+}
+
+func (d *decoder) readStreamID() (StreamID, error) {
+	ms, err := d.readLen()
+	if err != nil {
+		return StreamID{}, err
+	}
+	seq, err := d.readLen()
+	return StreamID{Ms: ms, Seq: seq}, err
+}
+
+// streamIDFrom returns the stream ID stored in the 16 bytes b.
+func streamIDFrom(b []byte) StreamID {
+	return StreamID{Ms: binary.BigEndian.Uint64(b), Seq: binary.BigEndian.Uint64(b[8:])}
+}
+
+func appendStreamID(b []byte, id StreamID) []byte {
+	b = binary.BigEndian.AppendUint64(b, id.Ms)
+	return binary.BigEndian.AppendUint64(b, id.Seq)
+}
+
+// appendStreamEntries appends the live entries of the listpack of a stream,
+// whose entries are lp and whose first entry has the ID master, to entries.
+//
+// The listpack starts with a master entry: the number of live and deleted
+// entries, and the fields of the first entry, ending with 0. Each entry is then
+// its flags, its ID as the difference with the master ID, either its fields
+// and values or, with the same fields as the master entry, only its values,
+// and the number of listpack entries that it takes.
+func appendStreamEntries(entries []StreamEntry, master StreamID, lp [][]byte) ([]StreamEntry, error) {
+	i := 0
+	next := func() (int64, bool) {
+		if i >= len(lp) {
+			return 0, false
+		}
+		v, err := strconv.ParseInt(string(lp[i]), 10, 64)
+		i++
+		return v, err == nil
+	}
+	count, ok1 := next()
+	deleted, ok2 := next()
+	nfields, ok3 := next()
+	if !ok1 || !ok2 || !ok3 || nfields < 0 || int64(len(lp)-i) < nfields+1 {
+		return nil, errStream
+	}
+	masterFields := lp[i : i+int(nfields)]
+	i += int(nfields)
+	if zero, ok := next(); !ok || zero != 0 {
+		return nil, errStream
+	}
+
+	for n := int64(0); n < count+deleted; n++ {
+		flags, ok1 := next()
+		ms, ok2 := next()
+		seq, ok3 := next()
+		if !ok1 || !ok2 || !ok3 {
+			return nil, errStream
+		}
+		e := StreamEntry{ID: StreamID{Ms: master.Ms + uint64(ms), Seq: master.Seq + uint64(seq)}}
+		if flags&streamFlagSameFields != 0 {
+			if len(lp)-i < len(masterFields) {
+				return nil, errStream
+			}
+			e.Fields = make([][]byte, 0, 2*len(masterFields))
+			for _, f := range masterFields {
+				e.Fields = append(e.Fields, f, lp[i])
+				i++
+			}
+		} else {
+			nf, ok := next()
+			if !ok || nf < 0 || int64(len(lp)-i) < 2*nf {
+				return nil, errStream
+			}
+			e.Fields = lp[i : i+2*int(nf)]
+			i += 2 * int(nf)
+		}
+		if _, ok := next(); !ok {
+			return nil, errStream
+		}
+		if flags&streamFlagDeleted == 0 {
+			entries = append(entries, e)
+		}
+	}
+	if i != len(lp) {
+		return nil, errStream
+	}
+	return entries, nil
+}
+
+// writeStream writes a stream of type typ.
+func (e *Encoder) writeStream(typ byte, s *Stream) {
+	nodes := (len(s.Entries) + streamNodeMaxEntries - 1) / streamNodeMaxEntries
+	e.writeLen(uint64(nodes))
+	for i := 0; i < len(s.Entries); i += streamNodeMaxEntries {
+		node := s.Entries[i:min(i+streamNodeMaxEntries, len(s.Entries))]
+		e.writeString(appendStreamID(nil, node[0].ID))
+		e.writeString(appendListpack(nil, streamListpack(node)))
+	}
+
+	e.writeLen(s.Length)
+	e.writeStreamID(s.LastID)
+	if typ >= typeStreamListpacks2 {
+		e.writeStreamID(s.FirstID)
+		e.writeStreamID(s.MaxDeletedID)
+		e.writeLen(s.EntriesAdded)
+	}
+
+	e.writeLen(uint64(len(s.Groups)))
+	for _, g := range s.Groups {
+		e.writeString(g.Name)
+		e.writeStreamID(g.LastID)
+		if typ >= typeStreamListpacks2 {
+			e.writeLen(uint64(g.EntriesRead))
+		}
+		e.writeLen(uint64(len(g.Pending)))
+		for _, p := range g.Pending {
+			e.write(appendStreamID(nil, p.ID))
+			e.writeMillis(p.DeliveryTime)
+			e.writeLen(p.DeliveryCount)
+		}
+		e.writeLen(uint64(len(g.Consumers)))
+		for _, c := range g.Consumers {
+			e.writeString(c.Name)
+			e.writeMillis(c.SeenTime)
+			if typ >= typeStreamListpacks3 {
+				e.writeMillis(c.ActiveTime)
+			}
+			e.writeLen(uint64(len(c.Pending)))
+			for _, id := range c.Pending {
+				e.write(appendStreamID(nil, id))
+			}
+		}
+	}
+}
+
+func (e *Encoder) writeStreamID(id StreamID) {
+	e.writeLen(id.Ms)
+	e.writeLen(id.Seq)
+}
+
+// streamListpack returns the listpack entries of a node of a stream, whose
+// master entry has the fields of its first entry.
+func streamListpack(node []StreamEntry) [][]byte {
+	master := node[0]
+	var lp [][]byte
+	num := func(v int64) {
+		lp = append(lp, strconv.AppendInt(nil, v, 10))
+	}
+	num(int64(len(node)))
+	num(0)
+	num(int64(len(master.Fields) / 2))
+	for i := 0; i+1 < len(master.Fields); i += 2 {
+		lp = append(lp, master.Fields[i])
+	}
+	num(0)
+	for _, entry := range node {
+		same := sameFields(entry.Fields, master.Fields)
+		if same {
+			num(streamFlagSameFields)
+		} else {
+			num(0)
+		}
+		num(int64(entry.ID.Ms - master.ID.Ms))
+		num(int64(entry.ID.Seq - master.ID.Seq))
+		nfields := len(entry.Fields) / 2
+		if same {
+			for i := 1; i < 2*nfields; i += 2 {
+				lp = append(lp, entry.Fields[i])
+			}
+			num(int64(nfields + 3))
+		} else {
+			num(int64(nfields))
+			lp = append(lp, entry.Fields[:2*nfields]...)
+			num(int64(2*nfields + 4))
+		}
+	}
+	return lp
+}
+
+// sameFields reports whether the entries with the fields and values a and b
+// have the same fields, in the same order.
+func sameFields(a, b [][]byte) bool {
+	if len(a)/2 != len(b)/2 {
+		return false
+	}
+	for i := 0; i+1 < len(a); i += 2 {
+		if string(a[i]) != string(b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -2,7 +2,6 @@ package resp
 
 import (
 	"errors"
-	"strconv"
 )
 
 var (
@@ -46,17 +45,44 @@ type Command struct {
 	// The first argument is always the command name (e.g., "GET", "SET").
 	// Subsequent arguments are the command parameters.
 	Args [][]byte
+
+	// Kind is the protocol the command was sent with. Inline and Tile38
+	// commands are converted to RESP in Raw.
+	Kind Kind
 }
 
 // parseInt converts a byte slice to an integer.
 // Returns the integer value and a boolean indicating success.
 //
 // This is a helper function used internally for parsing RESP protocol numbers.
-// It uses strconv.Atoi for reliable parsing.
+// It scans the digits in place so that the command hot path does not allocate.
 func parseInt(b []byte) (int, bool) {
-	// Use the built-in strconv.Atoi for better performance
-	n, err := strconv.Atoi(string(b))
-	return n, err == nil
+	if len(b) == 0 {
+		return 0, false
+	}
+	var neg bool
+	switch b[0] {
+	case '-':
+		neg = true
+		b = b[1:]
+	case '+':
+		b = b[1:]
+	}
+	if len(b) == 0 || len(b) > 18 {
+		// 18 digits always fit in an int64 without overflow checks.
+		return 0, false
+	}
+	var n int
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+	}
+	if neg {
+		n = -n
+	}
+	return n, true
 }
 
 // ReadCommands parses a raw message buffer and returns complete commands.
@@ -93,28 +119,17 @@ func ReadCommands(buf []byte) ([]Command, []byte, error) {
 	b := buf
 
 	for len(b) > 0 {
-		switch b[0] {
-		case '*':
-			// RESP formatted command
-			cmd, rest, err := parseRESPCommand(b)
-			if err != nil {
-				return nil, writeback, err
-			}
-			if cmd != nil {
-				cmds = append(cmds, *cmd)
-			}
-			b = rest
-		default:
-			// Plain text command
-			cmd, rest, err := parsePlainTextCommand(b)
-			if err != nil {
-				return nil, writeback, err
-			}
-			if cmd != nil {
-				cmds = append(cmds, *cmd)
-			}
-			b = rest
+		cmd, n, err := ReadCommand(b, nil)
+		if err != nil {
+			return nil, writeback, err
+		}
+		if n == 0 {
+			break
+		}
+		if len(cmd.Args) > 0 {
+			cmds = append(cmds, cmd)
 		}
+		b = b[n:]
 	}
 
 	if len(b) > 0 {
@@ -127,234 +142,60 @@ func ReadCommands(buf []byte) ([]Command, []byte, error) {
 	return nil, writeback, nil
 }
 
-// parseRESPCommand parses a RESP formatted command from a byte slice.
+// ReadCommand parses a single command from the start of buf.
 //
-// RESP commands are arrays with the format:
-// "*<count>\r\n$<len1>\r\n<arg1>\r\n$<len2>\r\n<arg2>\r\n..."
+// Unlike ReadCommands it neither copies the input nor allocates a command
+// slice: the returned Command.Raw and Command.Args point directly into buf,
+// and args is reused as the backing array for Command.Args. This makes it
+// suitable for parsing straight out of a network read buffer, as long as the
+// command is no longer referenced once that buffer is discarded.
 //
 // Parameters:
-//   - b: The input bytes to parse
-//
-// Returns:
-//   - *Command: The parsed command, or nil if incomplete
-//   - []byte: The remaining unparsed bytes
-//   - error: An error if the protocol is malformed
-func parseRESPCommand(b []byte) (*Command, []byte, error) {
-	marks := make([]int, 0, 16)
-	for i := 1; i < len(b); i++ {
-		if b[i] == '\n' {
-			if b[i-1] != '\r' {
-				return nil, nil, errInvalidMultiBulkLength
-			}
-			count, ok := parseInt(b[1 : i-1])
-			if !ok || count <= 0 {
-				return nil, nil, errInvalidMultiBulkLength
-			}
-			marks = marks[:0]
-			for j := 0; j < count; j++ {
-				i++
-				if i >= len(b) || b[i] != '$' {
-					return nil, b, nil // Not enough data
-				}
-				si := i
-				for ; i < len(b); i++ {
-					if b[i] == '\n' {
-						if b[i-1] != '\r' {
-							return nil, nil, errInvalidBulkLength
-						}
-						size, ok := parseInt(b[si+1 : i-1])
-						if !ok || size < 0 {
-							return nil, nil, errInvalidBulkLength
-						}
-						if i+size+2 >= len(b) {
-							return nil, b, nil // Not enough data
-						}
-						if b[i+size+2] != '\n' || b[i+size+1] != '\r' {
-							return nil, nil, errInvalidBulkLength
-						}
-						i++
-						marks = append(marks, i, i+size)
-						i += size + 1
-						break
-					}
-				}
-			}
-			if len(marks) == count*2 {
-				cmd := &Command{
-					Raw:  b[:i+1],
-					Args: make([][]byte, len(marks)/2),
-				}
-				for h := 0; h < len(marks); h += 2 {
-					cmd.Args[h/2] = cmd.Raw[marks[h]:marks[h+1]]
-				}
-				return cmd, b[i+1:], nil
-			}
-		}
-	}
-	return nil, b, nil
-}
-
-// parsePlainTextCommand parses a plain text command from a byte slice.
-//
-// Plain text commands are space-separated arguments terminated by a newline.
-// Supports quoted strings with escape sequences.
-//
-// Parameters:
-//   - b: The input bytes to parse
+//   - buf: The input buffer containing raw bytes from the network
+//   - args: An optional reusable slice for the parsed arguments. Can be nil.
 //
 // Returns:
-//   - *Command: The parsed command, or nil if incomplete
-//   - []byte: The remaining unparsed bytes
+//   - Command: The parsed command. Args is empty when an empty line was consumed.
+//   - int: The number of bytes consumed, or 0 if buf holds an incomplete command
 //   - error: An error if the protocol is malformed
-func parsePlainTextCommand(b []byte) (*Command, []byte, error) {
-	for i := 0; i < len(b); i++ {
-		if b[i] == '\n' {
-			line := b[:i]
-			if i > 0 && b[i-1] == '\r' {
-				line = b[:i-1]
-			}
-			cmd, err := parseLine(line)
-			if err != nil {
-				return nil, nil, err
-			}
-			if cmd != nil {
-				return cmd, b[i+1:], nil
-			}
-			return nil, b[i+1:], nil
-		}
-	}
-	return nil, b, nil
-}
-
-// parseLine parses a single line of plain text command.
-//
-// The line is split into arguments by spaces, with support for:
-//   - Single or double quoted strings
-//   - Escape sequences (\n, \r, \t, \\)
-//
-// Parameters:
-//   - line: The line to parse (without the newline terminator)
-//
-// Returns:
-//   - *Command: The parsed command converted to RESP format, or nil if empty
-//   - error: An error if quotes are unbalanced
-func parseLine(line []byte) (*Command, error) {
-	var cmd Command
-	var quote bool
-	var quotech byte
-	var escape bool
-	var arg []byte
-
-	for i := 0; i < len(line); i++ {
-		c := line[i]
-		if !quote {
-			if c == ' ' {
-				if len(arg) > 0 {
-					cmd.Args = append(cmd.Args, arg)
-					arg = nil
-				}
-				continue
-			}
-			if c == '"' || c == '\'' {
-				if i != 0 {
-					return nil, errUnbalancedQuotes
-				}
-				quotech = c
-				quote = true
-				continue
-			}
-		} else {
-			if escape {
-				escape = false
-				switch c {
-				case 'n':
-					c = '\n'
-				case 'r':
-					c = '\r'
-				case 't':
-					c = '\t'
-				}
-			} else if c == quotech {
-				quote = false
-				quotech = 0
-				cmd.Args = append(cmd.Args, arg)
-				arg = nil
-				continue
-			} else if c == '\\' {
-				escape = true
-				continue
-			}
-		}
-		arg = append(arg, c)
-	}
-
-	if quote {
-		return nil, errUnbalancedQuotes
-	}
-	if len(arg) > 0 {
-		cmd.Args = append(cmd.Args, arg)
-	}
-
-	if len(cmd.Args) > 0 {
-		// Convert to RESP command syntax
-		var wr Writer
-		wr.WriteArray(len(cmd.Args))
-		for i := range cmd.Args {
-			wr.WriteBulk(cmd.Args[i])
-			cmd.Args[i] = append([]byte(nil), cmd.Args[i]...)
-		}
-		cmd.Raw = wr.b
-		return &cmd, nil
-	}
-	return nil, nil
-}
-
-// Writer allows for writing RESP messages incrementally.
-//
-// This is a helper type for building RESP messages programmatically.
-// It's used internally to convert parsed plain text commands to RESP format.
 //
 // Example:
 //
-//	var w resp.Writer
-//	w.WriteArray(2)
-//	w.WriteBulk([]byte("GET"))
-//	w.WriteBulk([]byte("key"))
-//	// w.b == []byte("*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n")
-type Writer struct {
-	b []byte
+//	var args [][]byte
+//	for len(buf) > 0 {
+//	    cmd, n, err := resp.ReadCommand(buf, args)
+//	    if err != nil || n == 0 {
+//	        break
+//	    }
+//	    args = cmd.Args[:0]
+//	    buf = buf[n:]
+//	    // handle cmd
+//	}
+func ReadCommand(buf []byte, args [][]byte) (Command, int, error) {
+	return commandParser.ReadCommand(buf, args)
 }
 
-// WriteArray writes an RESP array header to the writer.
-// The count parameter specifies the number of elements in the array.
-//
-// After calling WriteArray, you should call WriteBulk for each element.
+// ReadStreamCommand is like ReadCommand, but stops early at a final bulk argument
+// whose declared length is larger than threshold, so that the argument can be
+// streamed to the application instead of being buffered in full.
 //
-// Example:
+// When such an argument is found, the returned Command holds every argument
+// before it, Raw covers the command up to and including the "$<len>\r\n" header
+// of the streamed argument, n is the length of Raw, and bulkLen is the declared
+// length of the argument. The caller is then responsible for consuming bulkLen
+// bytes followed by "\r\n" from the input. In every other case bulkLen is -1
+// and the results are identical to ReadCommand.
 //
-//	var w resp.Writer
-//	w.WriteArray(3)
-//	w.WriteBulk([]byte("item1"))
-//	w.WriteBulk([]byte("item2"))
-//	w.WriteBulk([]byte("item3"))
-func (w *Writer) WriteArray(count int) {
-	w.b = append(w.b, '*')
-	w.b = strconv.AppendInt(w.b, int64(count), 10)
-	w.b = append(w.b, '\r', '\n')
-}
-
-// WriteBulk writes a bulk string to the writer.
-// The bulk parameter contains the string data.
+// Only the last argument of a RESP array is ever streamed; large arguments in
+// other positions, and plain text commands, are parsed as usual. A threshold
+// less than or equal to zero disables streaming.
 //
 // Example:
 //
-//	var w resp.Writer
-//	w.WriteBulk([]byte("hello"))
-//	// w.b == []byte("$5\r\nhello\r\n")
-func (w *Writer) WriteBulk(bulk []byte) {
-	w.b = append(w.b, '$')
-	w.b = strconv.AppendInt(w.b, int64(len(bulk)), 10)
-	w.b = append(w.b, '\r', '\n')
-	w.b = append(w.b, bulk...)
-	w.b = append(w.b, '\r', '\n')
+//	buf := []byte("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$1048576\r\n...")
+//	cmd, n, bulkLen, err := resp.ReadStreamCommand(buf, nil, 64*1024)
+//	// cmd.Args == [][]byte{[]byte("SET"), []byte("key")}
+//	// bulkLen == 1048576, and the value starts at buf[n:]
+func ReadStreamCommand(buf []byte, args [][]byte, threshold int) (cmd Command, n int, bulkLen int, err error) {
+	return commandParser.ReadStreamCommand(buf, args, threshold)
 }
@@ -37,3 +37,104 @@ func TestWriteBulkSpecialChars(t *testing.T) {
 	w.WriteBulk([]byte("hello\r\nworld"))
 	assert.Equal(t, []byte("$12\r\nhello\r\nworld\r\n"), w.b)
 }
+
+func TestReadCommand(t *testing.T) {
+	buf := []byte("*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n*1\r\n$4\r\nPI")
+	cmd, n, err := ReadCommand(buf, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 22, n)
+	assert.Equal(t, [][]byte{[]byte("GET"), []byte("key")}, cmd.Args)
+	assert.Equal(t, buf[:22], cmd.Raw)
+
+	cmd, n, err = ReadCommand(buf[n:], cmd.Args[:0])
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Nil(t, cmd.Args)
+}
+
+func TestReadCommandReusesArgs(t *testing.T) {
+	args := make([][]byte, 0, 4)
+	cmd, _, err := ReadCommand([]byte("*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n"), args)
+	assert.NoError(t, err)
+	assert.Equal(t, &args[:1][0], &cmd.Args[0])
+}
+
+func TestReadCommandPlainText(t *testing.T) {
+	cmd, n, err := ReadCommand([]byte("\r\nPING\r\n"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Empty(t, cmd.Args)
+
+	cmd, n, err = ReadCommand([]byte("PING\r\n"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, n)
+	assert.Equal(t, [][]byte{[]byte("PING")}, cmd.Args)
+	assert.Equal(t, []byte("*1\r\n$4\r\nPING\r\n"), cmd.Raw)
+}
+
+func TestReadCommandErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"zero count", []byte("*0\r\n")},
+		{"bad count", []byte("*a\r\n")},
+		{"missing cr", []byte("*1\n")},
+		{"missing dollar", []byte("*1\r\n+PING\r\n")},
+		{"bad bulk length", []byte("*1\r\n$-4\r\nPING\r\n")},
+		{"bad terminator", []byte("*1\r\n$4\r\nPINGxx")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, n, err := ReadCommand(tt.input, nil)
+			assert.Error(t, err)
+			assert.Equal(t, 0, n)
+		})
+	}
+}
+
+func TestReadCommands(t *testing.T) {
+	buf := []byte("*1\r\n$4\r\nPING\r\nECHO hi\r\n*2\r\n$3\r\nGET")
+	cmds, leftover, err := ReadCommands(buf)
+	assert.NoError(t, err)
+	assert.Len(t, cmds, 2)
+	assert.Equal(t, [][]byte{[]byte("PING")}, cmds[0].Args)
+	assert.Equal(t, [][]byte{[]byte("ECHO"), []byte("hi")}, cmds[1].Args)
+	assert.Equal(t, []byte("*2\r\n$3\r\nGET"), leftover)
+}
+
+func BenchmarkReadCommand(b *testing.B) {
+	buf := []byte("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n")
+	var args [][]byte
+	b.SetBytes(int64(len(buf)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		cmd, _, _ := ReadCommand(buf, args)
+		args = cmd.Args[:0]
+	}
+}
+
+func TestReadStreamCommand(t *testing.T) {
+	buf := []byte("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$10\r\n01234")
+	cmd, n, bulkLen, err := ReadStreamCommand(buf, nil, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, bulkLen)
+	assert.Equal(t, len(buf)-5, n)
+	assert.Equal(t, [][]byte{[]byte("SET"), []byte("key")}, cmd.Args)
+	assert.Equal(t, buf[:n], cmd.Raw)
+
+	// Below the threshold the command is buffered as usual.
+	cmd, n, bulkLen, err = ReadStreamCommand(buf, nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, -1, bulkLen)
+	assert.Equal(t, 0, n)
+
+	// Only the final argument is streamed.
+	buf = []byte("*3\r\n$3\r\nSET\r\n$10\r\n0123456789\r\n$1\r\nv\r\n")
+	cmd, n, bulkLen, err = ReadStreamCommand(buf, nil, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, -1, bulkLen)
+	assert.Equal(t, len(buf), n)
+	assert.Len(t, cmd.Args, 3)
+}
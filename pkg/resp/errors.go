@@ -0,0 +1,240 @@
+package resp
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Error codes of the standard Redis error replies. The code is the first word
+// of an error message, such as "WRONGTYPE" in "-WRONGTYPE Operation against a
+// key holding the wrong kind of value".
+const (
+	CodeErr       = "ERR"
+	CodeWrongType = "WRONGTYPE"
+	CodeNoAuth    = "NOAUTH"
+	CodeNoPerm    = "NOPERM"
+	CodeMoved     = "MOVED"
+	CodeAsk       = "ASK"
+	CodeBusy      = "BUSY"
+	CodeLoading   = "LOADING"
+	CodeReadOnly  = "READONLY"
+	CodeExecAbort = "EXECABORT"
+	CodeOOM       = "OOM"
+	CodeNoScript  = "NOSCRIPT"
+)
+
+// The standard Redis error replies, worded exactly as Redis sends them. They
+// can be written with AppendErr, and errors.Is matches any reply error with
+// the same code against them.
+//
+// Example:
+//
+//	out = resp.AppendErr(out, resp.ErrWrongType)
+//	// "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+//
+//	if errors.Is(err, resp.ErrLoading) {
+//	    time.Sleep(time.Second) // the server is still starting, try again
+//	}
+var (
+	ErrWrongType = &ReplyError{Msg: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	ErrNoAuth    = &ReplyError{Msg: "NOAUTH Authentication required."}
+	ErrBusy      = &ReplyError{Msg: "BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE."}
+	ErrLoading   = &ReplyError{Msg: "LOADING Redis is loading the dataset in memory"}
+	ErrReadOnly  = &ReplyError{Msg: "READONLY You can't write against a read only replica."}
+	ErrExecAbort = &ReplyError{Msg: "EXECABORT Transaction discarded because of previous errors."}
+	ErrOOM       = &ReplyError{Msg: "OOM command not allowed when used memory > 'maxmemory'."}
+	ErrNoScript  = &ReplyError{Msg: "NOSCRIPT No matching script. Please use EVAL."}
+
+	// ErrSyntax and ErrNotInteger are common ERR replies. Since all generic
+	// errors share the ERR code, errors.Is matches them by their full message.
+	ErrSyntax     = &ReplyError{Msg: "ERR syntax error"}
+	ErrNotInteger = &ReplyError{Msg: "ERR value is not an integer or out of range"}
+)
+
+// ReplyError is an error reply, such as "-ERR unknown command\r\n", sent or
+// received by a RESP server.
+//
+// Unmarshal returns it when the value being decoded is an error reply, except
+// when the target is an empty interface, which then holds the error. MOVED and
+// ASK redirections are returned as a *RedirectError instead.
+type ReplyError struct {
+	// Msg is the complete error message, including its error code.
+	Msg string
+}
+
+// Error returns the error message as sent by the server.
+func (e *ReplyError) Error() string {
+	return e.Msg
+}
+
+// Code returns the error code, the first word of the message, such as "ERR" or
+// "WRONGTYPE".
+func (e *ReplyError) Code() string {
+	return errorCode(e.Msg)
+}
+
+// Is reports whether target is a *ReplyError with the same code, so that
+// errors.Is(err, resp.ErrWrongType) holds for any WRONGTYPE reply. Generic
+// errors with the ERR code only match the exact same message.
+func (e *ReplyError) Is(target error) bool {
+	t, ok := target.(*ReplyError)
+	if !ok {
+		return false
+	}
+	code := e.Code()
+	if code == CodeErr || code != t.Code() {
+		return e.Msg == t.Msg
+	}
+	return true
+}
+
+// RedirectError is a MOVED or ASK reply of Redis Cluster, which sends the
+// client to the node serving a hash slot.
+//
+// Example:
+//
+//	var redirect *resp.RedirectError
+//	if errors.As(err, &redirect) {
+//	    conn = dial(redirect.Addr) // retry there, after ASKING if redirect.Ask
+//	}
+type RedirectError struct {
+	// Ask is set for a temporary ASK redirection during a slot migration, and
+	// clear for a permanent MOVED redirection.
+	Ask bool
+
+	// Slot is the hash slot of the key.
+	Slot int
+
+	// Addr is the address of the node to redirect to, as "host:port".
+	Addr string
+}
+
+// Error returns the redirection as sent by Redis, e.g. "MOVED 3999 127.0.0.1:6381".
+func (e *RedirectError) Error() string {
+	code := CodeMoved
+	if e.Ask {
+		code = CodeAsk
+	}
+	return code + " " + strconv.Itoa(e.Slot) + " " + e.Addr
+}
+
+// Moved returns the MOVED redirection to the node at addr serving slot.
+func Moved(slot int, addr string) *RedirectError {
+	return &RedirectError{Slot: slot, Addr: addr}
+}
+
+// Ask returns the ASK redirection to the node at addr importing slot.
+func Ask(slot int, addr string) *RedirectError {
+	return &RedirectError{Ask: true, Slot: slot, Addr: addr}
+}
+
+// WrongArgs returns the error Redis replies when cmd is called with the wrong
+// number of arguments.
+//
+// Example:
+//
+//	if len(cmd.Args) != 2 {
+//	    return resp.AppendErr(out, resp.WrongArgs(string(cmd.Args[0]))), redhub.None
+//	}
+//	// "-ERR wrong number of arguments for 'get' command\r\n"
+func WrongArgs(cmd string) *ReplyError {
+	return &ReplyError{Msg: "ERR wrong number of arguments for '" + strings.ToLower(cmd) + "' command"}
+}
+
+// UnknownCommand returns the error Redis replies for a command it does not
+// know, quoting the command and the start of its arguments.
+//
+// Example:
+//
+//	resp.UnknownCommand(cmd.Args)
+//	// "ERR unknown command 'foo', with args beginning with: 'a' 'b' "
+func UnknownCommand(args [][]byte) *ReplyError {
+	var b strings.Builder
+	b.WriteString("ERR unknown command '")
+	if len(args) > 0 {
+		b.WriteString(truncateArg(args[0]))
+	}
+	b.WriteString("', with args beginning with: ")
+	for i := 1; i < len(args) && b.Len() < 128; i++ {
+		b.WriteString("'" + truncateArg(args[i]) + "' ")
+	}
+	return &ReplyError{Msg: b.String()}
+}
+
+// truncateArg shortens an argument quoted in an error message, as Redis does.
+func truncateArg(arg []byte) string {
+	const max = 128
+	if len(arg) > max {
+		arg = arg[:max]
+	}
+	return string(arg)
+}
+
+// NoPerm returns the error Redis replies when an ACL user may not run cmd.
+//
+// Example:
+//
+//	resp.NoPerm("default", "flushall")
+//	// "NOPERM User default has no permissions to run the 'flushall' command"
+func NoPerm(user, cmd string) *ReplyError {
+	return &ReplyError{Msg: "NOPERM User " + user + " has no permissions to run the '" + strings.ToLower(cmd) + "' command"}
+}
+
+// ParseError converts the message of an error reply, as received by a client,
+// to a typed error: a *RedirectError for well-formed MOVED and ASK replies, and
+// a *ReplyError otherwise.
+//
+// Example:
+//
+//	err := resp.ParseError("MOVED 3999 127.0.0.1:6381")
+//	// err.(*resp.RedirectError).Slot == 3999
+//
+//	err = resp.ParseError("WRONGTYPE Operation against a key holding the wrong kind of value")
+//	// errors.Is(err, resp.ErrWrongType) == true
+func ParseError(msg string) error {
+	switch code := errorCode(msg); code {
+	case CodeMoved, CodeAsk:
+		fields := strings.Fields(msg)
+		if len(fields) == 3 {
+			slot, err := strconv.Atoi(fields[1])
+			if err == nil && slot >= 0 {
+				return &RedirectError{Ask: code == CodeAsk, Slot: slot, Addr: fields[2]}
+			}
+		}
+	}
+	return &ReplyError{Msg: msg}
+}
+
+// AppendErr appends err as an error reply to b.
+//
+// Reply errors, and errors wrapping them, are written with their own message:
+// *ReplyError values such as ErrWrongType, *RedirectError values such as
+// Moved(slot, addr). Other errors are prefixed with the generic "ERR" code
+// unless their message already starts with an upper case code, the way
+// AppendAny writes errors.
+//
+// Example:
+//
+//	out = resp.AppendErr(out, errors.New("no such key")) // "-ERR no such key\r\n"
+//	out = resp.AppendErr(out, fmt.Errorf("set: %w", resp.ErrOOM))
+//	// "-OOM command not allowed when used memory > 'maxmemory'.\r\n"
+func AppendErr(b []byte, err error) []byte {
+	var reply *ReplyError
+	if errors.As(err, &reply) {
+		return AppendError(b, reply.Msg)
+	}
+	var redirect *RedirectError
+	if errors.As(err, &redirect) {
+		return AppendError(b, redirect.Error())
+	}
+	return AppendError(b, prefixERRIfNeeded(err.Error()))
+}
+
+// errorCode returns the first word of an error message.
+func errorCode(msg string) string {
+	if i := strings.IndexByte(msg, ' '); i >= 0 {
+		return msg[:i]
+	}
+	return msg
+}
@@ -0,0 +1,121 @@
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppendErr(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{"wrongtype", ErrWrongType, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{"noauth", ErrNoAuth, "-NOAUTH Authentication required.\r\n"},
+		{"busy", ErrBusy, "-BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE.\r\n"},
+		{"loading", ErrLoading, "-LOADING Redis is loading the dataset in memory\r\n"},
+		{"readonly", ErrReadOnly, "-READONLY You can't write against a read only replica.\r\n"},
+		{"execabort", ErrExecAbort, "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+		{"oom", ErrOOM, "-OOM command not allowed when used memory > 'maxmemory'.\r\n"},
+		{"noscript", ErrNoScript, "-NOSCRIPT No matching script. Please use EVAL.\r\n"},
+		{"noperm", NoPerm("alice", "FLUSHALL"), "-NOPERM User alice has no permissions to run the 'flushall' command\r\n"},
+		{"moved", Moved(3999, "127.0.0.1:6381"), "-MOVED 3999 127.0.0.1:6381\r\n"},
+		{"ask", Ask(3999, "127.0.0.1:6381"), "-ASK 3999 127.0.0.1:6381\r\n"},
+		{"wrong args", WrongArgs("GET"), "-ERR wrong number of arguments for 'get' command\r\n"},
+		{
+			"unknown command",
+			UnknownCommand([][]byte{[]byte("foo"), []byte("a"), []byte("b")}),
+			"-ERR unknown command 'foo', with args beginning with: 'a' 'b' \r\n",
+		},
+		{"unknown command without args", UnknownCommand([][]byte{[]byte("foo")}), "-ERR unknown command 'foo', with args beginning with: \r\n"},
+		{"wrapped", fmt.Errorf("set: %w", ErrOOM), "-OOM command not allowed when used memory > 'maxmemory'.\r\n"},
+		{"wrapped redirect", fmt.Errorf("get: %w", Moved(1, "h:1")), "-MOVED 1 h:1\r\n"},
+		{"plain", errors.New("no such key"), "-ERR no such key\r\n"},
+		{"plain with code", errors.New("NOTFOUND no such key"), "-NOTFOUND no such key\r\n"},
+		{"newlines", errors.New("a\r\nb"), "-ERR a  b\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, string(AppendErr(nil, tt.err)))
+			assert.Equal(t, tt.expected, string(AppendAny(nil, tt.err)))
+		})
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      string
+		expected error
+	}{
+		{"moved", "MOVED 3999 127.0.0.1:6381", &RedirectError{Slot: 3999, Addr: "127.0.0.1:6381"}},
+		{"ask", "ASK 12182 [::1]:7000", &RedirectError{Ask: true, Slot: 12182, Addr: "[::1]:7000"}},
+		{"malformed moved", "MOVED 3999", &ReplyError{Msg: "MOVED 3999"}},
+		{"bad slot", "MOVED x 127.0.0.1:6381", &ReplyError{Msg: "MOVED x 127.0.0.1:6381"}},
+		{"negative slot", "ASK -1 127.0.0.1:6381", &ReplyError{Msg: "ASK -1 127.0.0.1:6381"}},
+		{"wrongtype", ErrWrongType.Msg, ErrWrongType},
+		{"generic", "ERR bad", &ReplyError{Msg: "ERR bad"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ParseError(tt.msg)
+			assert.Equal(t, tt.expected, err)
+			assert.Equal(t, tt.msg, err.Error())
+		})
+	}
+}
+
+func TestReplyErrorIs(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		target   error
+		expected bool
+	}{
+		{"same code", ParseError("WRONGTYPE other wording"), ErrWrongType, true},
+		{"wrapped", fmt.Errorf("get: %w", ParseError("LOADING")), ErrLoading, true},
+		{"other code", ParseError("NOAUTH Authentication required."), ErrWrongType, false},
+		{"same generic", ParseError("ERR syntax error"), ErrSyntax, true},
+		{"other generic", ParseError("ERR syntax error"), ErrNotInteger, false},
+		{"not a reply error", errors.New("WRONGTYPE"), ErrWrongType, false},
+		{"redirect", ParseError("MOVED 1 h:1"), ErrWrongType, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, errors.Is(tt.err, tt.target))
+		})
+	}
+}
+
+func TestReplyErrorCode(t *testing.T) {
+	assert.Equal(t, CodeWrongType, ErrWrongType.Code())
+	assert.Equal(t, CodeErr, WrongArgs("get").Code())
+	assert.Equal(t, "LOADING", (&ReplyError{Msg: "LOADING"}).Code())
+	assert.Equal(t, "", (&ReplyError{}).Code())
+}
+
+func TestUnmarshalRedirect(t *testing.T) {
+	var s string
+	err := Unmarshal([]byte("-MOVED 3999 127.0.0.1:6381\r\n"), &s)
+	var redirect *RedirectError
+	assert.True(t, errors.As(err, &redirect))
+	assert.Equal(t, Moved(3999, "127.0.0.1:6381"), redirect)
+
+	var v interface{}
+	assert.NoError(t, Unmarshal([]byte("-WRONGTYPE x\r\n"), &v))
+	assert.True(t, errors.Is(v.(error), ErrWrongType))
+}
+
+func TestWriterWriteErr(t *testing.T) {
+	var w Writer
+	w.WriteErr(ErrNoScript)
+	w.WriteErr(errors.New("bad"))
+	assert.Equal(t, "-NOSCRIPT No matching script. Please use EVAL.\r\n-ERR bad\r\n", string(w.Bytes()))
+}
@@ -0,0 +1,171 @@
+package resp
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// field describes a struct field that takes part in RESP encoding and decoding.
+type field struct {
+	name      string       // key used in RESP, from the tag or the Go field name
+	index     []int        // index path for reflect.Value.FieldByIndex
+	typ       reflect.Type // type of the field
+	omitEmpty bool         // skip the field when encoding its zero value
+}
+
+// structInfo is the cached RESP view of a struct type.
+type structInfo struct {
+	fields []field
+	byName map[string]int // lower-cased name to position in fields
+}
+
+// structInfoCache maps a reflect.Type to its *structInfo.
+var structInfoCache sync.Map
+
+// cachedStructInfo returns the RESP field metadata of the struct type t.
+//
+// Fields are listed in declaration order. A field is controlled by its "resp"
+// tag, which holds an optional name followed by comma separated options:
+//
+//	Name string `resp:"name"`           // use "name" as the key
+//	Hits int    `resp:"hits,omitempty"` // skip when zero
+//	Meta Meta   `resp:",inline"`        // flatten Meta's fields into the parent
+//	Tmp  string `resp:"-"`              // ignore the field
+//
+// Anonymous struct fields without a tag name are inlined, as in encoding/json.
+// When several fields end up with the same name, the least nested one wins.
+func cachedStructInfo(t reflect.Type) *structInfo {
+	if si, ok := structInfoCache.Load(t); ok {
+		return si.(*structInfo)
+	}
+	si := newStructInfo(t)
+	actual, _ := structInfoCache.LoadOrStore(t, si)
+	return actual.(*structInfo)
+}
+
+func newStructInfo(t reflect.Type) *structInfo {
+	var all []field
+	collectFields(t, nil, map[reflect.Type]bool{}, &all)
+
+	// Resolve name conflicts in favour of the shallowest field, keeping the
+	// declaration order of the fields that remain.
+	depth := make(map[string]int, len(all))
+	for _, f := range all {
+		if d, ok := depth[f.name]; !ok || len(f.index) < d {
+			depth[f.name] = len(f.index)
+		}
+	}
+	si := &structInfo{byName: make(map[string]int, len(all))}
+	for _, f := range all {
+		if len(f.index) != depth[f.name] {
+			continue
+		}
+		key := strings.ToLower(f.name)
+		if _, dup := si.byName[key]; dup {
+			continue
+		}
+		si.byName[key] = len(si.fields)
+		si.fields = append(si.fields, f)
+	}
+	return si
+}
+
+func collectFields(t reflect.Type, index []int, visited map[reflect.Type]bool, out *[]field) {
+	if visited[t] {
+		return
+	}
+	visited[t] = true
+	defer delete(visited, t)
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("resp")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		inline := hasTagOption(opts, "inline")
+
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		idx := append(append([]int(nil), index...), i)
+		if ft.Kind() == reflect.Struct && (inline || (sf.Anonymous && name == "")) {
+			if !sf.IsExported() && (!sf.Anonymous || sf.Type.Kind() == reflect.Ptr) {
+				// Reflection can neither set nor allocate through these.
+				continue
+			}
+			collectFields(ft, idx, visited, out)
+			continue
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		*out = append(*out, field{
+			name:      name,
+			index:     idx,
+			typ:       sf.Type,
+			omitEmpty: hasTagOption(opts, "omitempty"),
+		})
+	}
+}
+
+func hasTagOption(opts, name string) bool {
+	for opts != "" {
+		var opt string
+		opt, opts, _ = strings.Cut(opts, ",")
+		if opt == name {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldByIndex returns the field of v at index. Nil embedded pointers on the way
+// are allocated when alloc is true; otherwise ok is false if one is found.
+func fieldByIndex(v reflect.Value, index []int, alloc bool) (fv reflect.Value, ok bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !alloc {
+					return reflect.Value{}, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// isEmptyValue reports whether v is left out by the omitempty option.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	case reflect.Struct:
+		if v.Type() == timeType {
+			return v.Interface().(time.Time).IsZero()
+		}
+	}
+	return false
+}
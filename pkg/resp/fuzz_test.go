@@ -0,0 +1,496 @@
+package resp
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// respSeeds are valid, truncated and malformed inputs shared by the fuzz
+// targets as their seed corpus.
+var respSeeds = []string{
+	"+OK\r\n",
+	"-ERR bad\r\n",
+	":42\r\n",
+	":-0\r\n",
+	"$5\r\nhello\r\n",
+	"$0\r\n\r\n",
+	"$-1\r\n",
+	"$-2\r\n",
+	"$9223372036854775806\r\nx\r\n",
+	"$+3\r\nabc\r\n",
+	"*-1\r\n",
+	"*0\r\n",
+	"*-3\r\n",
+	"*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n",
+	"*2\r\n$3\r\nGET\r\n$3\r\nke",
+	"*1\r\n*1\r\n*1\r\n:1\r\n",
+	"*2\r\n:1\r\n+two\r\n",
+	"*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\nPING\r\n",
+	"*1\r\n$4\r\nPI\nG\r\n",
+	"PING\r\n",
+	"SET key \"hello world\"\n",
+	"SET 'it\\'s' \"\\x41\\n\"\r\n",
+	"SET a\"b c\"\r\n",
+	"SET \"a\"b\r\n",
+	"\r\n",
+	"$13 SET key value\r\n",
+	"$4 PING\r\n$5 GET k\r\n",
+	"$x PING\r\n",
+	"$-5 PING\r\n",
+	"$14 SET k string \"a b\"\r\n",
+	"$14 SET k string \"\r\n",
+	"$9 SET k {\"a\r\n",
+	strings.Repeat("*1\r\n", 600) + ":1\r\n",
+}
+
+// refValue is a value decoded by refDecode, kept in a form that is easy to
+// compare.
+type refValue struct {
+	typ   Type
+	data  string
+	null  bool
+	elems []refValue
+}
+
+// refDecode is a reference RESP2 decoder, written for clarity rather than
+// speed, with the rules ReadNextRESP documents. It returns the length of the
+// value, or false if b does not start with a complete and valid value.
+func refDecode(b string, depth int) (refValue, int, bool) {
+	if b == "" {
+		return refValue{}, 0, false
+	}
+	nl := strings.IndexByte(b, '\n')
+	if nl < 2 || b[nl-1] != '\r' {
+		return refValue{}, 0, false
+	}
+	v := refValue{typ: Type(b[0]), data: b[1 : nl-1]}
+	n := nl + 1
+	switch v.typ {
+	case String, Error:
+		return v, n, true
+	case Integer:
+		digits := strings.TrimPrefix(v.data, "-")
+		if digits == "" || strings.Trim(digits, "0123456789") != "" {
+			return refValue{}, 0, false
+		}
+		return v, n, true
+	case Bulk, Array:
+	default:
+		return refValue{}, 0, false
+	}
+
+	// Lengths have at most 18 digits and an optional sign.
+	digits := strings.TrimLeft(v.data, "+-")
+	if len(v.data)-len(digits) > 1 || digits == "" || len(digits) > 18 ||
+		strings.Trim(digits, "0123456789") != "" {
+		return refValue{}, 0, false
+	}
+	count, _ := strconv.Atoi(strings.TrimPrefix(v.data, "+"))
+	if count < -1 {
+		return refValue{}, 0, false
+	}
+	v.data = ""
+	if count == -1 {
+		v.null = true
+		return v, n, true
+	}
+	if v.typ == Bulk {
+		if len(b)-n < count+2 || b[n+count:n+count+2] != "\r\n" {
+			return refValue{}, 0, false
+		}
+		v.data = b[n : n+count]
+		return v, n + count + 2, true
+	}
+	if count > 0 && depth == 0 {
+		return refValue{}, 0, false
+	}
+	for i := 0; i < count; i++ {
+		elem, m, ok := refDecode(b[n:], depth-1)
+		if !ok {
+			return refValue{}, 0, false
+		}
+		v.elems = append(v.elems, elem)
+		n += m
+	}
+	return v, n, true
+}
+
+// toRefValue converts a value returned by ReadNextRESP for comparison with
+// refDecode.
+func toRefValue(r RESP) refValue {
+	v := refValue{typ: r.Type, data: string(r.Data)}
+	switch r.Type {
+	case Bulk:
+		v.null = r.Data == nil
+	case Array:
+		v.data = ""
+		v.null = r.Count < 0
+		r.ForEach(func(elem RESP) bool {
+			v.elems = append(v.elems, toRefValue(elem))
+			return true
+		})
+	}
+	return v
+}
+
+func equalRefValues(a, b refValue) bool {
+	if a.typ != b.typ || a.data != b.data || a.null != b.null || len(a.elems) != len(b.elems) {
+		return false
+	}
+	for i := range a.elems {
+		if !equalRefValues(a.elems[i], b.elems[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// FuzzReadNextRESP checks ReadNextRESP against the reference decoder, and the
+// streaming Reader against ReadNextRESP. ReadNextRESPDepth and Reader.MaxDepth
+// are checked the same way with a lower limit.
+func FuzzReadNextRESP(f *testing.F) {
+	for _, seed := range respSeeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		n, r := ReadNextRESP(b)
+		ref, refN, ok := refDecode(string(b), DefaultMaxDepth)
+		if !ok {
+			refN = 0
+		}
+		if n != refN {
+			t.Fatalf("ReadNextRESP(%q) consumed %d bytes, reference %d", b, n, refN)
+		}
+		if n > 0 {
+			if !bytes.Equal(r.Raw, b[:n]) {
+				t.Fatalf("ReadNextRESP(%q).Raw = %q, want %q", b, r.Raw, b[:n])
+			}
+			if got := toRefValue(r); !equalRefValues(got, ref) {
+				t.Fatalf("ReadNextRESP(%q) = %+v, reference %+v", b, got, ref)
+			}
+		}
+
+		rd := NewReader(bytes.NewReader(b))
+		v, err := rd.ReadValue()
+		if (err == nil) != (n > 0) {
+			t.Fatalf("Reader.ReadValue(%q) error %v, ReadNextRESP consumed %d bytes", b, err, n)
+		}
+		if err == nil && !bytes.Equal(v.Raw, b[:n]) {
+			t.Fatalf("Reader.ReadValue(%q).Raw = %q, want %q", b, v.Raw, b[:n])
+		}
+
+		const depth = 2
+		n, _ = ReadNextRESPDepth(b, depth)
+		_, refN, ok = refDecode(string(b), depth)
+		if !ok {
+			refN = 0
+		}
+		if n != refN {
+			t.Fatalf("ReadNextRESPDepth(%q, %d) consumed %d bytes, reference %d", b, depth, n, refN)
+		}
+		rd = NewReader(bytes.NewReader(b))
+		rd.MaxDepth = depth
+		if _, err := rd.ReadValue(); (err == nil) != (n > 0) {
+			t.Fatalf("Reader.ReadValue(%q) with MaxDepth %d error %v, ReadNextRESPDepth consumed %d bytes", b, depth, err, n)
+		}
+	})
+}
+
+// parserFuzzConfigs are the Parser configurations exercised by FuzzParser.
+var parserFuzzConfigs = []*Parser{
+	commandParser,
+	nextCommandParser,
+	{},
+	{Telnet: true, Tile38: true, Copy: true},
+	{Telnet: true, Tile38: true, MaxBulkLen: 4, MaxMultiBulkLen: 2, MaxInlineLen: 8},
+}
+
+// FuzzParser checks every Parser configuration for consistent results: RESP
+// commands against ReadNextRESP, inline commands against the reference
+// sdssplitargs, and the RESP conversion of inline and Tile38 commands against
+// the parser itself.
+func FuzzParser(f *testing.F) {
+	for _, seed := range respSeeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		for _, p := range parserFuzzConfigs {
+			cmd, n, bulkLen, err := p.ReadStreamCommand(b, nil, 3)
+			if n < 0 || n > len(b) || (err != nil && n != 0) {
+				t.Fatalf("%+v: ReadStreamCommand(%q) = %d, %v", p, b, n, err)
+			}
+			if n == 0 || len(cmd.Args) == 0 {
+				continue
+			}
+			if bulkLen >= 0 {
+				if cmd.Kind != Redis || bulkLen <= 3 || bulkLen > p.maxBulkLen() {
+					t.Fatalf("%+v: ReadStreamCommand(%q) streams %d bytes", p, b, bulkLen)
+				}
+				continue
+			}
+			switch cmd.Kind {
+			case Redis:
+				if !bytes.Equal(cmd.Raw, b[:n]) {
+					t.Fatalf("%+v: ReadCommand(%q).Raw = %q", p, b, cmd.Raw)
+				}
+				m, r := ReadNextRESP(b)
+				if m != n || r.Type != Array || r.Count != len(cmd.Args) {
+					t.Fatalf("%+v: ReadCommand(%q) consumed %d bytes, ReadNextRESP %d", p, b, n, m)
+				}
+				i := 0
+				r.ForEach(func(elem RESP) bool {
+					if elem.Type != Bulk || !bytes.Equal(elem.Data, cmd.Args[i]) {
+						t.Fatalf("%+v: ReadCommand(%q) argument %d = %q, want %q", p, b, i, cmd.Args[i], elem.Data)
+					}
+					i++
+					return true
+				})
+			case Telnet:
+				line := bytes.TrimSuffix(b[:n-1], []byte("\r"))
+				want, ok := refSplitArgs(line)
+				if !ok || !equalArgs(cmd.Args, want) {
+					t.Fatalf("%+v: ReadCommand(%q) = %q, sdssplitargs %q", p, b, cmd.Args, want)
+				}
+			}
+			if cmd.Kind != Redis {
+				// The RESP conversion must parse back to the same arguments.
+				raw, m, err := (&Parser{}).ReadCommand(cmd.Raw, nil)
+				if err != nil || m != len(cmd.Raw) || !equalArgs(raw.Args, cmd.Args) {
+					t.Fatalf("%+v: ReadCommand(%q).Raw = %q does not parse back: %v", p, b, cmd.Raw, err)
+				}
+			}
+		}
+	})
+}
+
+// FuzzReadCommands checks that ReadCommands, ReadNextCommand and the streaming
+// Reader agree on the commands in a buffer.
+func FuzzReadCommands(f *testing.F) {
+	for _, seed := range respSeeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		cmds, leftover, err := ReadCommands(b)
+
+		rd := NewReader(bytes.NewReader(b))
+		for i, cmd := range cmds {
+			got, rerr := rd.ReadCommand()
+			if rerr != nil || !equalArgs(got.Args, cmd.Args) {
+				t.Fatalf("Reader.ReadCommand(%q) #%d = %q, %v; ReadCommands %q", b, i, got.Args, rerr, cmd.Args)
+			}
+		}
+		_, rerr := rd.ReadCommand()
+		switch {
+		case err != nil:
+			// ReadCommands drops the commands before the error; the Reader
+			// returns them and then fails on the same one.
+			for rerr == nil {
+				_, rerr = rd.ReadCommand()
+			}
+			if rerr == io.EOF {
+				t.Fatalf("ReadCommands(%q) failed with %v, Reader did not", b, err)
+			}
+		case len(leftover) == 0:
+			if rerr != io.EOF {
+				t.Fatalf("ReadCommands(%q) consumed everything, Reader returned %v", b, rerr)
+			}
+		default:
+			if rerr == nil || (rerr == io.EOF && len(bytes.TrimLeft(leftover, " \t\v\f\x00")) > 0) {
+				t.Fatalf("ReadCommands(%q) left %q, Reader returned %v", b, leftover, rerr)
+			}
+		}
+
+		// Without Tile38 commands, which only ReadNextCommand understands, and
+		// the empty commands it accepts, ReadNextCommand reads the same commands.
+		if bytes.HasPrefix(b, []byte("$")) || bytes.Contains(b, []byte("\n$")) ||
+			bytes.Contains(b, []byte("*0")) || bytes.Contains(b, []byte("*-")) {
+			return
+		}
+		packet := b
+		var next [][][]byte
+		for len(packet) > 0 {
+			complete, args, _, rest, nerr := ReadNextCommand(packet, nil)
+			if nerr != nil {
+				// Unlike ReadCommands, ReadNextCommand rejects quotes inside
+				// arguments.
+				if err == nil && nerr != errUnbalancedQuotes {
+					t.Fatalf("ReadNextCommand(%q) failed with %v, ReadCommands did not", packet, nerr)
+				}
+				return
+			}
+			if !complete {
+				break
+			}
+			if len(rest) >= len(packet) {
+				t.Fatalf("ReadNextCommand(%q) made no progress", packet)
+			}
+			if len(args) > 0 {
+				next = append(next, append([][]byte(nil), args...))
+			}
+			packet = rest
+		}
+		if err != nil {
+			return
+		}
+		if len(next) != len(cmds) {
+			t.Fatalf("ReadNextCommand(%q) read %d commands, ReadCommands %d", b, len(next), len(cmds))
+		}
+		for i := range next {
+			if !equalArgs(next[i], cmds[i].Args) {
+				t.Fatalf("ReadNextCommand(%q) #%d = %q, ReadCommands %q", b, i, next[i], cmds[i].Args)
+			}
+		}
+	})
+}
+
+// FuzzUnmarshal checks that Unmarshal never panics, and only accepts input
+// that ReadNextRESP reads as exactly one value.
+func FuzzUnmarshal(f *testing.F) {
+	for _, seed := range respSeeds {
+		f.Add([]byte(seed))
+	}
+	type record struct {
+		Name  string
+		Count int
+		Tags  []string
+		Attrs map[string]string
+		Next  *record
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var v interface{}
+		err := Unmarshal(b, &v)
+		if n, _ := ReadNextRESP(b); err == nil && n != len(b) {
+			t.Fatalf("Unmarshal(%q) accepted %d of %d bytes", b, n, len(b))
+		}
+		var s []string
+		_ = Unmarshal(b, &s)
+		var m map[string]int
+		_ = Unmarshal(b, &m)
+		var r record
+		_ = Unmarshal(b, &r)
+	})
+}
+
+// FuzzSplitInline checks splitInline against a line by line port of
+// sdssplitargs.
+func FuzzSplitInline(f *testing.F) {
+	for _, seed := range respSeeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, line []byte) {
+		args, err := splitInline(line, nil, false)
+		want, ok := refSplitArgs(line)
+		if (err == nil) != ok || !equalArgs(args, want) {
+			t.Fatalf("splitInline(%q) = %q, %v; sdssplitargs %q, %v", line, args, err, want, ok)
+		}
+	})
+}
+
+// refSplitArgs is sdssplitargs from Redis's sds.c, ported statement by
+// statement. Reading past the end of line yields the C string terminator.
+func refSplitArgs(line []byte) ([][]byte, bool) {
+	at := func(i int) byte {
+		if i < len(line) {
+			return line[i]
+		}
+		return 0
+	}
+	isHex := func(c byte) bool {
+		return strings.IndexByte("0123456789abcdefABCDEF", c) >= 0 && c != 0
+	}
+	hexVal := func(c byte) byte {
+		v, _ := strconv.ParseUint(string(c), 16, 8)
+		return byte(v)
+	}
+	isspace := func(c byte) bool { return c != 0 && strings.IndexByte(" \t\n\v\f\r", c) >= 0 }
+
+	var vector [][]byte
+	p := 0
+	for {
+		for at(p) != 0 && isspace(at(p)) {
+			p++
+		}
+		if at(p) == 0 {
+			return vector, true
+		}
+		inq, insq, done := false, false, false
+		current := []byte{}
+		for !done {
+			if inq {
+				if at(p) == '\\' && at(p+1) == 'x' && isHex(at(p+2)) && isHex(at(p+3)) {
+					current = append(current, hexVal(at(p+2))*16+hexVal(at(p+3)))
+					p += 3
+				} else if at(p) == '\\' && at(p+1) != 0 {
+					p++
+					c := at(p)
+					switch c {
+					case 'n':
+						c = '\n'
+					case 'r':
+						c = '\r'
+					case 't':
+						c = '\t'
+					case 'b':
+						c = '\b'
+					case 'a':
+						c = '\a'
+					}
+					current = append(current, c)
+				} else if at(p) == '"' {
+					if at(p+1) != 0 && !isspace(at(p+1)) {
+						return nil, false
+					}
+					done = true
+				} else if at(p) == 0 {
+					return nil, false
+				} else {
+					current = append(current, at(p))
+				}
+			} else if insq {
+				if at(p) == '\\' && at(p+1) == '\'' {
+					p++
+					current = append(current, '\'')
+				} else if at(p) == '\'' {
+					if at(p+1) != 0 && !isspace(at(p+1)) {
+						return nil, false
+					}
+					done = true
+				} else if at(p) == 0 {
+					return nil, false
+				} else {
+					current = append(current, at(p))
+				}
+			} else {
+				switch at(p) {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inq = true
+				case '\'':
+					insq = true
+				default:
+					current = append(current, at(p))
+				}
+			}
+			if at(p) != 0 {
+				p++
+			}
+		}
+		vector = append(vector, current)
+	}
+}
+
+func equalArgs(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,159 @@
+package resp
+
+import (
+	"math"
+	"strconv"
+	"unicode/utf8"
+)
+
+// respLine returns the first line of b without its terminator, and the length
+// of the line including the terminator.
+func respLine(b []byte) ([]byte, int) {
+	for i := 1; i < len(b); i++ {
+		if b[i] == '\n' {
+			return b[:i-1], i + 1
+		}
+	}
+	return b, len(b)
+}
+
+// appendJSON appends the RESP value at the start of b as JSON, and returns the
+// length of the value. Since the values come from a Writer or a Value, b is
+// assumed to be well-formed.
+func appendJSON(dst, b []byte) ([]byte, int) {
+	line, n := respLine(b)
+	data := line[1:]
+	switch b[0] {
+	case String, Error:
+		return appendJSONString(dst, data), n
+	case Integer, BigNumber:
+		return appendJSONInteger(dst, data), n
+	case Null:
+		return append(dst, "null"...), n
+	case Boolean:
+		return strconv.AppendBool(dst, len(data) > 0 && data[0] == 't'), n
+	case Double:
+		f, err := strconv.ParseFloat(string(data), 64)
+		if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+			return appendJSONString(dst, data), n
+		}
+		return strconv.AppendFloat(dst, f, 'g', -1, 64), n
+	case Bulk, BulkError, Verbatim:
+		size, _ := strconv.Atoi(string(data))
+		if size < 0 {
+			return append(dst, "null"...), n
+		}
+		text := b[n : n+size]
+		if b[0] == Verbatim && len(text) >= 4 {
+			text = text[4:] // drop the "txt:" format
+		}
+		return appendJSONString(dst, text), n + size + 2
+	case Array, Set, Push:
+		count, _ := strconv.Atoi(string(data))
+		if count < 0 {
+			return append(dst, "null"...), n
+		}
+		dst = append(dst, '[')
+		for i := 0; i < count; i++ {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			var m int
+			dst, m = appendJSON(dst, b[n:])
+			n += m
+		}
+		return append(dst, ']'), n
+	case Map:
+		count, _ := strconv.Atoi(string(data))
+		dst = append(dst, '{')
+		for i := 0; i < count; i++ {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			var m int
+			dst, m = appendJSONMember(dst, b[n:])
+			n += m
+		}
+		return append(dst, '}'), n
+	case Attribute:
+		count, _ := strconv.Atoi(string(data))
+		for i := 0; i < 2*count; i++ {
+			_, m := appendJSON(nil, b[n:])
+			n += m
+		}
+		var m int
+		dst, m = appendJSON(dst, b[n:])
+		return dst, n + m
+	}
+	return dst, len(b)
+}
+
+// appendJSONInteger appends the decimal integer text as a JSON number, which
+// must not have a plus sign or leading zeros.
+func appendJSONInteger(dst, text []byte) []byte {
+	neg := len(text) > 0 && text[0] == '-'
+	if len(text) > 0 && (text[0] == '-' || text[0] == '+') {
+		text = text[1:]
+	}
+	for len(text) > 1 && text[0] == '0' {
+		text = text[1:]
+	}
+	if len(text) == 0 {
+		return append(dst, '0')
+	}
+	if neg && string(text) != "0" {
+		dst = append(dst, '-')
+	}
+	return append(dst, text...)
+}
+
+// appendJSONMember appends the key/value pair at the start of b as a member of
+// a JSON object, and returns the length of the pair. Keys that are not strings
+// are converted to the text of their JSON value.
+func appendJSONMember(dst, b []byte) ([]byte, int) {
+	mark := len(dst)
+	dst, n := appendJSON(dst, b)
+	if len(dst) == mark || dst[mark] != '"' {
+		key := string(dst[mark:])
+		dst = appendJSONString(dst[:mark], []byte(key))
+	}
+	dst = append(dst, ':')
+	dst, m := appendJSON(dst, b[n:])
+	return dst, n + m
+}
+
+// appendJSONString appends s as a JSON string. Invalid UTF-8 is replaced with
+// U+FFFD, as encoding/json does.
+func appendJSONString(dst, s []byte) []byte {
+	const hex = "0123456789abcdef"
+	dst = append(dst, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				dst = append(dst, '\\', c)
+			case c == '\n':
+				dst = append(dst, '\\', 'n')
+			case c == '\r':
+				dst = append(dst, '\\', 'r')
+			case c == '\t':
+				dst = append(dst, '\\', 't')
+			case c < 0x20:
+				dst = append(dst, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+			default:
+				dst = append(dst, c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRune(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			dst = append(dst, `�`...)
+		} else {
+			dst = append(dst, s[i:i+size]...)
+		}
+		i += size
+	}
+	return append(dst, '"')
+}
@@ -0,0 +1,493 @@
+package resp
+
+import (
+	"bytes"
+	"strings"
+)
+
+// DefaultMaxMultiBulkLen is the largest number of command arguments accepted
+// by a Parser whose MaxMultiBulkLen is zero. Its other defaults are shared with
+// Reader: DefaultMaxBulkLen and DefaultMaxInlineLen.
+const DefaultMaxMultiBulkLen = DefaultMaxArrayLen
+
+var (
+	errTooBigMultiBulkCount = &errProtocol{"too big mbulk count string"}
+	errTooBigBulkCount      = &errProtocol{"too big bulk count string"}
+)
+
+// Parser parses commands sent by clients. Its fields select the protocols that
+// are accepted and how strictly they are checked; the zero value only accepts
+// RESP arrays of bulk strings, with the default limits.
+//
+// The package-level functions are shorthands for two configurations:
+//
+//	ReadCommand, ReadCommands, ReadStreamCommand: Parser{Telnet: true, RejectEmpty: true}
+//	ReadNextCommand: Parser{Telnet: true, Tile38: true, StrictInline: true}
+//
+// A Parser is never modified while parsing, so one Parser may be shared by any
+// number of goroutines.
+//
+// Example:
+//
+//	p := &resp.Parser{Telnet: true, Copy: true, MaxBulkLen: 1 << 20}
+//	cmd, n, err := p.ReadCommand(buf, nil)
+//	if err != nil {
+//	    return err // e.g. "Protocol error: invalid bulk length"
+//	}
+//	if n == 0 {
+//	    return nil // wait for more data
+//	}
+//	buf = buf[n:]
+type Parser struct {
+	// Telnet accepts inline commands: lines of space separated arguments that
+	// do not start with '*', as typed into telnet or nc. They are split like
+	// Redis does, including its quoting rules.
+	Telnet bool
+
+	// Tile38 accepts Tile38 native commands, which start with '$', such as
+	// "$13 SET key value\r\n". Without it such lines are parsed as inline
+	// commands, if Telnet is set.
+	Tile38 bool
+
+	// StrictInline rejects inline commands with a quote in the middle of an
+	// argument, such as foo"bar baz", with an "unbalanced quotes" error.
+	// Otherwise the quote starts a quoted part of the argument, as Redis does.
+	StrictInline bool
+
+	// RejectEmpty rejects multibulk commands with zero or a negative number of
+	// arguments, such as "*0\r\n", with an "invalid multibulk length" error.
+	// Otherwise they are consumed as empty commands, as Redis does.
+	RejectEmpty bool
+
+	// Copy makes every command own its data. By default the Raw and Args of a
+	// RESP command point into the parsed buffer and must be copied before the
+	// buffer is reused. Inline and Tile38 commands always own their data.
+	Copy bool
+
+	// MaxBulkLen is the largest accepted argument length. Zero means
+	// DefaultMaxBulkLen.
+	MaxBulkLen int
+
+	// MaxMultiBulkLen is the largest accepted number of arguments. Zero means
+	// DefaultMaxMultiBulkLen.
+	MaxMultiBulkLen int
+
+	// MaxInlineLen is the longest accepted inline command or header line. Zero
+	// means DefaultMaxInlineLen.
+	MaxInlineLen int
+}
+
+var (
+	// commandParser is used by ReadCommand, ReadCommands and ReadStreamCommand.
+	commandParser = &Parser{Telnet: true, RejectEmpty: true}
+
+	// nextCommandParser is used by ReadNextCommand.
+	nextCommandParser = &Parser{Telnet: true, Tile38: true, StrictInline: true}
+)
+
+func (p *Parser) maxBulkLen() int {
+	if p.MaxBulkLen > 0 {
+		return p.MaxBulkLen
+	}
+	return DefaultMaxBulkLen
+}
+
+func (p *Parser) maxMultiBulkLen() int {
+	if p.MaxMultiBulkLen > 0 {
+		return p.MaxMultiBulkLen
+	}
+	return DefaultMaxMultiBulkLen
+}
+
+func (p *Parser) maxInlineLen() int {
+	if p.MaxInlineLen > 0 {
+		return p.MaxInlineLen
+	}
+	return DefaultMaxInlineLen
+}
+
+// kind returns the protocol of a command starting with c, or false if that
+// protocol is not enabled.
+func (p *Parser) kind(c byte) (Kind, bool) {
+	switch {
+	case c == '*':
+		return Redis, true
+	case c == '$' && p.Tile38:
+		return Tile38, true
+	case p.Telnet:
+		return Telnet, true
+	}
+	return Redis, false
+}
+
+// ReadCommand parses a single command from the start of buf.
+//
+// The arguments are appended to args[:0], so a slice can be reused across calls
+// to avoid allocations. Unless Copy is set, the Raw and Args of RESP commands
+// point directly into buf.
+//
+// Returns:
+//   - Command: The parsed command. Args is empty when an empty command, such as
+//     an empty line, was consumed.
+//   - int: The number of bytes consumed, or 0 if buf holds an incomplete command
+//   - error: An error if the protocol is malformed or a limit is exceeded
+func (p *Parser) ReadCommand(buf []byte, args [][]byte) (Command, int, error) {
+	cmd, n, _, err := p.ReadStreamCommand(buf, args, 0)
+	return cmd, n, err
+}
+
+// ReadStreamCommand is like ReadCommand, but stops early at a final bulk argument
+// whose declared length is larger than threshold, as described for the
+// package-level ReadStreamCommand. A threshold less than or equal to zero
+// disables streaming.
+func (p *Parser) ReadStreamCommand(buf []byte, args [][]byte, threshold int) (cmd Command, n int, bulkLen int, err error) {
+	if len(buf) == 0 {
+		return Command{}, 0, -1, nil
+	}
+	kind, ok := p.kind(buf[0])
+	if !ok {
+		return Command{}, 0, -1, &errProtocol{"expected '*', got '" + string(buf[0]) + "'"}
+	}
+	switch kind {
+	case Redis:
+		cmd, n, bulkLen, err = p.parseMultiBulk(buf, args, threshold)
+		if p.Copy && n > 0 {
+			cmd = copyCommand(cmd)
+		}
+		return cmd, n, bulkLen, err
+	case Tile38:
+		cmd, n, err = p.parseTile38(buf, args)
+	default:
+		cmd, n, err = p.parseInline(buf, args)
+	}
+	return cmd, n, -1, err
+}
+
+// parseMultiBulk parses a RESP formatted command, an array of bulk strings:
+// "*<count>\r\n$<len1>\r\n<arg1>\r\n$<len2>\r\n<arg2>\r\n..."
+func (p *Parser) parseMultiBulk(b []byte, args [][]byte, threshold int) (Command, int, int, error) {
+	args = args[:0]
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		if len(b) > p.maxInlineLen() {
+			return Command{}, 0, -1, errTooBigMultiBulkCount
+		}
+		return Command{}, 0, -1, nil // Not enough data
+	}
+	if i < 2 || b[i-1] != '\r' {
+		return Command{}, 0, -1, errInvalidMultiBulkLength
+	}
+	count, ok := parseInt(b[1 : i-1])
+	if !ok || count > p.maxMultiBulkLen() {
+		return Command{}, 0, -1, errInvalidMultiBulkLength
+	}
+	i++
+	if count <= 0 {
+		if p.RejectEmpty {
+			return Command{}, 0, -1, errInvalidMultiBulkLength
+		}
+		return Command{Raw: b[:i], Args: args, Kind: Redis}, i, -1, nil
+	}
+	for j := 0; j < count; j++ {
+		if i >= len(b) {
+			return Command{}, 0, -1, nil // Not enough data
+		}
+		if b[i] != '$' {
+			return Command{}, 0, -1, &errProtocol{"expected '$', got '" + string(b[i]) + "'"}
+		}
+		si := i
+		e := bytes.IndexByte(b[i:], '\n')
+		if e < 0 {
+			if len(b)-i > p.maxInlineLen() {
+				return Command{}, 0, -1, errTooBigBulkCount
+			}
+			return Command{}, 0, -1, nil // Not enough data
+		}
+		i += e
+		if b[i-1] != '\r' {
+			return Command{}, 0, -1, errInvalidBulkLength
+		}
+		size, ok := parseInt(b[si+1 : i-1])
+		if !ok || size < 0 || size > p.maxBulkLen() {
+			return Command{}, 0, -1, errInvalidBulkLength
+		}
+		i++
+		if threshold > 0 && size > threshold && j == count-1 {
+			return Command{Raw: b[:i], Args: args, Kind: Redis}, i, size, nil
+		}
+		if size > len(b)-i-2 {
+			return Command{}, 0, -1, nil // Not enough data
+		}
+		if b[i+size] != '\r' || b[i+size+1] != '\n' {
+			return Command{}, 0, -1, errInvalidBulkLength
+		}
+		args = append(args, b[i:i+size])
+		i += size + 2
+	}
+	return Command{Raw: b[:i], Args: args, Kind: Redis}, i, -1, nil
+}
+
+// Needed returns the number of bytes buf must hold before ReadStreamCommand can
+// parse the incomplete command at its start, as far as the headers received so
+// far tell. For a RESP command whose bulk string is partly received, that is the
+// size up to the end of the bulk string, so a caller receiving a large argument
+// in parts can wait for it rather than parse it again on every read. It is at
+// least len(buf)+1, and is only meaningful after ReadStreamCommand returned 0
+// bytes without an error for buf and the same threshold.
+func (p *Parser) Needed(buf []byte, threshold int) int {
+	need := len(buf) + 1
+	if len(buf) == 0 || buf[0] != '*' {
+		return need
+	}
+	i := bytes.IndexByte(buf, '\n')
+	if i < 2 {
+		return need
+	}
+	count, ok := parseInt(buf[1 : i-1])
+	if !ok {
+		return need
+	}
+	i++
+	for j := 0; j < count && i < len(buf); j++ {
+		e := bytes.IndexByte(buf[i:], '\n')
+		if e < 2 || buf[i] != '$' {
+			return need
+		}
+		size, ok := parseInt(buf[i+1 : i+e-1])
+		if !ok || size < 0 || threshold > 0 && size > threshold && j == count-1 {
+			return need
+		}
+		i += e + 1 + size + 2
+	}
+	return max(i, need)
+}
+
+// copyCommand returns cmd with Raw copied into a new buffer and Args pointing
+// into that copy. Args are always sub-slices of Raw for RESP commands.
+func copyCommand(cmd Command) Command {
+	raw := append([]byte(nil), cmd.Raw...)
+	for i, arg := range cmd.Args {
+		off := cap(cmd.Raw) - cap(arg)
+		cmd.Args[i] = raw[off : off+len(arg) : off+len(arg)]
+	}
+	cmd.Raw = raw
+	return cmd
+}
+
+// parseTile38 parses a Tile38 native command: "$<len> <line>\r\n", where line
+// holds space separated arguments.
+func (p *Parser) parseTile38(b []byte, args [][]byte) (Command, int, error) {
+	args = args[:0]
+	sp := bytes.IndexByte(b, ' ')
+	if sp < 0 {
+		if len(b) > p.maxInlineLen() {
+			return Command{}, 0, errInvalidMessage
+		}
+		return Command{}, 0, nil // Not enough data
+	}
+	n, ok := parseInt(b[1:sp])
+	if !ok || n < 0 || n > p.maxBulkLen() {
+		return Command{}, 0, errInvalidMessage
+	}
+	i := sp + 1
+	if n > len(b)-i-2 {
+		return Command{}, 0, nil // Not enough data
+	}
+	if b[i+n] != '\r' || b[i+n+1] != '\n' {
+		return Command{}, 0, errInvalidMessage
+	}
+	line := b[i : i+n]
+reading:
+	for len(line) != 0 {
+		if line[0] == '{' {
+			// The native protocol cannot understand json boundaries so it assumes that
+			// a json element must be at the end of the line.
+			args = append(args, line)
+			break
+		}
+		if len(line) >= 2 && line[0] == '"' && line[len(line)-1] == '"' {
+			if len(args) > 0 &&
+				strings.EqualFold(string(args[0]), "set") &&
+				strings.EqualFold(string(args[len(args)-1]), "string") {
+				// Setting a string value that is contained inside double quotes.
+				// This is only because of the boundary issues of the native protocol.
+				args = append(args, line[1:len(line)-1])
+				break
+			}
+		}
+		for i := 0; i < len(line); i++ {
+			if line[i] == ' ' {
+				if i > 0 {
+					args = append(args, line[:i])
+				}
+				line = line[i+1:]
+				continue reading
+			}
+		}
+		args = append(args, line)
+		break
+	}
+	return Command{Raw: encodeArgs(args), Args: args, Kind: Tile38}, i + n + 2, nil
+}
+
+// parseInline parses an inline command terminated by "\n" or "\r\n".
+func (p *Parser) parseInline(b []byte, args [][]byte) (Command, int, error) {
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		if len(b) > p.maxInlineLen() {
+			return Command{}, 0, errTooBigInline
+		}
+		return Command{}, 0, nil // Not enough data
+	}
+	if i > p.maxInlineLen() {
+		return Command{}, 0, errTooBigInline
+	}
+	line := b[:i]
+	if i > 0 && b[i-1] == '\r' {
+		line = b[:i-1]
+	}
+	args, err := splitInline(line, args[:0], p.StrictInline)
+	if err != nil {
+		return Command{}, 0, err
+	}
+	if len(args) == 0 {
+		return Command{Kind: Telnet}, i + 1, nil
+	}
+	return Command{Raw: encodeArgs(args), Args: args, Kind: Telnet}, i + 1, nil
+}
+
+// SplitArgs splits a line into arguments with the grammar of inline commands,
+// which is also the grammar of the lines of redis.conf files. The arguments
+// do not reference line.
+//
+// Example:
+//
+//	args, err := resp.SplitArgs([]byte(`save "3600 1 300 100"`)) // [save, 3600 1 300 100]
+func SplitArgs(line []byte) ([][]byte, error) {
+	return splitInline(line, nil, false)
+}
+
+// splitInline splits an inline command line into arguments, which are appended
+// to args, following the grammar of sdssplitargs in Redis:
+//
+//   - Arguments are separated by spaces, tabs, "\r" and "\n".
+//   - A double or single quote starts a quoted part of the current argument,
+//     which may contain separators. Its closing quote must be followed by a
+//     separator or the end of the line.
+//   - Within double quotes, "\xHH" is the byte with the hex value HH, "\n",
+//     "\r", "\t", "\b" and "\a" are control characters, and a backslash takes
+//     any other character literally.
+//   - Within single quotes, only "\'" is an escape.
+//   - A NUL byte ends the line, as it does for the C string Redis splits.
+//
+// A quote that is left open, or a closing quote directly followed by another
+// character, is an "unbalanced quotes" error. With strict, so is a quote that
+// does not start its argument.
+func splitInline(line []byte, args [][]byte, strict bool) ([][]byte, error) {
+	if i := bytes.IndexByte(line, 0); i >= 0 {
+		line = line[:i]
+	}
+	// Arguments are never longer than the line, so buf never grows and the
+	// arguments can all point into it.
+	buf := make([]byte, 0, len(line))
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+		start := len(buf)
+		var quote byte
+	arg:
+		for ; ; i++ {
+			if i == len(line) {
+				if quote != 0 {
+					return nil, errUnbalancedQuotes
+				}
+				break
+			}
+			c := line[i]
+			switch {
+			case quote == '"' && c == '\\' && i+3 < len(line) && line[i+1] == 'x' &&
+				isHexDigit(line[i+2]) && isHexDigit(line[i+3]):
+				buf = append(buf, hexDigitVal(line[i+2])<<4|hexDigitVal(line[i+3]))
+				i += 3
+			case quote == '"' && c == '\\' && i+1 < len(line):
+				i++
+				switch c = line[i]; c {
+				case 'n':
+					c = '\n'
+				case 'r':
+					c = '\r'
+				case 't':
+					c = '\t'
+				case 'b':
+					c = '\b'
+				case 'a':
+					c = '\a'
+				}
+				buf = append(buf, c)
+			case quote == '\'' && c == '\\' && i+1 < len(line) && line[i+1] == '\'':
+				i++
+				buf = append(buf, '\'')
+			case quote != 0 && c == quote:
+				if i+1 < len(line) && !isSpace(line[i+1]) {
+					return nil, errUnbalancedQuotes
+				}
+				i++
+				break arg
+			case quote != 0:
+				buf = append(buf, c)
+			case c == ' ' || c == '\n' || c == '\r' || c == '\t':
+				break arg
+			case c == '"' || c == '\'':
+				if strict && len(buf) > start {
+					return nil, errUnbalancedQuotes
+				}
+				quote = c
+			default:
+				buf = append(buf, c)
+			}
+		}
+		args = append(args, buf[start:len(buf):len(buf)])
+	}
+}
+
+// isSpace reports whether c is a space character for the C isspace function.
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\v' || c == '\f' || c == '\r'
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexDigitVal(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	}
+	return c - '0'
+}
+
+// encodeArgs returns the RESP encoding of args, which are changed to point
+// into it so that the command owns its data.
+func encodeArgs(args [][]byte) []byte {
+	size := 16
+	for _, arg := range args {
+		size += len(arg) + 16
+	}
+	raw := AppendArray(make([]byte, 0, size), len(args))
+	for i, arg := range args {
+		raw = appendPrefix(raw, Bulk, int64(len(arg)))
+		start := len(raw)
+		raw = append(raw, arg...)
+		args[i] = raw[start:len(raw):len(raw)]
+		raw = append(raw, '\r', '\n')
+	}
+	return raw
+}
@@ -0,0 +1,344 @@
+package resp
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// parserConfigs are the configurations behind the package-level functions,
+// whose differing semantics are all covered by the tests below.
+var parserConfigs = map[string]*Parser{
+	"ReadCommand":     commandParser,
+	"ReadNextCommand": nextCommandParser,
+}
+
+func TestParserCommands(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		args  map[string][]string // expected args per configuration; nil means an error
+		n     int
+	}{
+		{
+			name:  "multibulk",
+			input: "*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n",
+			args:  map[string][]string{"ReadCommand": {"GET", "key"}, "ReadNextCommand": {"GET", "key"}},
+			n:     22,
+		},
+		{
+			name:  "empty multibulk",
+			input: "*0\r\n",
+			args:  map[string][]string{"ReadCommand": nil, "ReadNextCommand": {}},
+			n:     4,
+		},
+		{
+			name:  "inline",
+			input: "SET key value\r\n",
+			args:  map[string][]string{"ReadCommand": {"SET", "key", "value"}, "ReadNextCommand": {"SET", "key", "value"}},
+			n:     15,
+		},
+		{
+			name:  "inline quoted argument",
+			input: "SET key \"hello world\\n\"\n",
+			args:  map[string][]string{"ReadCommand": {"SET", "key", "hello world\n"}, "ReadNextCommand": {"SET", "key", "hello world\n"}},
+			n:     24,
+		},
+		{
+			name:  "quote inside argument",
+			input: "SET key it's\r\n",
+			args:  map[string][]string{"ReadCommand": nil, "ReadNextCommand": nil},
+		},
+		{
+			name:  "quote opening inside argument",
+			input: "SET key foo\"bar baz\"\r\n",
+			args:  map[string][]string{"ReadCommand": {"SET", "key", "foobar baz"}, "ReadNextCommand": nil},
+			n:     22,
+		},
+		{
+			name:  "text after closing quote",
+			input: "SET 'a'b\r\n",
+			args:  map[string][]string{"ReadCommand": nil, "ReadNextCommand": nil},
+		},
+		{
+			name:  "unbalanced quotes",
+			input: "SET 'a\r\n",
+			args:  map[string][]string{"ReadCommand": nil, "ReadNextCommand": nil},
+		},
+		{
+			name:  "tile38",
+			input: "$13 SET key value\r\n",
+			args:  map[string][]string{"ReadCommand": {"$13", "SET", "key", "value"}, "ReadNextCommand": {"SET", "key", "value"}},
+			n:     19,
+		},
+	}
+
+	for _, tt := range tests {
+		for name, p := range parserConfigs {
+			t.Run(tt.name+"/"+name, func(t *testing.T) {
+				cmd, n, err := p.ReadCommand([]byte(tt.input), nil)
+				expected := tt.args[name]
+				if expected == nil {
+					assert.Error(t, err)
+					assert.Equal(t, 0, n)
+					return
+				}
+				assert.NoError(t, err)
+				assert.Equal(t, tt.n, n)
+				args := make([]string, len(cmd.Args))
+				for i, arg := range cmd.Args {
+					args[i] = string(arg)
+				}
+				assert.Equal(t, expected, args)
+			})
+		}
+	}
+}
+
+// TestSplitInline covers the sdssplitargs grammar, including the edge cases of
+// the Redis test suite.
+func TestSplitInline(t *testing.T) {
+	tests := []struct {
+		line string
+		args []string // nil means an unbalanced quotes error
+	}{
+		{"", []string{}},
+		{" \t \v\f ", []string{}},
+		{"SET key value", []string{"SET", "key", "value"}},
+		{"  SET\tkey   value  ", []string{"SET", "key", "value"}},
+		{"SET key \"hello world\"", []string{"SET", "key", "hello world"}},
+		{"SET key 'hello world'", []string{"SET", "key", "hello world"}},
+		{"SET \"\" ''", []string{"SET", "", ""}},
+		{"foo\"bar baz\"", []string{"foo" + "bar baz"}},
+		{"\"\\x41\\x62\\x7e\\xff\"", []string{"Ab~\xff"}},
+		{"\"\\x4g\\xZ\"", []string{"x4gxZ"}},
+		{"\"\\n\\r\\t\\b\\a\\\\\\\"\\q\"", []string{"\n\r\t\b\a\\\"q"}},
+		{"'it\\'s \\n \\x41 \"'", []string{"it's \\n \\x41 \""}},
+		{"\"a\"\tb", []string{"a", "b"}},
+		{"\"a\"\vb", []string{"a", "b"}},
+		{"a\vb", []string{"a\vb"}},
+		{"GET a\x00b", []string{"GET", "a"}},
+		{"set \"\"\"test-key\"\"\" test-value", nil},
+		{"set \"\"test-key\"\" test-value", nil},
+		{"SET key \"unterminated", nil},
+		{"SET key 'unterminated", nil},
+		{"SET key it's", nil},
+		{"SET \"a\"b", nil},
+		{"SET 'a'b", nil},
+		{"SET \"a\\\"", nil},
+		{"SET \"a\x00\"", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			args, err := SplitArgs([]byte(tt.line))
+			if tt.args == nil {
+				assert.Equal(t, errUnbalancedQuotes, err)
+				assert.EqualError(t, err, "Protocol error: unbalanced quotes in request")
+				return
+			}
+			assert.NoError(t, err)
+			got := []string{}
+			for _, arg := range args {
+				got = append(got, string(arg))
+			}
+			assert.Equal(t, tt.args, got)
+		})
+	}
+}
+
+func TestParserStrictInline(t *testing.T) {
+	tests := []struct {
+		line    string
+		lenient []string // nil means an unbalanced quotes error
+		strict  []string
+	}{
+		{"SET key \"a b\" 'c'", []string{"SET", "key", "a b", "c"}, []string{"SET", "key", "a b", "c"}},
+		{"SET key foo\"bar baz\"", []string{"SET", "key", "foobar baz"}, nil},
+		{"SET key foo''", []string{"SET", "key", "foo"}, nil},
+		{"SET key it's", nil, nil},
+		{"SET \"a\"b", nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			for _, strict := range []bool{false, true} {
+				p := &Parser{Telnet: true, StrictInline: strict}
+				expected := tt.lenient
+				if strict {
+					expected = tt.strict
+				}
+				cmd, n, err := p.ReadCommand([]byte(tt.line+"\r\n"), nil)
+				if expected == nil {
+					assert.Equal(t, errUnbalancedQuotes, err, "strict %v", strict)
+					assert.Equal(t, 0, n)
+					continue
+				}
+				assert.NoError(t, err, "strict %v", strict)
+				args := make([]string, len(cmd.Args))
+				for i, arg := range cmd.Args {
+					args[i] = string(arg)
+				}
+				assert.Equal(t, expected, args, "strict %v", strict)
+			}
+		})
+	}
+}
+
+func TestParserNeeded(t *testing.T) {
+	tests := []struct {
+		name      string
+		buf       string
+		threshold int
+		need      int
+	}{
+		{"empty", "", 0, 1},
+		{"partial count", "*2", 0, 3},
+		{"no arguments yet", "*2\r\n", 0, 5},
+		{"partial length", "*2\r\n$3", 0, 7},
+		{"partial first argument", "*2\r\n$3\r\nGE", 0, 13},
+		{"partial second argument", "*2\r\n$3\r\nGET\r\n$10\r\nab", 0, 30},
+		{"second argument lacks CRLF", "*2\r\n$3\r\nGET\r\n$1\r\na", 0, 20},
+		{"partial streamed length", "*2\r\n$3\r\nSET\r\n$10", 4, 17},
+		{"inline", "GET fo", 0, 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Parser{Telnet: true}
+			_, n, _, err := p.ReadStreamCommand([]byte(tt.buf), nil, tt.threshold)
+			assert.NoError(t, err)
+			assert.Equal(t, 0, n)
+			assert.Equal(t, tt.need, p.Needed([]byte(tt.buf), tt.threshold))
+		})
+	}
+
+	// The command parses once that many bytes are buffered.
+	p := &Parser{}
+	buf := []byte("*2\r\n$3\r\nGET\r\n$10\r\n0123456789\r\n")
+	need := p.Needed(buf[:20], 0)
+	_, n, err := p.ReadCommand(buf[:need-1], nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	_, n, err = p.ReadCommand(buf[:need], nil)
+	assert.NoError(t, err)
+	assert.Equal(t, len(buf), n)
+}
+
+func TestParserKinds(t *testing.T) {
+	p := &Parser{Telnet: true, Tile38: true}
+	cmd, _, err := p.ReadCommand([]byte("*1\r\n$4\r\nPING\r\n"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, Redis, cmd.Kind)
+
+	cmd, _, err = p.ReadCommand([]byte("$4 PING\r\n"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, Tile38, cmd.Kind)
+	assert.Equal(t, "*1\r\n$4\r\nPING\r\n", string(cmd.Raw))
+
+	cmd, _, err = p.ReadCommand([]byte("PING\r\n"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, Telnet, cmd.Kind)
+	assert.Equal(t, "*1\r\n$4\r\nPING\r\n", string(cmd.Raw))
+
+	// Only RESP is accepted by the zero value.
+	_, _, err = (&Parser{}).ReadCommand([]byte("PING\r\n"), nil)
+	assert.EqualError(t, err, "Protocol error: expected '*', got 'P'")
+	_, _, err = (&Parser{}).ReadCommand([]byte("$4 PING\r\n"), nil)
+	assert.EqualError(t, err, "Protocol error: expected '*', got '$'")
+}
+
+func TestParserLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		parser Parser
+		input  string
+		err    string
+	}{
+		{"bulk length", Parser{MaxBulkLen: 4}, "*1\r\n$5\r\nhello\r\n", "Protocol error: invalid bulk length"},
+		{"multibulk length", Parser{MaxMultiBulkLen: 1}, "*2\r\n$1\r\na\r\n$1\r\nb\r\n", "Protocol error: invalid multibulk length"},
+		{"inline length", Parser{Telnet: true, MaxInlineLen: 8}, "PING " + strings.Repeat("a", 10) + "\r\n", "Protocol error: too big inline request"},
+		{"unterminated inline", Parser{Telnet: true, MaxInlineLen: 8}, strings.Repeat("a", 10), "Protocol error: too big inline request"},
+		{"unterminated multibulk count", Parser{MaxInlineLen: 8}, "*" + strings.Repeat("1", 10), "Protocol error: too big mbulk count string"},
+		{"unterminated bulk count", Parser{MaxInlineLen: 8}, "*1\r\n$" + strings.Repeat("1", 10), "Protocol error: too big bulk count string"},
+		{"tile38 length", Parser{Tile38: true, MaxBulkLen: 2}, "$4 PING\r\n", "Protocol error: invalid message"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, n, err := tt.parser.ReadCommand([]byte(tt.input), nil)
+			assert.EqualError(t, err, tt.err)
+			assert.Equal(t, 0, n)
+		})
+	}
+
+	// Below the limits the same input is only incomplete.
+	_, n, err := (&Parser{}).ReadCommand([]byte("*1\r\n$"+strings.Repeat("1", 10)), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestParserCopy(t *testing.T) {
+	buf := []byte("*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n")
+
+	cmd, _, err := (&Parser{}).ReadCommand(buf, nil)
+	assert.NoError(t, err)
+	assert.Same(t, &buf[0], &cmd.Raw[0])
+
+	cmd, _, err = (&Parser{Copy: true}).ReadCommand(buf, nil)
+	assert.NoError(t, err)
+	for i := range buf {
+		buf[i] = 'x'
+	}
+	assert.Equal(t, "*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n", string(cmd.Raw))
+	assert.Equal(t, [][]byte{[]byte("GET"), []byte("key")}, cmd.Args)
+	assert.Equal(t, 3, cap(cmd.Args[0]), "appending to an argument must not overwrite Raw")
+}
+
+func TestParserZeroAllocs(t *testing.T) {
+	buf := []byte("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n")
+	p := &Parser{Telnet: true}
+	args := make([][]byte, 0, 4)
+	allocs := testing.AllocsPerRun(100, func() {
+		cmd, _, _ := p.ReadCommand(buf, args)
+		args = cmd.Args[:0]
+	})
+	assert.Equal(t, 0.0, allocs)
+}
+
+func TestParserTile38LoneQuote(t *testing.T) {
+	// A string value made of a single double quote is not a quoted string.
+	input := []byte("$14 SET k string \"\r\n")
+	cmd, n, err := (&Parser{Tile38: true}).ReadCommand(input, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, len(input), n)
+	assert.Equal(t, [][]byte{[]byte("SET"), []byte("k"), []byte("string"), []byte(`"`)}, cmd.Args)
+
+	complete, args, kind, leftover, err := ReadNextCommand(input, nil)
+	assert.NoError(t, err)
+	assert.True(t, complete)
+	assert.Equal(t, Tile38, kind)
+	assert.Equal(t, cmd.Args, args)
+	assert.Empty(t, leftover)
+}
+
+func TestReadNextCommandCompat(t *testing.T) {
+	complete, args, kind, leftover, err := ReadNextCommand([]byte("$4 PING\r\n*1\r\n"), nil)
+	assert.NoError(t, err)
+	assert.True(t, complete)
+	assert.Equal(t, Tile38, kind)
+	assert.Equal(t, [][]byte{[]byte("PING")}, args)
+	assert.Equal(t, []byte("*1\r\n"), leftover)
+
+	complete, _, kind, leftover, err = ReadNextCommand(leftover, nil)
+	assert.NoError(t, err)
+	assert.False(t, complete)
+	assert.Equal(t, Redis, kind)
+	assert.Equal(t, []byte("*1\r\n"), leftover)
+
+	complete, _, kind, _, err = ReadNextCommand([]byte("GET 'a\r\n"), nil)
+	assert.Equal(t, errUnbalancedQuotes, err)
+	assert.False(t, complete)
+	assert.Equal(t, Telnet, kind)
+}
@@ -0,0 +1,274 @@
+package resp
+
+import (
+	"bufio"
+	"io"
+	"math"
+)
+
+// Default limits of a Reader created by NewReader. They match the defaults of
+// Redis itself.
+const (
+	// DefaultMaxBulkLen is the largest accepted bulk string, like Redis's
+	// proto-max-bulk-len.
+	DefaultMaxBulkLen = 512 * 1024 * 1024
+
+	// DefaultMaxArrayLen is the largest accepted number of array elements.
+	DefaultMaxArrayLen = math.MaxInt32
+
+	// DefaultMaxInlineLen is the longest accepted line, which bounds inline
+	// commands as well as simple strings, errors and integers.
+	DefaultMaxInlineLen = 64 * 1024
+
+	// DefaultMaxDepth is the largest number of arrays a value may be nested
+	// in. It bounds the recursion of ReadNextRESP and Unmarshal, which would
+	// otherwise exhaust the stack on a long run of "*1\r\n" headers.
+	DefaultMaxDepth = 512
+)
+
+// readChunkSize bounds how much a Reader allocates ahead of the data that has
+// actually arrived, so that a large declared bulk length alone cannot make it
+// allocate the whole length up front.
+const readChunkSize = 64 * 1024
+
+var (
+	errTooBigInline  = &errProtocol{"too big inline request"}
+	errInvalidLine   = &errProtocol{"expected '\\r\\n' line terminator"}
+	errUnknownPrefix = &errProtocol{"unknown type byte"}
+	errTooDeep       = &errProtocol{"too deeply nested reply"}
+)
+
+// Reader reads RESP values and commands incrementally from an io.Reader.
+//
+// Unlike ReadNextRESP and ReadCommands, which need the complete message in
+// memory, a Reader pulls exactly as much data from its source as each value
+// needs, which makes it suitable for net.Conn clients, AOF files and tests.
+//
+// The values and commands returned by a Reader reference its internal buffer
+// and are only valid until the next call to one of its Read methods. Copy any
+// data that must be retained.
+//
+// After a protocol error the position in the stream is unknown, so the Reader
+// should be discarded along with its source.
+//
+// Example:
+//
+//	conn, _ := net.Dial("tcp", "127.0.0.1:6379")
+//	w := resp.NewWriter(conn)
+//	r := resp.NewReader(conn)
+//
+//	w.WriteArray(1)
+//	w.WriteBulkString("PING")
+//	if err := w.Flush(); err != nil {
+//	    return err
+//	}
+//	reply, err := r.ReadValue()
+//	// reply.Type == resp.String, string(reply.Data) == "PONG"
+type Reader struct {
+	// MaxBulkLen is the largest accepted bulk string length.
+	MaxBulkLen int
+
+	// MaxArrayLen is the largest accepted number of array elements.
+	MaxArrayLen int
+
+	// MaxInlineLen is the longest accepted line, including inline commands.
+	MaxInlineLen int
+
+	// MaxDepth is the largest number of arrays a value may be nested in.
+	MaxDepth int
+
+	rd      *bufio.Reader
+	buf     []byte
+	args    [][]byte
+	pending []int // elements left in each open array, see readValue
+}
+
+// NewReader returns a Reader that reads from r using the default limits.
+// If r is already a *bufio.Reader, it is used directly.
+func NewReader(r io.Reader) *Reader {
+	rd, ok := r.(*bufio.Reader)
+	if !ok {
+		rd = bufio.NewReader(r)
+	}
+	return &Reader{
+		MaxBulkLen:   DefaultMaxBulkLen,
+		MaxArrayLen:  DefaultMaxArrayLen,
+		MaxInlineLen: DefaultMaxInlineLen,
+		MaxDepth:     DefaultMaxDepth,
+		rd:           rd,
+	}
+}
+
+// ReadValue reads the next complete RESP value, such as a server reply.
+//
+// It returns io.EOF if the source ends before the value starts, and
+// io.ErrUnexpectedEOF if it ends in the middle of the value.
+//
+// Example:
+//
+//	r := resp.NewReader(strings.NewReader("*2\r\n$3\r\nfoo\r\n:42\r\n"))
+//	v, err := r.ReadValue()
+//	// v.Type == resp.Array, v.Count == 2
+func (r *Reader) ReadValue() (RESP, error) {
+	r.buf = r.buf[:0]
+	if err := r.readValue(); err != nil {
+		return RESP{}, err
+	}
+	n, v := readNextRESP(r.buf, r.MaxDepth)
+	if n != len(r.buf) {
+		return RESP{}, errInvalidMessage
+	}
+	return v, nil
+}
+
+// ReadCommand reads the next command, either a RESP array of bulk strings or an
+// inline command terminated by a newline, as sent by clients to a server. Empty
+// inline commands are skipped.
+//
+// It returns io.EOF if the source ends before the command starts, and
+// io.ErrUnexpectedEOF if it ends in the middle of the command.
+//
+// Example:
+//
+//	r := resp.NewReader(strings.NewReader("*1\r\n$4\r\nPING\r\nGET key\r\n"))
+//	cmd, _ := r.ReadCommand() // cmd.Args == [][]byte{[]byte("PING")}
+//	cmd, _ = r.ReadCommand()  // cmd.Args == [][]byte{[]byte("GET"), []byte("key")}
+func (r *Reader) ReadCommand() (Command, error) {
+	for {
+		r.buf = r.buf[:0]
+		c, err := r.rd.Peek(1)
+		if err != nil {
+			return Command{}, err
+		}
+		multibulk := c[0] == '*'
+		if multibulk {
+			if err := r.readValue(); err != nil {
+				return Command{}, err
+			}
+		} else if err := r.readLine(); err != nil {
+			return Command{}, err
+		}
+		cmd, n, err := ReadCommand(r.buf, r.args)
+		if err != nil {
+			return Command{}, err
+		}
+		if n != len(r.buf) {
+			return Command{}, errInvalidBulkLength
+		}
+		if len(cmd.Args) == 0 {
+			continue
+		}
+		if multibulk {
+			// Inline commands own their arguments; only keep RESP ones for reuse.
+			r.args = cmd.Args[:0]
+		}
+		return cmd, nil
+	}
+}
+
+// readLine appends the next line, including its terminator, to r.buf.
+func (r *Reader) readLine() error {
+	start := len(r.buf)
+	for {
+		frag, err := r.rd.ReadSlice('\n')
+		r.buf = append(r.buf, frag...)
+		if len(r.buf)-start > r.MaxInlineLen {
+			return errTooBigInline
+		}
+		switch err {
+		case nil:
+			return nil
+		case bufio.ErrBufferFull:
+			continue
+		case io.EOF:
+			if len(r.buf) > 0 {
+				return io.ErrUnexpectedEOF
+			}
+		}
+		return err
+	}
+}
+
+// readValue appends the next complete RESP value to r.buf, checking the
+// structure and limits of every element on the way.
+func (r *Reader) readValue() error {
+	// pending holds the number of elements still to be read for every open
+	// array, innermost last.
+	pending := r.pending[:0]
+	defer func() { r.pending = pending[:0] }()
+	for {
+		start := len(r.buf)
+		if err := r.readLine(); err != nil {
+			return err
+		}
+		line := r.buf[start:]
+		if len(line) < 3 || line[len(line)-2] != '\r' {
+			return errInvalidLine
+		}
+		switch line[0] {
+		case Integer, String, Error:
+		case Bulk:
+			n, ok := parseInt(line[1 : len(line)-2])
+			if !ok || n < -1 || n > r.MaxBulkLen {
+				return errInvalidBulkLength
+			}
+			if n >= 0 {
+				if err := r.readBulk(n); err != nil {
+					return err
+				}
+			}
+		case Array:
+			n, ok := parseInt(line[1 : len(line)-2])
+			if !ok || n < -1 || n > r.MaxArrayLen {
+				return errInvalidMultiBulkLength
+			}
+			if n > 0 {
+				if len(pending) >= r.MaxDepth {
+					return errTooDeep
+				}
+				pending = append(pending, n)
+				continue
+			}
+		default:
+			return errUnknownPrefix
+		}
+		// A value is complete, which may complete the arrays around it.
+		for len(pending) > 0 {
+			pending[len(pending)-1]--
+			if pending[len(pending)-1] > 0 {
+				break
+			}
+			pending = pending[:len(pending)-1]
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+	}
+}
+
+// readBulk appends n bytes of bulk data and its terminator to r.buf.
+func (r *Reader) readBulk(n int) error {
+	remaining := n + 2
+	for remaining > 0 {
+		chunk := remaining
+		if chunk > readChunkSize {
+			chunk = readChunkSize
+		}
+		start := len(r.buf)
+		if cap(r.buf)-start < chunk {
+			r.buf = append(r.buf[:cap(r.buf)], make([]byte, chunk)...)[:start]
+		}
+		r.buf = r.buf[:start+chunk]
+		if _, err := io.ReadFull(r.rd, r.buf[start:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		remaining -= chunk
+	}
+	if r.buf[len(r.buf)-2] != '\r' || r.buf[len(r.buf)-1] != '\n' {
+		return errInvalidBulkLength
+	}
+	return nil
+}
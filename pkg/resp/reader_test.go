@@ -0,0 +1,128 @@
+package resp
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReaderReadValue(t *testing.T) {
+	input := "+OK\r\n-ERR bad\r\n:42\r\n$5\r\nhello\r\n$-1\r\n*-1\r\n" +
+		"*2\r\n*1\r\n$3\r\nfoo\r\n:7\r\n"
+	// OneByteReader makes every value arrive in many small reads.
+	r := NewReader(iotest.OneByteReader(strings.NewReader(input)))
+
+	expected := []struct {
+		typ  Type
+		data string
+	}{
+		{String, "OK"},
+		{Error, "ERR bad"},
+		{Integer, "42"},
+		{Bulk, "hello"},
+		{Bulk, ""},
+		{Array, ""},
+	}
+	for _, e := range expected {
+		v, err := r.ReadValue()
+		assert.NoError(t, err)
+		assert.Equal(t, e.typ, v.Type)
+		assert.Equal(t, e.data, string(v.Data))
+	}
+
+	v, err := r.ReadValue()
+	assert.NoError(t, err)
+	assert.Equal(t, Type(Array), v.Type)
+	assert.Equal(t, 2, v.Count)
+	var nested []interface{}
+	assert.NoError(t, Unmarshal(v.Raw, &nested))
+	assert.Equal(t, []interface{}{[]interface{}{"foo"}, int64(7)}, nested)
+
+	_, err = r.ReadValue()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReaderLargeBulk(t *testing.T) {
+	payload := bytes.Repeat([]byte("x"), 3*readChunkSize+5)
+	var w Writer
+	w.WriteBulk(payload)
+	r := NewReader(bytes.NewReader(w.b))
+	v, err := r.ReadValue()
+	assert.NoError(t, err)
+	assert.Equal(t, payload, v.Data)
+}
+
+func TestReaderReadCommand(t *testing.T) {
+	input := "*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n\r\nset a b\r\n*1\r\n$4\r\nPING\r\n"
+	r := NewReader(iotest.HalfReader(strings.NewReader(input)))
+
+	cmd, err := r.ReadCommand()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("GET"), []byte("key")}, cmd.Args)
+	assert.Equal(t, "*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n", string(cmd.Raw))
+
+	cmd, err = r.ReadCommand()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("set"), []byte("a"), []byte("b")}, cmd.Args)
+
+	cmd, err = r.ReadCommand()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("PING")}, cmd.Args)
+
+	_, err = r.ReadCommand()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReaderErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		setup func(r *Reader)
+		err   string
+	}{
+		{"truncated bulk", "$5\r\nhel", nil, io.ErrUnexpectedEOF.Error()},
+		{"truncated array", "*2\r\n:1\r\n", nil, io.ErrUnexpectedEOF.Error()},
+		{"truncated line", "+OK", nil, io.ErrUnexpectedEOF.Error()},
+		{"bad bulk length", "$x\r\n", nil, "Protocol error: invalid bulk length"},
+		{"bad bulk terminator", "$1\r\nab\r\n", nil, "Protocol error: invalid bulk length"},
+		{"bad array length", "*-2\r\n", nil, "Protocol error: invalid multibulk length"},
+		{"bare newline", "+OK\n", nil, "Protocol error: expected '\\r\\n' line terminator"},
+		{"unknown type", "?x\r\n", nil, "Protocol error: unknown type byte"},
+		{"bad integer", ":12a\r\n", nil, "Protocol error: invalid message"},
+		{"bulk limit", "$11\r\nhello world\r\n", func(r *Reader) { r.MaxBulkLen = 10 }, "Protocol error: invalid bulk length"},
+		{"array limit", "*3\r\n:1\r\n:2\r\n:3\r\n", func(r *Reader) { r.MaxArrayLen = 2 }, "Protocol error: invalid multibulk length"},
+		{"line limit", "+" + strings.Repeat("a", 16) + "\r\n", func(r *Reader) { r.MaxInlineLen = 8 }, "Protocol error: too big inline request"},
+		{"depth limit", "*1\r\n*1\r\n*1\r\n:1\r\n", func(r *Reader) { r.MaxDepth = 2 }, "Protocol error: too deeply nested reply"},
+		{"default depth limit", strings.Repeat("*1\r\n", DefaultMaxDepth+1) + ":1\r\n", nil, "Protocol error: too deeply nested reply"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReader(strings.NewReader(tt.input))
+			if tt.setup != nil {
+				tt.setup(r)
+			}
+			_, err := r.ReadValue()
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+}
+
+func TestReaderCommandErrors(t *testing.T) {
+	r := NewReader(strings.NewReader("*1\r\n:1\r\n"))
+	_, err := r.ReadCommand()
+	assert.EqualError(t, err, "Protocol error: expected '$', got ':'")
+
+	r = NewReader(strings.NewReader("GET 'key\r\n"))
+	_, err = r.ReadCommand()
+	assert.EqualError(t, err, "Protocol error: unbalanced quotes in request")
+
+	r = NewReader(strings.NewReader(strings.Repeat("a", 100) + "\r\n"))
+	r.MaxInlineLen = 50
+	_, err = r.ReadCommand()
+	assert.EqualError(t, err, "Protocol error: too big inline request")
+}
@@ -62,6 +62,22 @@
 //	out = resp.AppendAny(out, errors.New("ERR")) // Error
 //	out = resp.AppendAny(out, []int{1, 2, 3})   // Array
 //	out = resp.AppendAny(out, map[string]int{"a": 1}) // Array with key/value pairs
+//	out = resp.AppendAny(out, user)             // Array with key/value pairs, see AppendAny
+//
+// AppendAnyProto encodes maps and structs as RESP3 maps for clients that
+// switched protocols with HELLO 3.
+//
+// # Streaming
+//
+// NewReader and NewWriter read and write RESP incrementally over an io.Reader
+// or io.Writer, such as a net.Conn or a file:
+//
+//	r := resp.NewReader(conn)
+//	cmd, err := r.ReadCommand()
+//
+//	w := resp.NewWriter(conn)
+//	w.WriteString("OK")
+//	err = w.Flush()
 //
 // # Protocol Support
 //
@@ -77,6 +93,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Type represents the RESP data type identifier.
@@ -106,6 +123,44 @@ const (
 	Error = '-'
 )
 
+// RESP3 type identifier constants. They are only understood by clients that
+// switched to RESP3 with the HELLO command.
+const (
+	// Null represents the RESP3 null type: "_\r\n"
+	Null = '_'
+
+	// Boolean represents the RESP3 boolean type: "#t\r\n" or "#f\r\n"
+	Boolean = '#'
+
+	// Double represents the RESP3 double type: ",3.14\r\n", ",inf\r\n" or ",nan\r\n"
+	Double = ','
+
+	// BigNumber represents the RESP3 big number type: "(3492890328409238509324850943850943825024385\r\n"
+	BigNumber = '('
+
+	// BulkError represents the RESP3 bulk error type: "!21\r\nSYNTAX invalid syntax\r\n"
+	BulkError = '!'
+
+	// Verbatim represents the RESP3 verbatim string type: "=15\r\ntxt:Some string\r\n"
+	// The first three bytes give the format of the text, such as "txt" or "mkd".
+	Verbatim = '='
+
+	// Map represents the RESP3 map type: "%1\r\n+key\r\n+value\r\n"
+	// The count is the number of key/value pairs.
+	Map = '%'
+
+	// Set represents the RESP3 set type: "~2\r\n+a\r\n+b\r\n"
+	Set = '~'
+
+	// Attribute represents the RESP3 attribute type: "|1\r\n+key\r\n+value\r\n"
+	// It carries auxiliary key/value pairs for the value that follows it.
+	Attribute = '|'
+
+	// Push represents the RESP3 push type: ">2\r\n+message\r\n+hello\r\n"
+	// Push data is sent out of band, for example by Pub/Sub.
+	Push = '>'
+)
+
 // RESP represents a parsed RESP value.
 // It contains the type identifier, raw bytes, parsed data, and element count for arrays.
 type RESP struct {
@@ -143,7 +198,9 @@ func (r *RESP) ForEach(iter func(resp RESP) bool) {
 // ReadNextRESP parses the next RESP value from a byte slice.
 // It returns the number of bytes consumed and the parsed RESP value.
 //
-// If the input is incomplete or invalid, returns (0, RESP{}).
+// If the input is incomplete or invalid, returns (0, RESP{}). Arrays nested
+// more than DefaultMaxDepth levels deep are invalid; use ReadNextRESPDepth for
+// another limit.
 //
 // This function handles all RESP types:
 //   - Integer: Parses the integer value
@@ -159,6 +216,23 @@ func (r *RESP) ForEach(iter func(resp RESP) bool) {
 //	// resp.Type == resp.Integer
 //	// resp.Data == []byte("42")
 func ReadNextRESP(b []byte) (n int, resp RESP) {
+	return readNextRESP(b, DefaultMaxDepth)
+}
+
+// ReadNextRESPDepth is like ReadNextRESP, but arrays may be nested at most
+// maxDepth levels deep, as with Reader.MaxDepth. Lowering the limit bounds the
+// recursion spent on untrusted input.
+//
+// Example:
+//
+//	n, _ := resp.ReadNextRESPDepth([]byte("*1\r\n*1\r\n:1\r\n"), 1)
+//	// n == 0, the value is nested too deep
+func ReadNextRESPDepth(b []byte, maxDepth int) (n int, resp RESP) {
+	return readNextRESP(b, maxDepth)
+}
+
+// readNextRESP is ReadNextRESP with arrays limited to depth levels of nesting.
+func readNextRESP(b []byte, depth int) (n int, resp RESP) {
 	if len(b) == 0 {
 		return 0, RESP{} // no data to read
 	}
@@ -207,19 +281,20 @@ func ReadNextRESP(b []byte) (n int, resp RESP) {
 		// String, Error
 		return len(resp.Raw), resp
 	}
-	var err error
-	resp.Count, err = strconv.Atoi(string(resp.Data))
+	var ok bool
+	resp.Count, ok = parseInt(resp.Data)
+	if !ok || resp.Count < -1 {
+		return 0, RESP{} // invalid length, only -1 denotes null
+	}
 	if resp.Type == Bulk {
 		// Bulk
-		if err != nil {
-			return 0, RESP{} // invalid number of bytes
-		}
 		if resp.Count < 0 {
 			resp.Data = nil
 			resp.Count = 0
 			return len(resp.Raw), resp
 		}
-		if len(b) < i+resp.Count+2 {
+		// Compare without adding to Count, which could overflow.
+		if resp.Count > len(b)-i-2 {
 			return 0, RESP{} // not enough data
 		}
 		if b[i+resp.Count] != '\r' || b[i+resp.Count+1] != '\n' {
@@ -231,13 +306,13 @@ func ReadNextRESP(b []byte) (n int, resp RESP) {
 		return len(resp.Raw), resp
 	}
 	// Array
-	if err != nil {
-		return 0, RESP{} // invalid number of elements
+	if depth <= 0 && resp.Count > 0 {
+		return 0, RESP{} // nested too deep
 	}
 	var tn int
 	sdata := b[i:]
 	for j := 0; j < resp.Count; j++ {
-		rn, rresp := ReadNextRESP(sdata)
+		rn, rresp := readNextRESP(sdata, depth-1)
 		if rresp.Type == 0 {
 			return 0, RESP{}
 		}
@@ -295,203 +370,15 @@ var errInvalidMessage = &errProtocol{"invalid message"}
 func ReadNextCommand(packet []byte, argsbuf [][]byte) (
 	complete bool, args [][]byte, kind Kind, leftover []byte, err error,
 ) {
-	args = argsbuf[:0]
-	if len(packet) > 0 {
-		if packet[0] != '*' {
-			if packet[0] == '$' {
-				return readTile38Command(packet, args)
-			}
-			return readTelnetCommand(packet, args)
-		}
-		// standard redis command
-		for s, i := 1, 1; i < len(packet); i++ {
-			if packet[i] == '\n' {
-				if packet[i-1] != '\r' {
-					return false, args[:0], Redis, packet, errInvalidMultiBulkLength
-				}
-				count, ok := parseInt(packet[s : i-1])
-				if !ok || count < 0 {
-					return false, args[:0], Redis, packet, errInvalidMultiBulkLength
-				}
-				i++
-				if count == 0 {
-					return true, args[:0], Redis, packet[i:], nil
-				}
-			nextArg:
-				for j := 0; j < count; j++ {
-					if i == len(packet) {
-						break
-					}
-					if packet[i] != '$' {
-						return false, args[:0], Redis, packet,
-							&errProtocol{"expected '$', got '" +
-								string(packet[i]) + "'"}
-					}
-					for s := i + 1; i < len(packet); i++ {
-						if packet[i] == '\n' {
-							if packet[i-1] != '\r' {
-								return false, args[:0], Redis, packet, errInvalidBulkLength
-							}
-							n, ok := parseInt(packet[s : i-1])
-							if !ok || count <= 0 {
-								return false, args[:0], Redis, packet, errInvalidBulkLength
-							}
-							i++
-							if len(packet)-i >= n+2 {
-								if packet[i+n] != '\r' || packet[i+n+1] != '\n' {
-									return false, args[:0], Redis, packet, errInvalidBulkLength
-								}
-								args = append(args, packet[i:i+n])
-								i += n + 2
-								if j == count-1 {
-									// done reading
-									return true, args, Redis, packet[i:], nil
-								}
-								continue nextArg
-							}
-							break
-						}
-					}
-					break
-				}
-				break
-			}
-		}
-	}
-	return false, args[:0], Redis, packet, nil
-}
-
-func readTile38Command(packet []byte, argsbuf [][]byte) (
-	complete bool, args [][]byte, kind Kind, leftover []byte, err error,
-) {
-	for i := 1; i < len(packet); i++ {
-		if packet[i] == ' ' {
-			n, ok := parseInt(packet[1:i])
-			if !ok || n < 0 {
-				return false, args[:0], Tile38, packet, errInvalidMessage
-			}
-			i++
-			if len(packet) >= i+n+2 {
-				if packet[i+n] != '\r' || packet[i+n+1] != '\n' {
-					return false, args[:0], Tile38, packet, errInvalidMessage
-				}
-				line := packet[i : i+n]
-			reading:
-				for len(line) != 0 {
-					if line[0] == '{' {
-						// The native protocol cannot understand json boundaries so it assumes that
-						// a json element must be at the end of the line.
-						args = append(args, line)
-						break
-					}
-					if line[0] == '"' && line[len(line)-1] == '"' {
-						if len(args) > 0 &&
-							strings.ToLower(string(args[0])) == "set" &&
-							strings.ToLower(string(args[len(args)-1])) == "string" {
-							// Setting a string value that is contained inside double quotes.
-							// This is only because of the boundary issues of the native protocol.
-							args = append(args, line[1:len(line)-1])
-							break
-						}
-					}
-					i := 0
-					for ; i < len(line); i++ {
-						if line[i] == ' ' {
-							value := line[:i]
-							if len(value) > 0 {
-								args = append(args, value)
-							}
-							line = line[i+1:]
-							continue reading
-						}
-					}
-					args = append(args, line)
-					break
-				}
-				return true, args, Tile38, packet[i+n+2:], nil
-			}
-			break
-		}
+	if len(packet) == 0 {
+		return false, argsbuf[:0], Redis, packet, nil
 	}
-	return false, args[:0], Tile38, packet, nil
-}
-
-func readTelnetCommand(packet []byte, argsbuf [][]byte) (
-	complete bool, args [][]byte, kind Kind, leftover []byte, err error,
-) {
-	// just a plain text command
-	for i := 0; i < len(packet); i++ {
-		if packet[i] == '\n' {
-			var line []byte
-			if i > 0 && packet[i-1] == '\r' {
-				line = packet[:i-1]
-			} else {
-				line = packet[:i]
-			}
-			var quote bool
-			var quotech byte
-			var escape bool
-		outer:
-			for {
-				nline := make([]byte, 0, len(line))
-				for i := 0; i < len(line); i++ {
-					c := line[i]
-					if !quote {
-						if c == ' ' {
-							if len(nline) > 0 {
-								args = append(args, nline)
-							}
-							line = line[i+1:]
-							continue outer
-						}
-						if c == '"' || c == '\'' {
-							if i != 0 {
-								return false, args[:0], Telnet, packet, errUnbalancedQuotes
-							}
-							quotech = c
-							quote = true
-							line = line[i+1:]
-							continue outer
-						}
-					} else {
-						if escape {
-							escape = false
-							switch c {
-							case 'n':
-								c = '\n'
-							case 'r':
-								c = '\r'
-							case 't':
-								c = '\t'
-							}
-						} else if c == quotech {
-							quote = false
-							quotech = 0
-							args = append(args, nline)
-							line = line[i+1:]
-							if len(line) > 0 && line[0] != ' ' {
-								return false, args[:0], Telnet, packet, errUnbalancedQuotes
-							}
-							continue outer
-						} else if c == '\\' {
-							escape = true
-							continue
-						}
-					}
-					nline = append(nline, c)
-				}
-				if quote {
-					return false, args[:0], Telnet, packet, errUnbalancedQuotes
-				}
-				if len(line) > 0 {
-					args = append(args, line)
-				}
-				break
-			}
-			return true, args, Telnet, packet[i+1:], nil
-		}
+	kind, _ = nextCommandParser.kind(packet[0])
+	cmd, n, err := nextCommandParser.ReadCommand(packet, argsbuf)
+	if err != nil || n == 0 {
+		return false, argsbuf[:0], kind, packet, err
 	}
-	return false, args[:0], Telnet, packet, nil
+	return true, cmd.Args, cmd.Kind, packet[n:], nil
 }
 
 // appendPrefix will append a "$3\r\n" style redis prefix for a message.
@@ -795,8 +682,11 @@ type Marshaler interface {
 //	int, int8, int16, int32, int64 -> bulk string
 //	uint, uint8, uint16, uint32, uint64 -> bulk string
 //	float32, float64 -> bulk string
+//	time.Time -> bulk string in RFC 3339 format with nanoseconds
 //	[]T -> array (for any slice type)
 //	map[K]V -> array with key/value pairs (sorted by key for string keys)
+//	struct -> array with key/value pairs (in field declaration order)
+//	*T -> the value pointed to, or null for a nil pointer
 //	SimpleString -> simple string (not bulk)
 //	SimpleInt -> integer (not bulk)
 //	Marshaler -> raw bytes from MarshalRESP()
@@ -824,16 +714,102 @@ type Marshaler interface {
 //	// Map (sorted by key)
 //	out = resp.AppendAny(out, map[string]int{"a": 1, "b": 2})
 //	// "*4\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$1\r\n2\r\n"
+//
+// # Structs
+//
+// Structs are encoded like maps, with one key/value pair per exported field.
+// Field names and behaviour are controlled by "resp" struct tags:
+//
+//	type User struct {
+//	    Name    string    `resp:"name"`           // key "name" instead of "Name"
+//	    Email   string    `resp:"email,omitempty"` // left out when empty
+//	    Created time.Time `resp:"created"`        // "2024-01-02T15:04:05Z"
+//	    Meta    Meta      `resp:",inline"`        // Meta's fields are added to User's
+//	    Secret  string    `resp:"-"`              // never encoded
+//	    Address *Address  `resp:"address"`        // nested key/value array, or null
+//	}
+//
+// Fields keep their declaration order, so the output is deterministic. Embedded
+// structs without a tag name are inlined like ",inline" fields, and the fields of
+// a nil embedded pointer are left out. When several fields have the same name, the
+// least nested one is used. omitempty leaves out false, 0, "", nil pointers and
+// interfaces, empty slices and maps, and the zero time.Time. The field layout of
+// each struct type is computed once and cached.
+//
+// Unmarshal decodes the same layout back into a struct.
 func AppendAny(b []byte, v interface{}) []byte {
+	return appendAny(b, v, RESP2)
+}
+
+// Protocol is a RESP protocol version, as negotiated by a client with HELLO.
+type Protocol int
+
+// Supported protocol versions.
+const (
+	// RESP2 is the protocol spoken by default by every Redis client.
+	RESP2 Protocol = 2
+
+	// RESP3 adds, among others, native map and null types.
+	RESP3 Protocol = 3
+)
+
+// AppendAnyProto is like AppendAny, but encodes v for the given protocol version.
+// Returns the updated byte slice.
+//
+// With RESP2 the result is identical to AppendAny. With RESP3, maps and structs
+// are written as native maps ("%<count>\r\n" followed by the key/value pairs)
+// and nil values as the RESP3 null ("_\r\n"). All other types are unchanged.
+//
+// Example:
+//
+//	type Server struct {
+//	    Name string `resp:"name"`
+//	    Port int    `resp:"port"`
+//	}
+//
+//	out = resp.AppendAnyProto(out, Server{"redhub", 6379}, resp.RESP3)
+//	// "%2\r\n$4\r\nname\r\n$6\r\nredhub\r\n$4\r\nport\r\n$4\r\n6379\r\n"
+func AppendAnyProto(b []byte, v interface{}, proto Protocol) []byte {
+	return appendAny(b, v, proto)
+}
+
+// AppendMap appends a RESP3 map header to the input bytes.
+// Returns the updated byte slice.
+//
+// The format is "%<count>\r\n" where <count> is the number of key/value pairs.
+// After calling this, you should append each key followed by its value.
+// Only clients that switched to RESP3 with HELLO understand maps; use an array
+// of 2*n elements for RESP2 clients.
+//
+// Example:
+//
+//	out := []byte{}
+//	out = resp.AppendMap(out, 1)
+//	out = resp.AppendBulkString(out, "key")
+//	out = resp.AppendBulkString(out, "value")
+//	// Result: "%1\r\n$3\r\nkey\r\n$5\r\nvalue\r\n"
+func AppendMap(b []byte, n int) []byte {
+	return appendPrefix(b, Map, int64(n))
+}
+
+// appendMapHeader appends the header of n key/value pairs for proto.
+func appendMapHeader(b []byte, n int, proto Protocol) []byte {
+	if proto >= RESP3 {
+		return AppendMap(b, n)
+	}
+	return AppendArray(b, n*2)
+}
+
+func appendAny(b []byte, v interface{}, proto Protocol) []byte {
 	switch v := v.(type) {
 	case SimpleString:
 		b = AppendString(b, string(v))
 	case SimpleInt:
 		b = AppendInt(b, int64(v))
 	case nil:
-		b = AppendNull(b)
+		b = AppendNullProto(b, proto)
 	case error:
-		b = AppendError(b, prefixERRIfNeeded(v.Error()))
+		b = AppendErr(b, v)
 	case string:
 		b = AppendBulkString(b, v)
 	case []byte:
@@ -868,20 +844,29 @@ func AppendAny(b []byte, v interface{}) []byte {
 		b = AppendBulkFloat(b, float64(v))
 	case float64:
 		b = AppendBulkFloat(b, float64(v))
+	case time.Time:
+		b = AppendBulkString(b, v.Format(time.RFC3339Nano))
 	case Marshaler:
 		b = append(b, v.MarshalRESP()...)
 	default:
 		vv := reflect.ValueOf(v)
 		switch vv.Kind() {
+		case reflect.Ptr:
+			if vv.IsNil() {
+				return appendAny(b, nil, proto)
+			}
+			b = appendAny(b, vv.Elem().Interface(), proto)
+		case reflect.Struct:
+			b = appendStruct(b, vv, proto)
 		case reflect.Slice:
 			n := vv.Len()
 			b = AppendArray(b, n)
 			for i := 0; i < n; i++ {
-				b = AppendAny(b, vv.Index(i).Interface())
+				b = appendAny(b, vv.Index(i).Interface(), proto)
 			}
 		case reflect.Map:
 			n := vv.Len()
-			b = AppendArray(b, n*2)
+			b = appendMapHeader(b, n, proto)
 			var i int
 			var strKey bool
 			var strsKeyItems []strKeyItem
@@ -900,8 +885,8 @@ func AppendAny(b []byte, v interface{}) []byte {
 						key.(string), iter.Value().Interface(),
 					}
 				} else {
-					b = AppendAny(b, key)
-					b = AppendAny(b, iter.Value().Interface())
+					b = appendAny(b, key, proto)
+					b = appendAny(b, iter.Value().Interface(), proto)
 				}
 				i++
 			}
@@ -911,7 +896,7 @@ func AppendAny(b []byte, v interface{}) []byte {
 				})
 				for _, item := range strsKeyItems {
 					b = AppendBulkString(b, item.key)
-					b = AppendAny(b, item.value)
+					b = appendAny(b, item.value, proto)
 				}
 			}
 		default:
@@ -921,6 +906,36 @@ func AppendAny(b []byte, v interface{}) []byte {
 	return b
 }
 
+// appendStruct appends the fields of the struct v as key/value pairs, in the
+// order given by cachedStructInfo.
+func appendStruct(b []byte, v reflect.Value, proto Protocol) []byte {
+	si := cachedStructInfo(v.Type())
+
+	// Count the fields first, as the header precedes them. Fields behind nil
+	// embedded pointers and empty omitempty fields are left out.
+	values := make([]reflect.Value, len(si.fields))
+	n := 0
+	for i := range si.fields {
+		f := &si.fields[i]
+		fv, ok := fieldByIndex(v, f.index, false)
+		if !ok || (f.omitEmpty && isEmptyValue(fv)) {
+			continue
+		}
+		values[i] = fv
+		n++
+	}
+
+	b = appendMapHeader(b, n, proto)
+	for i, fv := range values {
+		if !fv.IsValid() {
+			continue
+		}
+		b = AppendBulkString(b, si.fields[i].name)
+		b = appendAny(b, fv.Interface(), proto)
+	}
+	return b
+}
+
 type strKeyItem struct {
 	key   string
 	value interface{}
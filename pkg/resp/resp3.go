@@ -0,0 +1,171 @@
+package resp
+
+import (
+	"math"
+	"strconv"
+)
+
+// AppendNullProto appends a null value for the given protocol version.
+// Returns the updated byte slice.
+//
+// RESP3 has a dedicated null type, "_\r\n"; RESP2 uses the null bulk string,
+// "$-1\r\n", as AppendNull does.
+//
+// Example:
+//
+//	out := []byte{}
+//	out = resp.AppendNullProto(out, resp.RESP3) // "_\r\n"
+//	out = resp.AppendNullProto(out, resp.RESP2) // "$-1\r\n"
+func AppendNullProto(b []byte, proto Protocol) []byte {
+	if proto >= RESP3 {
+		return append(b, Null, '\r', '\n')
+	}
+	return AppendNull(b)
+}
+
+// AppendBoolean appends a RESP3 boolean to the input bytes.
+// Returns the updated byte slice.
+//
+// The format is "#t\r\n" for true and "#f\r\n" for false.
+//
+// Example:
+//
+//	out := []byte{}
+//	out = resp.AppendBoolean(out, true) // "#t\r\n"
+func AppendBoolean(b []byte, t bool) []byte {
+	if t {
+		return append(b, Boolean, 't', '\r', '\n')
+	}
+	return append(b, Boolean, 'f', '\r', '\n')
+}
+
+// AppendDouble appends a RESP3 double to the input bytes.
+// Returns the updated byte slice.
+//
+// The format is ",<floating-point-number>\r\n". Infinities are written as "inf"
+// and "-inf", and NaN as "nan".
+//
+// Example:
+//
+//	out := []byte{}
+//	out = resp.AppendDouble(out, 3.14)        // ",3.14\r\n"
+//	out = resp.AppendDouble(out, math.Inf(1)) // ",inf\r\n"
+func AppendDouble(b []byte, f float64) []byte {
+	b = append(b, Double)
+	switch {
+	case math.IsInf(f, 1):
+		b = append(b, "inf"...)
+	case math.IsInf(f, -1):
+		b = append(b, "-inf"...)
+	case math.IsNaN(f):
+		b = append(b, "nan"...)
+	default:
+		b = strconv.AppendFloat(b, f, 'g', -1, 64)
+	}
+	return append(b, '\r', '\n')
+}
+
+// AppendBigNumber appends a RESP3 big number to the input bytes.
+// Returns the updated byte slice.
+//
+// The format is "(<number>\r\n". The number is written as given, so it must be
+// a valid decimal integer, such as the output of big.Int's String method.
+//
+// Example:
+//
+//	out := []byte{}
+//	out = resp.AppendBigNumber(out, "3492890328409238509324850943850943825024385")
+//	// "(3492890328409238509324850943850943825024385\r\n"
+func AppendBigNumber(b []byte, n string) []byte {
+	b = append(b, BigNumber)
+	b = append(b, n...)
+	return append(b, '\r', '\n')
+}
+
+// AppendBulkError appends a RESP3 bulk error to the input bytes.
+// Returns the updated byte slice.
+//
+// The format is "!<length>\r\n<message>\r\n". Unlike AppendError, the message
+// may contain newlines.
+//
+// Example:
+//
+//	out := []byte{}
+//	out = resp.AppendBulkError(out, "SYNTAX invalid syntax")
+//	// "!21\r\nSYNTAX invalid syntax\r\n"
+func AppendBulkError(b []byte, s string) []byte {
+	b = appendPrefix(b, BulkError, int64(len(s)))
+	b = append(b, s...)
+	return append(b, '\r', '\n')
+}
+
+// AppendVerbatim appends a RESP3 verbatim string to the input bytes.
+// Returns the updated byte slice.
+//
+// The format is "=<length>\r\n<format>:<text>\r\n", where format is exactly three
+// bytes, such as "txt" for plain text or "mkd" for markdown. Clients may use it
+// to display the text without escaping.
+//
+// Example:
+//
+//	out := []byte{}
+//	out = resp.AppendVerbatim(out, "txt", "Some string") // "=15\r\ntxt:Some string\r\n"
+func AppendVerbatim(b []byte, format, text string) []byte {
+	b = appendPrefix(b, Verbatim, int64(len(format)+1+len(text)))
+	b = append(b, format...)
+	b = append(b, ':')
+	b = append(b, text...)
+	return append(b, '\r', '\n')
+}
+
+// AppendSet appends a RESP3 set header to the input bytes.
+// Returns the updated byte slice.
+//
+// The format is "~<count>\r\n", followed by the count elements of the set.
+//
+// Example:
+//
+//	out := []byte{}
+//	out = resp.AppendSet(out, 2)
+//	out = resp.AppendBulkString(out, "a")
+//	out = resp.AppendBulkString(out, "b")
+//	// "~2\r\n$1\r\na\r\n$1\r\nb\r\n"
+func AppendSet(b []byte, n int) []byte {
+	return appendPrefix(b, Set, int64(n))
+}
+
+// AppendPush appends a RESP3 push header to the input bytes.
+// Returns the updated byte slice.
+//
+// The format is "><count>\r\n", followed by the count elements of the push
+// data. The first element is usually a bulk string naming the kind of data,
+// such as "message" for Pub/Sub.
+//
+// Example:
+//
+//	out := []byte{}
+//	out = resp.AppendPush(out, 3)
+//	out = resp.AppendBulkString(out, "message")
+//	out = resp.AppendBulkString(out, "news")
+//	out = resp.AppendBulkString(out, "hello")
+func AppendPush(b []byte, n int) []byte {
+	return appendPrefix(b, Push, int64(n))
+}
+
+// AppendAttribute appends a RESP3 attribute header to the input bytes.
+// Returns the updated byte slice.
+//
+// The format is "|<count>\r\n", followed by count key/value pairs. The
+// attribute describes the value written after it, and is not part of the reply
+// itself.
+//
+// Example:
+//
+//	out := []byte{}
+//	out = resp.AppendAttribute(out, 1)
+//	out = resp.AppendBulkString(out, "ttl")
+//	out = resp.AppendInt(out, 3600)
+//	out = resp.AppendBulkString(out, "value")
+func AppendAttribute(b []byte, n int) []byte {
+	return appendPrefix(b, Attribute, int64(n))
+}
@@ -2,7 +2,9 @@ package resp
 
 import (
 	"errors"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -377,6 +379,76 @@ func (f MarshalerFunc) MarshalRESP() []byte {
 	return f()
 }
 
+type appendMeta struct {
+	Version int `resp:"version"`
+}
+
+type AppendOwner struct {
+	Owner string `resp:"owner"`
+}
+
+type appendItem struct {
+	*AppendOwner
+	appendMeta
+	Name    string            `resp:"name"`
+	Email   string            `resp:"email,omitempty"`
+	Extra   map[string]string `resp:"extra,omitempty"`
+	Created time.Time         `resp:"created"`
+	Parent  *appendItem       `resp:"parent"`
+	Secret  string            `resp:"-"`
+	Stats   struct {
+		Hits int `resp:"hits"`
+	} `resp:",inline"`
+	Tags    []string
+	private string
+}
+
+func TestAppendAnyStruct(t *testing.T) {
+	created := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	item := appendItem{Name: "a", Created: created, Secret: "s", private: "p"}
+	item.Version = 3
+	item.Stats.Hits = 7
+	item.Tags = []string{"x"}
+
+	expected := "*12\r\n" +
+		"$7\r\nversion\r\n$1\r\n3\r\n" +
+		"$4\r\nname\r\n$1\r\na\r\n" +
+		"$7\r\ncreated\r\n$20\r\n2024-01-02T15:04:05Z\r\n" +
+		"$6\r\nparent\r\n$-1\r\n" +
+		"$4\r\nhits\r\n$1\r\n7\r\n" +
+		"$4\r\nTags\r\n*1\r\n$1\r\nx\r\n"
+	assert.Equal(t, expected, string(AppendAny(nil, item)))
+
+	// Pointers are followed, and embedded pointers add their fields once set.
+	item.AppendOwner = &AppendOwner{Owner: "o"}
+	item.Email = "e@x"
+	out := AppendAny(nil, &item)
+	assert.True(t, strings.HasPrefix(string(out), "*16\r\n$5\r\nowner\r\n$1\r\no\r\n$7\r\nversion\r\n"))
+	assert.Contains(t, string(out), "$5\r\nemail\r\n$3\r\ne@x\r\n")
+
+	// The encoding round-trips through Unmarshal.
+	var decoded appendItem
+	assert.NoError(t, Unmarshal(out, &decoded))
+	item.Secret, item.private = "", ""
+	assert.Equal(t, item, decoded)
+}
+
+func TestAppendAnyNilPointer(t *testing.T) {
+	var item *appendItem
+	assert.Equal(t, []byte("$-1\r\n"), AppendAny(nil, item))
+}
+
+func TestAppendAnyProto(t *testing.T) {
+	type pair struct {
+		A int    `resp:"a"`
+		B string `resp:"b,omitempty"`
+	}
+	assert.Equal(t, "*2\r\n$1\r\na\r\n$1\r\n1\r\n", string(AppendAnyProto(nil, pair{A: 1}, RESP2)))
+	assert.Equal(t, "%1\r\n$1\r\na\r\n$1\r\n1\r\n", string(AppendAnyProto(nil, pair{A: 1}, RESP3)))
+	assert.Equal(t, "%1\r\n$1\r\nk\r\n_\r\n", string(AppendAnyProto(nil, map[string]interface{}{"k": nil}, RESP3)))
+	assert.Equal(t, "*1\r\n%0\r\n", string(AppendAnyProto(nil, []map[int]int{{}}, RESP3)))
+}
+
 func TestAppendTile38(t *testing.T) {
 	result := AppendTile38(nil, []byte("SET key value"))
 	assert.Equal(t, []byte("$13 SET key value\r\n"), result)
@@ -458,6 +530,10 @@ func TestReadNextRESP_Invalid(t *testing.T) {
 		{"empty", []byte{}},
 		{"unknown type", []byte("?test\r\n")},
 		{"missing cr", []byte("+test\n")},
+		{"bulk length overflow", []byte("$9223372036854775806\r\nx\r\n")},
+		{"negative bulk length", []byte("$-2\r\n")},
+		{"negative array length", []byte("*-3\r\n")},
+		{"too deep", []byte(strings.Repeat("*1\r\n", DefaultMaxDepth+1) + ":1\r\n")},
 	}
 
 	for _, tt := range tests {
@@ -469,6 +545,31 @@ func TestReadNextRESP_Invalid(t *testing.T) {
 	}
 }
 
+func TestReadNextRESP_Depth(t *testing.T) {
+	input := []byte(strings.Repeat("*1\r\n", DefaultMaxDepth) + "*0\r\n")
+	n, resp := ReadNextRESP(input)
+	assert.Equal(t, len(input), n)
+	assert.Equal(t, Type(Array), resp.Type)
+}
+
+func TestReadNextRESPDepth(t *testing.T) {
+	input := []byte("*1\r\n*1\r\n:1\r\n")
+
+	n, resp := ReadNextRESPDepth(input, 2)
+	assert.Equal(t, len(input), n)
+	assert.Equal(t, Type(Array), resp.Type)
+
+	n, resp = ReadNextRESPDepth(input, 1)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, RESP{}, resp)
+
+	n, _ = ReadNextRESPDepth([]byte("*1\r\n*0\r\n"), 1)
+	assert.Equal(t, 8, n)
+
+	n, _ = ReadNextRESPDepth([]byte(":1\r\n"), 0)
+	assert.Equal(t, 4, n)
+}
+
 func TestForEach(t *testing.T) {
 	input := []byte("*3\r\n$3\r\nfoo\r\n$3\r\nbar\r\n$3\r\nbaz\r\n")
 	_, resp := ReadNextRESP(input)
@@ -0,0 +1,43 @@
+package resp
+
+import "strconv"
+
+// convertTile38 replaces the complete value written since w.start with its
+// Tile38 native reply (see SetKind).
+func (w *Writer) convertTile38() {
+	if len(w.b) == w.start {
+		return
+	}
+	w.scratch = appendTile38Reply(w.scratch[:0], w.b[w.start:])
+	w.b = AppendTile38(w.b[:w.start], w.scratch)
+	w.start = len(w.b)
+}
+
+// appendTile38Reply appends the JSON object Tile38 replies with for the RESP
+// value b.
+func appendTile38Reply(dst, b []byte) []byte {
+	switch b[0] {
+	case Error, BulkError:
+		dst = append(dst, `{"ok":false,"err":`...)
+		dst, _ = appendJSON(dst, b)
+		return append(dst, '}')
+	case String:
+		if string(b) == "+OK\r\n" {
+			return append(dst, `{"ok":true}`...)
+		}
+	case Map:
+		dst = append(dst, `{"ok":true`...)
+		line, n := respLine(b)
+		count, _ := strconv.Atoi(string(line[1:]))
+		for i := 0; i < count; i++ {
+			dst = append(dst, ',')
+			var m int
+			dst, m = appendJSONMember(dst, b[n:])
+			n += m
+		}
+		return append(dst, '}')
+	}
+	dst = append(dst, `{"ok":true,"result":`...)
+	dst, _ = appendJSON(dst, b)
+	return append(dst, '}')
+}
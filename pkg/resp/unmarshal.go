@@ -0,0 +1,456 @@
+package resp
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// ErrInvalidRESP is returned by Unmarshal when the input is not exactly one
+// complete, well-formed RESP value.
+var ErrInvalidRESP = errors.New("resp: invalid RESP value")
+
+// Unmarshaler is the interface implemented by types that can unmarshal a RESP
+// representation of themselves. It mirrors Marshaler: UnmarshalRESP receives the
+// complete raw RESP value, including its type marker and terminators.
+//
+// UnmarshalRESP must copy the data if it wishes to retain it after returning.
+//
+// Example:
+//
+//	type Point struct{ X, Y int }
+//
+//	func (p *Point) UnmarshalRESP(data []byte) error {
+//	    var xy []int
+//	    if err := resp.Unmarshal(data, &xy); err != nil {
+//	        return err
+//	    }
+//	    if len(xy) != 2 {
+//	        return errors.New("point needs two coordinates")
+//	    }
+//	    p.X, p.Y = xy[0], xy[1]
+//	    return nil
+//	}
+type Unmarshaler interface {
+	UnmarshalRESP(data []byte) error
+}
+
+// UnmarshalTypeError describes a RESP value that cannot be stored in a Go
+// value of a specific type.
+type UnmarshalTypeError struct {
+	Value string       // description of the RESP value, e.g. "array" or "bulk string \"abc\""
+	Type  reflect.Type // type of the Go value it could not be assigned to
+	Field string       // the struct field holding the Go value, if any
+}
+
+// Error returns a description of the mismatch.
+func (e *UnmarshalTypeError) Error() string {
+	if e.Field != "" {
+		return "resp: cannot unmarshal " + e.Value + " into Go struct field " +
+			e.Field + " of type " + e.Type.String()
+	}
+	return "resp: cannot unmarshal " + e.Value + " into Go value of type " + e.Type.String()
+}
+
+// InvalidUnmarshalError describes an invalid argument passed to Unmarshal.
+// The argument must be a non-nil pointer.
+type InvalidUnmarshalError struct {
+	Type reflect.Type
+}
+
+// Error returns a description of the invalid argument.
+func (e *InvalidUnmarshalError) Error() string {
+	if e.Type == nil {
+		return "resp: Unmarshal(nil)"
+	}
+	if e.Type.Kind() != reflect.Ptr {
+		return "resp: Unmarshal(non-pointer " + e.Type.String() + ")"
+	}
+	return "resp: Unmarshal(nil " + e.Type.String() + ")"
+}
+
+var (
+	durationType    = reflect.TypeOf(time.Duration(0))
+	unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	errorType       = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Unmarshal parses the RESP-encoded data and stores the result in the value
+// pointed to by v. data must contain exactly one complete RESP value.
+//
+// The conversion rules are the reverse of AppendAny:
+//
+//	integer, simple string, bulk string -> string, []byte, bool, int*, uint*, float*
+//	array -> slice, array, or map/struct (from flat key/value pairs)
+//	null -> nil pointer, slice, map or interface; other values are zeroed
+//	error -> returned as a *ReplyError, or *RedirectError (see ParseError)
+//	any value -> Unmarshaler, pointer (allocated as needed), interface{}
+//
+// Numbers are parsed from their text when they arrive as strings, as Redis often
+// sends them that way. Booleans accept integers and strconv.ParseBool syntax. A
+// time.Duration accepts a Go duration string such as "1.5s", or a plain number,
+// which is taken to be in seconds like most Redis timeouts. A time.Time accepts
+// an RFC 3339 string, as written by AppendAny, or an integer Unix time.
+//
+// Structs are filled from arrays of alternating field names and values, such as
+// the replies of HGETALL or CONFIG GET. Names are matched case-insensitively
+// against the "resp" struct tag, or the field name if there is no tag; unknown
+// names are ignored. See AppendAny for the tag syntax.
+//
+// An interface{} receives int64 for integers, string for simple and bulk
+// strings, []interface{} for arrays, the result of ParseError for errors and nil
+// for nulls.
+//
+// If a value cannot be stored in its target, Unmarshal returns an
+// *UnmarshalTypeError after decoding the remaining values as far as possible.
+//
+// Input that ReadNextRESP does not accept, including arrays nested more than
+// DefaultMaxDepth levels deep, is rejected with ErrInvalidRESP.
+//
+// Example:
+//
+//	var user struct {
+//	    Name string        `resp:"name"`
+//	    Age  int           `resp:"age"`
+//	    TTL  time.Duration `resp:"ttl"`
+//	}
+//	data := []byte("*6\r\n$4\r\nname\r\n$3\r\nbob\r\n$3\r\nage\r\n:42\r\n$3\r\nttl\r\n:60\r\n")
+//	err := resp.Unmarshal(data, &user)
+//	// user.Name == "bob", user.Age == 42, user.TTL == time.Minute
+func Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return &InvalidUnmarshalError{reflect.TypeOf(v)}
+	}
+	n, r := ReadNextRESP(data)
+	if n == 0 || n != len(data) {
+		return ErrInvalidRESP
+	}
+	var d decoder
+	d.value(r, rv.Elem(), "")
+	return d.err
+}
+
+// decoder keeps the first error found while decoding a value.
+type decoder struct {
+	err error
+}
+
+func (d *decoder) saveError(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *decoder) typeError(r RESP, t reflect.Type, fieldName string) {
+	d.saveError(&UnmarshalTypeError{Value: describeRESP(r), Type: t, Field: fieldName})
+}
+
+// describeRESP returns a short description of r for error messages.
+func describeRESP(r RESP) string {
+	switch r.Type {
+	case Integer:
+		return "integer " + string(r.Data)
+	case String:
+		return "simple string " + strconv.Quote(string(r.Data))
+	case Bulk:
+		if r.Data == nil {
+			return "null"
+		}
+		return "bulk string " + strconv.Quote(string(r.Data))
+	case Array:
+		if r.Count < 0 {
+			return "null"
+		}
+		return "array"
+	case Error:
+		return "error"
+	}
+	return "unknown value"
+}
+
+// isNull reports whether r is a RESP2 null bulk string or null array.
+func isNull(r RESP) bool {
+	return (r.Type == Bulk && r.Data == nil) || (r.Type == Array && r.Count < 0)
+}
+
+// isText reports whether r carries its value as text.
+func isText(r RESP) bool {
+	return r.Type == Integer || r.Type == String || r.Type == Bulk
+}
+
+// value decodes r into v, which must be settable.
+func (d *decoder) value(r RESP, v reflect.Value, fieldName string) {
+	// Unmarshaler takes precedence over all other rules, including nulls.
+	if v.Kind() != reflect.Ptr && v.CanAddr() && v.Addr().Type().Implements(unmarshalerType) {
+		v = v.Addr()
+	}
+	if v.Kind() == reflect.Ptr && v.Type().Implements(unmarshalerType) {
+		if v.IsNil() {
+			if isNull(r) {
+				return
+			}
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		if err := v.Interface().(Unmarshaler).UnmarshalRESP(r.Raw); err != nil {
+			d.saveError(err)
+		}
+		return
+	}
+
+	if r.Type == Error {
+		if v.Kind() == reflect.Interface && (v.NumMethod() == 0 || v.Type() == errorType) {
+			v.Set(reflect.ValueOf(ParseError(string(r.Data))))
+			return
+		}
+		d.saveError(ParseError(string(r.Data)))
+		return
+	}
+
+	if v.Kind() == reflect.Ptr {
+		if isNull(r) {
+			v.Set(reflect.Zero(v.Type()))
+			return
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		d.value(r, v.Elem(), fieldName)
+		return
+	}
+
+	if isNull(r) {
+		v.Set(reflect.Zero(v.Type()))
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			d.typeError(r, v.Type(), fieldName)
+			return
+		}
+		v.Set(reflect.ValueOf(genericValue(r)))
+	case reflect.String:
+		if !isText(r) {
+			d.typeError(r, v.Type(), fieldName)
+			return
+		}
+		v.SetString(string(r.Data))
+	case reflect.Bool:
+		if !isText(r) {
+			d.typeError(r, v.Type(), fieldName)
+			return
+		}
+		b, err := strconv.ParseBool(string(r.Data))
+		if err != nil {
+			d.typeError(r, v.Type(), fieldName)
+			return
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if !isText(r) {
+			d.typeError(r, v.Type(), fieldName)
+			return
+		}
+		if v.Type() == durationType {
+			dur, ok := parseDuration(string(r.Data))
+			if !ok {
+				d.typeError(r, v.Type(), fieldName)
+				return
+			}
+			v.SetInt(int64(dur))
+			return
+		}
+		n, err := strconv.ParseInt(string(r.Data), 10, v.Type().Bits())
+		if err != nil {
+			d.typeError(r, v.Type(), fieldName)
+			return
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if !isText(r) {
+			d.typeError(r, v.Type(), fieldName)
+			return
+		}
+		n, err := strconv.ParseUint(string(r.Data), 10, v.Type().Bits())
+		if err != nil {
+			d.typeError(r, v.Type(), fieldName)
+			return
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		if !isText(r) {
+			d.typeError(r, v.Type(), fieldName)
+			return
+		}
+		f, err := strconv.ParseFloat(string(r.Data), v.Type().Bits())
+		if err != nil {
+			d.typeError(r, v.Type(), fieldName)
+			return
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 && isText(r) {
+			v.SetBytes(append([]byte{}, r.Data...))
+			return
+		}
+		if r.Type != Array {
+			d.typeError(r, v.Type(), fieldName)
+			return
+		}
+		s := reflect.MakeSlice(v.Type(), r.Count, r.Count)
+		var i int
+		r.ForEach(func(e RESP) bool {
+			d.value(e, s.Index(i), fieldName)
+			i++
+			return true
+		})
+		v.Set(s)
+	case reflect.Array:
+		if r.Type != Array {
+			d.typeError(r, v.Type(), fieldName)
+			return
+		}
+		var i int
+		r.ForEach(func(e RESP) bool {
+			if i < v.Len() {
+				d.value(e, v.Index(i), fieldName)
+			}
+			i++
+			return true
+		})
+		for ; i < v.Len(); i++ {
+			v.Index(i).Set(reflect.Zero(v.Type().Elem()))
+		}
+	case reflect.Map:
+		if r.Type != Array || r.Count%2 != 0 {
+			d.typeError(r, v.Type(), fieldName)
+			return
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(v.Type(), r.Count/2))
+		}
+		var key reflect.Value
+		r.ForEach(func(e RESP) bool {
+			if !key.IsValid() {
+				key = reflect.New(v.Type().Key()).Elem()
+				d.value(e, key, fieldName)
+				return true
+			}
+			elem := reflect.New(v.Type().Elem()).Elem()
+			d.value(e, elem, fieldName)
+			v.SetMapIndex(key, elem)
+			key = reflect.Value{}
+			return true
+		})
+	case reflect.Struct:
+		if v.Type() == timeType && isText(r) {
+			t, ok := parseTime(r)
+			if !ok {
+				d.typeError(r, v.Type(), fieldName)
+				return
+			}
+			v.Set(reflect.ValueOf(t))
+			return
+		}
+		if r.Type != Array || r.Count%2 != 0 {
+			d.typeError(r, v.Type(), fieldName)
+			return
+		}
+		si := cachedStructInfo(v.Type())
+		var f *field
+		var isValue bool
+		r.ForEach(func(e RESP) bool {
+			if !isValue {
+				isValue = true
+				f = nil
+				if isText(e) {
+					if i, ok := si.byName[toLower(e.Data)]; ok {
+						f = &si.fields[i]
+					}
+				}
+				return true
+			}
+			isValue = false
+			if f != nil {
+				fv, _ := fieldByIndex(v, f.index, true)
+				d.value(e, fv, v.Type().Name()+"."+f.name)
+			}
+			return true
+		})
+	default:
+		d.typeError(r, v.Type(), fieldName)
+	}
+}
+
+// genericValue converts r into the value stored in an empty interface.
+func genericValue(r RESP) interface{} {
+	switch r.Type {
+	case Integer:
+		n, err := strconv.ParseInt(string(r.Data), 10, 64)
+		if err != nil {
+			return string(r.Data)
+		}
+		return n
+	case String, Bulk:
+		if r.Data == nil {
+			return nil
+		}
+		return string(r.Data)
+	case Error:
+		return &ReplyError{Msg: string(r.Data)}
+	case Array:
+		if r.Count < 0 {
+			return nil
+		}
+		vals := make([]interface{}, 0, r.Count)
+		r.ForEach(func(e RESP) bool {
+			vals = append(vals, genericValue(e))
+			return true
+		})
+		return vals
+	}
+	return nil
+}
+
+// parseDuration parses a Go duration string or a plain number of seconds.
+func parseDuration(s string) (time.Duration, bool) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Duration(n) * time.Second, true
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(f * float64(time.Second)), true
+	}
+	d, err := time.ParseDuration(s)
+	return d, err == nil
+}
+
+// parseTime parses an RFC 3339 time, as written by AppendAny, or a Unix time
+// in seconds when r is an integer.
+func parseTime(r RESP) (time.Time, bool) {
+	if r.Type == Integer {
+		n, err := strconv.ParseInt(string(r.Data), 10, 64)
+		return time.Unix(n, 0), err == nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, string(r.Data))
+	return t, err == nil
+}
+
+// toLower returns the ASCII lower-case version of b as a string.
+func toLower(b []byte) string {
+	for _, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			l := make([]byte, len(b))
+			for i, c := range b {
+				if c >= 'A' && c <= 'Z' {
+					c += 'a' - 'A'
+				}
+				l[i] = c
+			}
+			return string(l)
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,259 @@
+package resp
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnmarshalScalars(t *testing.T) {
+	t.Run("int from integer", func(t *testing.T) {
+		var v int
+		assert.NoError(t, Unmarshal([]byte(":-42\r\n"), &v))
+		assert.Equal(t, -42, v)
+	})
+	t.Run("int from bulk", func(t *testing.T) {
+		var v int64
+		assert.NoError(t, Unmarshal([]byte("$3\r\n123\r\n"), &v))
+		assert.Equal(t, int64(123), v)
+	})
+	t.Run("uint", func(t *testing.T) {
+		var v uint16
+		assert.NoError(t, Unmarshal([]byte(":65535\r\n"), &v))
+		assert.Equal(t, uint16(65535), v)
+	})
+	t.Run("float", func(t *testing.T) {
+		var v float64
+		assert.NoError(t, Unmarshal([]byte("$4\r\n3.25\r\n"), &v))
+		assert.Equal(t, 3.25, v)
+	})
+	t.Run("string from simple string", func(t *testing.T) {
+		var v string
+		assert.NoError(t, Unmarshal([]byte("+OK\r\n"), &v))
+		assert.Equal(t, "OK", v)
+	})
+	t.Run("string from integer", func(t *testing.T) {
+		var v string
+		assert.NoError(t, Unmarshal([]byte(":7\r\n"), &v))
+		assert.Equal(t, "7", v)
+	})
+	t.Run("bytes are copied", func(t *testing.T) {
+		data := []byte("$5\r\nhello\r\n")
+		var v []byte
+		assert.NoError(t, Unmarshal(data, &v))
+		data[4] = 'j'
+		assert.Equal(t, []byte("hello"), v)
+	})
+	t.Run("empty bulk", func(t *testing.T) {
+		var v []byte
+		assert.NoError(t, Unmarshal([]byte("$0\r\n\r\n"), &v))
+		assert.NotNil(t, v)
+		assert.Len(t, v, 0)
+	})
+	t.Run("bool", func(t *testing.T) {
+		var v bool
+		assert.NoError(t, Unmarshal([]byte(":1\r\n"), &v))
+		assert.True(t, v)
+		assert.NoError(t, Unmarshal([]byte("$5\r\nfalse\r\n"), &v))
+		assert.False(t, v)
+	})
+}
+
+func TestUnmarshalDuration(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected time.Duration
+	}{
+		{"integer seconds", ":60\r\n", time.Minute},
+		{"bulk seconds", "$2\r\n10\r\n", 10 * time.Second},
+		{"fractional seconds", "$3\r\n1.5\r\n", 1500 * time.Millisecond},
+		{"go duration", "$5\r\n250ms\r\n", 250 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var d time.Duration
+			assert.NoError(t, Unmarshal([]byte(tt.input), &d))
+			assert.Equal(t, tt.expected, d)
+		})
+	}
+}
+
+func TestUnmarshalNull(t *testing.T) {
+	t.Run("pointer", func(t *testing.T) {
+		s := "old"
+		v := &s
+		assert.NoError(t, Unmarshal([]byte("$-1\r\n"), &v))
+		assert.Nil(t, v)
+	})
+	t.Run("slice", func(t *testing.T) {
+		v := []string{"a"}
+		assert.NoError(t, Unmarshal([]byte("*-1\r\n"), &v))
+		assert.Nil(t, v)
+	})
+	t.Run("value is zeroed", func(t *testing.T) {
+		v := 5
+		assert.NoError(t, Unmarshal([]byte("$-1\r\n"), &v))
+		assert.Equal(t, 0, v)
+	})
+}
+
+func TestUnmarshalPointer(t *testing.T) {
+	var v *int
+	assert.NoError(t, Unmarshal([]byte(":3\r\n"), &v))
+	if assert.NotNil(t, v) {
+		assert.Equal(t, 3, *v)
+	}
+}
+
+func TestUnmarshalSlice(t *testing.T) {
+	var v []int
+	assert.NoError(t, Unmarshal([]byte("*3\r\n:1\r\n$1\r\n2\r\n:3\r\n"), &v))
+	assert.Equal(t, []int{1, 2, 3}, v)
+
+	var nested [][]string
+	assert.NoError(t, Unmarshal([]byte("*2\r\n*1\r\n+a\r\n*0\r\n"), &nested))
+	assert.Equal(t, [][]string{{"a"}, {}}, nested)
+}
+
+func TestUnmarshalArray(t *testing.T) {
+	v := [3]int{9, 9, 9}
+	assert.NoError(t, Unmarshal([]byte("*2\r\n:1\r\n:2\r\n"), &v))
+	assert.Equal(t, [3]int{1, 2, 0}, v)
+}
+
+func TestUnmarshalMap(t *testing.T) {
+	var v map[string]int
+	data := []byte("*4\r\n$1\r\na\r\n:1\r\n$1\r\nb\r\n$1\r\n2\r\n")
+	assert.NoError(t, Unmarshal(data, &v))
+	assert.Equal(t, map[string]int{"a": 1, "b": 2}, v)
+
+	err := Unmarshal([]byte("*1\r\n$1\r\na\r\n"), &v)
+	var te *UnmarshalTypeError
+	assert.True(t, errors.As(err, &te))
+}
+
+type UnmarshalBase struct {
+	ID int `resp:"id"`
+}
+
+type unmarshalUser struct {
+	*UnmarshalBase
+	Name    string        `resp:"name"`
+	Age     int           `resp:"age,omitempty"`
+	TTL     time.Duration `resp:"ttl"`
+	Tags    []string
+	Skipped string `resp:"-"`
+	hidden  string
+}
+
+func TestUnmarshalStruct(t *testing.T) {
+	w := Writer{}
+	w.WriteArray(16)
+	for _, s := range []string{
+		"id", "7",
+		"NAME", "bob",
+		"age", "42",
+		"ttl", "60",
+		"tags", "x",
+		"skipped", "no",
+		"hidden", "no",
+		"unknown", "ignored",
+	} {
+		w.WriteBulk([]byte(s))
+	}
+
+	var u unmarshalUser
+	err := Unmarshal(w.b, &u)
+	var te *UnmarshalTypeError
+	if assert.True(t, errors.As(err, &te)) {
+		assert.Equal(t, "unmarshalUser.Tags", te.Field)
+		assert.Equal(t, `bulk string "x"`, te.Value)
+	}
+	// The remaining fields are still decoded after a mismatch.
+	if assert.NotNil(t, u.UnmarshalBase) {
+		assert.Equal(t, 7, u.ID)
+	}
+	assert.Equal(t, "bob", u.Name)
+	assert.Equal(t, 42, u.Age)
+	assert.Equal(t, time.Minute, u.TTL)
+	assert.Empty(t, u.Skipped)
+	assert.Empty(t, u.hidden)
+}
+
+type point struct{ X, Y int }
+
+func (p *point) UnmarshalRESP(data []byte) error {
+	var xy []int
+	if err := Unmarshal(data, &xy); err != nil {
+		return err
+	}
+	if len(xy) != 2 {
+		return errors.New("bad point")
+	}
+	p.X, p.Y = xy[0], xy[1]
+	return nil
+}
+
+func TestUnmarshalUnmarshaler(t *testing.T) {
+	var p point
+	assert.NoError(t, Unmarshal([]byte("*2\r\n:1\r\n:2\r\n"), &p))
+	assert.Equal(t, point{1, 2}, p)
+
+	var ps []*point
+	assert.NoError(t, Unmarshal([]byte("*2\r\n*2\r\n:1\r\n:2\r\n$-1\r\n"), &ps))
+	assert.Equal(t, []*point{{1, 2}, nil}, ps)
+
+	assert.EqualError(t, Unmarshal([]byte("*1\r\n:1\r\n"), &p), "bad point")
+}
+
+func TestUnmarshalInterface(t *testing.T) {
+	var v interface{}
+	data := []byte("*5\r\n:1\r\n+OK\r\n$3\r\nfoo\r\n$-1\r\n-ERR bad\r\n")
+	assert.NoError(t, Unmarshal(data, &v))
+	assert.Equal(t, []interface{}{
+		int64(1), "OK", "foo", nil, &ReplyError{Msg: "ERR bad"},
+	}, v)
+}
+
+func TestUnmarshalReplyError(t *testing.T) {
+	var s string
+	err := Unmarshal([]byte("-WRONGTYPE Operation against a key\r\n"), &s)
+	var re *ReplyError
+	if assert.True(t, errors.As(err, &re)) {
+		assert.Equal(t, "WRONGTYPE Operation against a key", re.Error())
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	var i int
+	var i8 int8
+	var s string
+	var m map[string]string
+	tests := []struct {
+		name string
+		data string
+		v    interface{}
+		err  string
+	}{
+		{"nil", ":1\r\n", nil, "resp: Unmarshal(nil)"},
+		{"non-pointer", ":1\r\n", i, "resp: Unmarshal(non-pointer int)"},
+		{"nil pointer", ":1\r\n", (*int)(nil), "resp: Unmarshal(nil *int)"},
+		{"incomplete", "$5\r\nab", &s, ErrInvalidRESP.Error()},
+		{"trailing data", ":1\r\n:2\r\n", &i, ErrInvalidRESP.Error()},
+		{"not a number", "+abc\r\n", &i, `resp: cannot unmarshal simple string "abc" into Go value of type int`},
+		{"overflow", ":" + strconv.Itoa(1000) + "\r\n", &i8, "resp: cannot unmarshal integer 1000 into Go value of type int8"},
+		{"array into string", "*0\r\n", &s, "resp: cannot unmarshal array into Go value of type string"},
+		{"string into map", "+x\r\n", &m, `resp: cannot unmarshal simple string "x" into Go value of type map[string]string`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.EqualError(t, Unmarshal([]byte(tt.data), tt.v), tt.err)
+		})
+	}
+}
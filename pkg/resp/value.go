@@ -0,0 +1,232 @@
+package resp
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// Value is a decoded RESP value that owns its data, organized as a tree.
+//
+// Unlike RESP, which points into the parsed buffer and is meant for the hot
+// path, a Value is meant for tests and debugging: String formats it the way
+// redis-cli prints replies, MarshalJSON converts it to JSON, and Equal compares
+// encoded replies value by value.
+//
+// Example:
+//
+//	v, _ := resp.ParseValues([]byte("*3\r\n$1\r\na\r\n:1\r\n$-1\r\n"))
+//	fmt.Println(v[0])
+//	// 1) "a"
+//	// 2) (integer) 1
+//	// 3) (nil)
+type Value struct {
+	// Type is Integer, String, Bulk, Array or Error.
+	Type Type
+
+	// Str is the text of a simple string, error or bulk string, or the digits
+	// of an integer.
+	Str string
+
+	// Null is set for the null bulk string and the null array.
+	Null bool
+
+	// Elems holds the elements of an array.
+	Elems []Value
+}
+
+// NewValue converts r, as returned by ReadNextRESP, to a Value, copying its
+// data.
+func NewValue(r RESP) Value {
+	v := Value{Type: r.Type}
+	switch r.Type {
+	case Array:
+		if r.Count < 0 {
+			v.Null = true
+			break
+		}
+		v.Elems = make([]Value, 0, r.Count)
+		r.ForEach(func(elem RESP) bool {
+			v.Elems = append(v.Elems, NewValue(elem))
+			return true
+		})
+	case Bulk:
+		v.Null = r.Data == nil
+		v.Str = string(r.Data)
+	default:
+		v.Str = string(r.Data)
+	}
+	return v
+}
+
+// ParseValues decodes every value in b, such as the pipelined replies written
+// by a handler. It returns ErrInvalidRESP if b does not consist of complete and
+// valid values only.
+//
+// Example:
+//
+//	vals, err := resp.ParseValues([]byte("+OK\r\n:1\r\n"))
+//	// len(vals) == 2, vals[0].Str == "OK", vals[1].Str == "1"
+func ParseValues(b []byte) ([]Value, error) {
+	var vals []Value
+	for len(b) > 0 {
+		n, r := ReadNextRESP(b)
+		if n == 0 {
+			return nil, ErrInvalidRESP
+		}
+		vals = append(vals, NewValue(r))
+		b = b[n:]
+	}
+	return vals, nil
+}
+
+// Equal reports whether a and b hold the same sequence of RESP values. Unlike
+// bytes.Equal, it ignores how lengths are written, such as "$03" for "$3". If
+// a is not valid RESP, Equal falls back to comparing the bytes.
+//
+// It is meant for golden tests of handler output:
+//
+//	out, _ := handler(cmd, nil)
+//	if !resp.Equal(out, golden) {
+//	    vals, _ := resp.ParseValues(out)
+//	    t.Errorf("got:\n%v", vals)
+//	}
+func Equal(a, b []byte) bool {
+	va, err := ParseValues(a)
+	if err != nil {
+		return bytes.Equal(a, b)
+	}
+	vb, err := ParseValues(b)
+	if err != nil || len(va) != len(vb) {
+		return false
+	}
+	for i := range va {
+		if !va[i].Equal(vb[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Equal reports whether v and w are the same value.
+func (v Value) Equal(w Value) bool {
+	if v.Type != w.Type || v.Null != w.Null || v.Str != w.Str || len(v.Elems) != len(w.Elems) {
+		return false
+	}
+	for i := range v.Elems {
+		if !v.Elems[i].Equal(w.Elems[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// AppendRESP appends the RESP encoding of v to b.
+func (v Value) AppendRESP(b []byte) []byte {
+	switch {
+	case v.Type == Bulk && v.Null:
+		return AppendNull(b)
+	case v.Type == Bulk:
+		return AppendBulkString(b, v.Str)
+	case v.Type == Array && v.Null:
+		return AppendArray(b, -1)
+	case v.Type == Array:
+		b = AppendArray(b, len(v.Elems))
+		for _, elem := range v.Elems {
+			b = elem.AppendRESP(b)
+		}
+		return b
+	}
+	b = append(b, byte(v.Type))
+	b = append(b, v.Str...)
+	return append(b, '\r', '\n')
+}
+
+// MarshalJSON converts v to JSON: arrays become JSON arrays, integers become
+// numbers, nulls become null, and strings and errors become JSON strings.
+func (v Value) MarshalJSON() ([]byte, error) {
+	b, _ := appendJSON(nil, v.AppendRESP(nil))
+	return b, nil
+}
+
+// String formats v the way redis-cli prints replies:
+//
+//	OK                     simple string
+//	(error) ERR bad        error
+//	(integer) 42           integer
+//	"hello\n"              bulk string, with non-printable bytes escaped
+//	(nil)                  null bulk string or array
+//	(empty array)          array without elements
+//	1) "a"                 array, with nested arrays indented
+//	2) 1) (integer) 1
+//	   2) (integer) 2
+func (v Value) String() string {
+	b := v.appendCLI(nil, "")
+	return string(b[:len(b)-1])
+}
+
+// appendCLI appends v in redis-cli format, followed by a newline. Elements of
+// arrays after the first are indented with prefix, as in cliFormatReplyTTY.
+func (v Value) appendCLI(b []byte, prefix string) []byte {
+	switch {
+	case v.Null:
+		b = append(b, "(nil)"...)
+	case v.Type == Integer:
+		b = append(b, "(integer) "...)
+		b = append(b, v.Str...)
+	case v.Type == Error:
+		b = append(b, "(error) "...)
+		b = append(b, v.Str...)
+	case v.Type == Bulk:
+		b = appendRepr(b, v.Str)
+	case v.Type == Array && len(v.Elems) == 0:
+		b = append(b, "(empty array)"...)
+	case v.Type == Array:
+		width := len(strconv.Itoa(len(v.Elems)))
+		inner := prefix + string(bytes.Repeat([]byte{' '}, width+2))
+		for i, elem := range v.Elems {
+			if i > 0 {
+				b = append(b, prefix...)
+			}
+			idx := strconv.Itoa(i + 1)
+			for pad := len(idx); pad < width; pad++ {
+				b = append(b, ' ')
+			}
+			b = append(b, idx...)
+			b = append(b, ") "...)
+			b = elem.appendCLI(b, inner)
+		}
+		return b
+	default:
+		b = append(b, v.Str...)
+	}
+	return append(b, '\n')
+}
+
+// appendRepr appends s quoted and escaped like sdscatrepr in Redis.
+func appendRepr(b []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	b = append(b, '"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', '"':
+			b = append(b, '\\', c)
+		case '\n':
+			b = append(b, '\\', 'n')
+		case '\r':
+			b = append(b, '\\', 'r')
+		case '\t':
+			b = append(b, '\\', 't')
+		case '\a':
+			b = append(b, '\\', 'a')
+		case '\b':
+			b = append(b, '\\', 'b')
+		default:
+			if c >= 0x20 && c <= 0x7e {
+				b = append(b, c)
+			} else {
+				b = append(b, '\\', 'x', hex[c>>4], hex[c&0xf])
+			}
+		}
+	}
+	return append(b, '"')
+}
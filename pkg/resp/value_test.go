@@ -0,0 +1,102 @@
+package resp
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValueString(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		cli   string
+	}{
+		{"status", "+OK\r\n", "OK"},
+		{"error", "-ERR unknown command\r\n", "(error) ERR unknown command"},
+		{"integer", ":-42\r\n", "(integer) -42"},
+		{"bulk", "$5\r\nhello\r\n", `"hello"`},
+		{"escaped bulk", "$7\r\n\"a\\\"\n\x01\xff\r\n", `"\"a\\\"\n\x01\xff"`},
+		{"control bytes", "$4\r\n\t\r\a\b\r\n", `"\t\r\a\b"`},
+		{"null bulk", "$-1\r\n", "(nil)"},
+		{"null array", "*-1\r\n", "(nil)"},
+		{"empty array", "*0\r\n", "(empty array)"},
+		{"array", "*3\r\n$1\r\na\r\n:1\r\n$-1\r\n", "1) \"a\"\n2) (integer) 1\n3) (nil)"},
+		{
+			"nested array",
+			"*2\r\n*2\r\n:1\r\n*1\r\n+x\r\n$1\r\nb\r\n",
+			"1) 1) (integer) 1\n   2) 1) x\n2) \"b\"",
+		},
+		{
+			"wide index",
+			"*10\r\n" + strings.Repeat(":0\r\n", 9) + "*2\r\n:1\r\n:2\r\n",
+			" 1) (integer) 0\n 2) (integer) 0\n 3) (integer) 0\n 4) (integer) 0\n 5) (integer) 0\n" +
+				" 6) (integer) 0\n 7) (integer) 0\n 8) (integer) 0\n 9) (integer) 0\n10) 1) (integer) 1\n    2) (integer) 2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vals, err := ParseValues([]byte(tt.input))
+			assert.NoError(t, err)
+			assert.Len(t, vals, 1)
+			assert.Equal(t, tt.cli, vals[0].String())
+			assert.Equal(t, tt.input, string(vals[0].AppendRESP(nil)))
+		})
+	}
+}
+
+func TestValueJSON(t *testing.T) {
+	vals, err := ParseValues([]byte("*6\r\n+OK\r\n-ERR bad\r\n:007\r\n$2\r\n\"\n\r\n$-1\r\n*1\r\n:-0\r\n"))
+	assert.NoError(t, err)
+	b, err := json.Marshal(vals[0])
+	assert.NoError(t, err)
+	assert.Equal(t, `["OK","ERR bad",7,"\"\n",null,[0]]`, string(b))
+
+	// Values can be embedded in other JSON documents.
+	b, err = json.Marshal(map[string]Value{"reply": vals[0].Elems[2]})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"reply":7}`, string(b))
+}
+
+func TestParseValues(t *testing.T) {
+	vals, err := ParseValues([]byte("+OK\r\n*1\r\n$1\r\nx\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []Value{
+		{Type: String, Str: "OK"},
+		{Type: Array, Elems: []Value{{Type: Bulk, Str: "x"}}},
+	}, vals)
+
+	_, err = ParseValues([]byte("+OK\r\n$5\r\nab"))
+	assert.Equal(t, ErrInvalidRESP, err)
+
+	vals, err = ParseValues(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, vals)
+}
+
+func TestEqual(t *testing.T) {
+	tests := []struct {
+		name  string
+		a, b  string
+		equal bool
+	}{
+		{"identical", "+OK\r\n:1\r\n", "+OK\r\n:1\r\n", true},
+		{"length spelling", "*1\r\n$03\r\nabc\r\n", "*01\r\n$+3\r\nabc\r\n", true},
+		{"different type", "+OK\r\n", "$2\r\nOK\r\n", false},
+		{"null vs empty", "$-1\r\n", "$0\r\n\r\n", false},
+		{"extra value", "+OK\r\n", "+OK\r\n+OK\r\n", false},
+		{"nested difference", "*2\r\n:1\r\n*1\r\n:2\r\n", "*2\r\n:1\r\n*1\r\n:3\r\n", false},
+		{"invalid but identical", "$5\r\nab", "$5\r\nab", true},
+		{"invalid and valid", "+OK\r\n", "+OK", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.equal, Equal([]byte(tt.a), []byte(tt.b)))
+			assert.Equal(t, tt.equal, Equal([]byte(tt.b), []byte(tt.a)))
+		})
+	}
+}
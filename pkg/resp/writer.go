@@ -0,0 +1,636 @@
+package resp
+
+import (
+	"errors"
+	"io"
+	"strconv"
+)
+
+// writerBufferSize is the amount of buffered data that makes a Writer created
+// by NewWriter flush to its io.Writer.
+const writerBufferSize = 4096
+
+// errNotAggregate is returned by WriteAggregate for non-aggregate types.
+var errNotAggregate = errors.New("resp: not an aggregate type")
+
+// Writer allows for writing RESP messages incrementally.
+//
+// The zero value is ready to use and accumulates the messages in memory, which
+// Bytes returns. A Writer created by NewWriter buffers the messages and writes
+// them to an io.Writer, such as a net.Conn or a file, whenever enough data has
+// been gathered and when Flush is called.
+//
+// A Writer speaks RESP2 unless SetProtocol selects RESP3. The RESP3 types are
+// then written natively; with RESP2 they fall back to their closest RESP2
+// equivalent, the way Redis replies to RESP2 clients:
+//
+//	WriteMap, WriteSet, WritePush -> array (with 2*n elements for maps)
+//	WriteAttribute -> left out, along with its key/value pairs
+//	WriteNull -> null bulk string, WriteNullArray -> null array
+//	WriteBool -> integer 1 or 0
+//	WriteDouble, WriteBigNumber, WriteVerbatim -> bulk string
+//	WriteBulkError -> simple error
+//
+// This lets a handler build one reply for clients of both protocol versions.
+//
+// The write methods do not return errors. Once writing to the io.Writer fails,
+// all further writes are discarded and Flush returns the error.
+//
+// Example:
+//
+//	var w resp.Writer
+//	w.WriteArray(2)
+//	w.WriteBulk([]byte("GET"))
+//	w.WriteBulk([]byte("key"))
+//	// w.Bytes() == []byte("*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n")
+type Writer struct {
+	b       []byte
+	wr      io.Writer
+	err     error
+	proto   Protocol
+	kind    Kind
+	stack   []aggregate
+	discard int    // number of open aggregates whose elements are left out
+	start   int    // offset in b of the Tile38 reply being written
+	scratch []byte // JSON of the Tile38 reply being converted
+}
+
+// aggregate is an aggregate whose elements are still being written.
+type aggregate struct {
+	typ      Type
+	declared int  // number of elements announced, two per pair for maps
+	written  int  // number of complete elements written so far
+	explicit bool // opened by WriteAggregate, which also closes it
+	discard  bool // a RESP2 attribute, whose elements are left out
+}
+
+// AggregateLengthError reports an aggregate whose number of elements differs
+// from the number announced in its header. Key/value pairs count as two
+// elements.
+type AggregateLengthError struct {
+	Type     Type // type of the aggregate, e.g. Array or Map
+	Declared int  // number of elements announced
+	Written  int  // number of elements actually written
+}
+
+// Error returns a description of the mismatch.
+func (e *AggregateLengthError) Error() string {
+	return "resp: " + typeName(e.Type) + " declared with " + strconv.Itoa(e.Declared) +
+		" elements, but " + strconv.Itoa(e.Written) + " were written"
+}
+
+// typeName returns the name of the RESP type t.
+func typeName(t Type) string {
+	switch t {
+	case Array:
+		return "array"
+	case Map:
+		return "map"
+	case Set:
+		return "set"
+	case Push:
+		return "push"
+	case Attribute:
+		return "attribute"
+	}
+	return "type '" + string(rune(t)) + "'"
+}
+
+// NewWriter returns a Writer that writes RESP messages to w.
+//
+// Writes are buffered; call Flush once a message, or a batch of pipelined
+// messages, is complete.
+//
+// Example:
+//
+//	conn, _ := net.Dial("tcp", "127.0.0.1:6379")
+//	w := resp.NewWriter(conn)
+//	w.WriteArray(2)
+//	w.WriteBulkString("GET")
+//	w.WriteBulkString("key")
+//	if err := w.Flush(); err != nil {
+//	    return err
+//	}
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{b: make([]byte, 0, writerBufferSize), wr: w}
+}
+
+// SetProtocol selects the protocol version used by the following writes.
+// The default is RESP2.
+func (w *Writer) SetProtocol(proto Protocol) {
+	w.proto = proto
+}
+
+// Protocol returns the protocol version used by the Writer.
+func (w *Writer) Protocol() Protocol {
+	if w.proto < RESP3 {
+		return RESP2
+	}
+	return w.proto
+}
+
+// SetKind selects the wire protocol of the client the replies are written for,
+// usually the Kind of the commands it sends. The default is Redis.
+//
+// Redis and Telnet clients are answered with RESP. For Tile38 clients, every
+// top-level value is converted to JSON once it is complete, and written as a
+// Tile38 native message, "$<len> <json>\r\n". The JSON is an object with an
+// "ok" field, shaped after the replies of Tile38 itself:
+//
+//	WriteString("OK")                 -> {"ok":true}
+//	WriteError("ERR unknown command") -> {"ok":false,"err":"ERR unknown command"}
+//	WriteMap(1) "ping" "pong"         -> {"ok":true,"ping":"pong"}
+//	other values                      -> {"ok":true,"result":<value>}
+//
+// Within the value, arrays, sets and pushes become JSON arrays, maps become
+// objects, nulls become null, and integers, doubles and big numbers become
+// numbers. Attributes are left out.
+//
+// Example:
+//
+//	var w resp.Writer
+//	w.SetKind(resp.Tile38)
+//	w.WriteArray(2)
+//	w.WriteBulkString("a")
+//	w.WriteInt(1)
+//	// w.Bytes() == []byte(`$28 {"ok":true,"result":["a",1]}` + "\r\n")
+func (w *Writer) SetKind(kind Kind) {
+	w.kind = kind
+}
+
+// Kind returns the wire protocol the Writer writes replies for.
+func (w *Writer) Kind() Kind {
+	return w.kind
+}
+
+// wireProto returns the protocol version written to the buffer. Tile38 replies
+// are buffered as RESP3, which keeps the types needed for the JSON conversion.
+func (w *Writer) wireProto() Protocol {
+	if w.kind == Tile38 {
+		return RESP3
+	}
+	return w.proto
+}
+
+// Bytes returns the data written so far that has not been flushed. For a Writer
+// without an io.Writer, this is everything written since the last Reset.
+//
+// The slice is only valid until the next write or Reset.
+func (w *Writer) Bytes() []byte {
+	return w.b
+}
+
+// Len returns the number of bytes returned by Bytes.
+func (w *Writer) Len() int {
+	return len(w.b)
+}
+
+// Reset discards any unflushed data, open aggregates and error, so that the
+// Writer can be reused. The buffer is kept, as well as the io.Writer, the
+// protocol version and the kind.
+func (w *Writer) Reset() {
+	w.b = w.b[:0]
+	w.start = 0
+	w.err = nil
+	w.stack = w.stack[:0]
+	w.discard = 0
+}
+
+// Flush writes any buffered data to the underlying io.Writer and returns the
+// first error encountered by the Writer. It does nothing for a Writer without
+// an io.Writer.
+func (w *Writer) Flush() error {
+	if w.wr == nil || w.err != nil {
+		return w.err
+	}
+	if len(w.b) == 0 {
+		return nil
+	}
+	n, err := w.wr.Write(w.b)
+	if err == nil && n < len(w.b) {
+		err = io.ErrShortWrite
+	}
+	w.b = w.b[:0]
+	w.start = 0
+	w.err = err
+	return err
+}
+
+// flushIfFull flushes the buffer once it has reached writerBufferSize. A Tile38
+// reply stays buffered until it is complete and has been converted.
+func (w *Writer) flushIfFull() {
+	if w.kind == Tile38 && len(w.stack) > 0 {
+		return
+	}
+	if w.wr != nil && len(w.b) >= writerBufferSize {
+		_ = w.Flush()
+	}
+}
+
+// skip reports whether the next value is not to be written, either because of
+// an earlier error or because it belongs to a RESP2 attribute.
+func (w *Writer) skip() bool {
+	return w.err != nil || w.discard > 0
+}
+
+// value records that a complete value has been written, closing every
+// aggregate it completes.
+func (w *Writer) value() {
+	for len(w.stack) > 0 {
+		top := &w.stack[len(w.stack)-1]
+		top.written++
+		if top.explicit || top.written < top.declared {
+			break
+		}
+		typ := top.typ
+		w.pop()
+		if typ == Attribute {
+			// An attribute describes the next value instead of being one.
+			break
+		}
+	}
+	if w.kind == Tile38 && len(w.stack) == 0 {
+		w.convertTile38()
+	}
+	w.flushIfFull()
+}
+
+func (w *Writer) pop() {
+	if w.stack[len(w.stack)-1].discard {
+		w.discard--
+	}
+	w.stack = w.stack[:len(w.stack)-1]
+}
+
+// writeHeader writes the header of an aggregate of type t with n elements, or
+// n key/value pairs for maps and attributes.
+func (w *Writer) writeHeader(t Type, n int, explicit bool) {
+	discard := t == Attribute && (w.wireProto() < RESP3 || w.kind == Tile38)
+	if !w.skip() && !discard {
+		switch {
+		case w.wireProto() >= RESP3:
+			w.b = appendPrefix(w.b, byte(t), int64(n))
+		case t == Map:
+			w.b = AppendArray(w.b, n*2)
+		default:
+			w.b = AppendArray(w.b, n)
+		}
+	}
+	elems := n
+	if t == Map || t == Attribute {
+		elems = n * 2
+	}
+	if !explicit && elems <= 0 {
+		if t != Attribute {
+			w.value()
+		}
+		return
+	}
+	w.stack = append(w.stack, aggregate{typ: t, declared: elems, explicit: explicit, discard: discard})
+	if discard {
+		w.discard++
+	}
+	w.flushIfFull()
+}
+
+// WriteArray writes an RESP array header to the writer.
+// The count parameter specifies the number of elements in the array.
+//
+// After calling WriteArray, you should write each element of the array.
+// A negative count writes a null array; WriteNullArray also handles RESP3.
+//
+// Example:
+//
+//	var w resp.Writer
+//	w.WriteArray(3)
+//	w.WriteBulk([]byte("item1"))
+//	w.WriteBulk([]byte("item2"))
+//	w.WriteBulk([]byte("item3"))
+func (w *Writer) WriteArray(count int) {
+	w.writeHeader(Array, count, false)
+}
+
+// WriteMap writes a map header announcing count key/value pairs. After calling
+// WriteMap, write each key followed by its value.
+//
+// Example:
+//
+//	w.WriteMap(1)
+//	w.WriteBulkString("name")
+//	w.WriteBulkString("redhub")
+//	// RESP3: "%1\r\n$4\r\nname\r\n$6\r\nredhub\r\n"
+//	// RESP2: "*2\r\n$4\r\nname\r\n$6\r\nredhub\r\n"
+func (w *Writer) WriteMap(count int) {
+	w.writeHeader(Map, count, false)
+}
+
+// WriteSet writes a set header announcing count elements.
+//
+// Example:
+//
+//	w.WriteSet(2)
+//	w.WriteBulkString("a")
+//	w.WriteBulkString("b")
+//	// RESP3: "~2\r\n$1\r\na\r\n$1\r\nb\r\n"
+func (w *Writer) WriteSet(count int) {
+	w.writeHeader(Set, count, false)
+}
+
+// WritePush writes a push header announcing count elements, for out-of-band
+// data such as Pub/Sub messages.
+//
+// Example:
+//
+//	w.WritePush(3)
+//	w.WriteBulkString("message")
+//	w.WriteBulkString("news")
+//	w.WriteBulkString("hello")
+func (w *Writer) WritePush(count int) {
+	w.writeHeader(Push, count, false)
+}
+
+// WriteAttribute writes an attribute header announcing count key/value pairs,
+// which describe the value written after them. With RESP2 the attribute and
+// its pairs are left out.
+//
+// Example:
+//
+//	w.WriteAttribute(1)
+//	w.WriteBulkString("ttl")
+//	w.WriteInt(3600)
+//	w.WriteBulkString("value") // the reply itself
+func (w *Writer) WriteAttribute(count int) {
+	w.writeHeader(Attribute, count, false)
+}
+
+// WriteAggregate writes an aggregate of type t, which must be Array, Map, Set,
+// Push or Attribute, announcing n elements (or n key/value pairs for Map and
+// Attribute). It then calls fn to write the elements, and checks that exactly
+// the announced number was written.
+//
+// If fn writes too many or too few elements, or leaves a nested aggregate
+// unfinished, an *AggregateLengthError is returned. The output is then not
+// valid RESP, so the reply should be discarded, for example with Reset.
+//
+// Example:
+//
+//	err := w.WriteAggregate(resp.Array, len(items), func() {
+//	    for _, item := range items {
+//	        w.WriteAggregate(resp.Map, 2, func() {
+//	            w.WriteBulkString("id")
+//	            w.WriteInt(item.ID)
+//	            w.WriteBulkString("name")
+//	            w.WriteBulkString(item.Name)
+//	        })
+//	    }
+//	})
+func (w *Writer) WriteAggregate(t Type, n int, fn func()) error {
+	switch t {
+	case Array, Map, Set, Push, Attribute:
+	default:
+		return errNotAggregate
+	}
+	depth := len(w.stack)
+	w.writeHeader(t, n, true)
+	fn()
+
+	var err error
+	if len(w.stack) > depth+1 {
+		inner := w.stack[len(w.stack)-1]
+		err = &AggregateLengthError{Type: inner.typ, Declared: inner.declared, Written: inner.written}
+		for len(w.stack) > depth+1 {
+			w.pop()
+		}
+	}
+	agg := w.stack[depth]
+	w.pop()
+	if err == nil && agg.written != agg.declared {
+		err = &AggregateLengthError{Type: agg.typ, Declared: agg.declared, Written: agg.written}
+	}
+	if t != Attribute {
+		w.value()
+	}
+	return err
+}
+
+// WriteBulk writes a bulk string to the writer.
+// The bulk parameter contains the string data.
+//
+// When writing to an io.Writer, bulks larger than the buffer are passed to it
+// directly instead of being copied into the buffer.
+//
+// Example:
+//
+//	var w resp.Writer
+//	w.WriteBulk([]byte("hello"))
+//	// w.Bytes() == []byte("$5\r\nhello\r\n")
+func (w *Writer) WriteBulk(bulk []byte) {
+	if w.skip() {
+		w.value()
+		return
+	}
+	if w.wr == nil || len(bulk) < writerBufferSize || w.kind == Tile38 {
+		w.b = AppendBulk(w.b, bulk)
+		w.value()
+		return
+	}
+	w.b = appendPrefix(w.b, Bulk, int64(len(bulk)))
+	if w.Flush() != nil {
+		return
+	}
+	if _, err := w.wr.Write(bulk); err != nil {
+		w.err = err
+		return
+	}
+	w.b = append(w.b, '\r', '\n')
+	w.value()
+}
+
+// WriteBulkString writes a bulk string to the writer.
+//
+// Example:
+//
+//	var w resp.Writer
+//	w.WriteBulkString("hello") // "$5\r\nhello\r\n"
+func (w *Writer) WriteBulkString(bulk string) {
+	if w.wr != nil && len(bulk) >= writerBufferSize && w.kind != Tile38 {
+		w.WriteBulk([]byte(bulk))
+		return
+	}
+	if !w.skip() {
+		w.b = AppendBulkString(w.b, bulk)
+	}
+	w.value()
+}
+
+// WriteString writes a simple string to the writer. Newlines in s are replaced
+// with spaces, as for AppendString.
+//
+// Example:
+//
+//	var w resp.Writer
+//	w.WriteString("OK") // "+OK\r\n"
+func (w *Writer) WriteString(s string) {
+	if !w.skip() {
+		w.b = AppendString(w.b, s)
+	}
+	w.value()
+}
+
+// WriteError writes an error to the writer. Newlines in s are replaced with
+// spaces, as for AppendError.
+//
+// Example:
+//
+//	var w resp.Writer
+//	w.WriteError("ERR unknown command") // "-ERR unknown command\r\n"
+func (w *Writer) WriteError(s string) {
+	if !w.skip() {
+		w.b = AppendError(w.b, s)
+	}
+	w.value()
+}
+
+// WriteErr writes err as an error reply, following the rules of AppendErr.
+//
+// Example:
+//
+//	w.WriteErr(resp.ErrWrongType) // "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+func (w *Writer) WriteErr(err error) {
+	if !w.skip() {
+		w.b = AppendErr(w.b, err)
+	}
+	w.value()
+}
+
+// WriteBulkError writes an error that may contain newlines. With RESP2 it is
+// written as a simple error, with newlines replaced by spaces.
+//
+// Example:
+//
+//	w.WriteBulkError("SYNTAX invalid syntax") // RESP3: "!21\r\nSYNTAX invalid syntax\r\n"
+func (w *Writer) WriteBulkError(s string) {
+	if !w.skip() {
+		if w.wireProto() >= RESP3 {
+			w.b = AppendBulkError(w.b, s)
+		} else {
+			w.b = AppendError(w.b, s)
+		}
+	}
+	w.value()
+}
+
+// WriteInt writes an integer to the writer.
+//
+// Example:
+//
+//	var w resp.Writer
+//	w.WriteInt(42) // ":42\r\n"
+func (w *Writer) WriteInt(n int64) {
+	if !w.skip() {
+		w.b = AppendInt(w.b, n)
+	}
+	w.value()
+}
+
+// WriteNull writes a null value: "_\r\n" with RESP3, and the null bulk string
+// "$-1\r\n" with RESP2.
+//
+// Example:
+//
+//	var w resp.Writer
+//	w.WriteNull() // "$-1\r\n"
+func (w *Writer) WriteNull() {
+	if !w.skip() {
+		w.b = AppendNullProto(w.b, w.wireProto())
+	}
+	w.value()
+}
+
+// WriteNullArray writes a null array: "_\r\n" with RESP3, and "*-1\r\n" with
+// RESP2, as Redis does for commands such as BLPOP that time out.
+func (w *Writer) WriteNullArray() {
+	if !w.skip() {
+		if w.wireProto() >= RESP3 {
+			w.b = AppendNullProto(w.b, w.wireProto())
+		} else {
+			w.b = AppendArray(w.b, -1)
+		}
+	}
+	w.value()
+}
+
+// WriteBool writes a boolean: "#t\r\n" or "#f\r\n" with RESP3, and the integer
+// 1 or 0 with RESP2.
+func (w *Writer) WriteBool(t bool) {
+	if !w.skip() {
+		switch {
+		case w.wireProto() >= RESP3:
+			w.b = AppendBoolean(w.b, t)
+		case t:
+			w.b = AppendInt(w.b, 1)
+		default:
+			w.b = AppendInt(w.b, 0)
+		}
+	}
+	w.value()
+}
+
+// WriteDouble writes a floating point number: a double with RESP3, and a bulk
+// string with RESP2.
+//
+// Example:
+//
+//	w.WriteDouble(1.5) // RESP3: ",1.5\r\n", RESP2: "$3\r\n1.5\r\n"
+func (w *Writer) WriteDouble(f float64) {
+	if !w.skip() {
+		if w.wireProto() >= RESP3 {
+			w.b = AppendDouble(w.b, f)
+		} else {
+			w.b = AppendBulkFloat(w.b, f)
+		}
+	}
+	w.value()
+}
+
+// WriteBigNumber writes a decimal integer of arbitrary size, such as the output
+// of big.Int's String method: a big number with RESP3, and a bulk string with
+// RESP2.
+func (w *Writer) WriteBigNumber(n string) {
+	if !w.skip() {
+		if w.wireProto() >= RESP3 {
+			w.b = AppendBigNumber(w.b, n)
+		} else {
+			w.b = AppendBulkString(w.b, n)
+		}
+	}
+	w.value()
+}
+
+// WriteVerbatim writes text in the given three-byte format, such as "txt" or
+// "mkd": a verbatim string with RESP3, and a bulk string holding only text with
+// RESP2.
+func (w *Writer) WriteVerbatim(format, text string) {
+	if !w.skip() {
+		if w.wireProto() >= RESP3 {
+			w.b = AppendVerbatim(w.b, format, text)
+		} else {
+			w.b = AppendBulkString(w.b, text)
+		}
+	}
+	w.value()
+}
+
+// WriteAny writes v following the conversion rules of AppendAny, using RESP3
+// maps and nulls when the Writer speaks RESP3 (see AppendAnyProto).
+//
+// Example:
+//
+//	var w resp.Writer
+//	w.WriteAny(map[string]int{"a": 1}) // "*2\r\n$1\r\na\r\n$1\r\n1\r\n"
+func (w *Writer) WriteAny(v interface{}) {
+	if !w.skip() {
+		w.b = appendAny(w.b, v, w.wireProto())
+	}
+	w.value()
+}
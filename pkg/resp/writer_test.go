@@ -0,0 +1,249 @@
+package resp
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriterTypes(t *testing.T) {
+	var w Writer
+	w.WriteString("OK")
+	w.WriteError("ERR bad\nthing")
+	w.WriteInt(-7)
+	w.WriteBulkString("hi")
+	w.WriteNull()
+	assert.Equal(t, "+OK\r\n-ERR bad thing\r\n:-7\r\n$2\r\nhi\r\n$-1\r\n", string(w.b))
+	assert.NoError(t, w.Flush())
+}
+
+func TestNewWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WriteArray(2)
+	w.WriteBulkString("GET")
+	w.WriteBulk([]byte("key"))
+	assert.Equal(t, 0, buf.Len(), "small writes stay buffered")
+	assert.NoError(t, w.Flush())
+	assert.Equal(t, "*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n", buf.String())
+
+	// Large bulks are written straight through, and the result parses back.
+	buf.Reset()
+	big := strings.Repeat("v", 3*writerBufferSize)
+	w.WriteArray(1)
+	w.WriteBulkString(big)
+	assert.NoError(t, w.Flush())
+	cmd, err := NewReader(&buf).ReadCommand()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(big)}, cmd.Args)
+}
+
+type failingWriter struct {
+	n int
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if f.n == 0 {
+		return 0, errors.New("broken pipe")
+	}
+	f.n--
+	return len(p), nil
+}
+
+func TestWriterStickyError(t *testing.T) {
+	fw := &failingWriter{}
+	w := NewWriter(fw)
+	w.WriteBulk(bytes.Repeat([]byte("x"), writerBufferSize))
+	w.WriteInt(1)
+	assert.EqualError(t, w.Flush(), "broken pipe")
+	assert.EqualError(t, w.Flush(), "broken pipe")
+}
+
+func TestWriterBytesLenReset(t *testing.T) {
+	var w Writer
+	w.WriteString("OK")
+	assert.Equal(t, []byte("+OK\r\n"), w.Bytes())
+	assert.Equal(t, 5, w.Len())
+	w.Reset()
+	assert.Equal(t, 0, w.Len())
+	w.WriteInt(1)
+	assert.Equal(t, ":1\r\n", string(w.Bytes()))
+}
+
+func TestWriterRESP3(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(w *Writer)
+		resp2 string
+		resp3 string
+	}{
+		{"null", func(w *Writer) { w.WriteNull() }, "$-1\r\n", "_\r\n"},
+		{"null array", func(w *Writer) { w.WriteNullArray() }, "*-1\r\n", "_\r\n"},
+		{"bool", func(w *Writer) { w.WriteBool(true); w.WriteBool(false) }, ":1\r\n:0\r\n", "#t\r\n#f\r\n"},
+		{"double", func(w *Writer) { w.WriteDouble(1.5) }, "$3\r\n1.5\r\n", ",1.5\r\n"},
+		{"infinity", func(w *Writer) { w.WriteDouble(math.Inf(-1)) }, "$4\r\n-Inf\r\n", ",-inf\r\n"},
+		{"big number", func(w *Writer) { w.WriteBigNumber("12345678901234567890") }, "$20\r\n12345678901234567890\r\n", "(12345678901234567890\r\n"},
+		{"bulk error", func(w *Writer) { w.WriteBulkError("ERR a\nb") }, "-ERR a b\r\n", "!7\r\nERR a\nb\r\n"},
+		{"verbatim", func(w *Writer) { w.WriteVerbatim("txt", "hi") }, "$2\r\nhi\r\n", "=6\r\ntxt:hi\r\n"},
+		{"map", func(w *Writer) { w.WriteMap(1); w.WriteString("k"); w.WriteInt(1) }, "*2\r\n+k\r\n:1\r\n", "%1\r\n+k\r\n:1\r\n"},
+		{"set", func(w *Writer) { w.WriteSet(1); w.WriteString("a") }, "*1\r\n+a\r\n", "~1\r\n+a\r\n"},
+		{"push", func(w *Writer) { w.WritePush(1); w.WriteString("a") }, "*1\r\n+a\r\n", ">1\r\n+a\r\n"},
+		{
+			"attribute",
+			func(w *Writer) {
+				w.WriteAttribute(1)
+				w.WriteString("ttl")
+				w.WriteArray(2)
+				w.WriteInt(1)
+				w.WriteInt(2)
+				w.WriteString("value")
+			},
+			"+value\r\n",
+			"|1\r\n+ttl\r\n*2\r\n:1\r\n:2\r\n+value\r\n",
+		},
+		{"any", func(w *Writer) { w.WriteAny(map[string]interface{}{"k": nil}) }, "*2\r\n$1\r\nk\r\n$-1\r\n", "%1\r\n$1\r\nk\r\n_\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w Writer
+			tt.write(&w)
+			assert.Equal(t, tt.resp2, string(w.Bytes()))
+			assert.Empty(t, w.stack)
+
+			w = Writer{}
+			w.SetProtocol(RESP3)
+			tt.write(&w)
+			assert.Equal(t, tt.resp3, string(w.Bytes()))
+			assert.Empty(t, w.stack)
+		})
+	}
+}
+
+func TestWriteAggregate(t *testing.T) {
+	var w Writer
+	err := w.WriteAggregate(Array, 2, func() {
+		w.WriteAggregate(Map, 1, func() {
+			w.WriteBulkString("id")
+			w.WriteInt(1)
+		})
+		w.WriteArray(2)
+		w.WriteInt(2)
+		w.WriteInt(3)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "*2\r\n*2\r\n$2\r\nid\r\n:1\r\n*2\r\n:2\r\n:3\r\n", string(w.Bytes()))
+	assert.Empty(t, w.stack)
+
+	t.Run("too few", func(t *testing.T) {
+		var w Writer
+		err := w.WriteAggregate(Map, 2, func() {
+			w.WriteString("k")
+			w.WriteString("v")
+			w.WriteString("k2")
+		})
+		assert.EqualError(t, err, "resp: map declared with 4 elements, but 3 were written")
+		assert.Empty(t, w.stack)
+	})
+	t.Run("too many", func(t *testing.T) {
+		var w Writer
+		err := w.WriteAggregate(Set, 1, func() {
+			w.WriteInt(1)
+			w.WriteInt(2)
+		})
+		var le *AggregateLengthError
+		if assert.True(t, errors.As(err, &le)) {
+			assert.Equal(t, AggregateLengthError{Type: Set, Declared: 1, Written: 2}, *le)
+		}
+	})
+	t.Run("unfinished nested", func(t *testing.T) {
+		var w Writer
+		err := w.WriteAggregate(Array, 1, func() {
+			w.WriteArray(2)
+			w.WriteInt(1)
+		})
+		assert.EqualError(t, err, "resp: array declared with 2 elements, but 1 were written")
+		assert.Empty(t, w.stack)
+		// The writer keeps counting correctly afterwards.
+		assert.NoError(t, w.WriteAggregate(Array, 0, func() {}))
+	})
+	t.Run("not an aggregate", func(t *testing.T) {
+		var w Writer
+		assert.Error(t, w.WriteAggregate(Bulk, 1, func() {}))
+	})
+}
+
+func TestWriterTile38(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(w *Writer)
+		json  string
+	}{
+		{"ok", func(w *Writer) { w.WriteString("OK") }, `{"ok":true}`},
+		{"string", func(w *Writer) { w.WriteString("PONG") }, `{"ok":true,"result":"PONG"}`},
+		{"error", func(w *Writer) { w.WriteError("ERR unknown command") }, `{"ok":false,"err":"ERR unknown command"}`},
+		{"bulk error", func(w *Writer) { w.WriteBulkError("ERR a\nb") }, `{"ok":false,"err":"ERR a\nb"}`},
+		{"null", func(w *Writer) { w.WriteNull() }, `{"ok":true,"result":null}`},
+		{"bulk", func(w *Writer) { w.WriteBulkString("say \"hi\"\t\x01\xff") }, `{"ok":true,"result":"say \"hi\"\t\u0001` + "�" + `"}`},
+		{"numbers", func(w *Writer) {
+			w.WriteArray(4)
+			w.WriteInt(-7)
+			w.WriteDouble(1.5)
+			w.WriteDouble(math.Inf(1))
+			w.WriteBigNumber("12345678901234567890")
+		}, `{"ok":true,"result":[-7,1.5,"inf",12345678901234567890]}`},
+		{"bool and verbatim", func(w *Writer) {
+			w.WriteSet(2)
+			w.WriteBool(true)
+			w.WriteVerbatim("txt", "hi")
+		}, `{"ok":true,"result":[true,"hi"]}`},
+		{"top-level map", func(w *Writer) {
+			w.WriteMap(2)
+			w.WriteString("ping")
+			w.WriteString("pong")
+			w.WriteInt(1)
+			w.WriteArray(0)
+		}, `{"ok":true,"ping":"pong","1":[]}`},
+		{"nested map", func(w *Writer) {
+			w.WriteArray(1)
+			w.WriteAggregate(Map, 1, func() {
+				w.WriteBulkString("id")
+				w.WriteNullArray()
+			})
+		}, `{"ok":true,"result":[{"id":null}]}`},
+		{"attribute", func(w *Writer) {
+			w.WriteAttribute(1)
+			w.WriteString("ttl")
+			w.WriteInt(3600)
+			w.WriteBulkString("value")
+		}, `{"ok":true,"result":"value"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w Writer
+			w.SetKind(Tile38)
+			tt.write(&w)
+			assert.Equal(t, string(AppendTile38(nil, []byte(tt.json))), string(w.Bytes()))
+			assert.Empty(t, w.stack)
+		})
+	}
+
+	// Each top-level value is a message of its own, and only complete
+	// messages are flushed.
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetKind(Tile38)
+	w.WriteArray(2)
+	w.WriteBulkString(strings.Repeat("v", 2*writerBufferSize))
+	assert.Equal(t, 0, buf.Len())
+	w.WriteInt(1)
+	w.WriteString("OK")
+	assert.NoError(t, w.Flush())
+	big := `{"ok":true,"result":["` + strings.Repeat("v", 2*writerBufferSize) + `",1]}`
+	assert.Equal(t, string(AppendTile38(AppendTile38(nil, []byte(big)), []byte(`{"ok":true}`))), buf.String())
+}
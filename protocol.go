@@ -0,0 +1,107 @@
+package redhub
+
+import (
+	"github.com/IceFireDB/redhub/pkg/resp"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// ProtocolHandler is a command handler that writes its reply through a
+// resp.Writer instead of appending RESP to a buffer.
+//
+// The Writer is set up for the protocol of the connection (see Conn.Kind), so
+// the same handler answers Redis and Telnet clients with RESP and Tile38 clients
+// with Tile38 native JSON messages. The Writer is reused for the following
+// commands of the connection, which keeps any protocol version selected with
+// SetProtocol, for example after a HELLO 3 command.
+//
+// Like the handler passed to NewRedHub, it runs on the connection's event loop
+// and must not retain cmd, c or w after it returns.
+type ProtocolHandler func(c *Conn, cmd resp.Command, w *resp.Writer) Action
+
+// SetProtocolHandler installs a handler whose replies follow the protocol of
+// each connection. When set, it is called for every command instead of the
+// handler passed to NewRedHub. SetReplyHandler takes precedence over it.
+//
+// Tile38 native commands, "$<len> <command line>\r\n", are only accepted once
+// the parser allows them, see SetParser.
+//
+// SetProtocolHandler must be called before the server is started.
+//
+// Example:
+//
+//	rh.SetParser(&resp.Parser{Telnet: true, Tile38: true})
+//	rh.SetProtocolHandler(func(c *redhub.Conn, cmd resp.Command, w *resp.Writer) redhub.Action {
+//	    switch strings.ToLower(string(cmd.Args[0])) {
+//	    case "ping":
+//	        if c.Kind() == resp.Tile38 {
+//	            w.WriteMap(1) // {"ok":true,"ping":"pong"}
+//	            w.WriteString("ping")
+//	            w.WriteString("pong")
+//	        } else {
+//	            w.WriteString("PONG")
+//	        }
+//	    case "get":
+//	        w.WriteAny(store[string(cmd.Args[1])]) // {"ok":true,"result":...}
+//	    default:
+//	        w.WriteError("ERR unknown command") // {"ok":false,"err":"ERR unknown command"}
+//	    }
+//	    return redhub.None
+//	})
+func (rs *RedHub) SetProtocolHandler(handler ProtocolHandler) {
+	rs.protocolHandler = handler
+}
+
+// Kind returns the protocol spoken by the client: resp.Redis, resp.Tile38 or
+// resp.Telnet. It is detected from the first command of the connection, and is
+// resp.Redis until a command has been received.
+//
+// Each command also carries its own protocol in resp.Command.Kind.
+func (c *Conn) Kind() resp.Kind {
+	if cb, ok := c.Conn.Context().(*connBuffer); ok {
+		return cb.kind
+	}
+	return resp.Redis
+}
+
+// detectKind records the protocol of the connection from its first command.
+func (cb *connBuffer) detectKind(cmd resp.Command) {
+	if !cb.detected {
+		cb.kind = cmd.Kind
+		cb.detected = true
+	}
+}
+
+// serveProtocol runs the protocol handler for cmd and appends its reply to out.
+func (rs *RedHub) serveProtocol(c gnet.Conn, cb *connBuffer, cmd resp.Command, out []byte) ([]byte, Action) {
+	cb.conn.Conn = c
+	cb.writer.SetKind(cb.kind)
+	status := rs.protocolHandler(&cb.conn, cmd, &cb.writer)
+	out = append(out, cb.writer.Bytes()...)
+	cb.writer.Reset()
+	return out, status
+}
+
+// appendError appends an error reply in the protocol of the connection.
+func (cb *connBuffer) appendError(out []byte, msg string) []byte {
+	if cb.kind != resp.Tile38 {
+		return resp.AppendError(out, msg)
+	}
+	cb.writer.SetKind(resp.Tile38)
+	cb.writer.WriteError(msg)
+	out = append(out, cb.writer.Bytes()...)
+	cb.writer.Reset()
+	return out
+}
+
+// appendErr appends err as an error reply in the protocol of the connection,
+// following the rules of resp.AppendErr.
+func (cb *connBuffer) appendErr(out []byte, err error) []byte {
+	if cb.kind != resp.Tile38 {
+		return resp.AppendErr(out, err)
+	}
+	cb.writer.SetKind(resp.Tile38)
+	cb.writer.WriteErr(err)
+	out = append(out, cb.writer.Bytes()...)
+	cb.writer.Reset()
+	return out
+}
@@ -0,0 +1,488 @@
+package redhub
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// PubSub delivers the messages published on channels to the clients that
+// subscribed to them, like Redis Pub/Sub. Install it with SetPubSub.
+//
+// Messages are delivered with gnet's AsyncWrite, which queues them on the
+// event loop of each subscriber: publishing never waits for a subscriber, so
+// handlers may publish, or emit keyspace notifications with Notify, from the
+// event loop that runs them.
+//
+// A PubSub is safe for concurrent use.
+type PubSub struct {
+	mu       sync.RWMutex
+	channels map[string]map[*subscriber]struct{}
+	patterns map[string]map[*subscriber]struct{}
+
+	notify atomic.Uint32 // NotifyFlags
+}
+
+// subscriber is the Pub/Sub state of a client connection. Its channels and
+// patterns are only modified by the event loop of the connection, with the
+// PubSub locked.
+type subscriber struct {
+	conn     gnet.Conn
+	resp3    bool // Whether messages are sent as RESP3 pushes
+	channels map[string]struct{}
+	patterns map[string]struct{}
+}
+
+// count returns the number of subscriptions of the client.
+func (s *subscriber) count() int {
+	return len(s.channels) + len(s.patterns)
+}
+
+// NewPubSub returns a PubSub without subscribers, whose keyspace
+// notifications are disabled.
+//
+// Example:
+//
+//	ps := redhub.NewPubSub()
+//	ps.SetNotifyFlags(redhub.NotifyKeyevent | redhub.NotifyGeneric)
+//	rh.SetPubSub(ps)
+func NewPubSub() *PubSub {
+	return &PubSub{
+		channels: make(map[string]map[*subscriber]struct{}),
+		patterns: make(map[string]map[*subscriber]struct{}),
+	}
+}
+
+// SetPubSub enables Pub/Sub. RedHub then answers the following commands
+// itself:
+//
+//   - SUBSCRIBE, UNSUBSCRIBE, PSUBSCRIBE and PUNSUBSCRIBE, which manage the
+//     subscriptions of the client. While a RESP2 client has subscriptions,
+//     it may only send these commands, PING, QUIT and RESET;
+//   - PUBLISH channel message, which replies with the number of clients that
+//     received the message;
+//   - PUBSUB CHANNELS [pattern], PUBSUB NUMSUB [channel ...] and PUBSUB
+//     NUMPAT;
+//   - CONFIG GET notify-keyspace-events and CONFIG SET notify-keyspace-events
+//     flags, see SetNotifyFlags. Other CONFIG commands go to the handler.
+//     With a Config (see SetConfig), CONFIG is answered by the Config
+//     instead, where RegisterConfig declares notify-keyspace-events.
+//
+// Messages are sent as RESP3 pushes to the clients whose protocol handler
+// switched the connection to RESP3 (see SetProtocolHandler), and as RESP2
+// arrays otherwise. SetPubSub must be called before the server is started.
+func (rs *RedHub) SetPubSub(ps *PubSub) {
+	rs.pubsub = ps
+}
+
+// Publish sends message to the clients subscribed to channel, or to a pattern
+// matching it, and returns the number of deliveries.
+func (ps *PubSub) Publish(channel, message []byte) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	n := 0
+	if subs := ps.channels[string(channel)]; len(subs) > 0 {
+		var msgs [2][]byte
+		for s := range subs {
+			s.deliver(&msgs, func(b []byte, proto resp.Protocol) []byte {
+				b = appendPubSubHeader(b, proto, 3)
+				b = resp.AppendBulkString(b, "message")
+				b = resp.AppendBulk(b, channel)
+				return resp.AppendBulk(b, message)
+			})
+			n++
+		}
+	}
+	for pattern, subs := range ps.patterns {
+		if !stringMatch(pattern, channel, false) {
+			continue
+		}
+		var msgs [2][]byte
+		for s := range subs {
+			s.deliver(&msgs, func(b []byte, proto resp.Protocol) []byte {
+				b = appendPubSubHeader(b, proto, 4)
+				b = resp.AppendBulkString(b, "pmessage")
+				b = resp.AppendBulkString(b, pattern)
+				b = resp.AppendBulk(b, channel)
+				return resp.AppendBulk(b, message)
+			})
+			n++
+		}
+	}
+	return n
+}
+
+// deliver queues a message for the subscriber. msgs caches the message in
+// RESP2 and RESP3, as built by appendMessage, which is shared by all the
+// subscribers and must not be modified afterwards.
+func (s *subscriber) deliver(msgs *[2][]byte, appendMessage func(b []byte, proto resp.Protocol) []byte) {
+	i, proto := 0, resp.RESP2
+	if s.resp3 {
+		i, proto = 1, resp.RESP3
+	}
+	if msgs[i] == nil {
+		msgs[i] = appendMessage(nil, proto)
+	}
+	_ = s.conn.AsyncWrite(msgs[i], nil)
+}
+
+// appendPubSubHeader appends the header of a Pub/Sub message or reply of n
+// elements: a push in RESP3, an array in RESP2.
+func appendPubSubHeader(b []byte, proto resp.Protocol, n int) []byte {
+	if proto >= resp.RESP3 {
+		return resp.AppendPush(b, n)
+	}
+	return resp.AppendArray(b, n)
+}
+
+// Channels returns the channels with subscribers matching pattern, sorted.
+// An empty pattern matches every channel.
+func (ps *PubSub) Channels(pattern string) []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	var channels []string
+	for channel := range ps.channels {
+		if pattern == "" || stringMatch(pattern, []byte(channel), false) {
+			channels = append(channels, channel)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// NumSub returns the number of clients subscribed to channel, not counting
+// the clients subscribed to patterns.
+func (ps *PubSub) NumSub(channel string) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return len(ps.channels[channel])
+}
+
+// NumPat returns the number of patterns clients are subscribed to.
+func (ps *PubSub) NumPat() int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return len(ps.patterns)
+}
+
+// subscribe subscribes the client to channels, or patterns, and appends the
+// confirmations to out.
+func (ps *PubSub) subscribe(c gnet.Conn, cb *connBuffer, names [][]byte, pattern bool, out []byte) []byte {
+	proto := cb.writer.Protocol()
+	kind, index := "subscribe", ps.channels
+	if pattern {
+		kind, index = "psubscribe", ps.patterns
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	s := cb.sub
+	if s == nil {
+		s = &subscriber{conn: c, channels: make(map[string]struct{}), patterns: make(map[string]struct{})}
+		cb.sub = s
+	}
+	s.resp3 = proto >= resp.RESP3
+	own := s.channels
+	if pattern {
+		own = s.patterns
+	}
+	for _, name := range names {
+		if _, ok := own[string(name)]; !ok {
+			key := string(name)
+			own[key] = struct{}{}
+			subs := index[key]
+			if subs == nil {
+				subs = make(map[*subscriber]struct{})
+				index[key] = subs
+			}
+			subs[s] = struct{}{}
+		}
+		out = appendPubSubHeader(out, proto, 3)
+		out = resp.AppendBulkString(out, kind)
+		out = resp.AppendBulk(out, name)
+		out = resp.AppendInt(out, int64(s.count()))
+	}
+	return out
+}
+
+// unsubscribe unsubscribes the client from channels, or patterns, or from all
+// of them when names is empty, and appends the confirmations to out.
+func (ps *PubSub) unsubscribe(cb *connBuffer, names [][]byte, pattern bool, out []byte) []byte {
+	proto := cb.writer.Protocol()
+	kind := "unsubscribe"
+	if pattern {
+		kind = "punsubscribe"
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	s := cb.sub
+	var own map[string]struct{}
+	if s != nil {
+		own = s.channels
+		if pattern {
+			own = s.patterns
+		}
+	}
+	reply := func(name []byte) {
+		n := 0
+		if s != nil {
+			n = s.count()
+		}
+		out = appendPubSubHeader(out, proto, 3)
+		out = resp.AppendBulkString(out, kind)
+		if name == nil {
+			out = resp.AppendNullProto(out, proto)
+		} else {
+			out = resp.AppendBulk(out, name)
+		}
+		out = resp.AppendInt(out, int64(n))
+	}
+
+	if len(names) == 0 {
+		if len(own) == 0 {
+			reply(nil)
+			return out
+		}
+		for name := range own {
+			ps.removeLocked(s, name, pattern)
+			reply([]byte(name))
+		}
+		return out
+	}
+	for _, name := range names {
+		if _, ok := own[string(name)]; ok {
+			ps.removeLocked(s, string(name), pattern)
+		}
+		reply(name)
+	}
+	return out
+}
+
+// removeLocked removes the subscription of s to a channel or a pattern.
+func (ps *PubSub) removeLocked(s *subscriber, name string, pattern bool) {
+	own, index := s.channels, ps.channels
+	if pattern {
+		own, index = s.patterns, ps.patterns
+	}
+	delete(own, name)
+	if subs := index[name]; subs != nil {
+		delete(subs, s)
+		if len(subs) == 0 {
+			delete(index, name)
+		}
+	}
+}
+
+// remove removes all the subscriptions of a client, when its connection
+// closes.
+func (ps *PubSub) remove(s *subscriber) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for name := range s.channels {
+		ps.removeLocked(s, name, false)
+	}
+	for name := range s.patterns {
+		ps.removeLocked(s, name, true)
+	}
+}
+
+// servePubSub answers the Pub/Sub commands, and the commands that RESP2
+// clients may not send while subscribed. It reports whether cmd was handled.
+func (rs *RedHub) servePubSub(c gnet.Conn, cb *connBuffer, cmd resp.Command, out []byte) ([]byte, bool) {
+	ps := rs.pubsub
+	args := cmd.Args
+	switch name := args[0]; {
+	case equalFold(name, "subscribe"), equalFold(name, "psubscribe"):
+		if len(args) < 2 {
+			return cb.appendErr(out, resp.WrongArgs(strings.ToLower(string(name)))), true
+		}
+		return ps.subscribe(c, cb, args[1:], equalFold(name, "psubscribe"), out), true
+	case equalFold(name, "unsubscribe"), equalFold(name, "punsubscribe"):
+		return ps.unsubscribe(cb, args[1:], equalFold(name, "punsubscribe"), out), true
+	case equalFold(name, "publish"):
+		if len(args) != 3 {
+			return cb.appendErr(out, resp.WrongArgs("publish")), true
+		}
+		return resp.AppendInt(out, int64(ps.Publish(args[1], args[2]))), true
+	case equalFold(name, "pubsub"):
+		return rs.pubsubCommand(cb, args, out), true
+	case equalFold(name, "config") && rs.config == nil:
+		return rs.configNotify(cb, args, out)
+	}
+
+	if cb.sub == nil || cb.sub.count() == 0 || cb.writer.Protocol() >= resp.RESP3 {
+		return out, false
+	}
+	switch name := args[0]; {
+	case equalFold(name, "ping"):
+		if len(args) > 2 {
+			return cb.appendErr(out, resp.WrongArgs("ping")), true
+		}
+		out = resp.AppendArray(out, 2)
+		out = resp.AppendBulkString(out, "pong")
+		if len(args) == 2 {
+			return resp.AppendBulk(out, args[1]), true
+		}
+		return resp.AppendBulkString(out, ""), true
+	case equalFold(name, "quit"), equalFold(name, "reset"):
+		return out, false
+	}
+	return cb.appendError(out, "ERR Can't execute '"+strings.ToLower(string(args[0]))+
+		"': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context"), true
+}
+
+// pubsubCommand answers PUBSUB CHANNELS, NUMSUB and NUMPAT.
+func (rs *RedHub) pubsubCommand(cb *connBuffer, args [][]byte, out []byte) []byte {
+	ps := rs.pubsub
+	if len(args) < 2 {
+		return cb.appendErr(out, resp.WrongArgs("pubsub"))
+	}
+	switch sub := args[1]; {
+	case equalFold(sub, "channels") && len(args) <= 3:
+		var pattern string
+		if len(args) == 3 {
+			pattern = string(args[2])
+		}
+		channels := ps.Channels(pattern)
+		out = resp.AppendArray(out, len(channels))
+		for _, channel := range channels {
+			out = resp.AppendBulkString(out, channel)
+		}
+		return out
+	case equalFold(sub, "numsub"):
+		// A flat array even in RESP3, like Redis.
+		out = resp.AppendArray(out, (len(args)-2)*2)
+		for _, channel := range args[2:] {
+			out = resp.AppendBulk(out, channel)
+			out = resp.AppendInt(out, int64(ps.NumSub(string(channel))))
+		}
+		return out
+	case equalFold(sub, "numpat") && len(args) == 2:
+		return resp.AppendInt(out, int64(ps.NumPat()))
+	}
+	return cb.appendError(out, "ERR unknown subcommand or wrong number of arguments for '"+string(args[1])+"'. Try PUBSUB HELP.")
+}
+
+// appendMapHeader appends the header of a map of n pairs: a map in RESP3, an
+// array of 2*n elements in RESP2.
+func appendMapHeader(b []byte, proto resp.Protocol, n int) []byte {
+	if proto >= resp.RESP3 {
+		return resp.AppendMap(b, n)
+	}
+	return resp.AppendArray(b, 2*n)
+}
+
+// maxMatchNesting is the largest number of * that stringMatch tries to match
+// at once, like in Redis. Longer patterns match nothing.
+const maxMatchNesting = 1000
+
+// stringMatch reports whether s matches the glob-style pattern, with the
+// rules of Redis: * matches any sequence, ? any character, [abc], [^abc] and
+// [a-z] sets of characters, and \ escapes the next character.
+//
+// Like Redis since CVE-2022-36021, it does not backtrack over patterns with
+// many *, such as "*a*a*a*a*a*ab", which would take exponential time.
+func stringMatch(pattern string, s []byte, nocase bool) bool {
+	var skipLonger bool
+	return stringMatchNested(pattern, s, nocase, &skipLonger, 0)
+}
+
+// stringMatchNested is stringMatch for a pattern after nesting *. skipLonger
+// is set once the rest of the pattern after a * matched no suffix of s: the
+// * before it cannot match more of s either.
+func stringMatchNested(pattern string, s []byte, nocase bool, skipLonger *bool, nesting int) bool {
+	if nesting > maxMatchNesting {
+		return false
+	}
+	lower := func(c byte) byte {
+		if nocase && 'A' <= c && c <= 'Z' {
+			return c + 'a' - 'A'
+		}
+		return c
+	}
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if stringMatchNested(pattern[1:], s[i:], nocase, skipLonger, nesting+1) {
+					return true
+				}
+				if *skipLonger {
+					return false
+				}
+			}
+			*skipLonger = true
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			match := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) >= 2:
+					pattern = pattern[1:]
+					if pattern[0] == s[0] {
+						match = true
+					}
+				case len(pattern) >= 3 && pattern[1] == '-':
+					start, end := lower(pattern[0]), lower(pattern[2])
+					if start > end {
+						start, end = end, start
+					}
+					if c := lower(s[0]); start <= c && c <= end {
+						match = true
+					}
+					pattern = pattern[2:]
+				default:
+					if lower(pattern[0]) == lower(s[0]) {
+						match = true
+					}
+				}
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				// An unterminated set ends the pattern, like in Redis.
+				pattern = "]"
+			}
+			if match == not {
+				return false
+			}
+			s = s[1:]
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || lower(pattern[0]) != lower(s[0]) {
+				return false
+			}
+			s = s[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(s) == 0
+}
@@ -0,0 +1,208 @@
+package redhub
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pubsubClient is a connection to a server with Pub/Sub, which sees the
+// messages delivered to it along with its replies.
+type pubsubClient struct {
+	rh   *RedHub
+	conn *mockConn
+}
+
+func newPubSubClient(rh *RedHub) *pubsubClient {
+	conn := &mockConn{}
+	conn.SetContext(&connBuffer{})
+	return &pubsubClient{rh: rh, conn: conn}
+}
+
+// send serves input and returns what the client received since the last call.
+func (c *pubsubClient) send(input string) string {
+	c.conn.buf = []byte(input)
+	c.rh.OnTraffic(c.conn)
+	return c.received()
+}
+
+func (c *pubsubClient) received() string {
+	s := string(c.conn.written)
+	c.conn.written = nil
+	return s
+}
+
+func newPubSubTestServer() (*RedHub, *PubSub) {
+	ps := NewPubSub()
+	rh := NewRedHub(nil, func(c *Conn, err error) Action { return None }, func(cmd resp.Command, out []byte) ([]byte, Action) {
+		return resp.AppendString(out, "OK"), None
+	})
+	rh.SetPubSub(ps)
+	return rh, ps
+}
+
+func TestPubSub_Subscribe(t *testing.T) {
+	rh, ps := newPubSubTestServer()
+	sub, pub := newPubSubClient(rh), newPubSubClient(rh)
+
+	assert.Equal(t, "*3\r\n$9\r\nsubscribe\r\n$3\r\nfoo\r\n:1\r\n*3\r\n$9\r\nsubscribe\r\n$3\r\nbar\r\n:2\r\n",
+		sub.send("SUBSCRIBE foo bar\r\n"))
+	assert.Equal(t, "*3\r\n$10\r\npsubscribe\r\n$2\r\nf*\r\n:3\r\n", sub.send("PSUBSCRIBE f*\r\n"))
+
+	assert.Equal(t, ":2\r\n", pub.send("PUBLISH foo hello\r\n"))
+	assert.Equal(t, "*3\r\n$7\r\nmessage\r\n$3\r\nfoo\r\n$5\r\nhello\r\n"+
+		"*4\r\n$8\r\npmessage\r\n$2\r\nf*\r\n$3\r\nfoo\r\n$5\r\nhello\r\n", sub.received())
+	assert.Equal(t, ":1\r\n", pub.send("PUBLISH bar x\r\n"))
+	assert.Equal(t, "*3\r\n$7\r\nmessage\r\n$3\r\nbar\r\n$1\r\nx\r\n", sub.received())
+	assert.Equal(t, ":0\r\n", pub.send("PUBLISH baz x\r\n"))
+	assert.Empty(t, sub.received())
+
+	// While subscribed, a RESP2 client may only manage its subscriptions.
+	assert.Equal(t, "-ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context\r\n",
+		sub.send("GET foo\r\n"))
+	assert.Equal(t, "*2\r\n$4\r\npong\r\n$0\r\n\r\n", sub.send("PING\r\n"))
+	assert.Equal(t, "+OK\r\n", pub.send("GET foo\r\n"))
+
+	assert.Equal(t, "*2\r\n$3\r\nbar\r\n$3\r\nfoo\r\n", pub.send("PUBSUB CHANNELS\r\n"))
+	assert.Equal(t, "*1\r\n$3\r\nbar\r\n", pub.send("PUBSUB CHANNELS b*\r\n"))
+	assert.Equal(t, "*4\r\n$3\r\nfoo\r\n:1\r\n$3\r\nbaz\r\n:0\r\n", pub.send("PUBSUB NUMSUB foo baz\r\n"))
+	assert.Equal(t, ":1\r\n", pub.send("PUBSUB NUMPAT\r\n"))
+	assert.Equal(t, "-ERR unknown subcommand or wrong number of arguments for 'nope'. Try PUBSUB HELP.\r\n", pub.send("PUBSUB nope\r\n"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'publish' command\r\n", pub.send("PUBLISH foo\r\n"))
+
+	assert.Equal(t, "*3\r\n$11\r\nunsubscribe\r\n$3\r\nfoo\r\n:2\r\n", sub.send("UNSUBSCRIBE foo\r\n"))
+	assert.Equal(t, "*3\r\n$12\r\npunsubscribe\r\n$2\r\nf*\r\n:1\r\n", sub.send("PUNSUBSCRIBE\r\n"))
+	assert.Equal(t, "*3\r\n$11\r\nunsubscribe\r\n$3\r\nbar\r\n:0\r\n", sub.send("UNSUBSCRIBE\r\n"))
+	assert.Equal(t, "*3\r\n$11\r\nunsubscribe\r\n$-1\r\n:0\r\n", sub.send("UNSUBSCRIBE\r\n"))
+	assert.Equal(t, "+OK\r\n", sub.send("GET foo\r\n"))
+	assert.Empty(t, ps.Channels(""))
+	assert.Zero(t, ps.NumPat())
+}
+
+func TestPubSub_RESP3(t *testing.T) {
+	rh, _ := newPubSubTestServer()
+	sub := newPubSubClient(rh)
+	sub.conn.ctx.(*connBuffer).writer.SetProtocol(resp.RESP3)
+
+	assert.Equal(t, ">3\r\n$9\r\nsubscribe\r\n$3\r\nfoo\r\n:1\r\n", sub.send("SUBSCRIBE foo\r\n"))
+	// RESP3 clients may send any command while subscribed.
+	assert.Equal(t, "+OK\r\n", sub.send("GET foo\r\n"))
+	// The mock connection writes the message right away, while gnet would
+	// write it after the reply.
+	assert.Equal(t, ">3\r\n$7\r\nmessage\r\n$3\r\nfoo\r\n$2\r\nhi\r\n:1\r\n", sub.send("PUBLISH foo hi\r\n"))
+	assert.Equal(t, "*2\r\n$3\r\nfoo\r\n:1\r\n", sub.send("PUBSUB NUMSUB foo\r\n"))
+}
+
+func TestPubSub_Close(t *testing.T) {
+	rh, ps := newPubSubTestServer()
+	sub, pub := newPubSubClient(rh), newPubSubClient(rh)
+	sub.send("SUBSCRIBE foo\r\nPSUBSCRIBE *\r\n")
+	assert.Equal(t, 1, ps.NumSub("foo"))
+
+	rh.OnClose(sub.conn, nil)
+	assert.Zero(t, ps.NumSub("foo"))
+	assert.Zero(t, ps.NumPat())
+	assert.Equal(t, ":0\r\n", pub.send("PUBLISH foo x\r\n"))
+}
+
+func TestPubSub_Notify(t *testing.T) {
+	rh, ps := newPubSubTestServer()
+	sub, client := newPubSubClient(rh), newPubSubClient(rh)
+	sub.send("PSUBSCRIBE __key*__:*\r\n")
+
+	// Disabled by default.
+	ps.Notify(NotifyString, "set", []byte("foo"), 0)
+	assert.Empty(t, sub.received())
+
+	assert.Equal(t, "*2\r\n$22\r\nnotify-keyspace-events\r\n$0\r\n\r\n", client.send("CONFIG GET notify-keyspace-events\r\n"))
+	assert.Equal(t, "+OK\r\n", client.send("CONFIG SET notify-keyspace-events KE$\r\n"))
+	assert.Equal(t, "*2\r\n$22\r\nnotify-keyspace-events\r\n$3\r\n$KE\r\n", client.send("config get NOTIFY-KEYSPACE-EVENTS\r\n"))
+	assert.Equal(t, "-ERR CONFIG SET failed (possibly related to argument 'notify-keyspace-events') - Invalid event class character. Use 'Ag$lshzxeKEtmdn'.\r\n",
+		client.send("CONFIG SET notify-keyspace-events KQ\r\n"))
+	assert.Equal(t, NotifyKeyspace|NotifyKeyevent|NotifyString, ps.NotifyFlags())
+	// The other CONFIG commands go to the handler.
+	assert.Equal(t, "+OK\r\n", client.send("CONFIG GET maxmemory\r\n"))
+
+	ps.Notify(NotifyString, "set", []byte("foo"), 0)
+	assert.Equal(t, "*4\r\n$8\r\npmessage\r\n$10\r\n__key*__:*\r\n$18\r\n__keyspace@0__:foo\r\n$3\r\nset\r\n"+
+		"*4\r\n$8\r\npmessage\r\n$10\r\n__key*__:*\r\n$18\r\n__keyevent@0__:set\r\n$3\r\nfoo\r\n", sub.received())
+	ps.Notify(NotifyGeneric, "del", []byte("foo"), 0)
+	assert.Empty(t, sub.received())
+
+	ps.SetNotifyFlags(NotifyKeyevent | NotifyAll)
+	ps.Notify(NotifyExpired, "expired", []byte("k"), 3)
+	assert.Equal(t, "*4\r\n$8\r\npmessage\r\n$10\r\n__key*__:*\r\n$22\r\n__keyevent@3__:expired\r\n$1\r\nk\r\n", sub.received())
+	ps.Notify(NotifyKeyMiss, "keymiss", []byte("k"), 3)
+	assert.Empty(t, sub.received())
+}
+
+func TestNotifyFlags(t *testing.T) {
+	for _, tt := range []struct {
+		in, out string
+		flags   NotifyFlags
+	}{
+		{"", "", 0},
+		{"KEA", "AKE", NotifyKeyspace | NotifyKeyevent | NotifyAll},
+		{"Ex", "xE", NotifyKeyevent | NotifyExpired},
+		{"g$lshzxetdKEmn", "AKEmn", NotifyAll | NotifyKeyspace | NotifyKeyevent | NotifyKeyMiss | NotifyNew},
+		{"K$$g", "g$K", NotifyKeyspace | NotifyString | NotifyGeneric},
+	} {
+		flags, err := ParseNotifyFlags(tt.in)
+		require.NoError(t, err, tt.in)
+		assert.Equal(t, tt.flags, flags, tt.in)
+		assert.Equal(t, tt.out, flags.String(), tt.in)
+	}
+	_, err := ParseNotifyFlags("KEa")
+	assert.Error(t, err)
+}
+
+func TestStringMatch(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"foo", "foo", true},
+		{"foo", "fo", false},
+		{"f*o", "fo", true},
+		{"f*o", "fxxo", true},
+		{"f*o", "fxxob", false},
+		{"f?o", "fxo", true},
+		{"f?o", "fo", false},
+		{"h[ae]llo", "hello", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[b-a]llo", "hallo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"__keyspace@0__:*", "__keyspace@0__:foo", true},
+		{"__keyspace@*__:foo", "__keyevent@0__:foo", false},
+	} {
+		assert.Equal(t, tt.match, stringMatch(tt.pattern, []byte(tt.s), false), "%q %q", tt.pattern, tt.s)
+	}
+	assert.True(t, stringMatch("FOO*", []byte("foobar"), true))
+	assert.False(t, stringMatch("FOO*", []byte("foobar"), false))
+}
+
+func TestStringMatch_Pathological(t *testing.T) {
+	// Backtracking over every * would not end before the test times out.
+	s := []byte(strings.Repeat("a", 40))
+	start := time.Now()
+	assert.False(t, stringMatch("*a*a*a*a*a*a*a*a*a*a*a*ab", s, false))
+	assert.False(t, stringMatch(strings.Repeat("*a", 100)+"b", s, true))
+	assert.True(t, stringMatch(strings.Repeat("*a", 40), s, false))
+	assert.Less(t, time.Since(start), time.Second)
+
+	// Patterns with too many * match nothing.
+	s = []byte(strings.Repeat("a", 2*maxMatchNesting))
+	assert.True(t, stringMatch(strings.Repeat("a*", maxMatchNesting)+"a", s, false))
+	assert.False(t, stringMatch(strings.Repeat("a*", maxMatchNesting+1)+"a", s, false))
+}
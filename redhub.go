@@ -37,15 +37,21 @@
 // # Architecture
 //
 // RedHub implements an event-driven architecture using multiple event loops that run in parallel
-// (in multi-core mode). Each connection has an associated buffer for command accumulation,
-// and commands are parsed using the RESP protocol parser from the resp package.
+// (in multi-core mode). Commands are parsed directly from each connection's inbound buffer
+// using the RESP protocol parser from the resp package, without intermediate copies.
+//
+// The resp.Command passed to the handler references that inbound buffer, so its Raw and
+// Args slices are only valid until the handler returns. Handlers that keep arguments
+// around (for example to store a value) must copy them first.
 //
 // # Threading Model
 //
-// - Single-core mode: All connections are handled by a single event loop
-// - Multi-core mode: Multiple event loops distribute connections using load balancing strategies
-// - Connection Buffering: Each connection maintains its own buffer and command queue
-// - Thread Safety: Uses RWMutex for connection map synchronization
+//   - Single-core mode: All connections are handled by a single event loop
+//   - Multi-core mode: Multiple event loops distribute connections using load balancing strategies
+//   - Connection Buffering: Commands are parsed in place from gnet's inbound buffer;
+//     incomplete commands stay there until the rest of the data arrives
+//   - Thread Safety: Per-connection state lives in the gnet connection context, so event
+//     loops never contend on a shared lock
 //
 // # Performance
 //
@@ -55,12 +61,13 @@
 package redhub
 
 import (
-	"bytes"
 	"context"
 	"errors"
+	"os"
 	"sync"
 	"time"
 
+	"github.com/IceFireDB/redhub/pkg/cluster"
 	"github.com/IceFireDB/redhub/pkg/resp"
 	"github.com/panjf2000/gnet/v2"
 )
@@ -97,9 +104,17 @@ type Conn struct {
 // This can be used to store application-specific data such as authentication state,
 // selected database, or any other per-connection information.
 //
+// RedHub keeps its own per-connection state in the underlying gnet context, so the
+// application context is layered on top of it. Use this method rather than calling
+// SetContext on the embedded gnet.Conn directly.
+//
 // The context is accessible via the Context() method and is automatically
 // cleaned up when the connection is closed.
 func (c *Conn) SetContext(ctx interface{}) {
+	if cb, ok := c.Conn.Context().(*connBuffer); ok {
+		cb.ctx = ctx
+		return
+	}
 	c.Conn.SetContext(ctx)
 }
 
@@ -107,6 +122,9 @@ func (c *Conn) SetContext(ctx interface{}) {
 // Returns the data that was previously set using SetContext.
 // Returns nil if no context has been set.
 func (c *Conn) Context() interface{} {
+	if cb, ok := c.Conn.Context().(*connBuffer); ok {
+		return cb.ctx
+	}
 	return c.Conn.Context()
 }
 
@@ -192,33 +210,124 @@ type Options struct {
 	// This can reduce the number of system calls but requires careful handling.
 	// Default: false
 	EdgeTriggeredIO bool
+
+	// UnixSocketPerm sets the permission bits of the socket file when listening on
+	// a Unix domain socket, like Redis's unixsocketperm (e.g. 0770). It has no
+	// effect on other networks.
+	// Default: 0 (keep the permissions the socket was created with)
+	UnixSocketPerm os.FileMode
 }
 
 // RedHub represents the main server structure that manages connections and command processing.
 // It implements the gnet.EventHandler interface and is typically created using NewRedHub.
 //
-// RedHub maintains a map of connections to their associated buffers, allowing each
-// connection to accumulate data across multiple reads until complete commands are parsed.
+// RedHub attaches a buffer to each connection through the gnet connection context,
+// so the per-connection state is only ever touched by the event loop that owns the
+// connection and no global lock is taken on the request path.
 type RedHub struct {
-	onOpened     func(c *Conn) (out []byte, action Action)
-	onClosed     func(c *Conn, err error) (action Action)
-	handler      func(cmd resp.Command, out []byte) ([]byte, Action)
-	redHubBufMap map[gnet.Conn]*connBuffer
-	connSync     *sync.RWMutex
-	mu           sync.Mutex
-	addr         string
-	running      bool
-	engine       gnet.Engine
+	onOpened func(c *Conn) (out []byte, action Action)
+	onClosed func(c *Conn, err error) (action Action)
+	handler  func(cmd resp.Command, out []byte) ([]byte, Action)
+
+	parser          *resp.Parser
+	streamThreshold int
+	streamHandler   StreamHandler
+	replyHandler    ReplyHandler
+	protocolHandler ProtocolHandler
+	commands        commandTable
+	cluster         *cluster.Cluster
+	bus             *cluster.Bus
+	repl            *Replication
+	replica         *Replica
+	aof             *AOF
+	pubsub          *PubSub
+	tracking        *Tracking
+	config          *Config
+
+	// pipelinedReplies lets commands run behind a streamed reply, see
+	// SetPipelinedReplies.
+	pipelinedReplies bool
+
+	// writeMu serializes the write commands propagated to replicas or logged
+	// to the AOF, from their handler to their propagation, so that they are
+	// propagated and logged in the order they were applied.
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	running  bool
+	stopping bool
+	engines  []gnet.Engine
 }
 
-// connBuffer holds the buffer and commands for each connection.
+// connBuffer holds the reusable per-connection parsing state.
 // This structure is maintained internally by RedHub and is not exposed to users.
-//
-// The buffer accumulates incoming data until complete commands can be parsed.
-// Once commands are parsed, they are stored in the command slice for processing.
+// It is stored as the gnet connection context, with the application's own context
+// kept in the ctx field (see Conn.SetContext).
+//
+// Incoming data is never copied into the connBuffer: commands are parsed in place
+// from gnet's inbound buffer, and incomplete commands are simply left there until
+// more data arrives, without being parsed again until it may be complete (see
+// need). The slices below are reused across reads so that the hot path does not
+// allocate.
 type connBuffer struct {
-	buf     bytes.Buffer   // Accumulates incoming data from the network
-	command []resp.Command // Stores parsed commands waiting to be processed
+	args   [][]byte     // Backing array reused for the arguments of each parsed command
+	need   int          // Bytes to buffer before the incomplete command is parsed again
+	out    []byte       // Reply buffer reused across reads
+	ctx    interface{}  // Application context set through Conn.SetContext
+	stream *bulkStream  // Large argument currently being streamed, if any
+	reply  *ReplyWriter // Reply currently being streamed, if any
+
+	kind     resp.Kind   // Protocol of the connection, see Conn.Kind
+	detected bool        // Whether kind has been detected yet
+	conn     Conn        // Conn passed to the protocol handler
+	writer   resp.Writer // Writer passed to the protocol handler
+
+	keys     [][]byte // Keys of the command being routed to a cluster node
+	asking   bool     // Whether the client sent ASKING before this command
+	readonly bool     // Whether the client sent READONLY
+
+	replica *replica // Replication state, once the client sent REPLCONF or PSYNC
+
+	aofPending bool // Whether write commands were appended to the AOF but not written yet
+
+	sub      *subscriber     // Pub/Sub subscriptions, once the client sent SUBSCRIBE or PSUBSCRIBE
+	tracking *trackingClient // Client-side caching state, once the client sent a command
+}
+
+// maxRetainedBufferCap is the largest reply buffer kept for reuse by a connection.
+// Buffers that grew beyond it for an unusually large reply are released to the GC.
+const maxRetainedBufferCap = 64 * 1024
+
+// connBufferPool recycles connBuffers between connections.
+var connBufferPool = sync.Pool{
+	New: func() interface{} { return new(connBuffer) },
+}
+
+// release resets the connBuffer and returns it to the pool.
+func (cb *connBuffer) release() {
+	if cap(cb.out) > maxRetainedBufferCap {
+		cb.out = nil
+	}
+	if cap(cb.writer.Bytes()) > maxRetainedBufferCap {
+		cb.writer = resp.Writer{}
+	}
+	cb.args = cb.args[:0]
+	cb.need = 0
+	cb.out = cb.out[:0]
+	cb.ctx = nil
+	cb.kind = resp.Redis
+	cb.detected = false
+	cb.conn = Conn{}
+	cb.writer.Reset()
+	cb.writer.SetKind(resp.Redis)
+	cb.writer.SetProtocol(resp.RESP2)
+	cb.asking = false
+	cb.readonly = false
+	cb.replica = nil
+	cb.aofPending = false
+	cb.sub = nil
+	cb.tracking = nil
+	connBufferPool.Put(cb)
 }
 
 // NewRedHub creates a new RedHub instance with the specified event handlers.
@@ -245,23 +354,50 @@ func NewRedHub(
 	handler func(cmd resp.Command, out []byte) ([]byte, Action),
 ) *RedHub {
 	return &RedHub{
-		redHubBufMap: make(map[gnet.Conn]*connBuffer),
-		connSync:     &sync.RWMutex{},
-		onOpened:     onOpened,
-		onClosed:     onClosed,
-		handler:      handler,
+		onOpened: onOpened,
+		onClosed: onClosed,
+		handler:  handler,
+		parser:   defaultParser,
 	}
 }
 
+// defaultParser accepts RESP and inline commands, like resp.ReadCommand.
+var defaultParser = &resp.Parser{Telnet: true, RejectEmpty: true}
+
+// SetParser replaces the parser used to read commands from clients. By default
+// RedHub accepts RESP and inline commands, and parses them like resp.ReadCommand.
+//
+// With Parser.Copy set, the arguments passed to the handler own their data and
+// may be retained after it returns. The cmd.Args slice itself is still reused
+// for the next command.
+//
+// SetParser must be called before the server is started.
+//
+// Example:
+//
+//	rh.SetParser(&resp.Parser{
+//	    Telnet:     true,
+//	    Copy:       true,
+//	    MaxBulkLen: 64 << 20,
+//	})
+func (rs *RedHub) SetParser(p *resp.Parser) {
+	rs.parser = p
+}
+
 // OnBoot is called by gnet when the server is ready to accept connections.
 // This is part of the gnet.EventHandler interface.
 //
-// The engine parameter provides access to server-wide operations.
+// The engine parameter provides access to server-wide operations. When serving
+// several listeners, OnBoot is called once for the engine of each listener.
 // Typically returns gnet.None to indicate normal startup.
 func (rs *RedHub) OnBoot(eng gnet.Engine) (action gnet.Action) {
 	rs.mu.Lock()
-	rs.engine = eng
-	rs.mu.Unlock()
+	defer rs.mu.Unlock()
+	if rs.stopping {
+		// The server was closed, or another listener failed, while this one was starting.
+		return gnet.Shutdown
+	}
+	rs.engines = append(rs.engines, eng)
 	return gnet.None
 }
 
@@ -276,12 +412,10 @@ func (rs *RedHub) OnShutdown(eng gnet.Engine) {
 // OnOpen is called by gnet when a new connection is opened.
 // This is part of the gnet.EventHandler interface.
 //
-// A new buffer is created for the connection to accumulate incoming data,
+// A pooled buffer is attached to the connection context for parsing its commands,
 // and then the application's onOpened handler is called.
 func (rs *RedHub) OnOpen(c gnet.Conn) (out []byte, action gnet.Action) {
-	rs.connSync.Lock()
-	rs.redHubBufMap[c] = new(connBuffer)
-	rs.connSync.Unlock()
+	c.SetContext(connBufferPool.Get().(*connBuffer))
 	out, act := rs.onOpened(&Conn{Conn: c})
 	return out, gnet.Action(act)
 }
@@ -289,13 +423,32 @@ func (rs *RedHub) OnOpen(c gnet.Conn) (out []byte, action gnet.Action) {
 // OnClose is called by gnet when a connection is closed.
 // This is part of the gnet.EventHandler interface.
 //
-// The connection's buffer is removed from the map to free memory,
-// and then the application's onClosed handler is called.
+// The application's onClosed handler is called first, while its context is
+// still reachable, and then the connection's buffer is returned to the pool.
 func (rs *RedHub) OnClose(c gnet.Conn, err error) (action gnet.Action) {
-	rs.connSync.Lock()
-	delete(rs.redHubBufMap, c)
-	rs.connSync.Unlock()
-	return gnet.Action(rs.onClosed(&Conn{Conn: c}, err))
+	action = gnet.Action(rs.onClosed(&Conn{Conn: c}, err))
+	if cb, ok := c.Context().(*connBuffer); ok {
+		c.SetContext(nil)
+		if cb.sub != nil {
+			rs.pubsub.remove(cb.sub)
+		}
+		if cb.tracking != nil {
+			rs.tracking.remove(cb.tracking)
+		}
+		if cb.stream != nil || cb.reply != nil {
+			// A handler goroutine may still hold on to the buffer,
+			// so it is left to the GC instead of going back to the pool.
+			if cb.stream != nil {
+				cb.stream.abort()
+			}
+			if cb.reply != nil {
+				cb.reply.abort()
+			}
+			return action
+		}
+		cb.release()
+	}
+	return action
 }
 
 // OnTraffic is called by gnet when data is received from a connection.
@@ -303,61 +456,278 @@ func (rs *RedHub) OnClose(c gnet.Conn, err error) (action gnet.Action) {
 // of the request processing pipeline.
 //
 // The function:
-// 1. Reads all available data from the connection
-// 2. Appends it to the connection's buffer
-// 3. Parses complete commands from the buffer
-// 4. Processes each command through the handler
-// 5. Sends responses back to the client
-// 6. Handles incomplete commands by keeping remaining data in the buffer
+// 1. Peeks at all buffered data, once it holds the rest of any incomplete command
+// 2. Parses complete commands in place, reusing the connection's argument slice
+// 3. Processes each command through the handler in pipeline order
+// 4. Discards the consumed bytes, leaving any incomplete command buffered
+// 5. Sends the accumulated responses back to the client in one write
+//
+// If a stream handler is configured, a command with an oversized final argument
+// interrupts the loop and is handed to the stream handler (see SetStreamHandler).
+// Likewise, a reply handler returning a ReplyStreamer interrupts the loop until
+// its reply has been written (see SetReplyHandler), unless replies are
+// pipelined (see SetPipelinedReplies).
 func (rs *RedHub) OnTraffic(c gnet.Conn) (action gnet.Action) {
-	rs.connSync.RLock()
-	cb, ok := rs.redHubBufMap[c]
-	rs.connSync.RUnlock()
-
+	cb, ok := c.Context().(*connBuffer)
 	if !ok {
 		_, _ = c.Write(resp.AppendError(nil, "ERR Client is closed"))
 		return gnet.None
 	}
 
-	buf, _ := c.Next(-1)
-	if len(buf) == 0 {
+	if cb.reply != nil {
+		if cb.replica != nil {
+			// The reply of a replica is the replication stream, which never
+			// ends; it only sends acknowledgments.
+			return rs.readReplicaAcks(c, cb)
+		}
+		// Wait for the streamed reply; pipelined commands stay buffered.
 		return gnet.None
 	}
+	if cb.stream != nil {
+		resume, err := rs.feedStream(c, cb)
+		if err != nil {
+			_, _ = c.Write(cb.appendError(nil, "ERR "+err.Error()))
+			return gnet.Close
+		}
+		if !resume {
+			return gnet.None
+		}
+	}
 
-	cb.buf.Write(buf)
-	cmds, lastbyte, err := resp.ReadCommands(cb.buf.Bytes())
-	if err != nil {
-		_, _ = c.Write(resp.AppendError(nil, "ERR "+err.Error()))
+	// A large argument arrives over many reads: peeking at and parsing it on
+	// each one would copy it over and over.
+	if c.InboundBuffered() < cb.need {
+		return gnet.None
+	}
+	cb.need = 0
+	buf, _ := c.Peek(-1)
+	if len(buf) == 0 {
 		return gnet.None
 	}
 
-	cb.command = append(cb.command, cmds...)
-	cb.buf.Reset()
-
-	if len(lastbyte) == 0 {
-		var out []byte
-		for len(cb.command) > 0 {
-			cmd := cb.command[0]
-			cb.command = cb.command[1:]
+	out := cb.out[:0]
+	var consumed int
+	var queued []queuedReply // Streamed replies, each followed by the replies after it
+	for consumed < len(buf) {
+		cmd, n, bulkLen, err := rs.parser.ReadStreamCommand(buf[consumed:], cb.args, rs.streamThreshold)
+		if err != nil {
+			// The rest of the stream cannot be resynchronized, so drop it.
+			out = cb.appendError(out, "ERR "+err.Error())
+			consumed = len(buf)
+			break
+		}
+		if n == 0 {
+			cb.need = rs.parser.Needed(buf[consumed:], rs.streamThreshold)
+			break
+		}
+		if bulkLen >= 0 && queued != nil {
+			// The streamed argument waits for the replies before it.
+			break
+		}
+		consumed += n
+		if bulkLen >= 0 {
+			// Hand the large argument over to the stream handler. Commands behind
+			// it stay buffered until the handler's reply has been written.
+			var refused bool
+			if out, refused = rs.checkStream(cb, cmd, out); refused {
+				cb.stream = skipStream(c, bulkLen)
+			} else {
+				cb.stream = rs.startStream(c, cmd, bulkLen)
+			}
+			m, err := cb.stream.feed(buf[consumed:])
+			consumed += m
+			if err != nil {
+				out = cb.appendError(out, "ERR "+err.Error())
+				action = gnet.Close
+				break
+			}
+			if !refused || cb.stream.pending() {
+				break
+			}
+			cb.stream = nil
+			continue
+		}
+		if len(cmd.Args) == 0 {
+			continue
+		}
+		cb.args = cmd.Args[:0]
+		cb.detectKind(cmd)
+		if rs.commands != nil || rs.cluster != nil {
+			var handled bool
+			if out, handled = rs.checkCommand(cb, cmd, out); handled {
+				continue
+			}
+		}
 
-			var status Action
-			out, status = rs.handler(cmd, out)
+		var streamer ReplyStreamer
+		var status Action
+		out, streamer, status = rs.dispatch(c, cb, cmd, out)
+		if streamer != nil {
+			queued = append(queued, queuedReply{streamer: streamer, status: status, start: len(out)})
+			if rs.pipelinedReplies && cb.replica == nil {
+				continue
+			}
+			break
+		}
+		if status == Close {
+			if queued != nil {
+				// Close once the replies before it have been written.
+				queued = append(queued, queuedReply{status: Close, start: len(out)})
+			} else {
+				action = gnet.Close
+			}
+			break
+		}
+	}
 
-			if status == Close {
-				if len(out) > 0 {
-					_, _ = c.Write(out)
-				}
-				return gnet.Close
+	if cb.aofPending {
+		// The writes reach the AOF before their replies reach the client.
+		cb.aofPending = false
+		if err := rs.aof.flush(); err != nil {
+			// With FsyncAlways, writes that are not on disk are never
+			// answered.
+			out = out[:0]
+			queued = nil
+			action = gnet.Close
+		}
+	}
+	if queued != nil {
+		// The replies after the first streamer are written by the streamers,
+		// and out below, before the first streamer gets to run.
+		for i := range queued {
+			end := len(out)
+			if i+1 < len(queued) {
+				end = queued[i+1].start
 			}
+			queued[i].after = append([]byte(nil), out[queued[i].start:end]...)
 		}
-		if len(out) > 0 {
-			_, _ = c.Write(out)
+		out = out[:queued[0].start]
+		cb.reply = rs.startReply(c, cb, queued)
+	}
+	if len(out) > 0 {
+		_, _ = c.Write(out)
+	}
+	if consumed > 0 {
+		_, _ = c.Discard(consumed)
+	}
+	if cap(out) <= maxRetainedBufferCap {
+		cb.out = out[:0]
+	}
+	return action
+}
+
+// checkStream checks a command whose final argument is streamed like
+// checkCommand and dispatch check the others, with that argument left empty. It
+// reports whether cmd was refused, with the error reply appended to out.
+func (rs *RedHub) checkStream(cb *connBuffer, cmd resp.Command, out []byte) ([]byte, bool) {
+	if rs.commands == nil && rs.cluster == nil && rs.replica == nil {
+		return out, false
+	}
+	full := cmd
+	full.Args = append(cmd.Args[:len(cmd.Args):len(cmd.Args)], nil)
+	if out, refused := rs.checkCommand(cb, full, out); refused {
+		return out, true
+	}
+	if rs.replica != nil && rs.replica.following.Load() {
+		if spec := rs.commands.lookup(full.Args[0]); spec != nil && spec.Flags&FlagWrite != 0 {
+			return resp.AppendErr(out, resp.ErrReadOnly), true
 		}
-	} else {
-		cb.buf.Write(lastbyte)
 	}
+	return out, false
+}
 
-	return gnet.None
+// dispatch runs the handler of cmd. With replication enabled, it also answers the
+// replication commands, propagates the write commands to the replicas, and
+// refuses them while following a master. With an AOF, it answers BGREWRITEAOF
+// and appends the write commands to the AOF. With Pub/Sub, it answers the
+// Pub/Sub commands, and with client-side caching, the CLIENT subcommands of
+// tracking, and it records the keys read before the handler runs.
+func (rs *RedHub) dispatch(c gnet.Conn, cb *connBuffer, cmd resp.Command, out []byte) ([]byte, ReplyStreamer, Action) {
+	if rs.pubsub != nil {
+		if out, handled := rs.servePubSub(c, cb, cmd, out); handled {
+			return out, nil, None
+		}
+	}
+	if rs.tracking != nil {
+		if out, handled := rs.serveTracking(c, cb, cmd, out); handled {
+			return out, nil, None
+		}
+		rs.trackReads(cb, cmd)
+	}
+	if rs.config != nil {
+		if out, handled := rs.serveConfig(cb, cmd, out); handled {
+			return out, nil, None
+		}
+	}
+	if rs.repl == nil && rs.replica == nil && rs.aof == nil {
+		return rs.handle(c, cb, cmd, out)
+	}
+	if rs.repl != nil || rs.replica != nil {
+		if out, streamer, handled := rs.serveReplication(c, cb, cmd, out); handled {
+			return out, streamer, None
+		}
+	}
+	if rs.aof != nil {
+		if out, handled := rs.serveAOF(cmd, out); handled {
+			return out, nil, None
+		}
+	}
+	spec := rs.commands.lookup(cmd.Args[0])
+	if spec == nil || spec.Flags&FlagWrite == 0 {
+		return rs.handle(c, cb, cmd, out)
+	}
+	if rs.replica != nil && rs.replica.following.Load() {
+		return resp.AppendErr(out, resp.ErrReadOnly), nil, None
+	}
+	if rs.repl == nil && rs.aof == nil {
+		return rs.handle(c, cb, cmd, out)
+	}
+	if rs.aof != nil {
+		if err := rs.aof.writeError(); err != nil {
+			return cb.appendErr(out, err), nil, None
+		}
+	}
+	if rs.repl != nil {
+		rs.repl.pause.RLock()
+		defer rs.repl.pause.RUnlock()
+	}
+	if rs.aof != nil {
+		rs.aof.pause.RLock()
+		defer rs.aof.pause.RUnlock()
+	}
+	rs.writeMu.Lock()
+	defer rs.writeMu.Unlock()
+	if rs.repl != nil {
+		rs.repl.beginCommand()
+	}
+	if rs.aof != nil {
+		rs.aof.beginCommand()
+	}
+	mark := len(out)
+	out, streamer, status := rs.handle(c, cb, cmd, out)
+	succeeded := !isErrorReply(out[mark:])
+	if rs.repl != nil {
+		rs.repl.endCommand(cmd, succeeded)
+	}
+	if rs.aof != nil && rs.aof.endCommand(cmd, succeeded) {
+		cb.aofPending = true
+	}
+	return out, streamer, status
+}
+
+// handle runs the handler of cmd: the reply handler, the protocol handler or
+// the handler passed to NewRedHub, whichever is set.
+func (rs *RedHub) handle(c gnet.Conn, cb *connBuffer, cmd resp.Command, out []byte) ([]byte, ReplyStreamer, Action) {
+	if rs.replyHandler != nil {
+		return rs.replyHandler(cmd, out)
+	}
+	var status Action
+	if rs.protocolHandler != nil {
+		out, status = rs.serveProtocol(c, cb, cmd, out)
+	} else {
+		out, status = rs.handler(cmd, out)
+	}
+	return out, nil, status
 }
 
 // OnTick is called by gnet on a periodic timer when Ticker is enabled.
@@ -372,13 +742,15 @@ func (rs *RedHub) OnTick() (delay time.Duration, action gnet.Action) {
 // ListenAndServe starts the RedHub server on the specified address with the given options.
 //
 // This is the main entry point for starting a RedHub server. The address should be
-// in the format "tcp://host:port" (e.g., "tcp://127.0.0.1:6379").
+// in the format "tcp://host:port" (e.g., "tcp://127.0.0.1:6379"), or
+// "unix:///path/to/socket" for a Unix domain socket. Use ListenAndServeAll to
+// serve several addresses at once.
 //
 // The function blocks until the server is stopped, either by a Shutdown action or
 // by an error.
 //
 // Parameters:
-//   - addr: The address to listen on in format "scheme://host:port"
+//   - addr: The address to listen on in format "scheme://host:port" or "unix://path"
 //   - options: Server configuration options
 //   - rh: The RedHub instance created by NewRedHub
 //
@@ -394,6 +766,11 @@ func (rs *RedHub) OnTick() (delay time.Duration, action gnet.Action) {
 //	    log.Fatal(err)
 //	}
 func ListenAndServe(addr string, options Options, rh *RedHub) error {
+	return ListenAndServeAll([]Listener{{Addr: addr, Options: options}}, rh)
+}
+
+// gnetOptions converts the options into their gnet equivalents.
+func (options Options) gnetOptions() []gnet.Option {
 	var opts []gnet.Option
 
 	if options.Multicore {
@@ -435,35 +812,40 @@ func ListenAndServe(addr string, options Options, rh *RedHub) error {
 	if options.EdgeTriggeredIO {
 		opts = append(opts, gnet.WithEdgeTriggeredIO(true))
 	}
-
-	rh.mu.Lock()
-	rh.addr = addr
-	rh.running = true
-	rh.mu.Unlock()
-
-	err := gnet.Run(rh, addr, opts...)
-
-	rh.mu.Lock()
-	rh.running = false
-	rh.mu.Unlock()
-
-	return err
+	return opts
 }
 
 // Close gracefully shuts down the RedHub server.
 //
-// This method stops the server and closes all active connections. It is safe to call
-// multiple times. If the server is not currently running, it returns an error.
+// This method stops every listener of the server and closes all active connections.
+// It is safe to call multiple times. If the server is not currently running, it
+// returns an error.
 //
 // Returns an error if the server is not running or if the shutdown fails.
 func (rs *RedHub) Close() error {
 	rs.mu.Lock()
-	defer rs.mu.Unlock()
-
-	if !rs.running {
+	if !rs.running || rs.stopping {
+		rs.mu.Unlock()
 		return errors.New("server not running")
 	}
+	rs.mu.Unlock()
+	return rs.stop()
+}
+
+// stop shuts down all engines that have booted so far and makes any engine that
+// boots later shut down immediately.
+func (rs *RedHub) stop() error {
+	rs.mu.Lock()
+	rs.stopping = true
+	engines := rs.engines
+	rs.engines = nil
+	rs.mu.Unlock()
 
-	rs.running = false
-	return rs.engine.Stop(context.Background())
+	var err error
+	for _, eng := range engines {
+		if e := eng.Stop(context.Background()); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
 }
@@ -1,7 +1,22 @@
 package redhub
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -17,6 +32,7 @@ type mockConn struct {
 	written []byte
 	buf     []byte
 	ctx     interface{}
+	peeks   int
 }
 
 func (m *mockConn) Write(buf []byte) (n int, err error) {
@@ -53,6 +69,24 @@ func (m *mockConn) Next(n int) (buf []byte, err error) {
 	return buf, nil
 }
 
+func (m *mockConn) Peek(n int) (buf []byte, err error) {
+	m.peeks++
+	if n <= 0 || n > len(m.buf) {
+		return m.buf, nil
+	}
+	return m.buf[:n], nil
+}
+
+func (m *mockConn) Discard(n int) (int, error) {
+	if n <= 0 || n > len(m.buf) {
+		n = len(m.buf)
+	}
+	m.buf = m.buf[n:]
+	return n, nil
+}
+
+func (m *mockConn) InboundBuffered() int { return len(m.buf) }
+
 func (m *mockConn) AsyncWrite(buf []byte, callback gnet.AsyncCallback) error {
 	m.written = append(m.written, buf...)
 	return nil
@@ -75,8 +109,6 @@ func TestNewRedHub(t *testing.T) {
 
 	rh := NewRedHub(onOpened, onClosed, handler)
 	assert.NotNil(t, rh)
-	assert.NotNil(t, rh.redHubBufMap)
-	assert.NotNil(t, rh.connSync)
 }
 
 func TestOnOpen(t *testing.T) {
@@ -90,9 +122,7 @@ func TestOnOpen(t *testing.T) {
 	assert.Equal(t, "WELCOME", string(out))
 	assert.Equal(t, gnet.None, action)
 
-	rh.connSync.RLock()
-	_, ok := rh.redHubBufMap[mock]
-	rh.connSync.RUnlock()
+	_, ok := mock.ctx.(*connBuffer)
 	assert.True(t, ok)
 }
 
@@ -126,17 +156,12 @@ func TestOnClose(t *testing.T) {
 	rh := NewRedHub(nil, onClosed, nil)
 
 	mock := &mockConn{id: "test1"}
-	rh.connSync.Lock()
-	rh.redHubBufMap[mock] = &connBuffer{}
-	rh.connSync.Unlock()
+	mock.SetContext(&connBuffer{})
 
 	action := rh.OnClose(mock, nil)
 	assert.Equal(t, gnet.Close, action)
 
-	rh.connSync.RLock()
-	_, ok := rh.redHubBufMap[mock]
-	rh.connSync.RUnlock()
-	assert.False(t, ok)
+	assert.Nil(t, mock.ctx)
 }
 
 func TestOnClose_WithError(t *testing.T) {
@@ -147,9 +172,7 @@ func TestOnClose_WithError(t *testing.T) {
 	rh := NewRedHub(nil, onClosed, nil)
 
 	mock := &mockConn{id: "test2"}
-	rh.connSync.Lock()
-	rh.redHubBufMap[mock] = &connBuffer{}
-	rh.connSync.Unlock()
+	mock.SetContext(&connBuffer{})
 
 	err := assert.AnError
 	action := rh.OnClose(mock, err)
@@ -175,9 +198,7 @@ func TestOnTraffic_ValidCommand(t *testing.T) {
 	rh := NewRedHub(nil, nil, handler)
 
 	mock := &mockConn{id: "test1", buf: []byte("*1\r\n$4\r\nPING\r\n")}
-	rh.connSync.Lock()
-	rh.redHubBufMap[mock] = &connBuffer{}
-	rh.connSync.Unlock()
+	mock.SetContext(&connBuffer{})
 
 	action := rh.OnTraffic(mock)
 	assert.Equal(t, "OK", string(mock.written))
@@ -191,9 +212,7 @@ func TestOnTraffic_CloseAction(t *testing.T) {
 	rh := NewRedHub(nil, nil, handler)
 
 	mock := &mockConn{id: "test1", buf: []byte("*1\r\n$4\r\nQUIT\r\n")}
-	rh.connSync.Lock()
-	rh.redHubBufMap[mock] = &connBuffer{}
-	rh.connSync.Unlock()
+	mock.SetContext(&connBuffer{})
 
 	action := rh.OnTraffic(mock)
 	assert.Equal(t, gnet.Close, action)
@@ -208,9 +227,7 @@ func TestOnTraffic_MultipleCommands(t *testing.T) {
 	rh := NewRedHub(nil, nil, handler)
 
 	mock := &mockConn{id: "test1", buf: []byte("*2\r\n$3\r\nSET\r\n$3\r\nkey\r\n*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n")}
-	rh.connSync.Lock()
-	rh.redHubBufMap[mock] = &connBuffer{}
-	rh.connSync.Unlock()
+	mock.SetContext(&connBuffer{})
 
 	action := rh.OnTraffic(mock)
 	assert.Equal(t, gnet.None, action)
@@ -224,9 +241,7 @@ func TestOnTraffic_EmptyBuffer(t *testing.T) {
 	rh := NewRedHub(nil, nil, handler)
 
 	mock := &mockConn{id: "test1", buf: []byte{}}
-	rh.connSync.Lock()
-	rh.redHubBufMap[mock] = &connBuffer{}
-	rh.connSync.Unlock()
+	mock.SetContext(&connBuffer{})
 
 	action := rh.OnTraffic(mock)
 	assert.Equal(t, gnet.None, action)
@@ -268,6 +283,37 @@ func TestContextHandling(t *testing.T) {
 	rh.OnClose(mock, nil)
 }
 
+func TestContextLayering(t *testing.T) {
+	var seen interface{}
+	onOpened := func(c *Conn) ([]byte, Action) {
+		assert.Nil(t, c.Context())
+		c.SetContext("user-value")
+		return nil, None
+	}
+	onClosed := func(c *Conn, err error) Action {
+		seen = c.Context()
+		return None
+	}
+	handler := func(cmd resp.Command, out []byte) ([]byte, Action) {
+		return resp.AppendOK(out), None
+	}
+	rh := NewRedHub(onOpened, onClosed, handler)
+
+	mock := &mockConn{id: "test1"}
+	rh.OnOpen(mock)
+	cb, ok := mock.ctx.(*connBuffer)
+	assert.True(t, ok)
+	assert.Equal(t, "user-value", cb.ctx)
+
+	mock.buf = []byte("*1\r\n$4\r\nPING\r\n")
+	rh.OnTraffic(mock)
+	assert.Equal(t, "+OK\r\n", string(mock.written))
+
+	rh.OnClose(mock, nil)
+	assert.Equal(t, "user-value", seen)
+	assert.Nil(t, mock.ctx)
+}
+
 func TestBulkDataHandling(t *testing.T) {
 	smallData := make([]byte, 10)
 	for i := range smallData {
@@ -287,9 +333,7 @@ func TestBulkDataHandling(t *testing.T) {
 	buf = append(buf, '\r', '\n')
 
 	mock := &mockConn{id: "test1", buf: buf}
-	rh.connSync.Lock()
-	rh.redHubBufMap[mock] = &connBuffer{}
-	rh.connSync.Unlock()
+	mock.SetContext(&connBuffer{})
 
 	action := rh.OnTraffic(mock)
 	assert.Equal(t, gnet.None, action)
@@ -303,9 +347,7 @@ func TestShutdownAction(t *testing.T) {
 	rh := NewRedHub(nil, nil, handler)
 
 	mock := &mockConn{id: "test1", buf: []byte("*1\r\n$4\r\nQUIT\r\n")}
-	rh.connSync.Lock()
-	rh.redHubBufMap[mock] = &connBuffer{}
-	rh.connSync.Unlock()
+	mock.SetContext(&connBuffer{})
 
 	action := rh.OnTraffic(mock)
 	assert.Equal(t, gnet.Close, action)
@@ -375,3 +417,814 @@ func TestClose_Integration(t *testing.T) {
 		t.Error("Server did not stop within timeout")
 	}
 }
+
+func TestOnTraffic_PartialCommand(t *testing.T) {
+	var got []string
+	handler := func(cmd resp.Command, out []byte) ([]byte, Action) {
+		got = append(got, string(cmd.Args[1]))
+		return resp.AppendOK(out), None
+	}
+	rh := NewRedHub(nil, nil, handler)
+
+	mock := &mockConn{id: "test1", buf: []byte("*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n*2\r\n$3\r\nGET\r\n$3\r\nb")}
+	mock.SetContext(&connBuffer{})
+
+	action := rh.OnTraffic(mock)
+	assert.Equal(t, gnet.None, action)
+	assert.Equal(t, []string{"foo"}, got)
+	assert.Equal(t, "+OK\r\n", string(mock.written))
+	assert.Equal(t, "*2\r\n$3\r\nGET\r\n$3\r\nb", string(mock.buf))
+
+	mock.buf = append(mock.buf, "ar\r\n"...)
+	action = rh.OnTraffic(mock)
+	assert.Equal(t, gnet.None, action)
+	assert.Equal(t, []string{"foo", "bar"}, got)
+	assert.Equal(t, "+OK\r\n+OK\r\n", string(mock.written))
+	assert.Empty(t, mock.buf)
+}
+
+func TestOnTraffic_LargeArgumentInParts(t *testing.T) {
+	var got []int
+	handler := func(cmd resp.Command, out []byte) ([]byte, Action) {
+		got = append(got, len(cmd.Args[2]))
+		return resp.AppendOK(out), None
+	}
+	rh := NewRedHub(nil, nil, handler)
+
+	value := strings.Repeat("x", 1<<20)
+	data := []byte("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$1048576\r\n" + value + "\r\n")
+	mock := &mockConn{id: "test1"}
+	mock.SetContext(&connBuffer{})
+
+	// The argument is not peeked at again until it has been fully received.
+	for len(data) > 0 {
+		n := min(len(data), 64<<10)
+		mock.buf = append(mock.buf, data[:n]...)
+		data = data[n:]
+		assert.Equal(t, gnet.None, rh.OnTraffic(mock))
+	}
+	assert.Equal(t, 2, mock.peeks)
+	assert.Equal(t, []int{1 << 20}, got)
+	assert.Equal(t, "+OK\r\n", string(mock.written))
+	assert.Empty(t, mock.buf)
+}
+
+func TestOnTraffic_ProtocolError(t *testing.T) {
+	var callCount int
+	handler := func(cmd resp.Command, out []byte) ([]byte, Action) {
+		callCount++
+		return resp.AppendOK(out), None
+	}
+	rh := NewRedHub(nil, nil, handler)
+
+	mock := &mockConn{id: "test1", buf: []byte("*1\r\n$4\r\nPING\r\n*x\r\n$4\r\nPING\r\n")}
+	mock.SetContext(&connBuffer{})
+
+	action := rh.OnTraffic(mock)
+	assert.Equal(t, gnet.None, action)
+	assert.Equal(t, 1, callCount)
+	assert.Equal(t, "+OK\r\n-ERR Protocol error: invalid multibulk length\r\n", string(mock.written))
+	assert.Empty(t, mock.buf)
+}
+
+func TestSetParser(t *testing.T) {
+	var retained [][]byte
+	handler := func(cmd resp.Command, out []byte) ([]byte, Action) {
+		retained = append(retained, cmd.Args[1])
+		return resp.AppendOK(out), None
+	}
+	rh := NewRedHub(nil, nil, handler)
+	rh.SetParser(&resp.Parser{Copy: true, MaxBulkLen: 8})
+
+	mock := &mockConn{id: "test1", buf: []byte("*2\r\n$4\r\nECHO\r\n$1\r\na\r\n*0\r\n*2\r\n$4\r\nECHO\r\n$1\r\nb\r\n")}
+	mock.SetContext(&connBuffer{})
+	rh.OnTraffic(mock)
+	// Empty multibulk commands are skipped, as in Redis.
+	assert.Equal(t, "+OK\r\n+OK\r\n", string(mock.written))
+
+	// The copied arguments survive the reuse of the inbound buffer.
+	for i := range mock.buf {
+		mock.buf[i] = 'x'
+	}
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, retained)
+
+	mock = &mockConn{id: "test2", buf: []byte("PING\r\n*1\r\n$9\r\nTOOLARGE!\r\n")}
+	mock.SetContext(&connBuffer{})
+	rh.OnTraffic(mock)
+	assert.Equal(t, "-ERR Protocol error: expected '*', got 'P'\r\n", string(mock.written))
+
+	mock = &mockConn{id: "test3", buf: []byte("*1\r\n$9\r\nTOOLARGE!\r\n")}
+	mock.SetContext(&connBuffer{})
+	rh.OnTraffic(mock)
+	assert.Equal(t, "-ERR Protocol error: invalid bulk length\r\n", string(mock.written))
+}
+
+func TestProtocolHandler(t *testing.T) {
+	rh := NewRedHub(nil, nil, nil)
+	rh.SetParser(&resp.Parser{Telnet: true, Tile38: true})
+	var kinds []resp.Kind
+	rh.SetProtocolHandler(func(c *Conn, cmd resp.Command, w *resp.Writer) Action {
+		kinds = append(kinds, c.Kind())
+		switch strings.ToLower(string(cmd.Args[0])) {
+		case "ping":
+			w.WriteString("PONG")
+		case "get":
+			w.WriteArray(2)
+			w.WriteBulkString("value")
+			w.WriteInt(1)
+		case "set":
+			w.WriteString(string(cmd.Args[len(cmd.Args)-1]))
+		case "quit":
+			w.WriteString("OK")
+			return Close
+		default:
+			w.WriteError("ERR unknown command")
+		}
+		return None
+	})
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+		kind     resp.Kind
+		action   gnet.Action
+	}{
+		{
+			name:     "redis",
+			input:    "*1\r\n$4\r\nPING\r\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\n",
+			expected: "+PONG\r\n*2\r\n$5\r\nvalue\r\n:1\r\n",
+			kind:     resp.Redis,
+		},
+		{
+			name:     "telnet",
+			input:    "PING\r\nQUIT\r\n",
+			expected: "+PONG\r\n+OK\r\n",
+			kind:     resp.Telnet,
+			action:   gnet.Close,
+		},
+		{
+			name:  "tile38",
+			input: "$4 PING\r\n$5 GET k\r\n$4 NOPE\r\n",
+			expected: "$27 {\"ok\":true,\"result\":\"PONG\"}\r\n" +
+				"$32 {\"ok\":true,\"result\":[\"value\",1]}\r\n" +
+				"$40 {\"ok\":false,\"err\":\"ERR unknown command\"}\r\n",
+			kind: resp.Tile38,
+		},
+		{
+			// A string value made of a single double quote used to crash the
+			// parser, and the server with it.
+			name:     "tile38 lone quote",
+			input:    "$14 SET k string \"\r\n",
+			expected: "$25 {\"ok\":true,\"result\":\"\\\"\"}\r\n",
+			kind:     resp.Tile38,
+		},
+		{
+			// The protocol sticks to the connection, so protocol errors are
+			// reported in it too.
+			name:     "tile38 protocol error",
+			input:    "$4 PING\r\n$x PING\r\n",
+			expected: "$27 {\"ok\":true,\"result\":\"PONG\"}\r\n$56 {\"ok\":false,\"err\":\"ERR Protocol error: invalid message\"}\r\n",
+			kind:     resp.Tile38,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kinds = kinds[:0]
+			mock := &mockConn{id: tt.name, buf: []byte(tt.input)}
+			mock.SetContext(&connBuffer{})
+			action := rh.OnTraffic(mock)
+			assert.Equal(t, tt.expected, string(mock.written))
+			assert.Equal(t, tt.action, action)
+			for _, kind := range kinds {
+				assert.Equal(t, tt.kind, kind)
+			}
+			assert.Equal(t, tt.kind, (&Conn{Conn: mock}).Kind())
+		})
+	}
+}
+
+// benchConn is a minimal gnet.Conn that replays the same inbound data on every
+// read and drops everything written to it, so that benchmarks only measure
+// RedHub's own allocations.
+type benchConn struct {
+	gnet.Conn
+	data []byte
+	buf  []byte
+	ctx  interface{}
+}
+
+func (b *benchConn) Context() interface{}     { return b.ctx }
+func (b *benchConn) SetContext(v interface{}) { b.ctx = v }
+
+func (b *benchConn) Peek(n int) ([]byte, error) { return b.buf, nil }
+func (b *benchConn) InboundBuffered() int       { return len(b.buf) }
+func (b *benchConn) Discard(n int) (int, error) {
+	b.buf = b.buf[n:]
+	return n, nil
+}
+func (b *benchConn) Write(p []byte) (int, error) { return len(p), nil }
+
+func benchmarkData(pipeline int) []byte {
+	var data []byte
+	for i := 0; i < pipeline; i++ {
+		data = append(data, "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n"...)
+		data = append(data, "*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n"...)
+	}
+	return data
+}
+
+func newBenchRedHub() *RedHub {
+	return NewRedHub(
+		func(c *Conn) ([]byte, Action) { return nil, None },
+		func(c *Conn, err error) Action { return None },
+		func(cmd resp.Command, out []byte) ([]byte, Action) {
+			if len(cmd.Args) == 3 {
+				return resp.AppendOK(out), None
+			}
+			return resp.AppendBulk(out, cmd.Args[1]), None
+		},
+	)
+}
+
+func benchmarkOnTraffic(b *testing.B, pipeline int) {
+	data := benchmarkData(pipeline)
+	rh := newBenchRedHub()
+	c := &benchConn{data: data}
+	rh.OnOpen(c)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.buf = c.data
+		rh.OnTraffic(c)
+	}
+}
+
+func BenchmarkOnTraffic(b *testing.B) {
+	benchmarkOnTraffic(b, 1)
+}
+
+func BenchmarkOnTraffic_Pipelined(b *testing.B) {
+	benchmarkOnTraffic(b, 32)
+}
+
+// BenchmarkOnTraffic_Parallel drives OnTraffic from many goroutines at once, each
+// with its own connection, the way gnet's event loops do in multicore mode.
+func BenchmarkOnTraffic_Parallel(b *testing.B) {
+	data := benchmarkData(8)
+	rh := newBenchRedHub()
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		c := &benchConn{data: data}
+		rh.OnOpen(c)
+		for pb.Next() {
+			c.buf = c.data
+			rh.OnTraffic(c)
+		}
+		rh.OnClose(c, nil)
+	})
+}
+
+func TestStreamHandler_Tile38Error(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	rh := NewRedHub(nil, nil, func(cmd resp.Command, out []byte) ([]byte, Action) {
+		return resp.AppendString(out, "PONG"), None
+	})
+	rh.SetParser(&resp.Parser{Tile38: true})
+	rh.SetStreamHandler(4, func(cmd resp.Command, body io.Reader, size int, out []byte) ([]byte, Action) {
+		<-release
+		return out, None
+	})
+
+	// A streamed argument not followed by CRLF is reported in the protocol of
+	// the connection, whether it is detected as the stream starts or later.
+	const tile38Error = "$60 {\"ok\":false,\"err\":\"ERR Protocol error: invalid bulk length\"}\r\n"
+	mock := &mockConn{buf: []byte("$4 PING\r\n*2\r\n$3\r\nSET\r\n$8\r\nxxxxxxxxYY")}
+	mock.SetContext(&connBuffer{})
+	assert.Equal(t, gnet.Close, rh.OnTraffic(mock))
+	assert.Equal(t, "+PONG\r\n"+tile38Error, string(mock.written))
+
+	mock = &mockConn{buf: []byte("$4 PING\r\n*2\r\n$3\r\nSET\r\n$8\r\nxxxx")}
+	mock.SetContext(&connBuffer{})
+	assert.Equal(t, gnet.None, rh.OnTraffic(mock))
+	mock.written = nil
+	mock.buf = []byte("xxxxYY")
+	assert.Equal(t, gnet.Close, rh.OnTraffic(mock))
+	assert.Equal(t, tile38Error, string(mock.written))
+}
+
+func TestStreamHandler_Checks(t *testing.T) {
+	rh := NewRedHub(nil, nil, func(cmd resp.Command, out []byte) ([]byte, Action) {
+		return resp.AppendString(out, "PONG"), None
+	})
+	rh.RegisterCommands(RedisCommands...)
+	var streamed int
+	rh.SetStreamHandler(4, func(cmd resp.Command, body io.Reader, size int, out []byte) ([]byte, Action) {
+		streamed++
+		return out, None
+	})
+
+	// SET key is missing its value once the streamed argument is counted as
+	// the key: its argument is skipped, and the next command served.
+	mock := &mockConn{buf: []byte("*2\r\n$3\r\nSET\r\n$8\r\n01234567\r\nPING\r\n")}
+	mock.SetContext(&connBuffer{})
+	assert.Equal(t, gnet.None, rh.OnTraffic(mock))
+	assert.Equal(t, "-ERR wrong number of arguments for 'set' command\r\n+PONG\r\n", string(mock.written))
+	assert.Empty(t, mock.buf)
+
+	// The same, with the argument arriving in parts.
+	mock = &mockConn{buf: []byte("*2\r\n$3\r\nSET\r\n$8\r\n0123")}
+	mock.SetContext(&connBuffer{})
+	assert.Equal(t, gnet.None, rh.OnTraffic(mock))
+	mock.buf = append(mock.buf, "4567\r\nPING\r\n"...)
+	assert.Equal(t, gnet.None, rh.OnTraffic(mock))
+	assert.Equal(t, "-ERR wrong number of arguments for 'set' command\r\n+PONG\r\n", string(mock.written))
+	assert.Zero(t, streamed)
+
+	// A stream handler cannot be used with an AOF, which would miss its writes.
+	aof, err := OpenAOF(AOFOptions{Dir: t.TempDir()})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer aof.Close()
+	rh.SetAOF(aof)
+	assert.EqualError(t, ListenAndServe("tcp://127.0.0.1:0", Options{}, rh),
+		"a stream handler cannot be used with replication or an AOF")
+}
+
+func TestStreamHandler_BufferLimit(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	rh := NewRedHub(nil, nil, func(cmd resp.Command, out []byte) ([]byte, Action) {
+		return out, None
+	})
+	rh.SetStreamHandler(4, func(cmd resp.Command, body io.Reader, size int, out []byte) ([]byte, Action) {
+		<-release
+		return out, None
+	})
+
+	// The handler reads nothing: the queue fills up, and the rest stays in
+	// the inbound buffer.
+	const size = 64 << 20
+	mock := &mockConn{buf: []byte("*2\r\n$3\r\nSET\r\n$67108864\r\n")}
+	mock.buf = append(mock.buf, make([]byte, 2*streamQueueLen*streamChunkSize)...)
+	mock.SetContext(&connBuffer{})
+	assert.Equal(t, gnet.None, rh.OnTraffic(mock))
+	assert.Equal(t, streamQueueLen*streamChunkSize, len(mock.buf))
+	assert.Equal(t, gnet.None, rh.OnTraffic(mock))
+
+	// Past the limit, the client is disconnected.
+	mock.buf = append(mock.buf, make([]byte, streamBufferLimit)...)
+	assert.Equal(t, gnet.Close, rh.OnTraffic(mock))
+	assert.Equal(t, "-ERR "+errStreamBufferLimit.Error()+"\r\n", string(mock.written))
+	assert.Less(t, streamBufferLimit, size)
+}
+
+func TestStreamHandler_Integration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	var mu sync.Mutex
+	sizes := make(map[string]int)
+	rh := NewRedHub(
+		func(c *Conn) (out []byte, action Action) { return nil, None },
+		func(c *Conn, err error) (action Action) { return None },
+		func(cmd resp.Command, out []byte) ([]byte, Action) {
+			mu.Lock()
+			defer mu.Unlock()
+			return resp.AppendInt(out, int64(sizes[string(cmd.Args[1])])), None
+		},
+	)
+	rh.SetStreamHandler(1024, func(cmd resp.Command, body io.Reader, size int, out []byte) ([]byte, Action) {
+		var total int
+		buf := make([]byte, 4096)
+		for {
+			// Read slowly so that the chunk queue fills up and feeding stalls.
+			time.Sleep(time.Microsecond)
+			n, err := body.Read(buf)
+			for _, c := range buf[:n] {
+				if c != 'x' {
+					return resp.AppendError(out, "ERR corrupted stream"), None
+				}
+			}
+			total += n
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return resp.AppendError(out, "ERR "+err.Error()), None
+			}
+		}
+		mu.Lock()
+		sizes[string(cmd.Args[1])] = total
+		mu.Unlock()
+		return resp.AppendInt(out, int64(size)), None
+	})
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- ListenAndServe("tcp://127.0.0.1:16380", Options{}, rh)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	defer func() {
+		assert.NoError(t, rh.Close())
+		<-serverErr
+	}()
+
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:16380", time.Second)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	const size = 4 << 20
+	var req []byte
+	req = append(req, "*3\r\n$3\r\nSET\r\n$3\r\nbig\r\n"...)
+	req = resp.AppendBulk(req, bytes.Repeat([]byte{'x'}, size))
+	req = append(req, "*2\r\n$3\r\nGET\r\n$3\r\nbig\r\n"...)
+	go func() {
+		for len(req) > 0 {
+			n := 100000
+			if n > len(req) {
+				n = len(req)
+			}
+			_, _ = conn.Write(req[:n])
+			req = req[n:]
+		}
+	}()
+
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	expected := fmt.Sprintf(":%d\r\n:%d\r\n", size, size)
+	reply := make([]byte, len(expected))
+	_, err = io.ReadFull(conn, reply)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, string(reply))
+}
+
+func TestReplyHandler_Integration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	const chunks = 2048
+	chunk := bytes.Repeat([]byte{'y'}, 1024)
+	file := bytes.Repeat([]byte{'z'}, 3<<20)
+	f, err := os.CreateTemp(t.TempDir(), "reply")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+	_, err = f.Write(file)
+	assert.NoError(t, err)
+
+	rh := NewRedHub(
+		func(c *Conn) (out []byte, action Action) { return nil, None },
+		func(c *Conn, err error) (action Action) { return None },
+		nil,
+	)
+	rh.SetReplyHandler(func(cmd resp.Command, out []byte) ([]byte, ReplyStreamer, Action) {
+		switch strings.ToLower(string(cmd.Args[0])) {
+		case "scan":
+			out = resp.AppendArray(out, chunks)
+			return out, func(w *ReplyWriter) error {
+				for i := 0; i < chunks; i++ {
+					if _, err := w.Write(resp.AppendBulk(nil, chunk)); err != nil {
+						return err
+					}
+				}
+				return nil
+			}, None
+		case "dump":
+			return out, func(w *ReplyWriter) error {
+				return w.WriteBulkFile(f, 0, int64(len(file)))
+			}, None
+		}
+		return resp.AppendString(out, "PONG"), nil, None
+	})
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- ListenAndServe("tcp://127.0.0.1:16381", Options{}, rh)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	defer func() {
+		assert.NoError(t, rh.Close())
+		<-serverErr
+	}()
+
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:16381", time.Second)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("PING\r\nSCAN\r\nPING\r\nDUMP\r\nPING\r\n"))
+	assert.NoError(t, err)
+
+	var expected []byte
+	expected = resp.AppendString(expected, "PONG")
+	expected = resp.AppendArray(expected, chunks)
+	for i := 0; i < chunks; i++ {
+		expected = resp.AppendBulk(expected, chunk)
+	}
+	expected = resp.AppendString(expected, "PONG")
+	expected = resp.AppendBulk(expected, file)
+	expected = resp.AppendString(expected, "PONG")
+
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	reply := make([]byte, len(expected))
+	_, err = io.ReadFull(conn, reply)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(expected, reply), "streamed replies are out of order or corrupted")
+}
+
+func TestReplyHandler_Pipelined(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	// The streamers only finish once all the commands have been handled.
+	var handled sync.WaitGroup
+	handled.Add(5)
+	allHandled := make(chan struct{})
+	go func() {
+		handled.Wait()
+		close(allHandled)
+	}()
+	rh := NewRedHub(
+		func(c *Conn) (out []byte, action Action) { return nil, None },
+		func(c *Conn, err error) (action Action) { return None },
+		nil,
+	)
+	rh.SetReplyHandler(func(cmd resp.Command, out []byte) ([]byte, ReplyStreamer, Action) {
+		defer handled.Done()
+		switch strings.ToLower(string(cmd.Args[0])) {
+		case "get":
+			value := append([]byte(nil), cmd.Args[1]...)
+			return out, func(w *ReplyWriter) error {
+				select {
+				case <-allHandled:
+				case <-time.After(time.Second):
+					return errors.New("the commands behind the reply were not handled")
+				}
+				_, err := w.Write(resp.AppendBulk(nil, value))
+				return err
+			}, None
+		case "quit":
+			return resp.AppendOK(out), nil, Close
+		}
+		return resp.AppendString(out, "PONG"), nil, None
+	})
+	rh.SetPipelinedReplies(true)
+
+	// The server closes the connection first, so a TCP port would be left
+	// in TIME_WAIT.
+	sock := filepath.Join(t.TempDir(), "redhub.sock")
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- ListenAndServe("unix://"+sock, Options{}, rh)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	defer func() {
+		assert.NoError(t, rh.Close())
+		<-serverErr
+	}()
+
+	conn, err := net.DialTimeout("unix", sock, time.Second)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("PING\r\nGET a\r\nPING\r\nGET b\r\nQUIT\r\nPING\r\n"))
+	assert.NoError(t, err)
+
+	// The replies are in order, and the connection is closed after QUIT.
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reply, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "+PONG\r\n$1\r\na\r\n+PONG\r\n$1\r\nb\r\n+OK\r\n", string(reply))
+}
+
+func TestListenAndServeAll_Integration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	sock := filepath.Join(t.TempDir(), "redhub.sock")
+	// A stale socket file from a previous run must not prevent startup.
+	stale, err := net.Listen("unix", sock)
+	if !assert.NoError(t, err) {
+		return
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	rh := NewRedHub(
+		func(c *Conn) (out []byte, action Action) { return nil, None },
+		func(c *Conn, err error) (action Action) { return None },
+		func(cmd resp.Command, out []byte) ([]byte, Action) {
+			return resp.AppendString(out, "PONG"), None
+		},
+	)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- ListenAndServeAll([]Listener{
+			{Addr: "tcp://127.0.0.1:16382", Options: Options{Multicore: true}},
+			{Addr: "unix://" + sock, Options: Options{UnixSocketPerm: 0600}},
+		}, rh)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	fi, err := os.Stat(sock)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	}
+
+	for _, addr := range []struct{ network, address string }{
+		{"tcp", "127.0.0.1:16382"},
+		{"unix", sock},
+	} {
+		conn, err := net.DialTimeout(addr.network, addr.address, time.Second)
+		if !assert.NoError(t, err, addr.network) {
+			continue
+		}
+		_, err = conn.Write([]byte("PING\r\n"))
+		assert.NoError(t, err)
+		reply := make([]byte, 7)
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = io.ReadFull(conn, reply)
+		assert.NoError(t, err)
+		assert.Equal(t, "+PONG\r\n", string(reply))
+		conn.Close()
+	}
+
+	assert.NoError(t, rh.Close())
+	select {
+	case err := <-serverErr:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Error("Server did not stop within timeout")
+	}
+}
+
+// testTLSConfigs returns the TLS configurations of a server with a self-signed
+// certificate for 127.0.0.1, and of a client trusting it.
+func testTLSConfigs(t *testing.T) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "redhub"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	return server, &tls.Config{RootCAs: pool}
+}
+
+func TestListenAndServeAll_TLS(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	serverConfig, clientConfig := testTLSConfigs(t)
+	rh := NewRedHub(
+		func(c *Conn) (out []byte, action Action) { return nil, None },
+		func(c *Conn, err error) (action Action) { return None },
+		func(cmd resp.Command, out []byte) ([]byte, Action) {
+			if len(cmd.Args) > 1 {
+				return resp.AppendBulk(out, cmd.Args[1]), None
+			}
+			return resp.AppendString(out, "PONG"), None
+		},
+	)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- ListenAndServeAll([]Listener{
+			{Addr: "tcp://127.0.0.1:16385", TLSConfig: serverConfig},
+			{Addr: "tcp://127.0.0.1:16386"},
+		}, rh)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// Pipelined commands and a large argument are relayed in both directions.
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", "127.0.0.1:16385", clientConfig)
+	if assert.NoError(t, err) {
+		value := strings.Repeat("x", 1<<20)
+		var req, expected bytes.Buffer
+		for i := 0; i < 10; i++ {
+			req.WriteString("PING\r\n")
+			expected.WriteString("+PONG\r\n")
+		}
+		req.Write(resp.AppendArray(nil, 2))
+		req.Write(resp.AppendBulkString(nil, "ECHO"))
+		req.Write(resp.AppendBulkString(nil, value))
+		expected.Write(resp.AppendBulkString(nil, value))
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Write(req.Bytes())
+		assert.NoError(t, err)
+		reply := make([]byte, expected.Len())
+		_, err = io.ReadFull(conn, reply)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(expected.Bytes(), reply))
+		conn.Close()
+	}
+
+	// The TLS listener does not serve plaintext, while the other one does.
+	conn2, err := net.DialTimeout("tcp", "127.0.0.1:16385", time.Second)
+	if assert.NoError(t, err) {
+		_ = conn2.SetDeadline(time.Now().Add(5 * time.Second))
+		_, _ = conn2.Write([]byte("PING\r\n"))
+		reply, _ := io.ReadAll(conn2)
+		assert.NotContains(t, string(reply), "PONG")
+		conn2.Close()
+	}
+	conn2, err = net.DialTimeout("tcp", "127.0.0.1:16386", time.Second)
+	if assert.NoError(t, err) {
+		_, err = conn2.Write([]byte("PING\r\n"))
+		assert.NoError(t, err)
+		reply := make([]byte, 7)
+		_ = conn2.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = io.ReadFull(conn2, reply)
+		assert.NoError(t, err)
+		assert.Equal(t, "+PONG\r\n", string(reply))
+		conn2.Close()
+	}
+
+	// A client still connected is disconnected when the server stops.
+	conn, err = tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", "127.0.0.1:16385", clientConfig)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	assert.NoError(t, rh.Close())
+	select {
+	case err := <-serverErr:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Error("Server did not stop within timeout")
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestListenAndServeAll_TLSUnix(t *testing.T) {
+	serverConfig, _ := testTLSConfigs(t)
+	rh := NewRedHub(nil, nil, func(cmd resp.Command, out []byte) ([]byte, Action) { return out, None })
+	addr := "unix://" + filepath.Join(t.TempDir(), "redhub.sock")
+	err := ListenAndServeAll([]Listener{{Addr: addr, TLSConfig: serverConfig}}, rh)
+	assert.EqualError(t, err, "TLS is only supported on TCP listeners, not on "+addr)
+}
+
+func TestListenAndServeAll_ListenerError(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	busy, err := net.Listen("tcp", "127.0.0.1:16383")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer busy.Close()
+
+	rh := NewRedHub(nil, nil, nil)
+	done := make(chan error, 1)
+	go func() {
+		done <- ListenAndServeAll([]Listener{
+			{Addr: "tcp://127.0.0.1:16384"},
+			{Addr: "tcp://127.0.0.1:16383"},
+		}, rh)
+	}()
+
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(3 * time.Second):
+		t.Error("ListenAndServeAll did not fail within timeout")
+	}
+}
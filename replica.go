@@ -0,0 +1,646 @@
+package redhub
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+	"github.com/panjf2000/gnet/v2"
+)
+
+const (
+	// DefaultReplTimeout is the default ReplicaOptions.Timeout, like the
+	// repl-timeout of Redis.
+	DefaultReplTimeout = 60 * time.Second
+
+	// DefaultReplRetryInterval is the default ReplicaOptions.RetryInterval.
+	DefaultReplRetryInterval = time.Second
+
+	// replAckInterval is how often a replica acknowledges its offset.
+	replAckInterval = time.Second
+
+	// replEOFMarkLen is the length of the mark that ends a snapshot of unknown
+	// size, sent as "$EOF:<mark>".
+	replEOFMarkLen = 40
+)
+
+// SnapshotLoader loads the snapshots that a replica receives from its master
+// for a full resynchronization.
+type SnapshotLoader interface {
+	// LoadSnapshot replaces the dataset with the snapshot read from r, in the
+	// RDB format. The snapshot ends at io.EOF; what the loader leaves unread
+	// is skipped.
+	LoadSnapshot(r io.Reader) error
+}
+
+// SnapshotLoaderFunc adapts a function to the SnapshotLoader interface.
+type SnapshotLoaderFunc func(r io.Reader) error
+
+// LoadSnapshot calls f.
+func (f SnapshotLoaderFunc) LoadSnapshot(r io.Reader) error {
+	return f(r)
+}
+
+// ReplicaOptions configures a Replica.
+type ReplicaOptions struct {
+	// Loader loads the snapshots of full resynchronizations. It is required.
+	Loader SnapshotLoader
+
+	// Username and Password authenticate to the master with AUTH, when
+	// Password is set, like the masteruser and masterauth of Redis.
+	Username string
+	Password string
+
+	// ListeningPort is the port announced to the master, which lists it in
+	// its INFO and ROLE replies.
+	ListeningPort int
+
+	// Timeout bounds the time without data from the master before the link is
+	// considered lost. The master pings its replicas, every 10 seconds by
+	// default, so a quiet link stays up.
+	// Default: DefaultReplTimeout
+	Timeout time.Duration
+
+	// RetryInterval is the delay before reconnecting to the master.
+	// Default: DefaultReplRetryInterval
+	RetryInterval time.Duration
+}
+
+// Replica follows a master, like a Redis replica: it connects to the master,
+// loads a snapshot of its dataset, and applies the write commands that the
+// master streams afterwards. Install it with SetReplica.
+//
+// The commands of the master go to the handler of the server, exactly like
+// the commands of clients, except that their replies are discarded. When the
+// link is lost, the replica reconnects and resumes the stream from its offset
+// if the master still holds it in its backlog, without a new snapshot.
+//
+// A Replica is safe for concurrent use.
+type Replica struct {
+	rs   *RedHub
+	opts ReplicaOptions
+
+	following atomic.Bool
+	offset    atomic.Int64 // Bytes of the replication stream applied so far
+
+	ctl sync.Mutex // Serializes Follow and Stop
+
+	mu     sync.Mutex
+	master string    // Address of the master, if following one
+	id     string    // Replication ID of the master, "" before the first sync
+	state  string    // "connect", "connecting", "sync" or "connected"
+	lastIO time.Time // Last time data was received from the master
+	conn   net.Conn  // Connection to the master, if any
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewReplica returns a replica that does not follow any master yet.
+//
+// Example:
+//
+//	replica := redhub.NewReplica(redhub.ReplicaOptions{
+//	    Loader:        redhub.SnapshotLoaderFunc(store.Load),
+//	    ListeningPort: 6380,
+//	})
+//	rh.RegisterCommands(redhub.RedisCommands...)
+//	rh.SetReplica(replica)
+//	replica.Follow("10.0.0.1:6379") // or REPLICAOF 10.0.0.1 6379
+func NewReplica(opts ReplicaOptions) *Replica {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultReplTimeout
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = DefaultReplRetryInterval
+	}
+	return &Replica{opts: opts}
+}
+
+// SetReplica lets the server replicate a master with r. RedHub then answers
+// REPLICAOF host port, which makes r follow that master, and REPLICAOF NO ONE,
+// which stops it. While r follows a master, the write commands of the command
+// table (FlagWrite, see RegisterCommands) sent by clients are refused with a
+// -READONLY error, and ROLE describes the link to the master.
+//
+// The commands applied by a replica are not propagated to the replicas of the
+// server, if it has a Replication too. SetReplica must be called before the
+// server is started.
+func (rs *RedHub) SetReplica(r *Replica) {
+	r.rs = rs
+	rs.replica = r
+}
+
+// Follow makes the replica follow the master at addr, "host:port", instead of
+// the master it followed before, if any. It returns once the replica has
+// started connecting.
+func (r *Replica) Follow(addr string) error {
+	if r.rs == nil {
+		return errors.New("replica not installed with SetReplica")
+	}
+	if r.opts.Loader == nil {
+		return errors.New("replica without a snapshot loader")
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return err
+	}
+	r.ctl.Lock()
+	defer r.ctl.Unlock()
+	r.stopLink()
+	r.mu.Lock()
+	r.master = addr
+	r.state = "connect"
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	go r.run(addr, r.stop, r.done)
+	r.mu.Unlock()
+	r.following.Store(true)
+	return nil
+}
+
+// Stop stops following the master and waits until the link is closed. The
+// dataset is kept as it is.
+func (r *Replica) Stop() {
+	r.ctl.Lock()
+	defer r.ctl.Unlock()
+	r.stopLink()
+}
+
+// stopLink closes the link to the master, if any, and waits for it.
+func (r *Replica) stopLink() {
+	r.mu.Lock()
+	stop, done, conn := r.stop, r.done, r.conn
+	r.master, r.stop, r.done = "", nil, nil
+	r.mu.Unlock()
+	r.following.Store(false)
+	if stop == nil {
+		return
+	}
+	close(stop)
+	if conn != nil {
+		_ = conn.Close()
+	}
+	<-done
+	r.setState("")
+}
+
+// Master returns the address of the master, or "" if the replica does not
+// follow one.
+func (r *Replica) Master() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.master
+}
+
+// ID returns the replication ID of the master the dataset comes from, or ""
+// before the first synchronization.
+func (r *Replica) ID() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.id
+}
+
+// Offset returns the replication offset of the replica: the number of bytes
+// of the replication stream of the master applied so far.
+func (r *Replica) Offset() int64 {
+	return r.offset.Load()
+}
+
+// State returns the state of the link to the master: "connect" while waiting
+// to connect, "connecting" during the handshake, "sync" during a full
+// synchronization and "connected" once the stream is applied. It is "" if
+// the replica does not follow a master.
+func (r *Replica) State() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state
+}
+
+// AppendInfo appends the replication section of the INFO command to b.
+//
+// Example:
+//
+//	# Replication
+//	role:slave
+//	master_host:10.0.0.1
+//	master_port:6379
+//	master_link_status:up
+//	...
+func (r *Replica) AppendInfo(b []byte) []byte {
+	r.mu.Lock()
+	master, id, state, lastIO := r.master, r.id, r.state, r.lastIO
+	r.mu.Unlock()
+	off := r.offset.Load()
+
+	host, port := splitHostPort(master)
+	b = append(b, "# Replication\r\nrole:slave\r\nmaster_host:"...)
+	b = append(b, host...)
+	b = append(b, "\r\nmaster_port:"...)
+	b = append(b, port...)
+	b = append(b, "\r\nmaster_link_status:"...)
+	if state == "connected" {
+		b = append(b, "up"...)
+	} else {
+		b = append(b, "down"...)
+	}
+	b = append(b, "\r\nmaster_last_io_seconds_ago:"...)
+	if lastIO.IsZero() {
+		b = append(b, "-1"...)
+	} else {
+		b = strconv.AppendInt(b, int64(time.Since(lastIO)/time.Second), 10)
+	}
+	b = append(b, "\r\nmaster_sync_in_progress:"...)
+	if state == "sync" {
+		b = append(b, '1')
+	} else {
+		b = append(b, '0')
+	}
+	b = append(b, "\r\nslave_repl_offset:"...)
+	b = strconv.AppendInt(b, off, 10)
+	b = append(b, "\r\nmaster_replid:"...)
+	b = append(b, id...)
+	b = append(b, "\r\nmaster_repl_offset:"...)
+	b = strconv.AppendInt(b, off, 10)
+	b = append(b, "\r\n"...)
+	return b
+}
+
+// appendRole appends the reply of ROLE to out.
+func (r *Replica) appendRole(out []byte) []byte {
+	r.mu.Lock()
+	master, state := r.master, r.state
+	r.mu.Unlock()
+	host, port := splitHostPort(master)
+	portNum, _ := strconv.Atoi(port)
+	out = resp.AppendArray(out, 5)
+	out = resp.AppendBulkString(out, "slave")
+	out = resp.AppendBulkString(out, host)
+	out = resp.AppendInt(out, int64(portNum))
+	out = resp.AppendBulkString(out, state)
+	out = resp.AppendInt(out, r.offset.Load())
+	return out
+}
+
+func (r *Replica) setState(state string) {
+	r.mu.Lock()
+	r.state = state
+	r.mu.Unlock()
+}
+
+// run keeps a link to the master until stop is closed.
+func (r *Replica) run(addr string, stop, done chan struct{}) {
+	defer close(done)
+	for {
+		_ = r.sync(addr, stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		r.setState("connect")
+		select {
+		case <-stop:
+			return
+		case <-time.After(r.opts.RetryInterval):
+		}
+	}
+}
+
+// sync connects to the master, synchronizes with it and applies its stream
+// until the link is lost.
+func (r *Replica) sync(addr string, stop chan struct{}) error {
+	r.setState("connecting")
+	conn, err := net.DialTimeout("tcp", addr, r.opts.Timeout)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	select {
+	case <-stop:
+		r.mu.Unlock()
+		conn.Close()
+		return nil
+	default:
+	}
+	r.conn = conn
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.conn = nil
+		r.mu.Unlock()
+		conn.Close()
+	}()
+
+	l := &replicaLink{r: r, conn: conn}
+	l.br = bufio.NewReaderSize(deadlineReader{conn, r, r.opts.Timeout}, 64*1024)
+	if err := l.handshake(); err != nil {
+		return err
+	}
+	r.setState("connected")
+
+	ackDone := make(chan struct{})
+	defer close(ackDone)
+	go l.ackLoop(ackDone)
+	return l.stream()
+}
+
+// deadlineReader reads from the connection to the master, failing after the
+// replication timeout without data.
+type deadlineReader struct {
+	conn    net.Conn
+	r       *Replica
+	timeout time.Duration
+}
+
+func (d deadlineReader) Read(p []byte) (int, error) {
+	if err := d.conn.SetReadDeadline(time.Now().Add(d.timeout)); err != nil {
+		return 0, err
+	}
+	n, err := d.conn.Read(p)
+	if n > 0 {
+		d.r.mu.Lock()
+		d.r.lastIO = time.Now()
+		d.r.mu.Unlock()
+	}
+	return n, err
+}
+
+// replicaLink is a connection of a replica to its master.
+type replicaLink struct {
+	r    *Replica
+	conn net.Conn
+	br   *bufio.Reader
+	wmu  sync.Mutex // Serializes the writes of acknowledgments
+}
+
+// command sends a command of the handshake and returns its reply line.
+func (l *replicaLink) command(args ...string) (string, error) {
+	var b []byte
+	b = resp.AppendArray(b, len(args))
+	for _, arg := range args {
+		b = resp.AppendBulkString(b, arg)
+	}
+	if _, err := l.conn.Write(b); err != nil {
+		return "", err
+	}
+	return l.line()
+}
+
+// line reads a reply line, skipping the newlines that the master sends to keep
+// the link alive while it prepares a snapshot.
+func (l *replicaLink) line() (string, error) {
+	for {
+		line, err := l.br.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		if line = strings.TrimRight(line, "\r\n"); line != "" {
+			if line[0] == '-' {
+				return "", resp.ParseError(line[1:])
+			}
+			return line, nil
+		}
+	}
+}
+
+// handshake authenticates, describes the replica and asks for the stream
+// with PSYNC: from the offset of the replica if the master can continue it,
+// or after a snapshot otherwise.
+func (l *replicaLink) handshake() error {
+	opts := l.r.opts
+	if _, err := l.command("PING"); err != nil && !errors.Is(err, resp.ErrNoAuth) {
+		return err
+	}
+	if opts.Password != "" {
+		args := []string{"AUTH", opts.Password}
+		if opts.Username != "" {
+			args = []string{"AUTH", opts.Username, opts.Password}
+		}
+		if _, err := l.command(args...); err != nil {
+			return err
+		}
+	}
+	if opts.ListeningPort > 0 {
+		if _, err := l.command("REPLCONF", "listening-port", strconv.Itoa(opts.ListeningPort)); err != nil {
+			return err
+		}
+	}
+	if _, err := l.command("REPLCONF", "capa", "eof", "capa", "psync2"); err != nil {
+		return err
+	}
+
+	id, off := l.r.ID(), l.r.offset.Load()
+	reply, err := func() (string, error) {
+		if id == "" {
+			return l.command("PSYNC", "?", "-1")
+		}
+		return l.command("PSYNC", id, strconv.FormatInt(off+1, 10))
+	}()
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(reply)
+	if len(fields) == 0 {
+		return errors.New("unexpected PSYNC reply: " + strconv.Quote(reply))
+	}
+	switch {
+	case fields[0] == "+CONTINUE":
+		if len(fields) > 1 {
+			// The master changed its replication ID, with the same history.
+			l.r.mu.Lock()
+			l.r.id = fields[1]
+			l.r.mu.Unlock()
+		}
+		return nil
+	case fields[0] == "+FULLRESYNC" && len(fields) == 3:
+		off, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return errors.New("invalid FULLRESYNC reply: " + reply)
+		}
+		// The dataset is replaced: until the snapshot is loaded, it cannot
+		// continue any stream.
+		l.r.mu.Lock()
+		l.r.id, l.r.state = "", "sync"
+		l.r.mu.Unlock()
+		l.r.offset.Store(0)
+		if err := l.loadSnapshot(); err != nil {
+			return err
+		}
+		l.r.mu.Lock()
+		l.r.id = fields[1]
+		l.r.offset.Store(off)
+		l.r.mu.Unlock()
+		return nil
+	}
+	return errors.New("unexpected PSYNC reply: " + reply)
+}
+
+// loadSnapshot reads the snapshot of a full synchronization and passes it to
+// the loader. The snapshot is sent as "$<size>\r\n" followed by size bytes, or
+// as "$EOF:<mark>\r\n" followed by bytes up to the mark.
+func (l *replicaLink) loadSnapshot() error {
+	header, err := l.line()
+	if err != nil {
+		return err
+	}
+	if len(header) == 0 || header[0] != '$' {
+		return errors.New("invalid snapshot header: " + header)
+	}
+	var body io.Reader
+	if mark, ok := strings.CutPrefix(header, "$EOF:"); ok {
+		if len(mark) != replEOFMarkLen {
+			return errors.New("invalid snapshot header: " + header)
+		}
+		body = &eofReader{br: l.br, mark: []byte(mark)}
+	} else {
+		size, err := strconv.ParseInt(header[1:], 10, 64)
+		if err != nil || size < 0 {
+			return errors.New("invalid snapshot header: " + header)
+		}
+		body = io.LimitReader(l.br, size)
+	}
+	if err := l.r.opts.Loader.LoadSnapshot(body); err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, body)
+	return err
+}
+
+// stream applies the commands of the master until the link is lost.
+func (l *replicaLink) stream() error {
+	rs := l.r.rs
+	cb := &connBuffer{}
+	c := &replicaConn{remote: l.conn.RemoteAddr(), local: l.conn.LocalAddr()}
+	buf := make([]byte, 0, 64*1024)
+	var out []byte
+	for {
+		if len(buf) == cap(buf) {
+			buf = append(buf, 0)[:len(buf)]
+		}
+		n, err := l.br.Read(buf[len(buf):cap(buf)])
+		if err != nil {
+			return err
+		}
+		buf = buf[:len(buf)+n]
+
+		var consumed int
+		for consumed < len(buf) {
+			cmd, n, err := rs.parser.ReadCommand(buf[consumed:], cb.args)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				break
+			}
+			consumed += n
+			if len(cmd.Args) == 0 {
+				l.r.offset.Add(int64(n))
+				continue
+			}
+			cb.args = cmd.Args[:0]
+			switch {
+			case equalFold(cmd.Args[0], "ping"):
+			case equalFold(cmd.Args[0], "replconf"):
+				l.r.offset.Add(int64(n))
+				if len(cmd.Args) > 1 && equalFold(cmd.Args[1], "getack") {
+					if err := l.ack(); err != nil {
+						return err
+					}
+				}
+				continue
+			default:
+				// The replies of the master's commands are discarded, and so
+				// are their streamers: the writes must be done by the time
+				// the handler returns.
+				out, _, _ = rs.handle(c, cb, cmd, out[:0])
+			}
+			l.r.offset.Add(int64(n))
+		}
+		buf = buf[:copy(buf, buf[consumed:])]
+	}
+}
+
+// ack acknowledges the offset of the replica.
+func (l *replicaLink) ack() error {
+	off := strconv.FormatInt(l.r.offset.Load(), 10)
+	b := appendArgs(nil, [][]byte{[]byte("REPLCONF"), []byte("ACK"), []byte(off)})
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+	_, err := l.conn.Write(b)
+	return err
+}
+
+// ackLoop acknowledges the offset of the replica every second, which tells
+// the master that the link is alive.
+func (l *replicaLink) ackLoop(done chan struct{}) {
+	ticker := time.NewTicker(replAckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if l.ack() != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// eofReader reads a snapshot that ends with a mark.
+type eofReader struct {
+	br   *bufio.Reader
+	mark []byte
+	done bool
+}
+
+func (r *eofReader) Read(p []byte) (int, error) {
+	if r.done {
+		return 0, io.EOF
+	}
+	// The mark is still ahead, so at least its length can be read.
+	if _, err := r.br.Peek(len(r.mark)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	buf, _ := r.br.Peek(r.br.Buffered())
+	if i := bytes.Index(buf, r.mark); i >= 0 {
+		if i == 0 {
+			r.done = true
+			_, _ = r.br.Discard(len(r.mark))
+			return 0, io.EOF
+		}
+		buf = buf[:i]
+	} else {
+		// The end of the data may be the start of the mark.
+		buf = buf[:len(buf)-len(r.mark)+1]
+	}
+	n := copy(p, buf)
+	_, _ = r.br.Discard(n)
+	return n, nil
+}
+
+// replicaConn stands for the connection of the commands that no client sent,
+// from the master or the AOF being loaded, in the handlers, which may ask for
+// the context or the addresses of their connection.
+type replicaConn struct {
+	gnet.Conn
+	ctx    any
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *replicaConn) Context() any              { return c.ctx }
+func (c *replicaConn) SetContext(ctx any)        { c.ctx = ctx }
+func (c *replicaConn) RemoteAddr() net.Addr      { return c.remote }
+func (c *replicaConn) LocalAddr() net.Addr       { return c.local }
+func (c *replicaConn) Write([]byte) (int, error) { return 0, errors.New("replica link is read-only") }
@@ -0,0 +1,257 @@
+package redhub
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEOFReader(t *testing.T) {
+	mark := strings.Repeat("m", replEOFMarkLen)
+	payload := "snapshot" + strings.Repeat("m", replEOFMarkLen-1) + "x"
+	br := bufio.NewReaderSize(iotest.HalfReader(strings.NewReader(payload+mark+"*1\r\n$4\r\nPING\r\n")), 48)
+	r := &eofReader{br: br, mark: []byte(mark)}
+
+	data, err := io.ReadAll(iotest.OneByteReader(r))
+	require.NoError(t, err)
+	assert.Equal(t, payload, string(data))
+	// The stream goes on after the mark.
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "*1\r\n$4\r\nPING\r\n", string(rest))
+
+	// A stream lost before the mark is truncated.
+	br = bufio.NewReaderSize(strings.NewReader("snap"), 64)
+	_, err = io.ReadAll(&eofReader{br: br, mark: []byte(mark)})
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestReplica_Commands(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"REPLICAOF 127.0.0.1 x\r\n", "-ERR Invalid master port\r\n"},
+		{"REPLICAOF 127.0.0.1\r\n", "-ERR wrong number of arguments for 'replicaof' command\r\n"},
+		{"REPLICAOF NO ONE\r\n", "+OK\r\n"},
+		{"ROLE\r\n", "*3\r\n$6\r\nmaster\r\n:0\r\n*0\r\n"},
+		{"SET a 1\r\n", "+OK\r\n"},
+		{"PSYNC ? -1\r\n", "+OK\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			rh := NewRedHub(nil, nil, func(cmd resp.Command, out []byte) ([]byte, Action) {
+				return resp.AppendString(out, "OK"), None
+			})
+			rh.RegisterCommands(RedisCommands...)
+			replica := NewReplica(ReplicaOptions{Loader: SnapshotLoaderFunc(func(io.Reader) error { return nil })})
+			rh.SetReplica(replica)
+			mock := &mockConn{buf: []byte(tt.input)}
+			mock.SetContext(&connBuffer{})
+			rh.OnTraffic(mock)
+			assert.Equal(t, tt.expected, string(mock.written))
+			assert.Empty(t, replica.Master())
+		})
+	}
+}
+
+func TestReplica_Follow(t *testing.T) {
+	replica := NewReplica(ReplicaOptions{})
+	assert.EqualError(t, replica.Follow("127.0.0.1:6379"), "replica not installed with SetReplica")
+	NewRedHub(nil, nil, nil).SetReplica(replica)
+	assert.EqualError(t, replica.Follow("127.0.0.1:6379"), "replica without a snapshot loader")
+	assert.Equal(t, DefaultReplTimeout, replica.opts.Timeout)
+	assert.Equal(t, DefaultReplRetryInterval, replica.opts.RetryInterval)
+}
+
+func TestReplica_BlankPSYNCReply(t *testing.T) {
+	master, conn := net.Pipe()
+	defer master.Close()
+	defer conn.Close()
+	go func() {
+		rd := resp.NewReader(master)
+		for {
+			cmd, err := rd.ReadCommand()
+			if err != nil {
+				return
+			}
+			reply := "+OK\r\n"
+			if strings.EqualFold(string(cmd.Args[0]), "psync") {
+				reply = "   \r\n"
+			}
+			if _, err := master.Write([]byte(reply)); err != nil {
+				return
+			}
+		}
+	}()
+
+	// A line of spaces is a protocol error, not a crash of the replica.
+	l := &replicaLink{r: NewReplica(ReplicaOptions{}), conn: conn, br: bufio.NewReader(conn)}
+	assert.EqualError(t, l.handshake(), `unexpected PSYNC reply: "   "`)
+}
+
+// replTestStore is a tiny key-value store, whose snapshot is its keys and
+// values in a line.
+type replTestStore struct {
+	mu    sync.Mutex
+	data  map[string]string
+	loads int
+}
+
+func (s *replTestStore) handler(cmd resp.Command, out []byte) ([]byte, Action) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch strings.ToLower(string(cmd.Args[0])) {
+	case "set":
+		s.data[string(cmd.Args[1])] = string(cmd.Args[2])
+		return resp.AppendString(out, "OK"), None
+	case "ping":
+		return resp.AppendString(out, "PONG"), None
+	}
+	return resp.AppendError(out, "ERR unknown command"), None
+}
+
+func (s *replTestStore) Snapshot() (io.WriterTo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var b strings.Builder
+	for k, v := range s.data {
+		b.WriteString(k + "=" + v + ";")
+	}
+	return strings.NewReader(b.String()), nil
+}
+
+func (s *replTestStore) LoadSnapshot(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loads++
+	s.data = map[string]string{}
+	for _, kv := range strings.Split(string(b), ";") {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			s.data[k] = v
+		}
+	}
+	return nil
+}
+
+func (s *replTestStore) get(key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data[key]
+}
+
+func TestReplica_Integration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	// The stand-in master.
+	master := &replTestStore{data: map[string]string{"foo": "1"}}
+	rh := NewRedHub(
+		func(c *Conn) (out []byte, action Action) { return nil, None },
+		func(c *Conn, err error) (action Action) { return None },
+		master.handler,
+	)
+	rh.RegisterCommands(RedisCommands...)
+	repl := NewReplication(ReplicationOptions{Snapshotter: master})
+	rh.SetReplication(repl)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- ListenAndServe("tcp://127.0.0.1:16442", Options{Multicore: true}, rh)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	client, err := net.DialTimeout("tcp", "127.0.0.1:16442", time.Second)
+	require.NoError(t, err)
+	cr := resp.NewReader(client)
+	command := func(args ...string) string {
+		var b []byte
+		b = resp.AppendArray(b, len(args))
+		for _, arg := range args {
+			b = resp.AppendBulkString(b, arg)
+		}
+		_, err := client.Write(b)
+		require.NoError(t, err)
+		require.NoError(t, client.SetReadDeadline(time.Now().Add(5*time.Second)))
+		v, err := cr.ReadValue()
+		require.NoError(t, err)
+		return string(v.Data)
+	}
+
+	// The replica, whose clients are mock connections.
+	store := &replTestStore{data: map[string]string{"stale": "1"}}
+	replicaRH := NewRedHub(nil, nil, store.handler)
+	replicaRH.RegisterCommands(RedisCommands...)
+	replica := NewReplica(ReplicaOptions{Loader: store, ListeningPort: 6380, RetryInterval: 50 * time.Millisecond})
+	replicaRH.SetReplica(replica)
+	replicaCommand := func(input string) string {
+		mock := &mockConn{buf: []byte(input)}
+		mock.SetContext(&connBuffer{})
+		replicaRH.OnTraffic(mock)
+		return string(mock.written)
+	}
+	synced := func() bool {
+		return replica.State() == "connected" && replica.Offset() == repl.Offset()
+	}
+
+	// Full synchronization, and then the stream of writes.
+	assert.Equal(t, "+OK\r\n", replicaCommand("REPLICAOF 127.0.0.1 16442\r\n"))
+	require.Eventually(t, synced, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "1", store.get("foo"))
+	assert.Empty(t, store.get("stale"))
+	assert.Equal(t, repl.ID(), replica.ID())
+
+	assert.Equal(t, "OK", command("SET", "bar", "2"))
+	require.Eventually(t, func() bool { return store.get("bar") == "2" }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "1", command("WAIT", "1", "5000"))
+	assert.Eventually(t, synced, 5*time.Second, 10*time.Millisecond)
+
+	info := string(replica.AppendInfo(nil))
+	assert.Contains(t, info, "role:slave\r\nmaster_host:127.0.0.1\r\nmaster_port:16442\r\nmaster_link_status:up\r\n")
+	assert.Contains(t, info, "master_replid:"+repl.ID()+"\r\n")
+	masterInfo := string(repl.AppendInfo(nil))
+	assert.Contains(t, masterInfo, "slave0:ip=127.0.0.1,port=6380,state=online,")
+
+	// Clients cannot write to the replica.
+	assert.Equal(t, "-READONLY You can't write against a read only replica.\r\n", replicaCommand("SET x 1\r\n"))
+	assert.Equal(t, "+PONG\r\n", replicaCommand("PING\r\n"))
+	assert.Contains(t, replicaCommand("ROLE\r\n"), "$5\r\nslave\r\n$9\r\n127.0.0.1\r\n:16442\r\n$9\r\nconnected\r\n")
+	assert.Equal(t, "+OK Already connected to specified master\r\n", replicaCommand("REPLICAOF 127.0.0.1 16442\r\n"))
+
+	// The replica reconnects and resumes the stream, without a snapshot.
+	replica.mu.Lock()
+	require.NotNil(t, replica.conn)
+	require.NoError(t, replica.conn.Close())
+	replica.mu.Unlock()
+	assert.Equal(t, "OK", command("SET", "baz", "3"))
+	require.Eventually(t, func() bool { return store.get("baz") == "3" }, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, synced, 5*time.Second, 10*time.Millisecond)
+	store.mu.Lock()
+	assert.Equal(t, 1, store.loads)
+	store.mu.Unlock()
+
+	// REPLICAOF NO ONE makes the server writable again.
+	assert.Equal(t, "+OK\r\n", replicaCommand("REPLICAOF NO ONE\r\n"))
+	assert.Empty(t, replica.State())
+	assert.Equal(t, "+OK\r\n", replicaCommand("SET x 1\r\n"))
+	assert.Equal(t, "1", store.get("x"))
+
+	// The client and the replica close first, which leaves the port of the
+	// master free for the next run.
+	assert.NoError(t, client.Close())
+	assert.NoError(t, rh.Close())
+	<-serverErr
+}
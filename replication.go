@@ -0,0 +1,888 @@
+package redhub
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/IceFireDB/redhub/pkg/cluster"
+	"github.com/IceFireDB/redhub/pkg/resp"
+	"github.com/panjf2000/gnet/v2"
+)
+
+const (
+	// DefaultBacklogSize is the default ReplicationOptions.BacklogSize, like
+	// the repl-backlog-size of Redis.
+	DefaultBacklogSize = 1 << 20
+
+	// DefaultReplPingPeriod is the default ReplicationOptions.PingPeriod, like
+	// the repl-ping-replica-period of Redis.
+	DefaultReplPingPeriod = 10 * time.Second
+
+	// DefaultSnapshotTimeout is the default SnapshotTimeout of
+	// ReplicationOptions and AOFOptions.
+	DefaultSnapshotTimeout = 5 * time.Second
+
+	// replChunkSize is the largest part of the backlog sent to a replica at once.
+	replChunkSize = 64 * 1024
+
+	// replKeepalive is how often a newline is sent to a replica waiting for its
+	// snapshot, which keeps it from timing out.
+	replKeepalive = time.Second
+)
+
+var errSnapshotTimeout = errors.New("the snapshot was not captured in time")
+
+// Snapshotter provides the snapshots of the dataset that replicas load for a
+// full resynchronization.
+type Snapshotter interface {
+	// Snapshot captures the dataset. It is called while write commands are
+	// held back, on every event loop, so that the snapshot matches a position
+	// of the replication stream, and must return quickly, for example after
+	// copying the dataset or taking a copy-on-write view of it. Writes then
+	// resume, while the returned WriterTo writes the snapshot in the RDB
+	// format on its own goroutine.
+	//
+	// If Snapshot does not return within the SnapshotTimeout of the options,
+	// writes resume anyway: the full resynchronization or rewrite fails, and
+	// the snapshot is dropped once Snapshot returns, alongside the writes.
+	Snapshot() (io.WriterTo, error)
+}
+
+// takeSnapshot calls s.Snapshot and waits for it for at most timeout.
+func takeSnapshot(s Snapshotter, timeout time.Duration) (io.WriterTo, error) {
+	type result struct {
+		snapshot io.WriterTo
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		snapshot, err := s.Snapshot()
+		done <- result{snapshot, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.snapshot, res.err
+	case <-timer.C:
+		return nil, errSnapshotTimeout
+	}
+}
+
+// SnapshotFunc adapts a function to the Snapshotter interface.
+type SnapshotFunc func() (io.WriterTo, error)
+
+// Snapshot calls f.
+func (f SnapshotFunc) Snapshot() (io.WriterTo, error) {
+	return f()
+}
+
+// ReplicationOptions configures the replication of a master, see
+// NewReplication.
+type ReplicationOptions struct {
+	// Snapshotter provides the snapshots of full resynchronizations. Without
+	// it, replicas can only resume with a partial resynchronization.
+	Snapshotter Snapshotter
+
+	// BacklogSize is the size of the replication backlog, which holds the end
+	// of the replication stream. A replica that reconnects resumes from the
+	// backlog if it still holds its offset. It must also hold the writes made
+	// while a snapshot is transferred, or the replica has to start over.
+	// Default: DefaultBacklogSize
+	BacklogSize int
+
+	// PingPeriod is how often a PING is sent to the replicas when there are
+	// no writes, so that they can tell a quiet master from a lost link.
+	// Default: DefaultReplPingPeriod
+	PingPeriod time.Duration
+
+	// SnapshotTimeout is how long write commands are held back, at most, for
+	// the Snapshotter to capture a snapshot.
+	// Default: DefaultSnapshotTimeout
+	SnapshotTimeout time.Duration
+}
+
+// Replication streams the writes of a master to its replicas, like Redis
+// replication. Install it with SetReplication.
+//
+// The write commands of the command table (FlagWrite, see RegisterCommands)
+// are propagated to the replicas once the handler has served them without an
+// error reply. They are appended to the replication stream as RESP commands,
+// which also go to a backlog: the ring buffer that replicas resume from after
+// a disconnection. Write commands are served one at a time, even by several
+// event loops, so that the replicas apply them in the order the master did;
+// only the other commands run in parallel. A handler may propagate other
+// commands in place of its write command, see Propagate.
+//
+// A Replication is safe for concurrent use.
+type Replication struct {
+	opts ReplicationOptions
+	id   string
+
+	// pause is held by the write commands, around their handler and their
+	// propagation, and taken exclusively to capture a snapshot.
+	pause sync.RWMutex
+
+	mu       sync.Mutex
+	backlog  backlog
+	scratch  []byte
+	serving  bool   // Whether a write command is served, see beginCommand
+	pending  []byte // Commands propagated while it is served
+	lastFeed time.Time
+	replicas map[*replica]struct{}
+	acked    chan struct{} // Closed and replaced when a replica acknowledges an offset
+}
+
+// NewReplication returns the replication of a master with a new replication
+// ID and an empty backlog.
+//
+// Example:
+//
+//	repl := redhub.NewReplication(redhub.ReplicationOptions{
+//	    Snapshotter: redhub.SnapshotFunc(store.Snapshot),
+//	    BacklogSize: 16 << 20,
+//	})
+//	rh.RegisterCommands(redhub.RedisCommands...)
+//	rh.SetReplication(repl)
+func NewReplication(opts ReplicationOptions) *Replication {
+	if opts.BacklogSize <= 0 {
+		opts.BacklogSize = DefaultBacklogSize
+	}
+	if opts.PingPeriod <= 0 {
+		opts.PingPeriod = DefaultReplPingPeriod
+	}
+	if opts.SnapshotTimeout <= 0 {
+		opts.SnapshotTimeout = DefaultSnapshotTimeout
+	}
+	return &Replication{
+		opts:     opts,
+		id:       cluster.NewNodeID(),
+		backlog:  backlog{buf: make([]byte, opts.BacklogSize)},
+		lastFeed: time.Now(),
+		replicas: make(map[*replica]struct{}),
+		acked:    make(chan struct{}),
+	}
+}
+
+// SetReplication makes the server a replication master. RedHub then answers
+// the following commands itself:
+//
+//   - PSYNC and SYNC, which turn the connection into a replica, fed with a
+//     snapshot and the replication stream, or with the stream from the
+//     offset it asks for;
+//   - REPLCONF, which replicas send to describe themselves and acknowledge
+//     the offsets they have processed;
+//   - WAIT numreplicas timeout, which blocks the client until numreplicas
+//     replicas have acknowledged the writes made so far, or until the timeout
+//     in milliseconds elapses, and replies with their number;
+//   - ROLE, and REPLICAOF NO ONE, which is accepted as the server already is
+//     a master.
+//
+// Write commands are served one at a time by all the event loops, so a slow
+// write handler holds back the writes of every connection, and the commands
+// pipelined behind them. So does capturing a snapshot, for at most the
+// SnapshotTimeout of the options.
+//
+// A server with a stream handler cannot be a master (see SetStreamHandler).
+// SetReplication must be called before the server is started.
+func (rs *RedHub) SetReplication(r *Replication) {
+	rs.repl = r
+}
+
+// ID returns the replication ID of the master.
+func (r *Replication) ID() string {
+	return r.id
+}
+
+// Offset returns the replication offset: the number of bytes of the
+// replication stream so far.
+func (r *Replication) Offset() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.backlog.off
+}
+
+// Propagate appends a command to the replication stream, as if a write
+// command with these arguments had been served. Handlers use it to propagate
+// the effects of commands that are not deterministic, for example a DEL for a
+// key found expired, or a PEXPIREAT for an EXPIRE.
+//
+// Called by the handler of a write command, it replaces that command: the
+// commands it propagates are appended instead, once the handler returns, so
+// that an EXPIRE is not applied again after its PEXPIREAT. Since write
+// commands are served one at a time, every call made while one is served is
+// taken as coming from its handler: commands that propagate effects, such as
+// a read that deletes an expired key, are best flagged FlagWrite.
+func (r *Replication) Propagate(args ...[]byte) {
+	r.mu.Lock()
+	if r.serving {
+		r.pending = appendArgs(r.pending, args)
+	} else {
+		r.scratch = appendArgs(r.scratch[:0], args)
+		r.feedLocked(r.scratch)
+	}
+	r.mu.Unlock()
+}
+
+// ReplicaInfo describes a replica connected to a master.
+type ReplicaInfo struct {
+	Addr   string        // IP and listening port of the replica
+	State  string        // "wait_bgsave", "send_bulk" or "online"
+	Offset int64         // Last offset acknowledged by the replica
+	Lag    time.Duration // Time since the last acknowledgment
+}
+
+// Replicas returns the replicas connected to the master.
+func (r *Replication) Replicas() []ReplicaInfo {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	infos := make([]ReplicaInfo, 0, len(r.replicas))
+	for rep := range r.replicas {
+		infos = append(infos, ReplicaInfo{
+			Addr:   rep.addr(),
+			State:  rep.state,
+			Offset: rep.ack,
+			Lag:    now.Sub(rep.ackTime),
+		})
+	}
+	return infos
+}
+
+// AppendInfo appends the replication section of the INFO command to b.
+//
+// Example:
+//
+//	# Replication
+//	role:master
+//	connected_slaves:1
+//	slave0:ip=127.0.0.1,port=6380,state=online,offset=1404,lag=0
+//	master_replid:1c1e6e5ab5b2e4e1e5ae0b9c3dd4f6f1d7f0a4e2
+//	master_repl_offset:1404
+//	...
+func (r *Replication) AppendInfo(b []byte) []byte {
+	replicas := r.Replicas()
+	r.mu.Lock()
+	off, first, histlen := r.backlog.off, r.backlog.first(), r.backlog.histlen()
+	size := len(r.backlog.buf)
+	r.mu.Unlock()
+
+	b = append(b, "# Replication\r\nrole:master\r\nconnected_slaves:"...)
+	b = strconv.AppendInt(b, int64(len(replicas)), 10)
+	b = append(b, "\r\n"...)
+	for i, rep := range replicas {
+		ip, port := splitHostPort(rep.Addr)
+		b = append(b, "slave"...)
+		b = strconv.AppendInt(b, int64(i), 10)
+		b = append(b, ":ip="...)
+		b = append(b, ip...)
+		b = append(b, ",port="...)
+		b = append(b, port...)
+		b = append(b, ",state="...)
+		b = append(b, rep.State...)
+		b = append(b, ",offset="...)
+		b = strconv.AppendInt(b, rep.Offset, 10)
+		b = append(b, ",lag="...)
+		b = strconv.AppendInt(b, int64(rep.Lag/time.Second), 10)
+		b = append(b, "\r\n"...)
+	}
+	b = append(b, "master_replid:"...)
+	b = append(b, r.id...)
+	b = append(b, "\r\nmaster_repl_offset:"...)
+	b = strconv.AppendInt(b, off, 10)
+	b = append(b, "\r\nrepl_backlog_active:1\r\nrepl_backlog_size:"...)
+	b = strconv.AppendInt(b, int64(size), 10)
+	b = append(b, "\r\nrepl_backlog_first_byte_offset:"...)
+	b = strconv.AppendInt(b, first+1, 10)
+	b = append(b, "\r\nrepl_backlog_histlen:"...)
+	b = strconv.AppendInt(b, histlen, 10)
+	b = append(b, "\r\n"...)
+	return b
+}
+
+// feedLocked appends p to the replication stream and wakes up the replicas.
+// r.mu must be held.
+func (r *Replication) feedLocked(p []byte) {
+	r.backlog.write(p)
+	r.lastFeed = time.Now()
+	for rep := range r.replicas {
+		select {
+		case rep.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// beginCommand starts serving a write command: the commands propagated until
+// endCommand replace it.
+func (r *Replication) beginCommand() {
+	r.mu.Lock()
+	r.serving = true
+	r.pending = r.pending[:0]
+	r.mu.Unlock()
+}
+
+// endCommand propagates a write command served by the handler, if it
+// succeeded, or the commands the handler propagated in its place.
+func (r *Replication) endCommand(cmd resp.Command, succeeded bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.serving = false
+	switch {
+	case len(r.pending) > 0:
+		r.feedLocked(r.pending)
+		if cap(r.pending) > maxRetainedBufferCap {
+			r.pending = nil
+		}
+	case !succeeded:
+	case len(cmd.Raw) > 0 && cmd.Raw[0] == '*':
+		r.feedLocked(cmd.Raw)
+	default:
+		// Inline and Tile38 commands are propagated in RESP.
+		r.scratch = appendArgs(r.scratch[:0], cmd.Args)
+		r.feedLocked(r.scratch)
+	}
+}
+
+// ping propagates a PING if nothing was propagated during the ping period.
+func (r *Replication) ping(now time.Time) {
+	r.mu.Lock()
+	if now.Sub(r.lastFeed) >= r.opts.PingPeriod {
+		r.feedLocked(replPing)
+	}
+	r.mu.Unlock()
+}
+
+var (
+	replPing   = appendArgs(nil, [][]byte{[]byte("PING")})
+	replGetAck = appendArgs(nil, [][]byte{[]byte("REPLCONF"), []byte("GETACK"), []byte("*")})
+)
+
+// replica is a connection that replicates the master, or is about to.
+type replica struct {
+	ip      string
+	port    int // Listening port, as told with REPLCONF listening-port
+	state   string
+	pos     int64 // Offset of the next byte of the stream to send
+	ack     int64 // Last offset acknowledged
+	ackTime time.Time
+	wake    chan struct{}
+}
+
+// addr returns the address the replica listens on.
+func (rep *replica) addr() string {
+	return rep.ip + ":" + strconv.Itoa(rep.port)
+}
+
+// newReplica returns the replica state of the connection c.
+func newReplica(c gnet.Conn) *replica {
+	rep := &replica{state: "handshake", wake: make(chan struct{}, 1)}
+	if addr := c.RemoteAddr(); addr != nil {
+		rep.ip, _ = splitHostPort(addr.String())
+	}
+	return rep
+}
+
+// serveReplication answers the replication commands. It reports whether cmd
+// was one of them.
+func (rs *RedHub) serveReplication(c gnet.Conn, cb *connBuffer, cmd resp.Command, out []byte) ([]byte, ReplyStreamer, bool) {
+	r := rs.repl
+	name := cmd.Args[0]
+	switch {
+	case equalFold(name, "replicaof"), equalFold(name, "slaveof"):
+		return rs.replicaOf(cmd.Args, out), nil, true
+	case equalFold(name, "role"):
+		if rs.replica != nil && rs.replica.following.Load() {
+			return rs.replica.appendRole(out), nil, true
+		}
+		if r == nil {
+			out = resp.AppendArray(out, 3)
+			out = resp.AppendBulkString(out, "master")
+			out = resp.AppendInt(out, 0)
+			return resp.AppendArray(out, 0), nil, true
+		}
+		return r.appendRole(out), nil, true
+	}
+	if r == nil {
+		return out, nil, false
+	}
+	switch {
+	case equalFold(name, "replconf"):
+		return rs.replconf(c, cb, cmd.Args, out), nil, true
+	case equalFold(name, "psync"), equalFold(name, "sync"):
+		if cb.replica != nil && cb.replica.state != "handshake" {
+			return out, nil, true
+		}
+		if cb.replica == nil {
+			cb.replica = newReplica(c)
+		}
+		out, streamer := r.psync(cb.replica, cmd.Args, out)
+		return out, streamer, true
+	case equalFold(name, "wait"):
+		out, streamer := r.wait(cmd.Args, out)
+		return out, streamer, true
+	}
+	return out, nil, false
+}
+
+// replicaOf answers REPLICAOF host port, which makes the server follow a
+// master, and REPLICAOF NO ONE, which stops it.
+func (rs *RedHub) replicaOf(args [][]byte, out []byte) []byte {
+	if len(args) != 3 {
+		return resp.AppendErr(out, resp.WrongArgs(string(args[0])))
+	}
+	if equalFold(args[1], "no") && equalFold(args[2], "one") {
+		if rs.replica != nil {
+			rs.replica.Stop()
+		}
+		return resp.AppendString(out, "OK")
+	}
+	if rs.replica == nil {
+		return resp.AppendError(out, "ERR REPLICAOF is not supported by this server")
+	}
+	port, err := strconv.Atoi(string(args[2]))
+	if err != nil || port <= 0 || port > 65535 {
+		return resp.AppendError(out, "ERR Invalid master port")
+	}
+	addr := net.JoinHostPort(string(args[1]), strconv.Itoa(port))
+	if rs.replica.Master() == addr {
+		return resp.AppendString(out, "OK Already connected to specified master")
+	}
+	if err := rs.replica.Follow(addr); err != nil {
+		return resp.AppendErr(out, err)
+	}
+	return resp.AppendString(out, "OK")
+}
+
+// replconf answers REPLCONF. ACK and GETACK have no reply.
+func (rs *RedHub) replconf(c gnet.Conn, cb *connBuffer, args [][]byte, out []byte) []byte {
+	if len(args)%2 == 0 {
+		return resp.AppendError(out, "ERR syntax error")
+	}
+	if cb.replica == nil {
+		cb.replica = newReplica(c)
+	}
+	for i := 1; i < len(args); i += 2 {
+		option, value := args[i], args[i+1]
+		switch {
+		case equalFold(option, "ack"):
+			if off, err := strconv.ParseInt(string(value), 10, 64); err == nil {
+				rs.repl.ack(cb.replica, off)
+			}
+			return out
+		case equalFold(option, "getack"):
+			return out
+		case equalFold(option, "listening-port"):
+			port, err := strconv.Atoi(string(value))
+			if err != nil || port < 0 || port > 65535 {
+				return resp.AppendError(out, "ERR value is out of range")
+			}
+			cb.replica.port = port
+		case equalFold(option, "ip-address"):
+			cb.replica.ip = string(value)
+		case equalFold(option, "capa"), equalFold(option, "rdb-only"), equalFold(option, "rdb-filter-only"):
+		default:
+			return resp.AppendError(out, "ERR Unrecognized REPLCONF option: "+string(option))
+		}
+	}
+	return resp.AppendString(out, "OK")
+}
+
+// readReplicaAcks reads the REPLCONF ACKs that a replica sends while it is
+// being fed the replication stream. Anything else is ignored.
+func (rs *RedHub) readReplicaAcks(c gnet.Conn, cb *connBuffer) gnet.Action {
+	buf, _ := c.Peek(-1)
+	var consumed int
+	for consumed < len(buf) {
+		cmd, n, err := rs.parser.ReadCommand(buf[consumed:], cb.args)
+		if err != nil {
+			return gnet.Close
+		}
+		if n == 0 {
+			break
+		}
+		consumed += n
+		cb.args = cmd.Args[:0]
+		if len(cmd.Args) == 3 && equalFold(cmd.Args[0], "replconf") && equalFold(cmd.Args[1], "ack") {
+			if off, err := strconv.ParseInt(string(cmd.Args[2]), 10, 64); err == nil {
+				rs.repl.ack(cb.replica, off)
+			}
+		}
+	}
+	_, _ = c.Discard(consumed)
+	return gnet.None
+}
+
+// ack records the offset acknowledged by a replica and wakes up the clients
+// blocked in WAIT.
+func (r *Replication) ack(rep *replica, off int64) {
+	r.mu.Lock()
+	if off > rep.ack {
+		rep.ack = off
+	}
+	rep.ackTime = time.Now()
+	close(r.acked)
+	r.acked = make(chan struct{})
+	r.mu.Unlock()
+}
+
+// psync starts the synchronization of a replica. The reply is written by the
+// returned streamer, which then feeds the replica the replication stream
+// until the connection is closed.
+func (r *Replication) psync(rep *replica, args [][]byte, out []byte) ([]byte, ReplyStreamer) {
+	full := true
+	var off int64
+	if equalFold(args[0], "psync") {
+		if len(args) != 3 {
+			return resp.AppendErr(out, resp.WrongArgs("psync")), nil
+		}
+		requested, err := strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil {
+			return resp.AppendError(out, "ERR value is not an integer or out of range"), nil
+		}
+		// The replica asks for the offset of the next byte it needs, counting
+		// from 1, which is the number of bytes it has.
+		off = requested - 1
+		r.mu.Lock()
+		if string(args[1]) == r.id && r.backlog.contains(off) {
+			full = false
+			rep.state = "online"
+			rep.pos = off
+			rep.ack, rep.ackTime = off, time.Now()
+			r.replicas[rep] = struct{}{}
+		}
+		r.mu.Unlock()
+	}
+	if !full {
+		return resp.AppendString(out, "CONTINUE "+r.id), func(w *ReplyWriter) error {
+			defer r.remove(rep)
+			return r.stream(rep, w)
+		}
+	}
+	if r.opts.Snapshotter == nil {
+		return resp.AppendError(out, "ERR Full resynchronization is not available"), nil
+	}
+	announce := equalFold(args[0], "psync")
+	return out, func(w *ReplyWriter) error {
+		defer r.remove(rep)
+		if err := r.fullSync(rep, w, announce); err != nil {
+			return err
+		}
+		return r.stream(rep, w)
+	}
+}
+
+// fullSync captures a snapshot and sends it to the replica, after the
+// +FULLRESYNC reply of PSYNC if announce is set.
+func (r *Replication) fullSync(rep *replica, w *ReplyWriter, announce bool) error {
+	r.pause.Lock()
+	snapshot, err := takeSnapshot(r.opts.Snapshotter, r.opts.SnapshotTimeout)
+	r.mu.Lock()
+	off := r.backlog.off
+	if err == nil {
+		rep.state = "wait_bgsave"
+		rep.pos = off
+		rep.ack, rep.ackTime = off, time.Now()
+		r.replicas[rep] = struct{}{}
+	}
+	r.mu.Unlock()
+	r.pause.Unlock()
+	if err != nil {
+		// The connection is closed once the error has been written.
+		_, _ = w.Write(resp.AppendError(nil, "ERR snapshot failed: "+err.Error()))
+		_ = w.Flush()
+		return err
+	}
+
+	if announce {
+		reply := resp.AppendString(nil, "FULLRESYNC "+r.id+" "+strconv.FormatInt(off, 10))
+		if _, err := w.Write(reply); err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.CreateTemp("", "redhub-sync-*.rdb")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := writeSnapshot(w, snapshot, f); err != nil {
+		return err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	r.setState(rep, "send_bulk")
+	// Unlike a bulk string, the snapshot is not followed by CRLF: the stream
+	// starts right after it.
+	header := strconv.AppendInt([]byte{'$'}, size, 10)
+	if _, err := w.Write(append(header, '\r', '\n')); err != nil {
+		return err
+	}
+	if err := w.WriteFile(f, 0, size); err != nil {
+		return err
+	}
+	r.setState(rep, "online")
+	return nil
+}
+
+// writeSnapshot writes snapshot to f, sending newlines to the replica in the
+// meantime: it waits for the bulk length of the snapshot, and skips them.
+func writeSnapshot(w *ReplyWriter, snapshot io.WriterTo, f *os.File) error {
+	written := make(chan error, 1)
+	go func() {
+		_, err := snapshot.WriteTo(f)
+		written <- err
+	}()
+	keepalive := time.NewTicker(replKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case err := <-written:
+			return err
+		case <-keepalive.C:
+			_, err := w.Write([]byte("\n"))
+			if err == nil {
+				err = w.Flush()
+			}
+			if err != nil {
+				<-written
+				return err
+			}
+		}
+	}
+}
+
+// stream feeds the replication stream to the replica from its offset, until
+// the connection is closed or the replica falls behind the backlog.
+func (r *Replication) stream(rep *replica, w *ReplyWriter) error {
+	var buf []byte
+	ping := time.NewTimer(r.opts.PingPeriod)
+	defer ping.Stop()
+	for {
+		r.mu.Lock()
+		var ok bool
+		buf, ok = r.backlog.read(buf[:0], rep.pos, replChunkSize)
+		r.mu.Unlock()
+		if !ok {
+			return errReplicaBehind
+		}
+		if len(buf) > 0 {
+			if _, err := w.Write(buf); err != nil {
+				return err
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			rep.pos += int64(len(buf))
+			continue
+		}
+		select {
+		case <-rep.wake:
+		case now := <-ping.C:
+			r.ping(now)
+			ping.Reset(r.opts.PingPeriod)
+		case <-w.aborted:
+			return errReplyAborted
+		}
+	}
+}
+
+// errReplicaBehind closes the connection of a replica whose offset is no longer
+// in the backlog.
+var errReplicaBehind = errors.New("replica fell behind the replication backlog")
+
+// remove forgets a replica whose connection is closed.
+func (r *Replication) remove(rep *replica) {
+	r.mu.Lock()
+	delete(r.replicas, rep)
+	r.mu.Unlock()
+}
+
+func (r *Replication) setState(rep *replica, state string) {
+	r.mu.Lock()
+	rep.state = state
+	r.mu.Unlock()
+}
+
+// wait answers WAIT numreplicas timeout, right away if enough replicas have
+// acknowledged the current offset, or with a streamer that waits for them.
+func (r *Replication) wait(args [][]byte, out []byte) ([]byte, ReplyStreamer) {
+	if len(args) != 3 {
+		return resp.AppendErr(out, resp.WrongArgs("wait")), nil
+	}
+	n, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return resp.AppendError(out, "ERR value is not an integer or out of range"), nil
+	}
+	ms, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return resp.AppendError(out, "ERR timeout is not an integer or out of range"), nil
+	}
+	if ms < 0 {
+		return resp.AppendError(out, "ERR timeout is negative"), nil
+	}
+
+	r.mu.Lock()
+	target := r.backlog.off
+	count := r.countAckedLocked(target)
+	if count >= n {
+		r.mu.Unlock()
+		return resp.AppendInt(out, int64(count)), nil
+	}
+	// Ask the replicas for their offsets, rather than wait for their next ACK.
+	r.feedLocked(replGetAck)
+	r.mu.Unlock()
+
+	return out, func(w *ReplyWriter) error {
+		var timeout <-chan time.Time
+		if ms > 0 {
+			timer := time.NewTimer(time.Duration(ms) * time.Millisecond)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		for {
+			r.mu.Lock()
+			count := r.countAckedLocked(target)
+			acked := r.acked
+			r.mu.Unlock()
+			if count >= n {
+				_, err := w.Write(resp.AppendInt(nil, int64(count)))
+				return err
+			}
+			select {
+			case <-acked:
+			case <-timeout:
+				r.mu.Lock()
+				count = r.countAckedLocked(target)
+				r.mu.Unlock()
+				_, err := w.Write(resp.AppendInt(nil, int64(count)))
+				return err
+			case <-w.aborted:
+				return errReplyAborted
+			}
+		}
+	}
+}
+
+// countAckedLocked returns the number of replicas that have acknowledged off.
+// r.mu must be held.
+func (r *Replication) countAckedLocked(off int64) int {
+	var n int
+	for rep := range r.replicas {
+		if rep.state == "online" && rep.ack >= off {
+			n++
+		}
+	}
+	return n
+}
+
+// appendRole appends the reply of ROLE to out.
+func (r *Replication) appendRole(out []byte) []byte {
+	replicas := r.Replicas()
+	out = resp.AppendArray(out, 3)
+	out = resp.AppendBulkString(out, "master")
+	out = resp.AppendInt(out, r.Offset())
+	out = resp.AppendArray(out, len(replicas))
+	for _, rep := range replicas {
+		ip, port := splitHostPort(rep.Addr)
+		out = resp.AppendArray(out, 3)
+		out = resp.AppendBulkString(out, ip)
+		out = resp.AppendBulkString(out, port)
+		out = resp.AppendBulkString(out, strconv.FormatInt(rep.Offset, 10))
+	}
+	return out
+}
+
+// isErrorReply reports whether a reply is an error.
+func isErrorReply(b []byte) bool {
+	return len(b) > 0 && (b[0] == '-' || b[0] == '!')
+}
+
+// appendArgs appends args to b as a RESP array of bulk strings.
+func appendArgs(b []byte, args [][]byte) []byte {
+	b = resp.AppendArray(b, len(args))
+	for _, arg := range args {
+		b = resp.AppendBulk(b, arg)
+	}
+	return b
+}
+
+// splitHostPort splits "host:port", keeping the brackets out of IPv6 hosts.
+func splitHostPort(addr string) (host, port string) {
+	for i := len(addr) - 1; i >= 0; i-- {
+		if addr[i] == ':' {
+			host, port = addr[:i], addr[i+1:]
+			if len(host) > 1 && host[0] == '[' && host[len(host)-1] == ']' {
+				host = host[1 : len(host)-1]
+			}
+			return host, port
+		}
+	}
+	return addr, ""
+}
+
+// backlog is the replication backlog: a ring buffer holding the end of the
+// replication stream.
+type backlog struct {
+	buf []byte
+	off int64 // Bytes written so far, the replication offset
+}
+
+// write appends p to the stream.
+func (b *backlog) write(p []byte) {
+	size := len(b.buf)
+	if len(p) > size {
+		b.off += int64(len(p) - size)
+		p = p[len(p)-size:]
+	}
+	for len(p) > 0 {
+		i := int(b.off % int64(size))
+		n := copy(b.buf[i:], p)
+		p = p[n:]
+		b.off += int64(n)
+	}
+}
+
+// first returns the offset of the first byte held.
+func (b *backlog) first() int64 {
+	return b.off - b.histlen()
+}
+
+// histlen returns the number of bytes held.
+func (b *backlog) histlen() int64 {
+	return min(b.off, int64(len(b.buf)))
+}
+
+// contains reports whether the stream can be resumed at offset off.
+func (b *backlog) contains(off int64) bool {
+	return off >= b.first() && off <= b.off
+}
+
+// read appends to dst at most max bytes of the stream from offset off. It
+// reports false if off is not in the backlog anymore.
+func (b *backlog) read(dst []byte, off int64, max int) ([]byte, bool) {
+	if !b.contains(off) {
+		return dst, false
+	}
+	n := int(min(b.off-off, int64(max)))
+	for n > 0 {
+		i := int(off % int64(len(b.buf)))
+		m := min(n, len(b.buf)-i)
+		dst = append(dst, b.buf[i:i+m]...)
+		off += int64(m)
+		n -= m
+	}
+	return dst, true
+}
@@ -0,0 +1,365 @@
+package redhub
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBacklog(t *testing.T) {
+	b := backlog{buf: make([]byte, 8)}
+	read := func(off int64) (string, bool) {
+		data, ok := b.read(nil, off, 100)
+		return string(data), ok
+	}
+
+	b.write([]byte("abc"))
+	data, ok := read(0)
+	assert.True(t, ok)
+	assert.Equal(t, "abc", data)
+	data, ok = read(3)
+	assert.True(t, ok)
+	assert.Empty(t, data)
+	_, ok = read(4)
+	assert.False(t, ok)
+
+	// The ring wraps around and drops the oldest bytes.
+	b.write([]byte("defghij"))
+	assert.Equal(t, int64(10), b.off)
+	assert.Equal(t, int64(2), b.first())
+	assert.Equal(t, int64(8), b.histlen())
+	_, ok = read(1)
+	assert.False(t, ok)
+	data, _ = read(2)
+	assert.Equal(t, "cdefghij", data)
+	data, _ = read(7)
+	assert.Equal(t, "hij", data)
+	part, _ := b.read(nil, 3, 4)
+	assert.Equal(t, "defg", string(part))
+
+	// Writes larger than the backlog only keep their end.
+	b.write([]byte("0123456789"))
+	assert.Equal(t, int64(20), b.off)
+	data, _ = read(12)
+	assert.Equal(t, "23456789", data)
+}
+
+// newReplTestServer returns a server whose handler answers OK to every
+// command, except the commands on the key "bad".
+func newReplTestServer() (*RedHub, *Replication) {
+	rh := NewRedHub(nil, nil, func(cmd resp.Command, out []byte) ([]byte, Action) {
+		if len(cmd.Args) > 1 && string(cmd.Args[1]) == "bad" {
+			return resp.AppendError(out, "WRONGTYPE Operation against a key holding the wrong kind of value"), None
+		}
+		return resp.AppendString(out, "OK"), None
+	})
+	rh.RegisterCommands(RedisCommands...)
+	repl := NewReplication(ReplicationOptions{})
+	rh.SetReplication(repl)
+	return rh, repl
+}
+
+func TestReplication_Propagate(t *testing.T) {
+	rh, repl := newReplTestServer()
+	mock := &mockConn{buf: []byte("*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\nGET a\r\nSET bad 1\r\nDEL a b\r\nPING\r\n")}
+	mock.SetContext(&connBuffer{})
+	rh.OnTraffic(mock)
+	assert.Equal(t, strings.Repeat("+OK\r\n", 2)+"-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"+
+		strings.Repeat("+OK\r\n", 2), string(mock.written))
+	repl.Propagate([]byte("PEXPIREAT"), []byte("b"), []byte("100"))
+
+	// Only the write commands that succeeded are propagated, inline commands
+	// in RESP.
+	expected := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n" +
+		"*3\r\n$3\r\nDEL\r\n$1\r\na\r\n$1\r\nb\r\n" +
+		"*3\r\n$9\r\nPEXPIREAT\r\n$1\r\nb\r\n$3\r\n100\r\n"
+	stream, ok := repl.backlog.read(nil, 0, 1<<20)
+	assert.True(t, ok)
+	assert.Equal(t, expected, string(stream))
+	assert.Equal(t, int64(len(expected)), repl.Offset())
+}
+
+func TestReplication_PropagateInPlace(t *testing.T) {
+	// EXPIRE is propagated as the PEXPIREAT it computes, SET with its DEL of
+	// an expired key, and DEL as is.
+	var repl *Replication
+	rh := NewRedHub(nil, nil, func(cmd resp.Command, out []byte) ([]byte, Action) {
+		switch strings.ToLower(string(cmd.Args[0])) {
+		case "expire":
+			repl.Propagate([]byte("PEXPIREAT"), cmd.Args[1], []byte("1700000000000"))
+		case "set":
+			repl.Propagate([]byte("DEL"), []byte("old"))
+			repl.Propagate([]byte("SET"), cmd.Args[1], cmd.Args[2])
+		}
+		return resp.AppendInt(out, 1), None
+	})
+	rh.RegisterCommands(RedisCommands...)
+	repl = NewReplication(ReplicationOptions{})
+	rh.SetReplication(repl)
+
+	mock := &mockConn{buf: []byte("EXPIRE a 100\r\nSET a 1\r\nDEL a\r\n")}
+	mock.SetContext(&connBuffer{})
+	rh.OnTraffic(mock)
+	repl.Propagate([]byte("DEL"), []byte("b"))
+
+	expected := "*3\r\n$9\r\nPEXPIREAT\r\n$1\r\na\r\n$13\r\n1700000000000\r\n" +
+		"*2\r\n$3\r\nDEL\r\n$3\r\nold\r\n" +
+		"*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n" +
+		"*2\r\n$3\r\nDEL\r\n$1\r\na\r\n" +
+		"*2\r\n$3\r\nDEL\r\n$1\r\nb\r\n"
+	stream, ok := repl.backlog.read(nil, 0, 1<<20)
+	assert.True(t, ok)
+	assert.Equal(t, expected, string(stream))
+}
+
+func TestReplication_WriteOrder(t *testing.T) {
+	// The handler records the order it applies the writes in, as a store
+	// would, while other event loops serve writes to the same key.
+	var mu sync.Mutex
+	var applied []string
+	rh := NewRedHub(nil, nil, func(cmd resp.Command, out []byte) ([]byte, Action) {
+		mu.Lock()
+		applied = append(applied, string(cmd.Args[2]))
+		mu.Unlock()
+		runtime.Gosched()
+		return resp.AppendString(out, "OK"), None
+	})
+	rh.RegisterCommands(RedisCommands...)
+	repl := NewReplication(ReplicationOptions{})
+	rh.SetReplication(repl)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				mock := &mockConn{buf: []byte(fmt.Sprintf("SET k %d-%d\r\n", i, j))}
+				mock.SetContext(&connBuffer{})
+				rh.OnTraffic(mock)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	stream, ok := repl.backlog.read(nil, 0, 1<<20)
+	require.True(t, ok)
+	cmds, _, err := resp.ReadCommands(stream)
+	require.NoError(t, err)
+	propagated := make([]string, len(cmds))
+	for i, cmd := range cmds {
+		propagated[i] = string(cmd.Args[2])
+	}
+	assert.Equal(t, applied, propagated)
+}
+
+func TestReplication_Commands(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"REPLCONF listening-port 6380\r\n", "+OK\r\n"},
+		{"REPLCONF listening-port 6380 capa eof capa psync2\r\n", "+OK\r\n"},
+		{"REPLCONF listening-port x\r\n", "-ERR value is out of range\r\n"},
+		{"REPLCONF foo bar\r\n", "-ERR Unrecognized REPLCONF option: foo\r\n"},
+		{"REPLCONF capa\r\n", "-ERR syntax error\r\n"},
+		{"REPLCONF ACK 10\r\nREPLCONF GETACK *\r\n", ""},
+		{"PSYNC ? -1\r\n", "-ERR Full resynchronization is not available\r\n"},
+		{"PSYNC ?\r\n", "-ERR wrong number of arguments for 'psync' command\r\n"},
+		{"WAIT 0 0\r\n", ":0\r\n"},
+		{"WAIT 1 -1\r\n", "-ERR timeout is negative\r\n"},
+		{"WAIT x 0\r\n", "-ERR value is not an integer or out of range\r\n"},
+		{"ROLE\r\n", "*3\r\n$6\r\nmaster\r\n:0\r\n*0\r\n"},
+		{"REPLICAOF NO ONE\r\n", "+OK\r\n"},
+		{"SLAVEOF 127.0.0.1 6379\r\n", "-ERR REPLICAOF is not supported by this server\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			rh, repl := newReplTestServer()
+			mock := &mockConn{buf: []byte(tt.input)}
+			mock.SetContext(&connBuffer{})
+			rh.OnTraffic(mock)
+			assert.Equal(t, tt.expected, string(mock.written))
+			assert.Zero(t, repl.Offset())
+		})
+	}
+}
+
+// replTestReplica speaks the replica side of the replication protocol.
+type replTestReplica struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialReplica(t *testing.T, addr string) *replTestReplica {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	require.NoError(t, err)
+	return &replTestReplica{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (rep *replTestReplica) send(args ...string) {
+	var b []byte
+	b = resp.AppendArray(b, len(args))
+	for _, arg := range args {
+		b = resp.AppendBulkString(b, arg)
+	}
+	_, err := rep.conn.Write(b)
+	require.NoError(rep.t, err)
+}
+
+// line reads a line, skipping the newlines sent while a snapshot is written.
+func (rep *replTestReplica) line() string {
+	require.NoError(rep.t, rep.conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	for {
+		line, err := rep.r.ReadString('\n')
+		require.NoError(rep.t, err)
+		if line != "\n" {
+			return strings.TrimSuffix(line, "\r\n")
+		}
+	}
+}
+
+// read reads n bytes.
+func (rep *replTestReplica) read(n int) string {
+	require.NoError(rep.t, rep.conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	b := make([]byte, n)
+	_, err := io.ReadFull(rep.r, b)
+	require.NoError(rep.t, err)
+	return string(b)
+}
+
+func TestReplication_Integration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	// A tiny key-value store, whose snapshot is its keys and values in a line.
+	var mu sync.Mutex
+	data := map[string]string{"foo": "1"}
+	rh := NewRedHub(
+		func(c *Conn) (out []byte, action Action) { return nil, None },
+		func(c *Conn, err error) (action Action) { return None },
+		func(cmd resp.Command, out []byte) ([]byte, Action) {
+			mu.Lock()
+			defer mu.Unlock()
+			switch strings.ToLower(string(cmd.Args[0])) {
+			case "set":
+				data[string(cmd.Args[1])] = string(cmd.Args[2])
+				return resp.AppendString(out, "OK"), None
+			case "ping":
+				return resp.AppendString(out, "PONG"), None
+			}
+			return resp.AppendError(out, "ERR unknown command"), None
+		},
+	)
+	rh.RegisterCommands(RedisCommands...)
+	repl := NewReplication(ReplicationOptions{
+		Snapshotter: SnapshotFunc(func() (io.WriterTo, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			var s strings.Builder
+			for k, v := range data {
+				s.WriteString(k + "=" + v + ";")
+			}
+			return strings.NewReader(s.String()), nil
+		}),
+	})
+	rh.SetReplication(repl)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- ListenAndServe("tcp://127.0.0.1:16441", Options{Multicore: true}, rh)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	defer func() {
+		assert.NoError(t, rh.Close())
+		<-serverErr
+	}()
+
+	client, err := net.DialTimeout("tcp", "127.0.0.1:16441", time.Second)
+	require.NoError(t, err)
+	defer client.Close()
+	cr := resp.NewReader(client)
+	command := func(args ...string) string {
+		var b []byte
+		b = resp.AppendArray(b, len(args))
+		for _, arg := range args {
+			b = resp.AppendBulkString(b, arg)
+		}
+		_, err := client.Write(b)
+		require.NoError(t, err)
+		require.NoError(t, client.SetReadDeadline(time.Now().Add(5*time.Second)))
+		v, err := cr.ReadValue()
+		require.NoError(t, err)
+		return string(v.Data)
+	}
+	setCommand := func(key, value string) string {
+		return string(appendArgs(nil, [][]byte{[]byte("SET"), []byte(key), []byte(value)}))
+	}
+
+	// Full resynchronization: the snapshot, and then the writes.
+	command("SET", "foo", "2")
+	rep := dialReplica(t, "127.0.0.1:16441")
+	rep.send("PING")
+	assert.Equal(t, "+PONG", rep.line())
+	rep.send("REPLCONF", "listening-port", "6380", "capa", "psync2")
+	assert.Equal(t, "+OK", rep.line())
+	rep.send("PSYNC", "?", "-1")
+	fields := strings.Fields(rep.line())
+	require.Len(t, fields, 3)
+	assert.Equal(t, []string{"+FULLRESYNC", repl.ID()}, fields[:2])
+	offset, err := strconv.ParseInt(fields[2], 10, 64)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(setCommand("foo", "2"))), offset)
+	assert.Equal(t, "$6", rep.line())
+	assert.Equal(t, "foo=2;", rep.read(6))
+
+	assert.Equal(t, "OK", command("SET", "bar", "3"))
+	assert.Equal(t, setCommand("bar", "3"), rep.read(len(setCommand("bar", "3"))))
+	offset += int64(len(setCommand("bar", "3")))
+
+	// WAIT asks the replica for its offset.
+	waited := make(chan string, 1)
+	go func() { waited <- command("WAIT", "1", "5000") }()
+	getack := string(replGetAck)
+	assert.Equal(t, getack, rep.read(len(getack)))
+	rep.send("REPLCONF", "ACK", strconv.FormatInt(offset, 10))
+	assert.Equal(t, "1", <-waited)
+	offset += int64(len(getack))
+	// The replica has not acknowledged the first GETACK yet.
+	assert.Equal(t, "0", command("WAIT", "2", "10"))
+	assert.Equal(t, getack, rep.read(len(getack)))
+	offset += int64(len(getack))
+
+	info := string(repl.AppendInfo(nil))
+	assert.Contains(t, info, "connected_slaves:1\r\n")
+	assert.Contains(t, info, "slave0:ip=127.0.0.1,port=6380,state=online,offset=")
+	assert.Contains(t, info, "master_repl_offset:"+strconv.FormatInt(offset, 10)+"\r\n")
+
+	// The replica reconnects and resumes from its offset.
+	require.NoError(t, rep.conn.Close())
+	assert.Equal(t, "OK", command("SET", "baz", "4"))
+	rep = dialReplica(t, "127.0.0.1:16441")
+	defer rep.conn.Close()
+	rep.send("PSYNC", repl.ID(), strconv.FormatInt(offset+1, 10))
+	assert.Equal(t, "+CONTINUE "+repl.ID(), rep.line())
+	assert.Equal(t, setCommand("baz", "4"), rep.read(len(setCommand("baz", "4"))))
+	assert.Eventually(t, func() bool { return len(repl.Replicas()) == 1 }, time.Second, 10*time.Millisecond)
+
+	// An unknown replication ID needs a full resynchronization.
+	other := dialReplica(t, "127.0.0.1:16441")
+	defer other.conn.Close()
+	other.send("PSYNC", strings.Repeat("0", 40), "1")
+	assert.True(t, strings.HasPrefix(other.line(), "+FULLRESYNC "+repl.ID()+" "))
+}
@@ -0,0 +1,367 @@
+package redhub
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// ReplyStreamer produces a reply incrementally through a ReplyWriter.
+//
+// It runs on its own goroutine once the handler that returned it has finished,
+// so it may block on slow sources such as files or cursors. Every write blocks
+// until the connection has drained enough of its outbound buffer, which keeps
+// the memory used by a reply bounded regardless of its total size.
+//
+// If the streamer returns an error, the connection is closed, since the client
+// cannot be told about it in the middle of a partially written reply.
+type ReplyStreamer func(w *ReplyWriter) error
+
+// ReplyHandler is a command handler that may stream its reply.
+//
+// It is called exactly like the handler passed to NewRedHub. If it returns a
+// non-nil ReplyStreamer, out is written first and the streamer then writes the
+// rest of the reply. Commands pipelined behind it are not processed until the
+// streamer returns, so replies stay in order, unless SetPipelinedReplies was
+// called. The returned Action is applied after the streamer has finished.
+type ReplyHandler func(cmd resp.Command, out []byte) ([]byte, ReplyStreamer, Action)
+
+const (
+	// replyChunkSize is the amount of buffered reply data that triggers a flush.
+	replyChunkSize = 64 * 1024
+
+	// replyHighWater is the amount of data allowed to wait in gnet's outbound
+	// buffer before a ReplyWriter stops producing more.
+	replyHighWater = 1024 * 1024
+
+	// replyMaxBackoff bounds the delay between two checks of the outbound buffer.
+	replyMaxBackoff = 10 * time.Millisecond
+)
+
+var (
+	// errReplyAborted is returned by ReplyWriter once its connection has been closed.
+	errReplyAborted = errors.New("connection closed")
+
+	// errSendfileUnsupported makes WriteFile fall back to copying the file.
+	errSendfileUnsupported = errors.New("sendfile not supported")
+)
+
+// SetReplyHandler installs a handler that can stream large replies. When set,
+// it is called for every command instead of the handler passed to NewRedHub.
+//
+// SetReplyHandler must be called before the server is started.
+//
+// Example:
+//
+//	rh.SetReplyHandler(func(cmd resp.Command, out []byte) ([]byte, redhub.ReplyStreamer, redhub.Action) {
+//	    if strings.EqualFold(string(cmd.Args[0]), "dump") {
+//	        f, err := os.Open(path)
+//	        if err != nil {
+//	            return resp.AppendError(out, "ERR "+err.Error()), nil, redhub.None
+//	        }
+//	        fi, _ := f.Stat()
+//	        return out, func(w *redhub.ReplyWriter) error {
+//	            defer f.Close()
+//	            return w.WriteBulkFile(f, 0, fi.Size())
+//	        }, redhub.None
+//	    }
+//	    out, action := handler(cmd, out)
+//	    return out, nil, action
+//	})
+func (rs *RedHub) SetReplyHandler(handler ReplyHandler) {
+	rs.replyHandler = handler
+}
+
+// SetPipelinedReplies lets the commands pipelined behind a streamed reply run
+// before it has been written. The commands already received are then all
+// handled at once, and their replies, streamed or not, are written in order
+// as each streamer finishes. This suits a reply handler whose streamers only
+// wait for a result computed elsewhere, such as a proxy forwarding the whole
+// pipeline upstream before waiting for the first reply; a handler must then
+// not rely on the streamers of earlier commands having run. Commands received
+// while the replies are being written still wait for them.
+//
+// SetPipelinedReplies must be called before the server is started.
+func (rs *RedHub) SetPipelinedReplies(pipelined bool) {
+	rs.pipelinedReplies = pipelined
+}
+
+// queuedReply is a reply to write once the replies before it have been
+// written: a streamed reply, followed by the replies of the commands handled
+// after it, up to the next streamed reply.
+type queuedReply struct {
+	streamer ReplyStreamer // Streamer of the reply, if any
+	status   Action        // Action of the command, applied once its reply is written
+	start    int           // Offset in the reply buffer of the replies following it
+	after    []byte        // Replies following it, copied out of the reply buffer
+}
+
+// ReplyWriter writes a streamed reply to a connection. It implements io.Writer;
+// the bytes written must form valid RESP, for example built with the resp.Append
+// functions.
+//
+// A ReplyWriter is only valid inside the ReplyStreamer it was passed to and must
+// not be used concurrently.
+type ReplyWriter struct {
+	conn    gnet.Conn
+	buf     []byte
+	err     error
+	acks    chan replyAck
+	aborted chan struct{}
+}
+
+// replyAck reports the result of an operation run on the event loop.
+type replyAck struct {
+	n        int   // bytes written by sendfile
+	err      error // error of the operation
+	buffered int   // outbound bytes still waiting to be sent
+}
+
+func newReplyWriter(c gnet.Conn) *ReplyWriter {
+	return &ReplyWriter{
+		conn:    c,
+		acks:    make(chan replyAck, 1),
+		aborted: make(chan struct{}),
+	}
+}
+
+// Write buffers p and flushes it to the connection once enough data has been
+// gathered. Slices of at least replyChunkSize bytes are passed to the connection
+// without being copied into the buffer first.
+func (w *ReplyWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if len(p) >= replyChunkSize {
+		if err := w.flush(p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= replyChunkSize {
+		if err := w.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush sends any buffered data to the connection and waits until the outbound
+// buffer has drained below its high-water mark.
+func (w *ReplyWriter) Flush() error {
+	return w.flush(nil)
+}
+
+// flush writes the buffered data followed by extra using a single vectored write.
+func (w *ReplyWriter) flush(extra []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	bufs := make([][]byte, 0, 2)
+	if len(w.buf) > 0 {
+		bufs = append(bufs, w.buf)
+	}
+	if len(extra) > 0 {
+		bufs = append(bufs, extra)
+	}
+	if len(bufs) > 0 {
+		err := w.conn.AsyncWritev(bufs, func(c gnet.Conn, err error) error {
+			w.acks <- replyAck{err: err, buffered: c.OutboundBuffered()}
+			return nil
+		})
+		if err != nil {
+			w.err = err
+			return err
+		}
+		ack, err := w.wait()
+		if err != nil {
+			return err
+		}
+		if ack.err != nil {
+			w.err = ack.err
+			return ack.err
+		}
+		w.buf = w.buf[:0]
+		if ack.buffered <= replyHighWater {
+			return nil
+		}
+	}
+	return w.drain(replyHighWater)
+}
+
+// WriteFile sends size bytes of f starting at offset. On Linux the data is sent
+// with sendfile(2) straight from the page cache; elsewhere, and for files that
+// do not support it, it is copied through the writer.
+func (w *ReplyWriter) WriteFile(f *os.File, offset, size int64) error {
+	// sendfile bypasses gnet's outbound buffer, so it has to be empty first.
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := w.drain(0); err != nil {
+		return err
+	}
+	var backoff time.Duration
+	for size > 0 {
+		n := size
+		if n > replyHighWater {
+			n = replyHighWater
+		}
+		ack, err := w.exec(func(c gnet.Conn) replyAck {
+			if c.OutboundBuffered() > 0 {
+				return replyAck{buffered: c.OutboundBuffered()}
+			}
+			written, err := sendfile(c, f, &offset, int(n))
+			return replyAck{n: written, err: err}
+		})
+		if err != nil {
+			return err
+		}
+		if ack.err == errSendfileUnsupported {
+			return w.copyFile(f, offset, size)
+		}
+		if ack.err != nil {
+			w.err = ack.err
+			return ack.err
+		}
+		if ack.n == 0 {
+			backoff = w.backoff(backoff)
+			continue
+		}
+		backoff = 0
+		size -= int64(ack.n)
+	}
+	return nil
+}
+
+// WriteBulkFile sends size bytes of f starting at offset as a RESP bulk string.
+func (w *ReplyWriter) WriteBulkFile(f *os.File, offset, size int64) error {
+	w.buf = append(w.buf, '$')
+	w.buf = strconv.AppendInt(w.buf, size, 10)
+	w.buf = append(w.buf, '\r', '\n')
+	if err := w.WriteFile(f, offset, size); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte("\r\n"))
+	return err
+}
+
+// copyFile is the portable fallback for WriteFile.
+func (w *ReplyWriter) copyFile(f *os.File, offset, size int64) error {
+	n, err := io.Copy(w, io.NewSectionReader(f, offset, size))
+	if err == nil && n < size {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// drain waits until at most limit bytes are left in the outbound buffer.
+func (w *ReplyWriter) drain(limit int) error {
+	var backoff time.Duration
+	for {
+		ack, err := w.exec(func(c gnet.Conn) replyAck {
+			return replyAck{buffered: c.OutboundBuffered()}
+		})
+		if err != nil {
+			return err
+		}
+		if ack.buffered <= limit {
+			return nil
+		}
+		// gnet does not report when the outbound buffer drains, so poll it.
+		backoff = w.backoff(backoff)
+	}
+}
+
+// backoff sleeps before the next poll of the connection and returns the next delay.
+func (w *ReplyWriter) backoff(d time.Duration) time.Duration {
+	if d == 0 {
+		d = 50 * time.Microsecond
+	}
+	time.Sleep(d)
+	if d *= 2; d > replyMaxBackoff {
+		d = replyMaxBackoff
+	}
+	return d
+}
+
+// exec runs fn on the connection's event loop and waits for its result.
+func (w *ReplyWriter) exec(fn func(c gnet.Conn) replyAck) (replyAck, error) {
+	if w.err != nil {
+		return replyAck{}, w.err
+	}
+	c := w.conn
+	err := c.EventLoop().Execute(context.Background(), gnet.RunnableFunc(func(context.Context) error {
+		w.acks <- fn(c)
+		return nil
+	}))
+	if err != nil {
+		w.err = err
+		return replyAck{}, err
+	}
+	return w.wait()
+}
+
+// wait blocks until the event loop acknowledges the pending operation.
+func (w *ReplyWriter) wait() (replyAck, error) {
+	select {
+	case ack := <-w.acks:
+		return ack, nil
+	case <-w.aborted:
+		w.err = errReplyAborted
+		return replyAck{}, w.err
+	}
+}
+
+// abort unblocks the streamer when the connection goes away.
+func (w *ReplyWriter) abort() {
+	close(w.aborted)
+}
+
+// startReply runs the streamers of replies in order on a new goroutine, each
+// followed by the replies after it. Once they are all written, the remaining
+// data is flushed and the connection resumes processing pipelined commands.
+func (rs *RedHub) startReply(c gnet.Conn, cb *connBuffer, replies []queuedReply) *ReplyWriter {
+	w := newReplyWriter(c)
+	go func() {
+		var err error
+		status := None
+		for _, r := range replies {
+			if r.streamer != nil {
+				if err = r.streamer(w); err != nil {
+					break
+				}
+			}
+			if _, err = w.Write(r.after); err != nil {
+				break
+			}
+			if status = r.status; status == Close {
+				break
+			}
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		if err == errReplyAborted {
+			return
+		}
+		_ = c.EventLoop().Execute(context.Background(), gnet.RunnableFunc(func(context.Context) error {
+			if cb.reply != w {
+				return nil
+			}
+			cb.reply = nil
+			if err != nil || status == Close {
+				return c.Close()
+			}
+			// Resume any commands that were pipelined behind the reply.
+			return c.Wake(nil)
+		}))
+	}()
+	return w
+}
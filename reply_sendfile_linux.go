@@ -0,0 +1,31 @@
+//go:build linux
+
+package redhub
+
+import (
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// sendfile copies up to n bytes of f at *offset to the connection's socket with
+// sendfile(2), advancing *offset. It must be called on the connection's event
+// loop while its outbound buffer is empty. A would-block condition is reported
+// as zero bytes written and no error.
+func sendfile(c gnet.Conn, f *os.File, offset *int64, n int) (int, error) {
+	written, err := syscall.Sendfile(c.Fd(), int(f.Fd()), offset, n)
+	switch {
+	case err == syscall.EAGAIN:
+		return 0, nil
+	case err == syscall.EINVAL || err == syscall.ENOSYS:
+		return 0, errSendfileUnsupported
+	case err != nil:
+		return 0, err
+	case written == 0:
+		// The file ended before the requested size was sent.
+		return 0, io.ErrUnexpectedEOF
+	}
+	return written, nil
+}
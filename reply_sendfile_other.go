@@ -0,0 +1,15 @@
+//go:build !linux
+
+package redhub
+
+import (
+	"os"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// sendfile is only implemented on Linux; elsewhere WriteFile copies the file
+// through the ReplyWriter instead.
+func sendfile(c gnet.Conn, f *os.File, offset *int64, n int) (int, error) {
+	return 0, errSendfileUnsupported
+}
@@ -0,0 +1,312 @@
+package redhub
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// StreamHandler handles a command whose final bulk argument is too large to be
+// buffered, as configured with RedHub.SetStreamHandler.
+//
+// cmd.Args holds every argument except the streamed one, and cmd.Raw holds the
+// command up to and including the header of the streamed argument. Unlike the
+// regular handler, these slices are private copies and may be retained.
+//
+// body yields exactly size bytes of the argument as they arrive from the network.
+// It returns io.ErrUnexpectedEOF if the connection is closed before the argument
+// is complete. The handler does not have to read body to the end; any unread
+// bytes are skipped once it returns.
+//
+// The handler runs on its own goroutine, so it may block on body or on slow I/O
+// such as writing to disk without stalling the event loop. The connection does
+// not process any further commands until the handler returns, which keeps the
+// replies in pipeline order. The returned reply is then written to the client.
+//
+// The command goes through the same checks as the others first: its arity,
+// counting the streamed argument, its cluster slot and, on a replica, whether
+// it is a write command. A command that fails them gets its error reply, and
+// its argument is skipped without calling the handler.
+type StreamHandler func(cmd resp.Command, body io.Reader, size int, out []byte) ([]byte, Action)
+
+const (
+	// streamChunkSize is the largest chunk handed from the event loop to a stream reader.
+	streamChunkSize = 64 * 1024
+
+	// streamQueueLen is the number of chunks that may be in flight per stream.
+	// Once the queue is full, the event loop stops consuming the argument and leaves
+	// the remaining bytes in gnet's inbound buffer until the handler catches up.
+	streamQueueLen = 16
+
+	// streamBufferLimit is the most bytes left in gnet's inbound buffer while
+	// the handler catches up. gnet keeps reading from the socket meanwhile, so
+	// a client sending faster than the handler reads is disconnected past it,
+	// like the client-query-buffer-limit of Redis.
+	streamBufferLimit = 32 << 20
+)
+
+var (
+	// errStreamTerminator is reported when a streamed argument is not followed by CRLF.
+	errStreamTerminator = errors.New("Protocol error: invalid bulk length")
+
+	// errStreamBufferLimit is reported when more than streamBufferLimit bytes
+	// wait for the stream handler.
+	errStreamBufferLimit = errors.New("streamed argument buffered past the limit, the stream handler is too slow")
+)
+
+// streamChunkPool recycles the chunks handed to stream readers.
+var streamChunkPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, streamChunkSize)
+		return &b
+	},
+}
+
+// SetStreamHandler enables streaming of large bulk arguments.
+//
+// Commands whose final bulk argument is longer than threshold bytes are delivered
+// to handler as soon as the argument's header has been read, with the argument
+// itself exposed as an io.Reader over the incoming data. All other commands keep
+// going to the regular handler. A threshold less than or equal to zero, or a nil
+// handler, disables streaming.
+//
+// gnet cannot stop reading from a connection, so while the handler reads the
+// argument slower than it arrives, the rest of it is buffered by the event loop.
+// A connection with more than 32 MB buffered that way is closed.
+//
+// The commands served by the stream handler are neither propagated to replicas
+// nor logged to an AOF, so a server with a stream handler cannot use
+// SetReplication or SetAOF: ListenAndServeAll refuses to start it.
+// SetStreamHandler must be called before the server is started.
+//
+// Example:
+//
+//	rh.SetStreamHandler(1<<20, func(cmd resp.Command, body io.Reader, size int, out []byte) ([]byte, redhub.Action) {
+//	    f, err := os.Create(filepath.Join(dir, string(cmd.Args[1])))
+//	    if err != nil {
+//	        return resp.AppendError(out, "ERR "+err.Error()), redhub.None
+//	    }
+//	    defer f.Close()
+//	    if _, err := io.Copy(f, body); err != nil {
+//	        return resp.AppendError(out, "ERR "+err.Error()), redhub.None
+//	    }
+//	    return resp.AppendOK(out), redhub.None
+//	})
+func (rs *RedHub) SetStreamHandler(threshold int, handler StreamHandler) {
+	if handler == nil {
+		threshold = 0
+	}
+	rs.streamThreshold = threshold
+	rs.streamHandler = handler
+}
+
+// bulkStream carries one streamed bulk argument from the event loop, which feeds
+// it from the connection's inbound buffer, to the StreamHandler goroutine, which
+// reads it.
+//
+// Apart from the chunk queue and the stalled flag, all fields are only touched by
+// the event loop that owns the connection.
+type bulkStream struct {
+	conn      gnet.Conn
+	remaining int  // bytes of the argument not yet fed
+	crlf      int  // bytes of the trailing CRLF not yet consumed
+	done      bool // set once the handler has returned and its reply was written
+
+	chunks  chan *[]byte
+	aborted chan struct{}
+	stalled int32 // set when the event loop found the chunk queue full
+
+	// Reader state, owned by the handler goroutine.
+	cur   []byte
+	chunk *[]byte
+}
+
+func newBulkStream(c gnet.Conn, size int) *bulkStream {
+	s := &bulkStream{
+		conn:      c,
+		remaining: size,
+		crlf:      2,
+		chunks:    make(chan *[]byte, streamQueueLen),
+		aborted:   make(chan struct{}),
+	}
+	if size == 0 {
+		close(s.chunks)
+	}
+	return s
+}
+
+// pending reports whether the stream still expects bytes from the connection.
+func (s *bulkStream) pending() bool {
+	return s.remaining > 0 || s.crlf > 0
+}
+
+// wanted returns how many of the buffered bytes feed can consume now, so that
+// only those are copied out of the inbound buffer. When the chunk queue cannot
+// take them all, the stream is flagged as stalled, as by enqueue.
+func (s *bulkStream) wanted(buffered int) int {
+	n := s.remaining
+	if !s.done {
+		room := (cap(s.chunks) - len(s.chunks)) * streamChunkSize
+		if n > room && buffered > room {
+			atomic.StoreInt32(&s.stalled, 1)
+			room = (cap(s.chunks) - len(s.chunks)) * streamChunkSize
+		}
+		if n > room {
+			n = room
+		}
+	}
+	if n == s.remaining {
+		n += s.crlf
+	}
+	return min(n, buffered)
+}
+
+// feed consumes as much of buf as the stream can accept without blocking and
+// returns the number of bytes consumed. Once the handler is done, the rest of
+// the argument is skipped instead of queued.
+func (s *bulkStream) feed(buf []byte) (n int, err error) {
+	for s.remaining > 0 && n < len(buf) {
+		size := len(buf) - n
+		if size > s.remaining {
+			size = s.remaining
+		}
+		if size > streamChunkSize {
+			size = streamChunkSize
+		}
+		if !s.done {
+			chunk := streamChunkPool.Get().(*[]byte)
+			*chunk = append((*chunk)[:0], buf[n:n+size]...)
+			if !s.enqueue(chunk) {
+				streamChunkPool.Put(chunk)
+				return n, nil
+			}
+		}
+		n += size
+		s.remaining -= size
+		if s.remaining == 0 && !s.done {
+			close(s.chunks)
+		}
+	}
+	for s.remaining == 0 && s.crlf > 0 && n < len(buf) {
+		if buf[n] != "\r\n"[2-s.crlf] {
+			return n, errStreamTerminator
+		}
+		n++
+		s.crlf--
+	}
+	return n, nil
+}
+
+// enqueue hands a chunk to the reader without blocking the event loop.
+func (s *bulkStream) enqueue(chunk *[]byte) bool {
+	select {
+	case s.chunks <- chunk:
+		return true
+	default:
+	}
+	// Flag the stall before retrying, so that a reader draining the queue in
+	// between is guaranteed to see it and wake the connection up again.
+	atomic.StoreInt32(&s.stalled, 1)
+	select {
+	case s.chunks <- chunk:
+		return true
+	default:
+		return false
+	}
+}
+
+// abort unblocks the reader when the connection goes away mid-stream.
+func (s *bulkStream) abort() {
+	close(s.aborted)
+}
+
+// Read implements io.Reader for the StreamHandler.
+func (s *bulkStream) Read(p []byte) (int, error) {
+	for len(s.cur) == 0 {
+		if s.chunk != nil {
+			streamChunkPool.Put(s.chunk)
+			s.chunk = nil
+		}
+		select {
+		case chunk, ok := <-s.chunks:
+			if !ok {
+				return 0, io.EOF
+			}
+			s.chunk = chunk
+			s.cur = *chunk
+			if atomic.SwapInt32(&s.stalled, 0) == 1 {
+				// The event loop stopped feeding because the queue was full.
+				_ = s.conn.Wake(nil)
+			}
+		case <-s.aborted:
+			return 0, io.ErrUnexpectedEOF
+		}
+	}
+	n := copy(p, s.cur)
+	s.cur = s.cur[n:]
+	return n, nil
+}
+
+// skipStream returns a stream that skips an argument of size bytes, for a
+// command refused before its handler ran.
+func skipStream(c gnet.Conn, size int) *bulkStream {
+	s := newBulkStream(c, size)
+	s.done = true
+	return s
+}
+
+// startStream detaches cmd from the inbound buffer and runs the StreamHandler
+// for it on a new goroutine.
+func (rs *RedHub) startStream(c gnet.Conn, cmd resp.Command, size int) *bulkStream {
+	s := newBulkStream(c, size)
+	owned := resp.Command{
+		Raw:  append([]byte(nil), cmd.Raw...),
+		Args: make([][]byte, len(cmd.Args)),
+	}
+	for i, arg := range cmd.Args {
+		owned.Args[i] = append([]byte(nil), arg...)
+	}
+	go func() {
+		out, status := rs.streamHandler(owned, s, size, nil)
+		_ = c.AsyncWrite(out, func(c gnet.Conn, err error) error {
+			s.done = true
+			if err != nil {
+				return nil
+			}
+			if status == Close {
+				return c.Close()
+			}
+			// Resume any commands that were pipelined behind the stream.
+			return c.Wake(nil)
+		})
+	}()
+	return s
+}
+
+// feedStream forwards buffered data to the connection's active stream. It
+// returns true once the stream is finished and regular parsing may resume.
+func (rs *RedHub) feedStream(c gnet.Conn, cb *connBuffer) (bool, error) {
+	s := cb.stream
+	if n := s.wanted(c.InboundBuffered()); n > 0 {
+		buf, _ := c.Peek(n)
+		n, err := s.feed(buf)
+		if n > 0 {
+			_, _ = c.Discard(n)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	if s.pending() && c.InboundBuffered() > streamBufferLimit {
+		return false, errStreamBufferLimit
+	}
+	if s.pending() || !s.done {
+		return false, nil
+	}
+	cb.stream = nil
+	return true, nil
+}
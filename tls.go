@@ -0,0 +1,178 @@
+package redhub
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds the TLS handshake of a client, so that a client that
+// connects and sends nothing does not hold its connection open forever.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// tlsAcceptRetry is the delay before accepting again after a failed accept, for
+// example when the process ran out of file descriptors.
+const tlsAcceptRetry = 50 * time.Millisecond
+
+// tlsBridge serves a listener over TLS. gnet has no TLS layer, so the engine of
+// the listener listens on a Unix domain socket private to the process instead,
+// in a directory only the process can open. The bridge accepts the clients on
+// the listener's address, runs their TLS handshake, and relays each of them,
+// decrypted, over a connection of its own to that socket. The engine then serves
+// these connections like any other.
+type tlsBridge struct {
+	ln   net.Listener // TLS listener of the clients
+	dir  string       // Private directory holding the socket
+	path string       // Socket the engine of the listener listens on
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{} // Connections of the relays, to the clients and to the engine
+	closed bool                  // Whether close was called
+	wg     sync.WaitGroup
+}
+
+// listenTLS listens on the TCP address of ln and returns the bridge of its
+// clients. The engine of ln must listen on the bridge's addr.
+func listenTLS(ln Listener) (*tlsBridge, error) {
+	network, addr, ok := strings.Cut(ln.Addr, "://")
+	if !ok {
+		network, addr = "tcp", ln.Addr
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, errors.New("TLS is only supported on TCP listeners, not on " + ln.Addr)
+	}
+	lc := net.ListenConfig{KeepAliveConfig: net.KeepAliveConfig{
+		Enable:   ln.Options.TCPKeepAlive > 0,
+		Idle:     ln.Options.TCPKeepAlive,
+		Interval: ln.Options.TCPKeepInterval,
+		Count:    ln.Options.TCPKeepCount,
+	}}
+	l, err := lc.Listen(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp("", "redhub-tls-")
+	if err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	return &tlsBridge{
+		ln:    tls.NewListener(l, ln.TLSConfig),
+		dir:   dir,
+		path:  filepath.Join(dir, "redhub.sock"),
+		conns: make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// addr returns the address the engine of the listener listens on.
+func (b *tlsBridge) addr() string {
+	return "unix://" + b.path
+}
+
+// start accepts the clients in the background until close is called. The engine
+// must be listening.
+func (b *tlsBridge) start() {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		b.accept()
+	}()
+}
+
+// accept accepts the clients and relays each of them on its own goroutine.
+func (b *tlsBridge) accept() {
+	for {
+		c, err := b.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			time.Sleep(tlsAcceptRetry)
+			continue
+		}
+		if !b.track(c) {
+			return
+		}
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			defer b.untrack(c)
+			b.relay(c.(*tls.Conn))
+		}()
+	}
+}
+
+// track records c to be closed by close. It closes c and returns false if close
+// was already called.
+func (b *tlsBridge) track(c net.Conn) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		_ = c.Close()
+		return false
+	}
+	b.conns[c] = struct{}{}
+	return true
+}
+
+// untrack forgets c once it has been closed.
+func (b *tlsBridge) untrack(c net.Conn) {
+	b.mu.Lock()
+	delete(b.conns, c)
+	b.mu.Unlock()
+}
+
+// relay runs the TLS handshake of the client c, then relays its traffic to the
+// engine and back until either side closes the connection.
+func (b *tlsBridge) relay(c *tls.Conn) {
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	err := c.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		return
+	}
+	local, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: b.path, Net: "unix"})
+	if err != nil || !b.track(local) {
+		return
+	}
+	defer b.untrack(local)
+	defer local.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = io.Copy(local, c)
+		// The client sent everything it had: the server still answers it, then
+		// closes the connection on reading the end of the stream.
+		_ = local.CloseWrite()
+	}()
+	_, _ = io.Copy(c, local)
+	// The server closed the connection, which also ends the copy of the client.
+	_ = c.Close()
+	<-done
+}
+
+// close stops accepting clients, closes the connections being relayed, and
+// removes the socket of the engine. Connections to the engine are closed too, as
+// those dialed while it was stopping may never have been accepted.
+func (b *tlsBridge) close() {
+	_ = b.ln.Close()
+	b.mu.Lock()
+	b.closed = true
+	for c := range b.conns {
+		_ = c.Close()
+	}
+	b.mu.Unlock()
+	b.wg.Wait()
+	_ = os.RemoveAll(b.dir)
+}
@@ -0,0 +1,539 @@
+package redhub
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// DefaultTrackingMaxKeys is the default TrackingOptions.MaxKeys, like the
+// tracking-table-max-keys of Redis.
+const DefaultTrackingMaxKeys = 1000000
+
+// trackingChannel is the Pub/Sub channel of the invalidation messages sent to
+// RESP2 clients.
+const trackingChannel = "__redis__:invalidate"
+
+// TrackingOptions configures client-side caching, see NewTracking.
+type TrackingOptions struct {
+	// MaxKeys is the largest number of keys in the invalidation table. When
+	// the table grows beyond it, keys are removed from it, and invalidated
+	// for the clients that read them, as if they had been modified.
+	// Default: DefaultTrackingMaxKeys
+	MaxKeys int
+}
+
+// Tracking supports client-side caching, like the CLIENT TRACKING command of
+// Redis 6. Install it with SetTracking.
+//
+// The server remembers the keys read by the clients with tracking enabled,
+// from the keys of the read-only commands of the command table (FlagReadOnly,
+// see RegisterCommands). When the application reports that keys were
+// modified with Invalidate, the clients that read them are sent an
+// invalidation message, and the keys are forgotten until they are read
+// again. In BCAST mode, the keys read are not remembered: clients are sent
+// the invalidation of every key matching the prefixes they registered.
+//
+// A Tracking is safe for concurrent use.
+type Tracking struct {
+	opts TrackingOptions
+	rs   *RedHub // Server the clients are connected to, for Pub/Sub
+
+	mu       sync.Mutex
+	nextID   uint64
+	clients  map[uint64]*trackingClient
+	keys     map[string]map[uint64]struct{} // Invalidation table: clients by key read
+	prefixes map[string]map[uint64]struct{} // BCAST clients by prefix
+}
+
+// trackingClient is the tracking state of a client connection. Its fields are
+// only modified by the event loop of the connection, with the Tracking locked,
+// except caching, which only that event loop uses.
+type trackingClient struct {
+	id       uint64
+	conn     gnet.Conn
+	resp3    bool // Whether the client speaks RESP3
+	on       bool
+	bcast    bool
+	optin    bool
+	optout   bool
+	redirect uint64
+	prefixes []string
+	caching  bool // Whether CLIENT CACHING was sent before the current command
+}
+
+// NewTracking returns the client-side caching support of a server, with an
+// empty invalidation table.
+//
+// Example:
+//
+//	tracking := redhub.NewTracking(redhub.TrackingOptions{})
+//	rh.RegisterCommands(redhub.RedisCommands...)
+//	rh.SetPubSub(redhub.NewPubSub()) // For RESP2 clients, which subscribe to __redis__:invalidate
+//	rh.SetTracking(tracking)
+func NewTracking(opts TrackingOptions) *Tracking {
+	if opts.MaxKeys <= 0 {
+		opts.MaxKeys = DefaultTrackingMaxKeys
+	}
+	return &Tracking{
+		opts:     opts,
+		clients:  make(map[uint64]*trackingClient),
+		keys:     make(map[string]map[uint64]struct{}),
+		prefixes: make(map[string]map[uint64]struct{}),
+	}
+}
+
+// RegisterConfig declares tracking-table-max-keys in c, which sets MaxKeys.
+// Like in Redis, 0 leaves the invalidation table unbounded. Its default is
+// the current MaxKeys.
+func (t *Tracking) RegisterConfig(c *Config) error {
+	t.mu.Lock()
+	maxKeys := t.opts.MaxKeys
+	t.mu.Unlock()
+	if maxKeys == math.MaxInt {
+		maxKeys = 0
+	}
+	return c.Register(ConfigParam{
+		Name:    "tracking-table-max-keys",
+		Type:    ConfigInt,
+		Default: strconv.Itoa(maxKeys),
+		Max:     math.MaxInt,
+		OnChange: func(v ConfigValue) error {
+			t.mu.Lock()
+			t.opts.MaxKeys = int(v.Int)
+			if v.Int == 0 {
+				t.opts.MaxKeys = math.MaxInt
+			}
+			t.mu.Unlock()
+			return nil
+		},
+	})
+}
+
+// SetTracking enables client-side caching. RedHub then answers the following
+// subcommands of CLIENT itself, and passes the others to the handler:
+//
+//   - CLIENT TRACKING ON|OFF [REDIRECT id] [PREFIX prefix ...] [BCAST]
+//     [OPTIN] [OPTOUT], which enables or disables tracking for the client;
+//   - CLIENT CACHING YES|NO, which selects whether the keys read by the next
+//     command are tracked, in OPTIN and OPTOUT modes;
+//   - CLIENT ID, CLIENT GETREDIR and CLIENT TRACKINGINFO.
+//
+// Invalidation messages are sent as RESP3 pushes to the clients whose
+// protocol handler switched the connection to RESP3 (see SetProtocolHandler).
+// RESP2 clients get them through another connection, given with REDIRECT,
+// which subscribed to the __redis__:invalidate channel (see SetPubSub).
+//
+// SetTracking must be called before the server is started.
+func (rs *RedHub) SetTracking(t *Tracking) {
+	t.rs = rs
+	rs.tracking = t
+}
+
+// Invalidate reports that keys were modified: the clients that read them, or
+// registered a prefix of theirs in BCAST mode, are sent an invalidation
+// message. Handlers call Invalidate once the command has modified the keys,
+// and the application when keys expire or are evicted.
+//
+// Like Publish, Invalidate never waits for the clients.
+func (t *Tracking) Invalidate(keys ...[]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var pending map[uint64][][]byte
+	add := func(ids map[uint64]struct{}, key []byte) {
+		if pending == nil {
+			pending = make(map[uint64][][]byte)
+		}
+		for id := range ids {
+			pending[id] = append(pending[id], key)
+		}
+	}
+	for _, key := range keys {
+		if ids := t.keys[string(key)]; ids != nil {
+			add(ids, key)
+			delete(t.keys, string(key))
+		}
+		for prefix, ids := range t.prefixes {
+			if bytes.HasPrefix(key, []byte(prefix)) {
+				add(ids, key)
+			}
+		}
+	}
+	for id, keys := range pending {
+		if tc := t.clients[id]; tc != nil && tc.on {
+			t.sendLocked(tc, keys)
+		}
+	}
+}
+
+// InvalidateAll reports that the whole dataset was modified, for example by
+// FLUSHALL: all the clients with tracking enabled are told to drop their
+// cache, and the invalidation table is emptied.
+func (t *Tracking) InvalidateAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tc := range t.clients {
+		if tc.on {
+			t.sendLocked(tc, nil)
+		}
+	}
+	t.keys = make(map[string]map[uint64]struct{})
+}
+
+// sendLocked sends the invalidation of keys, or of every key when keys is nil,
+// to the client or to the client it redirects to.
+func (t *Tracking) sendLocked(tc *trackingClient, keys [][]byte) {
+	target := tc
+	if tc.redirect != 0 {
+		target = t.clients[tc.redirect]
+		if target == nil {
+			if tc.resp3 {
+				b := resp.AppendPush(nil, 2)
+				b = resp.AppendBulkString(b, "tracking-redir-broken")
+				b = resp.AppendInt(b, int64(tc.redirect))
+				_ = tc.conn.AsyncWrite(b, nil)
+			}
+			return
+		}
+	}
+
+	var b []byte
+	switch {
+	case target.resp3:
+		b = resp.AppendPush(b, 2)
+		b = resp.AppendBulkString(b, "invalidate")
+	case t.subscribed(target.conn):
+		b = resp.AppendArray(b, 3)
+		b = resp.AppendBulkString(b, "message")
+		b = resp.AppendBulkString(b, trackingChannel)
+	default:
+		// A RESP2 client only receives messages through Pub/Sub.
+		return
+	}
+	proto := resp.RESP2
+	if target.resp3 {
+		proto = resp.RESP3
+	}
+	if keys == nil {
+		b = resp.AppendNullProto(b, proto)
+	} else {
+		b = resp.AppendArray(b, len(keys))
+		for _, key := range keys {
+			b = resp.AppendBulk(b, key)
+		}
+	}
+	_ = target.conn.AsyncWrite(b, nil)
+}
+
+// subscribed reports whether the client on conn subscribed to the channel of
+// invalidation messages.
+func (t *Tracking) subscribed(conn gnet.Conn) bool {
+	ps := t.rs.pubsub
+	if ps == nil {
+		return false
+	}
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	for s := range ps.channels[trackingChannel] {
+		if s.conn == conn {
+			return true
+		}
+	}
+	return false
+}
+
+// rememberLocked records that the client read keys, and trims the
+// invalidation table to MaxKeys.
+func (t *Tracking) rememberLocked(tc *trackingClient, keys [][]byte) {
+	for _, key := range keys {
+		ids := t.keys[string(key)]
+		if ids == nil {
+			ids = make(map[uint64]struct{})
+			t.keys[string(key)] = ids
+		}
+		ids[tc.id] = struct{}{}
+	}
+	for key, ids := range t.keys {
+		if len(t.keys) <= t.opts.MaxKeys {
+			break
+		}
+		delete(t.keys, key)
+		for id := range ids {
+			if c := t.clients[id]; c != nil && c.on {
+				t.sendLocked(c, [][]byte{[]byte(key)})
+			}
+		}
+	}
+}
+
+// client returns the tracking state of the client on c, which gets its ID on
+// its first command.
+func (t *Tracking) client(c gnet.Conn, cb *connBuffer) *trackingClient {
+	tc := cb.tracking
+	resp3 := cb.writer.Protocol() >= resp.RESP3
+	if tc != nil && tc.resp3 == resp3 {
+		return tc
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tc == nil {
+		t.nextID++
+		tc = &trackingClient{id: t.nextID, conn: c}
+		t.clients[tc.id] = tc
+		cb.tracking = tc
+	}
+	tc.resp3 = resp3
+	return tc
+}
+
+// remove forgets a client, when its connection closes.
+func (t *Tracking) remove(tc *trackingClient) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.disableLocked(tc)
+	delete(t.clients, tc.id)
+}
+
+// disableLocked turns tracking off for the client. Its keys are left in the
+// invalidation table, and skipped when they are invalidated.
+func (t *Tracking) disableLocked(tc *trackingClient) {
+	for _, prefix := range tc.prefixes {
+		if ids := t.prefixes[prefix]; ids != nil {
+			delete(ids, tc.id)
+			if len(ids) == 0 {
+				delete(t.prefixes, prefix)
+			}
+		}
+	}
+	*tc = trackingClient{id: tc.id, conn: tc.conn, resp3: tc.resp3}
+}
+
+// serveTracking answers the CLIENT subcommands of client-side caching. It
+// reports whether cmd was one of them.
+func (rs *RedHub) serveTracking(c gnet.Conn, cb *connBuffer, cmd resp.Command, out []byte) ([]byte, bool) {
+	t := rs.tracking
+	tc := t.client(c, cb)
+	args := cmd.Args
+	if !equalFold(args[0], "client") || len(args) < 2 {
+		return out, false
+	}
+	sub := args[1]
+	if !equalFold(sub, "caching") {
+		tc.caching = false
+	}
+	switch {
+	case equalFold(sub, "id") && len(args) == 2:
+		return resp.AppendInt(out, int64(tc.id)), true
+	case equalFold(sub, "tracking") && len(args) >= 3:
+		return rs.clientTracking(cb, tc, args[2:], out), true
+	case equalFold(sub, "caching") && len(args) == 3:
+		switch {
+		case equalFold(args[2], "yes") && tc.optin, equalFold(args[2], "no") && tc.optout:
+			tc.caching = true
+			return resp.AppendOK(out), true
+		case equalFold(args[2], "yes"):
+			return cb.appendError(out, "ERR CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode."), true
+		case equalFold(args[2], "no"):
+			return cb.appendError(out, "ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode."), true
+		}
+		return cb.appendErr(out, resp.ErrSyntax), true
+	case equalFold(sub, "getredir") && len(args) == 2:
+		return resp.AppendInt(out, tc.redirectID()), true
+	case equalFold(sub, "trackinginfo") && len(args) == 2:
+		return rs.trackingInfo(cb, tc, out), true
+	}
+	return out, false
+}
+
+// redirectID returns the client the invalidation messages are sent to, as
+// CLIENT GETREDIR shows it: -1 when tracking is off, 0 for the client itself.
+func (tc *trackingClient) redirectID() int64 {
+	if !tc.on {
+		return -1
+	}
+	return int64(tc.redirect)
+}
+
+// clientTracking answers CLIENT TRACKING, whose arguments from ON or OFF on
+// are args.
+func (rs *RedHub) clientTracking(cb *connBuffer, tc *trackingClient, args [][]byte, out []byte) []byte {
+	t := rs.tracking
+	var on bool
+	switch {
+	case equalFold(args[0], "on"):
+		on = true
+	case equalFold(args[0], "off"):
+	default:
+		return cb.appendErr(out, resp.ErrSyntax)
+	}
+
+	var redirect uint64
+	var prefixes []string
+	var bcast, optin, optout bool
+	for i := 1; i < len(args); i++ {
+		switch opt := args[i]; {
+		case equalFold(opt, "bcast"):
+			bcast = true
+		case equalFold(opt, "optin"):
+			optin = true
+		case equalFold(opt, "optout"):
+			optout = true
+		case equalFold(opt, "redirect") && i+1 < len(args):
+			i++
+			id, err := strconv.ParseUint(string(args[i]), 10, 64)
+			if err != nil {
+				return cb.appendErr(out, resp.ErrNotInteger)
+			}
+			redirect = id
+		case equalFold(opt, "prefix") && i+1 < len(args):
+			i++
+			prefixes = append(prefixes, string(args[i]))
+		default:
+			return cb.appendErr(out, resp.ErrSyntax)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !on {
+		t.disableLocked(tc)
+		return resp.AppendOK(out)
+	}
+	switch {
+	case tc.on && tc.bcast != bcast:
+		return cb.appendError(out, "ERR You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode.")
+	case len(prefixes) > 0 && !bcast:
+		return cb.appendError(out, "ERR PREFIX option requires BCAST mode to be enabled")
+	case optin && optout:
+		return cb.appendError(out, "ERR You can't use both OPTIN and OPTOUT")
+	case bcast && (optin || optout):
+		return cb.appendError(out, "ERR OPTIN and OPTOUT are not compatible with BCAST")
+	case tc.on && (tc.optin != optin || tc.optout != optout):
+		return cb.appendError(out, "ERR You can't switch OPTIN/OPTOUT mode before disabling tracking for this client, and then re-enabling it with a different mode.")
+	}
+	if redirect != 0 && redirect != tc.id && t.clients[redirect] == nil {
+		return cb.appendError(out, "ERR The client ID you want redirect to does not exist")
+	}
+	if bcast {
+		if len(prefixes) == 0 && len(tc.prefixes) == 0 {
+			prefixes = []string{""}
+		}
+		for i, p := range prefixes {
+			for _, q := range append(tc.prefixes[:len(tc.prefixes):len(tc.prefixes)], prefixes[i+1:]...) {
+				if p != q && (strings.HasPrefix(p, q) || strings.HasPrefix(q, p)) {
+					return cb.appendError(out, "ERR Prefix '"+p+"' overlaps with an existing prefix '"+q+
+						"'. Prefixes for a single client must not overlap.")
+				}
+			}
+		}
+		for _, p := range prefixes {
+			if containsString(tc.prefixes, p) {
+				continue
+			}
+			tc.prefixes = append(tc.prefixes, p)
+			ids := t.prefixes[p]
+			if ids == nil {
+				ids = make(map[uint64]struct{})
+				t.prefixes[p] = ids
+			}
+			ids[tc.id] = struct{}{}
+		}
+	}
+	if redirect == tc.id {
+		redirect = 0
+	}
+	tc.on, tc.bcast, tc.optin, tc.optout, tc.redirect = true, bcast, optin, optout, redirect
+	return resp.AppendOK(out)
+}
+
+// containsString reports whether list contains s.
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// trackingInfo answers CLIENT TRACKINGINFO.
+func (rs *RedHub) trackingInfo(cb *connBuffer, tc *trackingClient, out []byte) []byte {
+	t := rs.tracking
+	t.mu.Lock()
+	var flags []string
+	if !tc.on {
+		flags = append(flags, "off")
+	} else {
+		flags = append(flags, "on")
+		if tc.bcast {
+			flags = append(flags, "bcast")
+		}
+		if tc.optin {
+			flags = append(flags, "optin")
+			if tc.caching {
+				flags = append(flags, "caching-yes")
+			}
+		}
+		if tc.optout {
+			flags = append(flags, "optout")
+			if tc.caching {
+				flags = append(flags, "caching-no")
+			}
+		}
+		if tc.redirect != 0 && t.clients[tc.redirect] == nil {
+			flags = append(flags, "broken_redirect")
+		}
+	}
+	redirect := tc.redirectID()
+	prefixes := append([]string(nil), tc.prefixes...)
+	t.mu.Unlock()
+	sort.Strings(prefixes)
+
+	proto := cb.writer.Protocol()
+	out = appendMapHeader(out, proto, 3)
+	out = resp.AppendBulkString(out, "flags")
+	out = resp.AppendArray(out, len(flags))
+	for _, flag := range flags {
+		out = resp.AppendBulkString(out, flag)
+	}
+	out = resp.AppendBulkString(out, "redirect")
+	out = resp.AppendInt(out, redirect)
+	out = resp.AppendBulkString(out, "prefixes")
+	out = resp.AppendArray(out, len(prefixes))
+	for _, prefix := range prefixes {
+		out = resp.AppendBulkString(out, prefix)
+	}
+	return out
+}
+
+// trackReads records the keys read by cmd, a command served to a client with
+// tracking enabled, before it runs: a write to the keys from another event
+// loop while the handler reads them must find them in the invalidation
+// table. A key recorded for a command that then fails only costs a spare
+// invalidation.
+func (rs *RedHub) trackReads(cb *connBuffer, cmd resp.Command) {
+	tc := cb.tracking
+	caching := tc.caching
+	tc.caching = false
+	if !tc.on || tc.bcast || tc.optin && !caching || tc.optout && caching {
+		return
+	}
+	spec := rs.commands.lookup(cmd.Args[0])
+	if spec == nil || spec.Flags&FlagReadOnly == 0 {
+		return
+	}
+	cb.keys = spec.AppendKeys(cb.keys[:0], cmd.Args)
+	if len(cb.keys) == 0 {
+		return
+	}
+	t := rs.tracking
+	t.mu.Lock()
+	t.rememberLocked(tc, cb.keys)
+	t.mu.Unlock()
+}
@@ -0,0 +1,187 @@
+package redhub
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTrackingTestServer(opts TrackingOptions) (*RedHub, *Tracking) {
+	rh, _ := newPubSubTestServer()
+	rh.RegisterCommands(RedisCommands...)
+	tracking := NewTracking(opts)
+	rh.SetTracking(tracking)
+	return rh, tracking
+}
+
+func newRESP3Client(rh *RedHub) *pubsubClient {
+	c := newPubSubClient(rh)
+	c.conn.ctx.(*connBuffer).writer.SetProtocol(resp.RESP3)
+	return c
+}
+
+func TestTracking_Default(t *testing.T) {
+	rh, tracking := newTrackingTestServer(TrackingOptions{})
+	c := newRESP3Client(rh)
+
+	assert.Equal(t, ":1\r\n", c.send("CLIENT ID\r\n"))
+	assert.Equal(t, ":-1\r\n", c.send("CLIENT GETREDIR\r\n"))
+	assert.Equal(t, "+OK\r\n", c.send("CLIENT TRACKING on\r\n"))
+	assert.Equal(t, ":0\r\n", c.send("CLIENT GETREDIR\r\n"))
+
+	// Only the keys read are tracked, once: after an invalidation, the key
+	// has to be read again.
+	c.send("GET a\r\nMGET b c\r\nSET d 1\r\n")
+	tracking.Invalidate([]byte("a"), []byte("c"), []byte("d"))
+	assert.Equal(t, ">2\r\n$10\r\ninvalidate\r\n*2\r\n$1\r\na\r\n$1\r\nc\r\n", c.received())
+	tracking.Invalidate([]byte("a"))
+	assert.Empty(t, c.received())
+
+	tracking.InvalidateAll()
+	assert.Equal(t, ">2\r\n$10\r\ninvalidate\r\n_\r\n", c.received())
+	tracking.Invalidate([]byte("b"))
+	assert.Empty(t, c.received())
+
+	assert.Equal(t, "+OK\r\n", c.send("CLIENT TRACKING off\r\n"))
+	c.send("GET a\r\n")
+	tracking.Invalidate([]byte("a"))
+	assert.Empty(t, c.received())
+
+	// The other CLIENT subcommands go to the handler.
+	assert.Equal(t, "+OK\r\n", c.send("CLIENT SETNAME x\r\n"))
+}
+
+func TestTracking_OptInOptOut(t *testing.T) {
+	rh, tracking := newTrackingTestServer(TrackingOptions{})
+	in, out := newRESP3Client(rh), newRESP3Client(rh)
+
+	assert.Equal(t, "-ERR CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode.\r\n", in.send("CLIENT CACHING yes\r\n"))
+	assert.Equal(t, "+OK\r\n", in.send("CLIENT TRACKING on OPTIN\r\n"))
+	assert.Equal(t, "+OK\r\n", out.send("CLIENT TRACKING on OPTOUT\r\n"))
+	assert.Equal(t, "-ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.\r\n", in.send("CLIENT CACHING no\r\n"))
+
+	// CLIENT CACHING applies to the next command only.
+	in.send("GET a\r\nCLIENT CACHING yes\r\nGET b\r\nGET c\r\n")
+	out.send("GET a\r\nCLIENT CACHING no\r\nGET b\r\nGET c\r\n")
+	tracking.Invalidate([]byte("a"), []byte("b"), []byte("c"))
+	assert.Equal(t, ">2\r\n$10\r\ninvalidate\r\n*1\r\n$1\r\nb\r\n", in.received())
+	assert.Equal(t, ">2\r\n$10\r\ninvalidate\r\n*2\r\n$1\r\na\r\n$1\r\nc\r\n", out.received())
+
+	assert.Equal(t, "*6\r\n$5\r\nflags\r\n*2\r\n$2\r\non\r\n$5\r\noptin\r\n$8\r\nredirect\r\n:0\r\n$8\r\nprefixes\r\n*0\r\n",
+		newPubSubClient(rh).send("CLIENT TRACKING on OPTIN\r\nCLIENT TRACKINGINFO\r\n")[5:])
+	assert.Equal(t, "-ERR You can't switch OPTIN/OPTOUT mode before disabling tracking for this client, and then re-enabling it with a different mode.\r\n",
+		in.send("CLIENT TRACKING on OPTOUT\r\n"))
+}
+
+func TestTracking_BCAST(t *testing.T) {
+	rh, tracking := newTrackingTestServer(TrackingOptions{})
+	all, users := newRESP3Client(rh), newRESP3Client(rh)
+
+	assert.Equal(t, "+OK\r\n", all.send("CLIENT TRACKING on BCAST\r\n"))
+	assert.Equal(t, "+OK\r\n", users.send("CLIENT TRACKING on BCAST PREFIX user: PREFIX session:\r\n"))
+	tracking.Invalidate([]byte("user:1"), []byte("item:1"))
+	assert.Equal(t, ">2\r\n$10\r\ninvalidate\r\n*2\r\n$6\r\nuser:1\r\n$6\r\nitem:1\r\n", all.received())
+	assert.Equal(t, ">2\r\n$10\r\ninvalidate\r\n*1\r\n$6\r\nuser:1\r\n", users.received())
+	// BCAST keys stay registered.
+	tracking.Invalidate([]byte("session:1"))
+	assert.Equal(t, ">2\r\n$10\r\ninvalidate\r\n*1\r\n$9\r\nsession:1\r\n", users.received())
+	assert.Equal(t, ">2\r\n$10\r\ninvalidate\r\n*1\r\n$9\r\nsession:1\r\n", all.received())
+
+	assert.Equal(t, "%3\r\n$5\r\nflags\r\n*2\r\n$2\r\non\r\n$5\r\nbcast\r\n$8\r\nredirect\r\n:0\r\n$8\r\nprefixes\r\n*2\r\n$8\r\nsession:\r\n$5\r\nuser:\r\n",
+		users.send("CLIENT TRACKINGINFO\r\n"))
+	assert.Equal(t, "-ERR Prefix 'user:a' overlaps with an existing prefix 'user:'. Prefixes for a single client must not overlap.\r\n",
+		users.send("CLIENT TRACKING on BCAST PREFIX user:a\r\n"))
+	assert.Equal(t, "-ERR You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode.\r\n",
+		users.send("CLIENT TRACKING on\r\n"))
+
+	c := newRESP3Client(rh)
+	for cmd, reply := range map[string]string{
+		"CLIENT TRACKING on PREFIX a":                 "-ERR PREFIX option requires BCAST mode to be enabled",
+		"CLIENT TRACKING on OPTIN OPTOUT":             "-ERR You can't use both OPTIN and OPTOUT",
+		"CLIENT TRACKING on BCAST OPTIN":              "-ERR OPTIN and OPTOUT are not compatible with BCAST",
+		"CLIENT TRACKING on REDIRECT x":               "-ERR value is not an integer or out of range",
+		"CLIENT TRACKING on REDIRECT 99":              "-ERR The client ID you want redirect to does not exist",
+		"CLIENT TRACKING on NOPE":                     "-ERR syntax error",
+		"CLIENT TRACKING maybe":                       "-ERR syntax error",
+		"CLIENT TRACKING on BCAST PREFIX a PREFIX ab": "-ERR Prefix 'a' overlaps with an existing prefix 'ab'. Prefixes for a single client must not overlap.",
+	} {
+		assert.Equal(t, reply+"\r\n", c.send(cmd+"\r\n"), cmd)
+	}
+
+	rh.OnClose(users.conn, nil)
+	tracking.Invalidate([]byte("user:2"))
+	assert.Equal(t, ">2\r\n$10\r\ninvalidate\r\n*1\r\n$6\r\nuser:2\r\n", all.received())
+	assert.Empty(t, users.received())
+}
+
+func TestTracking_Redirect(t *testing.T) {
+	rh, tracking := newTrackingTestServer(TrackingOptions{})
+	listener, c := newPubSubClient(rh), newPubSubClient(rh)
+
+	id := listener.send("CLIENT ID\r\n")
+	id = id[1 : len(id)-2]
+	assert.Equal(t, "+OK\r\n", c.send("CLIENT TRACKING on REDIRECT "+id+"\r\n"))
+	assert.Equal(t, ":"+id+"\r\n", c.send("CLIENT GETREDIR\r\n"))
+
+	// A RESP2 client receives the invalidations once it subscribed to
+	// __redis__:invalidate.
+	c.send("GET a\r\n")
+	tracking.Invalidate([]byte("a"))
+	assert.Empty(t, listener.received())
+	listener.send("SUBSCRIBE __redis__:invalidate\r\n")
+	c.send("GET a\r\n")
+	tracking.Invalidate([]byte("a"))
+	assert.Equal(t, "*3\r\n$7\r\nmessage\r\n$20\r\n__redis__:invalidate\r\n*1\r\n$1\r\na\r\n", listener.received())
+	tracking.InvalidateAll()
+	assert.Equal(t, "*3\r\n$7\r\nmessage\r\n$20\r\n__redis__:invalidate\r\n$-1\r\n", listener.received())
+	assert.Empty(t, c.received())
+
+	// A RESP3 client is told when the client it redirects to is gone.
+	r3 := newRESP3Client(rh)
+	assert.Equal(t, "+OK\r\n", r3.send("CLIENT TRACKING on REDIRECT "+id+"\r\n"))
+	r3.send("GET b\r\n")
+	rh.OnClose(listener.conn, nil)
+	tracking.Invalidate([]byte("b"))
+	assert.Equal(t, ">2\r\n$21\r\ntracking-redir-broken\r\n:"+id+"\r\n", r3.received())
+	assert.Contains(t, r3.send("CLIENT TRACKINGINFO\r\n"), "broken_redirect")
+}
+
+func TestTracking_MaxKeys(t *testing.T) {
+	rh, tracking := newTrackingTestServer(TrackingOptions{MaxKeys: 2})
+	c := newRESP3Client(rh)
+	c.send("CLIENT TRACKING on\r\nGET k1\r\nGET k2\r\n")
+	assert.Empty(t, c.received())
+
+	// A third key evicts one of the others, which is invalidated.
+	assert.Contains(t, c.send("GET k3\r\n"), ">2\r\n$10\r\ninvalidate\r\n*1\r\n$2\r\nk")
+	tracking.mu.Lock()
+	assert.Len(t, tracking.keys, 2)
+	tracking.mu.Unlock()
+
+	for i := 0; i < 10; i++ {
+		c.send("GET x" + strconv.Itoa(i) + "\r\n")
+	}
+	tracking.mu.Lock()
+	assert.Len(t, tracking.keys, 2)
+	tracking.mu.Unlock()
+}
+
+func TestTracking_WriteDuringRead(t *testing.T) {
+	var tracking *Tracking
+	rh := NewRedHub(nil, nil, func(cmd resp.Command, out []byte) ([]byte, Action) {
+		// Another event loop modifies the key while the handler reads it.
+		tracking.Invalidate(cmd.Args[1])
+		return resp.AppendBulkString(out, "old"), None
+	})
+	rh.RegisterCommands(RedisCommands...)
+	tracking = NewTracking(TrackingOptions{})
+	rh.SetTracking(tracking)
+	c := newRESP3Client(rh)
+	c.send("CLIENT TRACKING on\r\n")
+
+	// The key was recorded before the read, so the client is told that the
+	// value it got may be stale.
+	assert.Equal(t, ">2\r\n$10\r\ninvalidate\r\n*1\r\n$1\r\na\r\n$3\r\nold\r\n", c.send("GET a\r\n"))
+}